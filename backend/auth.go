@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shisha-tracker/backend/auth"
+	"github.com/shisha-tracker/backend/storage"
+	"golang.org/x/exp/slog"
+)
+
+// sessions signs the session tokens handed out by register and login.
+var sessions *auth.Sessions
+
+// sessionCookie carries the session token of browser clients.
+const sessionCookie = "shisha_session"
+
+// identityKey stores the authenticated identity in the gin context.
+const identityKey = "identity"
+
+// identity is the authenticated caller of a request.
+type identity struct {
+	User string
+	// Role is the current role of the account (see storage.Roles).
+	Role string
+	// Token is the id of the API token used, empty for sessions.
+	Token string
+}
+
+// newSessions configures session signing from SESSION_SECRET and SESSION_TTL (default
+// 24h). Without a secret a random key is used: sessions then end with the process and
+// are not accepted by other replicas.
+func newSessions() *auth.Sessions {
+	ttl := 24 * time.Hour
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Warn("auth: invalid SESSION_TTL", "value", v, "ttl", ttl)
+		} else {
+			ttl = d
+		}
+	}
+	key := []byte(os.Getenv("SESSION_SECRET"))
+	if len(key) == 0 {
+		slog.Warn("auth: SESSION_SECRET not set, using a random key (sessions do not survive restarts)")
+		var err error
+		if key, err = auth.RandomKey(32); err != nil {
+			fatal("auth: creating a session key failed", err)
+		}
+	}
+	return auth.NewSessions(key, ttl)
+}
+
+// authenticate resolves the caller from an "Authorization: Bearer" header (API token or
+// session token) or the session cookie. Requests without credentials pass anonymously;
+// an invalid bearer credential is rejected with 401, an invalid cookie is ignored so a
+// stale browser session does not lock the user out of the public pages. The role is
+// read from the account on every request, so role changes apply to running sessions.
+func authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if header := c.GetHeader("Authorization"); header != "" {
+			err := auth.ErrInvalid
+			var id identity
+			if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+				id, err = bearerIdentity(c, strings.TrimSpace(token))
+			}
+			if err != nil {
+				if errors.Is(err, auth.ErrInvalid) {
+					err = fmt.Errorf("%w: invalid bearer credentials", errUnauthorized)
+				}
+				_ = c.Error(err)
+				c.Abort()
+				return
+			}
+			c.Set(identityKey, id)
+		} else if cookie, err := c.Cookie(sessionCookie); err == nil {
+			if sess, err := sessions.Verify(cookie, time.Now()); err == nil {
+				id, err := accountIdentity(c, sess.User, "")
+				if err != nil && !errors.Is(err, auth.ErrInvalid) {
+					_ = c.Error(err)
+					c.Abort()
+					return
+				}
+				if err == nil {
+					c.Set(identityKey, id)
+				}
+			}
+		}
+		c.Next()
+	}
+}
+
+// bearerIdentity resolves an API token or a session token.
+func bearerIdentity(c *gin.Context, token string) (identity, error) {
+	if !strings.HasPrefix(token, auth.TokenPrefix) {
+		sess, err := sessions.Verify(token, time.Now())
+		if err != nil {
+			return identity{}, err
+		}
+		return accountIdentity(c, sess.User, "")
+	}
+	id, secret, err := auth.ParseAPIToken(token)
+	if err != nil {
+		return identity{}, err
+	}
+	stored, err := storageEngine.GetAPIToken(c.Request.Context(), id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return identity{}, auth.ErrInvalid
+	}
+	if err != nil {
+		return identity{}, err
+	}
+	if !auth.CheckSecret(stored.SecretHash, secret) {
+		return identity{}, auth.ErrInvalid
+	}
+	return accountIdentity(c, stored.User, stored.ID)
+}
+
+// accountIdentity loads the account behind a verified credential; a credential of an
+// account that no longer exists is invalid.
+func accountIdentity(c *gin.Context, name, token string) (identity, error) {
+	u, err := storageEngine.GetUser(c.Request.Context(), name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return identity{}, auth.ErrInvalid
+	}
+	if err != nil {
+		return identity{}, err
+	}
+	return identity{User: u.Name, Role: u.Role, Token: token}, nil
+}
+
+// currentIdentity returns the authenticated caller.
+func currentIdentity(c *gin.Context) (identity, bool) {
+	v, ok := c.Get(identityKey)
+	if !ok {
+		return identity{}, false
+	}
+	return v.(identity), true
+}
+
+// currentUser returns the name of the authenticated caller.
+func currentUser(c *gin.Context) (string, bool) {
+	id, ok := currentIdentity(c)
+	return id.User, ok
+}
+
+type credentials struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// sessionResponse answers register and login. The token is also set as cookie; scripts
+// may send it as bearer token instead.
+type sessionResponse struct {
+	User      *storage.User `json:"user"`
+	Token     string        `json:"token"`
+	ExpiresAt int64         `json:"expiresAt"`
+}
+
+// register answers POST /api/auth/register and logs the new user in.
+func register(c *gin.Context) {
+	var in credentials
+	if !bindJSON(c, &in) {
+		return
+	}
+	if err := auth.CheckPasswordPolicy(in.Password); err != nil {
+		_ = c.Error(fmt.Errorf("%w: %v", storage.ErrValidation, err))
+		return
+	}
+	hash, err := auth.HashPassword(in.Password)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	u, err := storageEngine.CreateUser(c.Request.Context(), &storage.User{Name: in.Name, PasswordHash: hash, CreatedAt: time.Now().Unix()})
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	startSession(c, http.StatusCreated, u)
+}
+
+// login answers POST /api/auth/login.
+func login(c *gin.Context) {
+	var in credentials
+	if !bindJSON(c, &in) {
+		return
+	}
+	u, err := storageEngine.GetUser(c.Request.Context(), in.Name)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		_ = c.Error(err)
+		return
+	}
+	if err != nil {
+		// unknown names take as long as wrong passwords
+		auth.CheckUnknownPassword(in.Password)
+	}
+	if err != nil || !auth.CheckPassword(u.PasswordHash, in.Password) {
+		_ = c.Error(fmt.Errorf("%w: invalid name or password", errUnauthorized))
+		return
+	}
+	startSession(c, http.StatusOK, u)
+}
+
+// startSession issues a session token for u and sets the session cookie.
+func startSession(c *gin.Context, status int, u *storage.User) {
+	token, sess := sessions.Issue(u.Name, time.Now())
+	setSessionCookie(c, token, int(sessions.TTL().Seconds()))
+	c.JSON(status, sessionResponse{User: u, Token: token, ExpiresAt: sess.Expires})
+}
+
+// logout answers POST /api/auth/logout by clearing the session cookie. Session tokens
+// are stateless: a copy kept elsewhere stays valid until it expires.
+func logout(c *gin.Context) {
+	setSessionCookie(c, "", -1)
+	c.Status(http.StatusNoContent)
+}
+
+func setSessionCookie(c *gin.Context, value string, maxAge int) {
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, value, maxAge, "/", "", secure, true)
+}
+
+// me answers GET /api/auth/me with the authenticated user.
+func me(c *gin.Context) {
+	name, _ := currentUser(c)
+	u, err := storageEngine.GetUser(c.Request.Context(), name)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, u)
+}
+
+// createdToken answers POST /api/auth/tokens; Token is only ever shown here.
+type createdToken struct {
+	storage.APIToken
+	Token string `json:"token"`
+}
+
+func createToken(c *gin.Context) {
+	var in struct {
+		Name string `json:"name"`
+	}
+	if !bindJSON(c, &in) {
+		return
+	}
+	id, secret, err := auth.NewAPIToken()
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	name, _ := currentUser(c)
+	t, err := storageEngine.CreateAPIToken(c.Request.Context(), &storage.APIToken{
+		ID:         id,
+		User:       name,
+		Name:       in.Name,
+		SecretHash: auth.HashSecret(secret),
+		CreatedAt:  time.Now().Unix(),
+	})
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusCreated, createdToken{APIToken: *t, Token: auth.FormatAPIToken(id, secret)})
+}
+
+func listTokens(c *gin.Context) {
+	name, _ := currentUser(c)
+	out, err := storageEngine.ListAPITokens(c.Request.Context(), name)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func deleteToken(c *gin.Context) {
+	name, _ := currentUser(c)
+	if err := storageEngine.DeleteAPIToken(c.Request.Context(), name, c.Param("tid")); err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// listUsers answers GET /api/admin/users.
+func listUsers(c *gin.Context) {
+	out, err := storageEngine.ListUsers(c.Request.Context())
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// setUserRole answers PUT /api/admin/users/:name/role with {"role"}. Admins cannot change
+// their own role, so the last admin cannot lock everybody out.
+func setUserRole(c *gin.Context) {
+	var in struct {
+		Role string `json:"role"`
+	}
+	if !bindJSON(c, &in) {
+		return
+	}
+	name := c.Param("name")
+	if self, _ := currentUser(c); strings.EqualFold(strings.TrimSpace(name), self) {
+		_ = c.Error(fmt.Errorf("%w: admins cannot change their own role", storage.ErrForbidden))
+		return
+	}
+	u, err := storageEngine.SetUserRole(c.Request.Context(), name, in.Role)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, u)
+}
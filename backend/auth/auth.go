@@ -0,0 +1,189 @@
+// Package auth implements the credentials of the API: bcrypt password hashes, signed
+// session tokens (HS256 JWTs) and personal API tokens.
+//
+// Session tokens are stateless: they carry the user name and expiry and are only valid
+// with the signing key, so every replica sharing the key accepts them. API tokens have
+// the form "sht_<id>_<secret>"; only the SHA-256 of the secret is stored.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password bounds; bcrypt only uses the first 72 bytes, so longer ones are rejected
+// rather than silently truncated.
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
+)
+
+// TokenPrefix starts every API token, so they are recognisable in configs and logs.
+const TokenPrefix = "sht_"
+
+// ErrInvalid is returned for malformed, forged or expired credentials.
+var ErrInvalid = errors.New("invalid credentials")
+
+// CheckPasswordPolicy validates a new password.
+func CheckPasswordPolicy(password string) error {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return fmt.Errorf("password must be %d to %d bytes", MinPasswordLength, MaxPasswordLength)
+	}
+	return nil
+}
+
+// HashPassword returns the bcrypt hash of password.
+func HashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// CheckPassword reports whether password matches the bcrypt hash.
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+var (
+	dummyOnce sync.Once
+	dummyHash string
+)
+
+// CheckUnknownPassword spends the time of a CheckPassword on an account that does not
+// exist, so the response time of a login does not tell which user names are taken. It
+// always reports false.
+func CheckUnknownPassword(password string) bool {
+	dummyOnce.Do(func() {
+		// any password will do; the cost is the one of real hashes
+		dummyHash, _ = HashPassword("no such account")
+	})
+	CheckPassword(dummyHash, password)
+	return false
+}
+
+// Session is the payload of a session token.
+type Session struct {
+	User     string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+// Sessions issues and verifies session tokens signed with one key.
+type Sessions struct {
+	key []byte
+	ttl time.Duration
+}
+
+// NewSessions returns a Sessions signing with key; tokens expire after ttl.
+func NewSessions(key []byte, ttl time.Duration) *Sessions {
+	return &Sessions{key: key, ttl: ttl}
+}
+
+// TTL returns the lifetime of issued tokens.
+func (s *Sessions) TTL() time.Duration {
+	return s.ttl
+}
+
+// jwtHeader is the fixed, pre-encoded JOSE header of every session token.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Issue returns a session token for user valid from now on.
+func (s *Sessions) Issue(user string, now time.Time) (string, Session) {
+	sess := Session{User: user, IssuedAt: now.Unix(), Expires: now.Add(s.ttl).Unix()}
+	payload, _ := json.Marshal(sess)
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + s.sign(signed), sess
+}
+
+// Verify checks the signature and expiry of token and returns its session.
+func (s *Sessions) Verify(token string, now time.Time) (*Session, error) {
+	parts := strings.Split(token, ".")
+	// the header is compared verbatim, which also pins the algorithm to HS256
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, ErrInvalid
+	}
+	want := s.sign(parts[0] + "." + parts[1])
+	if subtle.ConstantTimeCompare([]byte(parts[2]), []byte(want)) != 1 {
+		return nil, ErrInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	var sess Session
+	if err := json.Unmarshal(payload, &sess); err != nil || sess.User == "" {
+		return nil, ErrInvalid
+	}
+	if now.Unix() >= sess.Expires {
+		return nil, fmt.Errorf("%w: session expired", ErrInvalid)
+	}
+	return &sess, nil
+}
+
+func (s *Sessions) sign(data string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewAPIToken generates a token id and secret; the client gets FormatAPIToken(id, secret),
+// the storage HashSecret(secret).
+func NewAPIToken() (id, secret string, err error) {
+	b := make([]byte, 8+32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(b[:8]), base64.RawURLEncoding.EncodeToString(b[8:]), nil
+}
+
+// FormatAPIToken returns the token string handed to the client.
+func FormatAPIToken(id, secret string) string {
+	return TokenPrefix + id + "_" + secret
+}
+
+// ParseAPIToken splits a token string into id and secret.
+func ParseAPIToken(token string) (id, secret string, err error) {
+	rest, ok := strings.CutPrefix(token, TokenPrefix)
+	if !ok {
+		return "", "", ErrInvalid
+	}
+	// the id is hex, the secret base64url and may itself contain '_'
+	id, secret, ok = strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", "", ErrInvalid
+	}
+	return id, secret, nil
+}
+
+// HashSecret returns the stored form of an API token secret. The secret is random, so a
+// plain SHA-256 suffices.
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckSecret reports whether secret matches the stored hash.
+func CheckSecret(hash, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashSecret(secret)), []byte(hash)) == 1
+}
+
+// RandomKey returns n random bytes, e.g. a signing key when none is configured.
+func RandomKey(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
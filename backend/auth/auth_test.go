@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := NewSessions([]byte("test-key"), time.Hour)
+	token, sess := s.Issue("alice", now)
+	if sess.User != "alice" || sess.Expires != now.Add(time.Hour).Unix() {
+		t.Fatalf("unexpected session %+v", sess)
+	}
+	got, err := s.Verify(token, now.Add(59*time.Minute))
+	if err != nil || *got != sess {
+		t.Fatalf("Verify: %+v %v", got, err)
+	}
+
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","iat":1700000000,"exp":1900000000}`))
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	cases := map[string]struct {
+		token string
+		at    time.Time
+		with  *Sessions
+	}{
+		"expired":       {token, now.Add(time.Hour), s},
+		"other key":     {token, now, NewSessions([]byte("other-key"), time.Hour)},
+		"forged claims": {parts[0] + "." + forged + "." + parts[2], now, s},
+		"alg none":      {none + "." + parts[1] + ".", now, s},
+		"garbage":       {"not-a-token", now, s},
+	}
+	for name, tc := range cases {
+		if _, err := tc.with.Verify(tc.token, tc.at); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected ErrInvalid, got %v", name, err)
+		}
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	id, secret, err := NewAPIToken()
+	if err != nil {
+		t.Fatalf("NewAPIToken: %v", err)
+	}
+	token := FormatAPIToken(id, secret)
+	gotID, gotSecret, err := ParseAPIToken(token)
+	if err != nil || gotID != id || gotSecret != secret {
+		t.Fatalf("ParseAPIToken(%q) = %q, %q, %v", token, gotID, gotSecret, err)
+	}
+	hash := HashSecret(secret)
+	if !CheckSecret(hash, secret) || CheckSecret(hash, secret+"x") {
+		t.Fatalf("CheckSecret does not match its hash")
+	}
+	for _, bad := range []string{"", "sht_", "sht_abc", "sht__secret", "xyz_abc_def"} {
+		if _, _, err := ParseAPIToken(bad); !errors.Is(err, ErrInvalid) {
+			t.Errorf("ParseAPIToken(%q): expected ErrInvalid, got %v", bad, err)
+		}
+	}
+}
+
+func TestPasswords(t *testing.T) {
+	if CheckPasswordPolicy("short") == nil || CheckPasswordPolicy(strings.Repeat("x", 73)) == nil {
+		t.Fatalf("password policy accepts out-of-range lengths")
+	}
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if !CheckPassword(hash, "correct horse") || CheckPassword(hash, "wrong horse") {
+		t.Fatalf("CheckPassword does not match its hash")
+	}
+
+	// an unknown account costs a full bcrypt comparison, like a wrong password
+	CheckUnknownPassword("warm-up")
+	start := time.Now()
+	if CheckUnknownPassword("no such account") {
+		t.Fatalf("CheckUnknownPassword accepted a password")
+	}
+	if took := time.Since(start); took < time.Millisecond {
+		t.Fatalf("CheckUnknownPassword returned after %v, without comparing a hash", took)
+	}
+}
@@ -0,0 +1,335 @@
+// Package backup writes and restores snapshot archives of the complete shisha catalogue
+// and the accounts through storage.Storage, so an archive taken from one backend can be
+// restored into any other.
+//
+// An archive is a gzip-compressed tar file with these members:
+//
+//	manifest.json        Manifest: format version, creation time, counts and checksums
+//	shishas.jsonl        one storage.Shisha per line, ids included
+//	manufacturers.jsonl  one storage.Manufacturer per line, unused ones included (version 2)
+//	users.jsonl          one account per line, role and password hash included (version 2)
+//	tokens.jsonl         one API token per line, secret hash included (version 2)
+//
+// The manifest comes first so a reader can validate the data while streaming it. The
+// archive holds password and token hashes; keep it as private as the database.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+// FormatVersion is the archive layout written by Write. Restore rejects newer versions.
+// Version 1 archives hold the shishas only.
+const FormatVersion = 2
+
+const (
+	manifestName      = "manifest.json"
+	dataName          = "shishas.jsonl"
+	manufacturersName = "manufacturers.jsonl"
+	usersName         = "users.jsonl"
+	tokensName        = "tokens.jsonl"
+)
+
+// ErrInvalidArchive is returned when an archive is damaged, incomplete or of an
+// unsupported version.
+var ErrInvalidArchive = errors.New("invalid backup archive")
+
+// Manifest describes the content of an archive.
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Source names the storage backend the snapshot was taken from (informational).
+	Source        string `json:"source,omitempty"`
+	Shishas       int    `json:"shishas"`
+	Ratings       int    `json:"ratings"`
+	Comments      int    `json:"comments"`
+	Manufacturers int    `json:"manufacturers"`
+	Users         int    `json:"users"`
+	APITokens     int    `json:"apiTokens"`
+	// SHA256 is the hex checksum of the shishas member.
+	SHA256 string `json:"sha256"`
+	// Checksums holds the hex checksums of the other data members by name.
+	Checksums map[string]string `json:"checksums,omitempty"`
+}
+
+// Snapshot is the content of an archive.
+type Snapshot struct {
+	Shishas []storage.Shisha
+	// Manufacturers holds every manufacturer, also those no shisha references.
+	Manufacturers []storage.Manufacturer
+	Users         []storage.User
+	APITokens     []storage.APIToken
+}
+
+// userRecord and tokenRecord are the archive lines of accounts and tokens: unlike the
+// API, they carry the hashes.
+type userRecord struct {
+	storage.User
+	PasswordHash string `json:"passwordHash"`
+}
+
+type tokenRecord struct {
+	storage.APIToken
+	SecretHash string `json:"secretHash"`
+}
+
+// Write takes a point-in-time snapshot of st (storage.ReadSnapshot) and writes it as an
+// archive to w. On SQL backends all of it is read in one read-only transaction; on
+// CouchDB a read that overlapped a write is repeated, and Write fails with
+// storage.ErrConflict when the database kept changing.
+func Write(ctx context.Context, st storage.Storage, w io.Writer, source string) (*Manifest, error) {
+	var snap *Snapshot
+	err := storage.ReadSnapshot(ctx, st, func(view storage.Storage) error {
+		var err error
+		snap, err = read(ctx, view)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{Version: FormatVersion, CreatedAt: time.Now().UTC(), Source: source, Checksums: map[string]string{}}
+	for _, s := range snap.Shishas {
+		m.Shishas++
+		m.Ratings += len(s.Ratings)
+		m.Comments += len(s.Comments)
+	}
+	users := make([]userRecord, len(snap.Users))
+	for i, u := range snap.Users {
+		users[i] = userRecord{User: u, PasswordHash: u.PasswordHash}
+	}
+	tokens := make([]tokenRecord, len(snap.APITokens))
+	for i, t := range snap.APITokens {
+		tokens[i] = tokenRecord{APIToken: t, SecretHash: t.SecretHash}
+	}
+	m.Manufacturers, m.Users, m.APITokens = len(snap.Manufacturers), len(users), len(tokens)
+
+	data, err := encodeLines(snap.Shishas)
+	if err != nil {
+		return nil, err
+	}
+	m.SHA256 = checksum(data)
+	manufacturersData, err := encodeLines(snap.Manufacturers)
+	if err != nil {
+		return nil, err
+	}
+	usersData, err := encodeLines(users)
+	if err != nil {
+		return nil, err
+	}
+	tokensData, err := encodeLines(tokens)
+	if err != nil {
+		return nil, err
+	}
+	m.Checksums[manufacturersName] = checksum(manufacturersData)
+	m.Checksums[usersName] = checksum(usersData)
+	m.Checksums[tokensName] = checksum(tokensData)
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, member := range []struct {
+		name string
+		body []byte
+	}{{manifestName, manifest}, {dataName, data}, {manufacturersName, manufacturersData}, {usersName, usersData}, {tokensName, tokensData}} {
+		hdr := &tar.Header{Name: member.name, Mode: 0o600, Size: int64(len(member.body)), ModTime: m.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(member.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// read collects the snapshot of st.
+func read(ctx context.Context, st storage.Storage) (*Snapshot, error) {
+	page, err := st.ListShishas(ctx, storage.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("read catalogue: %w", err)
+	}
+	manufacturers, err := st.ListManufacturers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read manufacturers: %w", err)
+	}
+	users, err := st.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read users: %w", err)
+	}
+	snap := &Snapshot{Shishas: page.Items, Manufacturers: manufacturers, Users: users}
+	for _, u := range users {
+		tokens, err := st.ListAPITokens(ctx, u.Name)
+		if err != nil {
+			return nil, fmt.Errorf("read tokens of %s: %w", u.Name, err)
+		}
+		snap.APITokens = append(snap.APITokens, tokens...)
+	}
+	return snap, nil
+}
+
+// Read validates the archive in r (layout, version, checksums and counts) and returns
+// its manifest and content.
+func Read(r io.Reader) (*Manifest, *Snapshot, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	if hdr.Name != manifestName {
+		return nil, nil, fmt.Errorf("%w: expected %s as first member, got %s", ErrInvalidArchive, manifestName, hdr.Name)
+	}
+	var m Manifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return nil, nil, fmt.Errorf("%w: manifest: %v", ErrInvalidArchive, err)
+	}
+	if m.Version < 1 || m.Version > FormatVersion {
+		return nil, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidArchive, m.Version)
+	}
+
+	hdr, err = tr.Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: missing %s: %v", ErrInvalidArchive, dataName, err)
+	}
+	if hdr.Name != dataName {
+		return nil, nil, fmt.Errorf("%w: expected %s, got %s", ErrInvalidArchive, dataName, hdr.Name)
+	}
+	snap := &Snapshot{}
+	if snap.Shishas, err = decodeLines[storage.Shisha](tr, dataName, m.SHA256); err != nil {
+		return nil, nil, err
+	}
+	ratings, comments := 0, 0
+	for _, s := range snap.Shishas {
+		ratings += len(s.Ratings)
+		comments += len(s.Comments)
+	}
+	if len(snap.Shishas) != m.Shishas || ratings != m.Ratings || comments != m.Comments {
+		return nil, nil, fmt.Errorf("%w: manifest counts %d/%d/%d do not match data %d/%d/%d",
+			ErrInvalidArchive, m.Shishas, m.Ratings, m.Comments, len(snap.Shishas), ratings, comments)
+	}
+
+	// the other members, each listed in the manifest with its checksum
+	seen := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+		sum, listed := m.Checksums[hdr.Name]
+		if !listed || seen[hdr.Name] {
+			return nil, nil, fmt.Errorf("%w: unexpected member %s", ErrInvalidArchive, hdr.Name)
+		}
+		seen[hdr.Name] = true
+		switch hdr.Name {
+		case manufacturersName:
+			if snap.Manufacturers, err = decodeLines[storage.Manufacturer](tr, manufacturersName, sum); err != nil {
+				return nil, nil, err
+			}
+		case usersName:
+			records, err := decodeLines[userRecord](tr, usersName, sum)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, rec := range records {
+				u := rec.User
+				u.PasswordHash = rec.PasswordHash
+				snap.Users = append(snap.Users, u)
+			}
+		case tokensName:
+			records, err := decodeLines[tokenRecord](tr, tokensName, sum)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, rec := range records {
+				t := rec.APIToken
+				t.SecretHash = rec.SecretHash
+				snap.APITokens = append(snap.APITokens, t)
+			}
+		default:
+			return nil, nil, fmt.Errorf("%w: unknown member %s", ErrInvalidArchive, hdr.Name)
+		}
+	}
+	for name := range m.Checksums {
+		if !seen[name] {
+			return nil, nil, fmt.Errorf("%w: missing %s", ErrInvalidArchive, name)
+		}
+	}
+	if len(snap.Manufacturers) != m.Manufacturers || len(snap.Users) != m.Users || len(snap.APITokens) != m.APITokens {
+		return nil, nil, fmt.Errorf("%w: manifest counts %d manufacturers/%d users/%d tokens do not match data %d/%d/%d",
+			ErrInvalidArchive, m.Manufacturers, m.Users, m.APITokens, len(snap.Manufacturers), len(snap.Users), len(snap.APITokens))
+	}
+	return &m, snap, nil
+}
+
+// encodeLines writes items as JSON lines.
+func encodeLines[T any](items []T) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range items {
+		if err := enc.Encode(&items[i]); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeLines reads the JSON lines of member name from r and checks them against the
+// hex checksum sum.
+func decodeLines[T any](r io.Reader, name, sum string) ([]T, error) {
+	h := sha256.New()
+	dec := json.NewDecoder(io.TeeReader(r, h))
+	var items []T
+	for {
+		var item T
+		err := dec.Decode(&item)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s entry %d: %v", ErrInvalidArchive, name, len(items)+1, err)
+		}
+		items = append(items, item)
+	}
+	// hash whatever the decoder did not consume (trailing whitespace)
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return nil, fmt.Errorf("%w: %s checksum mismatch (manifest %s, data %s)", ErrInvalidArchive, name, sum, got)
+	}
+	return items, nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+func fixture() []storage.Shisha {
+	return []storage.Shisha{
+		{
+			ID:           3,
+			Name:         "Mint Breeze",
+			Flavor:       "Minze",
+			Manufacturer: storage.Manufacturer{Name: "Al Fakher"},
+			Smoked:       4,
+			Ratings:      []storage.Rating{{User: "alice", Score: 8, Timestamp: 1700000000}},
+			Comments:     []storage.Comment{{ID: 1, User: "bob", Message: "frisch", CreatedAt: 1700000100}},
+		},
+		{ID: 7, Name: "Love 66", Manufacturer: storage.Manufacturer{Name: "Adalya"}},
+	}
+}
+
+// fixtureStorage returns a memory storage with fixture(), a manufacturer without
+// shishas and two accounts, one with a token.
+func fixtureStorage(t *testing.T) storage.Storage {
+	t.Helper()
+	ctx := context.Background()
+	st := storage.NewMemoryAdapter(fixture()...)
+	if _, err := st.CreateManufacturer(ctx, &storage.Manufacturer{Name: "Tangiers"}); err != nil {
+		t.Fatalf("CreateManufacturer: %v", err)
+	}
+	for _, u := range fixtureUsers() {
+		u := u
+		if _, err := st.CreateUser(ctx, &u); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+	if _, err := st.CreateAPIToken(ctx, &fixtureTokens()[0]); err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+	return st
+}
+
+func fixtureUsers() []storage.User {
+	return []storage.User{
+		{Name: "alice", Role: storage.RoleAdmin, PasswordHash: "$2a$10$alice", CreatedAt: 1700000000},
+		{Name: "bob", Role: storage.RoleMember, PasswordHash: "$2a$10$bob", CreatedAt: 1700000050},
+	}
+}
+
+func fixtureTokens() []storage.APIToken {
+	return []storage.APIToken{{ID: "9f3c2a1b0e4d5c6f", User: "alice", Name: "skript", SecretHash: "c2VjcmV0", CreatedAt: 1700000200}}
+}
+
+func TestWriteRestore_AcrossBackends(t *testing.T) {
+	ctx := context.Background()
+	var archive bytes.Buffer
+	m, err := Write(ctx, fixtureStorage(t), &archive, "memory")
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if m.Shishas != 2 || m.Ratings != 1 || m.Comments != 1 || m.Manufacturers != 3 || m.Users != 2 || m.APITokens != 1 || m.Source != "memory" || m.SHA256 == "" {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	dst, err := storage.NewSQLiteAdapter(filepath.Join(t.TempDir(), "restore.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteAdapter: %v", err)
+	}
+	if _, err := Restore(ctx, dst, bytes.NewReader(archive.Bytes()), RestoreOptions{}); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	page, err := dst.ListShishas(ctx, storage.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListShishas: %v", err)
+	}
+	for i := range page.Items {
+		page.Items[i].Manufacturer.ID = 0 // SQL assigns its own manufacturer ids
+		page.Items[i].RatingStats = storage.RatingStats{}
+	}
+	if !reflect.DeepEqual(page.Items, fixture()) {
+		t.Fatalf("restored data differs:\ngot  %+v\nwant %+v", page.Items, fixture())
+	}
+	manufacturers, err := dst.ListManufacturers(ctx)
+	if err != nil || len(manufacturers) != 3 || manufacturers[2].Name != "Tangiers" {
+		t.Fatalf("restored manufacturers differ: %+v (%v)", manufacturers, err)
+	}
+	// accounts keep their roles and can log in with their old passwords and tokens
+	users, err := dst.ListUsers(ctx)
+	if err != nil || !reflect.DeepEqual(users, fixtureUsers()) {
+		t.Fatalf("restored users differ: %+v (%v)", users, err)
+	}
+	token, err := dst.GetAPIToken(ctx, fixtureTokens()[0].ID)
+	if err != nil || *token != fixtureTokens()[0] {
+		t.Fatalf("restored token differs: %+v (%v)", token, err)
+	}
+
+	// a second restore must not mix snapshots
+	if _, err := Restore(ctx, dst, bytes.NewReader(archive.Bytes()), RestoreOptions{VerifyOnly: true}); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("expected ErrNotEmpty, got %v", err)
+	}
+}
+
+func TestRestore_VerifyOnlyWritesNothing(t *testing.T) {
+	ctx := context.Background()
+	var archive bytes.Buffer
+	if _, err := Write(ctx, storage.NewMemoryAdapter(fixture()...), &archive, "memory"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	dst := storage.NewMemoryAdapter()
+	if _, err := Restore(ctx, dst, &archive, RestoreOptions{VerifyOnly: true}); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if page, _ := dst.ListShishas(ctx, storage.ListOptions{}); len(page.Items) != 0 {
+		t.Fatalf("verify wrote %d entries", len(page.Items))
+	}
+}
+
+// rewrite repacks archive, passing every member through edit.
+func rewrite(t *testing.T, archive []byte, edit func(name string, body []byte) []byte) []byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(tr)
+		body = edit(hdr.Name, body)
+		hdr.Size = int64(len(body))
+		_ = tw.WriteHeader(hdr)
+		_, _ = tw.Write(body)
+	}
+	_ = tw.Close()
+	_ = gw.Close()
+	return out.Bytes()
+}
+
+func TestRead_RejectsDamagedArchives(t *testing.T) {
+	var archive bytes.Buffer
+	if _, err := Write(context.Background(), fixtureStorage(t), &archive, "memory"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	cases := map[string][]byte{
+		"not gzip": []byte("plain text"),
+		"tampered data": rewrite(t, archive.Bytes(), func(name string, body []byte) []byte {
+			if name == dataName {
+				return bytes.Replace(body, []byte("Mint"), []byte("Mist"), 1)
+			}
+			return body
+		}),
+		"tampered user": rewrite(t, archive.Bytes(), func(name string, body []byte) []byte {
+			if name == usersName {
+				return bytes.Replace(body, []byte(`"member"`), []byte(`"admin"`), 1)
+			}
+			return body
+		}),
+		"newer version": rewrite(t, archive.Bytes(), func(name string, body []byte) []byte {
+			if name == manifestName {
+				return bytes.Replace(body, []byte(`"version": 2`), []byte(`"version": 99`), 1)
+			}
+			return body
+		}),
+		"truncated": archive.Bytes()[:archive.Len()/2],
+	}
+	for name, data := range cases {
+		if _, _, err := Read(bytes.NewReader(data)); !errors.Is(err, ErrInvalidArchive) {
+			t.Errorf("%s: expected ErrInvalidArchive, got %v", name, err)
+		}
+	}
+}
+
+func TestDir_ListPrunePath(t *testing.T) {
+	dir := t.TempDir()
+	for _, ts := range []string{"20240101T000000Z", "20240102T000000Z", "20240103T000000Z"} {
+		if err := os.WriteFile(filepath.Join(dir, filePrefix+ts+fileSuffix), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = os.WriteFile(filepath.Join(dir, "unrelated.txt"), []byte("x"), 0o644)
+
+	name, _, err := ToDir(context.Background(), storage.NewMemoryAdapter(fixture()...), dir, "memory")
+	if err != nil {
+		t.Fatalf("ToDir: %v", err)
+	}
+	if err := Prune(dir, 2); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	files, err := List(dir)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(files) != 2 || files[0].Name != name || files[1].CreatedAt != time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC) {
+		t.Fatalf("unexpected files after prune: %+v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unrelated.txt")); err != nil {
+		t.Fatalf("prune removed foreign file: %v", err)
+	}
+
+	if _, err := Path(dir, "../"+name); err == nil {
+		t.Fatalf("Path accepted a traversal")
+	}
+	if p, err := Path(dir, name); err != nil || p != filepath.Join(dir, name) {
+		t.Fatalf("Path(%q) = %q, %v", name, p, err)
+	}
+}
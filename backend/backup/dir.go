@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shisha-tracker/backend/storage"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	filePrefix = "shisha-backup-"
+	fileSuffix = ".tar.gz"
+	// fileTimeLayout sorts lexically in chronological order.
+	fileTimeLayout = "20060102T150405Z"
+)
+
+// File describes an archive stored in a backup directory.
+type File struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ToDir writes a new archive into dir and returns its file name. The archive is written
+// to a temporary file first and renamed once complete, so dir never holds partial
+// archives under a final name.
+func ToDir(ctx context.Context, st storage.Storage, dir, source string) (string, *Manifest, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", nil, err
+	}
+	tmp, err := os.CreateTemp(dir, ".partial-*")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+	m, err := Write(ctx, st, tmp, source)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	name := filePrefix + m.CreatedAt.Format(fileTimeLayout) + fileSuffix
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return "", nil, err
+	}
+	return name, m, nil
+}
+
+// List returns the archives in dir, newest first.
+func List(dir string) ([]File, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []File{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := []File{}
+	for _, e := range entries {
+		created, ok := parseName(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, File{Name: e.Name(), Size: info.Size(), CreatedAt: created})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name > files[j].Name })
+	return files, nil
+}
+
+// Path returns the path of the archive name in dir. It only accepts names as produced
+// by ToDir, so callers can pass user input without risking path traversal.
+func Path(dir, name string) (string, error) {
+	if _, ok := parseName(name); !ok || filepath.Base(name) != name {
+		return "", fmt.Errorf("%w: not a backup file name: %q", ErrInvalidArchive, name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// Prune deletes all but the newest keep archives in dir. keep <= 0 keeps everything.
+func Prune(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	files, err := List(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) <= keep {
+		return nil
+	}
+	for _, f := range files[keep:] {
+		if err := os.Remove(filepath.Join(dir, f.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Schedule writes an archive into dir every interval and prunes to keep archives until
+// ctx is done. Failures are logged and retried at the next tick.
+func Schedule(ctx context.Context, st storage.Storage, dir, source string, interval time.Duration, keep int) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		name, m, err := ToDir(ctx, st, dir, source)
+		if err != nil {
+			slog.ErrorContext(ctx, "backup: scheduled backup failed", "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "backup: wrote archive", "name", name, "shishas", m.Shishas)
+		if err := Prune(dir, keep); err != nil {
+			slog.WarnContext(ctx, "backup: pruning failed", "dir", dir, "error", err)
+		}
+	}
+}
+
+func parseName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(fileTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix))
+	return t, err == nil
+}
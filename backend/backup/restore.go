@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+// ErrNotEmpty is returned by Restore when the target storage already holds entries.
+var ErrNotEmpty = errors.New("target storage is not empty")
+
+// restoreBatchSize is the number of entries per RestoreShishas call.
+const restoreBatchSize = 200
+
+// RestoreOptions controls Restore.
+type RestoreOptions struct {
+	// VerifyOnly validates the archive and the target but writes nothing.
+	VerifyOnly bool
+}
+
+// Restore validates the archive in r and replays it into st: first the manufacturers
+// (under ids the target assigns; shishas find theirs by name), then the shishas with
+// their original ids, then the accounts with roles and password hashes, then the API
+// tokens. st must be empty (no shishas, manufacturers or users) so the result is
+// exactly the snapshot. If an entry is rejected the restore stops with an error; the
+// entries written so far stay in st.
+func Restore(ctx context.Context, st storage.Storage, r io.Reader, opts RestoreOptions) (*Manifest, error) {
+	m, snap, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	page, err := st.ListShishas(ctx, storage.ListOptions{Limit: 1})
+	if err != nil {
+		return nil, fmt.Errorf("check target: %w", err)
+	}
+	manufacturers, err := st.ListManufacturers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("check target: %w", err)
+	}
+	users, err := st.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("check target: %w", err)
+	}
+	if len(page.Items) > 0 || len(manufacturers) > 0 || len(users) > 0 {
+		return nil, ErrNotEmpty
+	}
+	if opts.VerifyOnly {
+		return m, nil
+	}
+	for i := range snap.Manufacturers {
+		mf := storage.Manufacturer{Name: snap.Manufacturers[i].Name}
+		if _, err := st.CreateManufacturer(ctx, &mf); err != nil {
+			return nil, fmt.Errorf("restore manufacturer %s: %w", mf.Name, err)
+		}
+	}
+	items := snap.Shishas
+	for start := 0; start < len(items); start += restoreBatchSize {
+		end := start + restoreBatchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		results, err := st.RestoreShishas(ctx, items[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("restore entries %d-%d: %w", start+1, end, err)
+		}
+		for k, res := range results {
+			if res.Err != nil {
+				return nil, fmt.Errorf("restore entry %d (id %d): %w", start+k+1, items[start+k].ID, res.Err)
+			}
+		}
+	}
+	for i := range snap.Users {
+		if _, err := st.CreateUser(ctx, &snap.Users[i]); err != nil {
+			return nil, fmt.Errorf("restore user %s: %w", snap.Users[i].Name, err)
+		}
+	}
+	for i := range snap.APITokens {
+		if _, err := st.CreateAPIToken(ctx, &snap.APITokens[i]); err != nil {
+			return nil, fmt.Errorf("restore token %s: %w", snap.APITokens[i].ID, err)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shisha-tracker/backend/backup"
+	"github.com/shisha-tracker/backend/storage"
+	"golang.org/x/exp/slog"
+)
+
+// defaultBackupKeep is the number of archives kept in BACKUP_DIR when BACKUP_KEEP is unset.
+const defaultBackupKeep = 7
+
+// backupDir returns BACKUP_DIR; empty disables the backup endpoints and schedule.
+func backupDir() string {
+	return os.Getenv("BACKUP_DIR")
+}
+
+// backupKeep returns BACKUP_KEEP, the number of archives kept when pruning.
+func backupKeep() int {
+	if v := os.Getenv("BACKUP_KEEP"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		slog.Warn("backup: invalid BACKUP_KEEP", "value", v, "keep", defaultBackupKeep)
+	}
+	return defaultBackupKeep
+}
+
+// startBackups runs scheduled backups into BACKUP_DIR every BACKUP_INTERVAL (e.g. "24h")
+// as a job of jobs, until the shutdown.
+// Only one replica should have BACKUP_INTERVAL set when several share the directory.
+func startBackups(jobs *jobGroup, s storage.Storage) {
+	dir, v := backupDir(), os.Getenv("BACKUP_INTERVAL")
+	if dir == "" || v == "" {
+		return
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		slog.Warn("backup: invalid BACKUP_INTERVAL, scheduled backups disabled", "value", v)
+		return
+	}
+	slog.Info("backup: scheduled backups enabled", "dir", dir, "interval", interval, "keep", backupKeep())
+	jobs.Go(func(ctx context.Context) {
+		backup.Schedule(ctx, s, dir, storageModeFromEnv(), interval, backupKeep())
+	})
+}
+
+// createBackup answers POST /api/admin/backups: writes a snapshot into BACKUP_DIR and
+// returns its file name and manifest.
+func createBackup(c *gin.Context) {
+	dir := backupDir()
+	if dir == "" {
+		_ = c.Error(fmt.Errorf("%w: backups are disabled (BACKUP_DIR not set)", errUnavailable))
+		return
+	}
+	name, m, err := backup.ToDir(c.Request.Context(), storageEngine, dir, storageModeFromEnv())
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	if err := backup.Prune(dir, backupKeep()); err != nil {
+		slog.WarnContext(c.Request.Context(), "backup: pruning failed", "dir", dir, "error", err)
+	}
+	slog.InfoContext(c.Request.Context(), "backup: wrote archive on demand", "name", name, "shishas", m.Shishas)
+	c.JSON(http.StatusCreated, gin.H{"name": name, "manifest": m})
+}
+
+// listBackups answers GET /api/admin/backups with the archives in BACKUP_DIR, newest first.
+func listBackups(c *gin.Context) {
+	dir := backupDir()
+	if dir == "" {
+		_ = c.Error(fmt.Errorf("%w: backups are disabled (BACKUP_DIR not set)", errUnavailable))
+		return
+	}
+	files, err := backup.List(dir)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, files)
+}
+
+// downloadBackup answers GET /api/admin/backups/:name with the archive file.
+func downloadBackup(c *gin.Context) {
+	dir := backupDir()
+	if dir == "" {
+		_ = c.Error(fmt.Errorf("%w: backups are disabled (BACKUP_DIR not set)", errUnavailable))
+		return
+	}
+	path, err := backup.Path(dir, c.Param("name"))
+	if err == nil {
+		_, err = os.Stat(path)
+	}
+	if err != nil {
+		_ = c.Error(fmt.Errorf("backup %q: %w", c.Param("name"), storage.ErrNotFound))
+		return
+	}
+	c.FileAttachment(path, c.Param("name"))
+}
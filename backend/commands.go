@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shisha-tracker/backend/auth"
+	"github.com/shisha-tracker/backend/backup"
+	"github.com/shisha-tracker/backend/storage"
+	"github.com/shisha-tracker/backend/transfer"
+)
+
+// commands are the maintenance subcommands of the backend binary. They use the same
+// STORAGE / database environment variables as the server.
+var commands = map[string]func(args []string) error{
+	"import":                  importCommand,
+	"export":                  exportCommand,
+	"backup":                  backupCommand,
+	"restore":                 restoreCommand,
+	"migrate":                 migrateCommand,
+	"normalize-manufacturers": normalizeManufacturersCommand,
+	"create-user":             createUserCommand,
+	"set-role":                setRoleCommand,
+}
+
+// runCommand executes the subcommand name with its arguments.
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command (available: %s)", commandNames())
+	}
+	return cmd(args)
+}
+
+func commandNames() string {
+	names := make([]string, 0, len(commands))
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// importCommand loads scraper JSONL files or exports, e.g.
+//
+//	server import -dry-run scripts/tabak.jsonl scripts/meine_tabaks.json
+//
+// "-" reads from stdin. A summary per file is printed as JSON to stdout.
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "parse and deduplicate only, write nothing")
+	batchSize := fs.Int("batch-size", transfer.DefaultBatchSize, "entries per write")
+	format := fs.String("format", "", "input format jsonl, csv or json (default: csv for *.csv files, jsonl otherwise)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: server import [-dry-run] [-format f] [-batch-size n] file ... (- for stdin)")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no input files")
+	}
+	st, err := openStorage(storageModeFromEnv())
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	for _, path := range fs.Args() {
+		var in io.Reader = os.Stdin
+		if path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		f := *format
+		if f == "" {
+			f = transfer.FormatJSONL
+			if strings.EqualFold(filepath.Ext(path), ".csv") {
+				f = transfer.FormatCSV
+			}
+		}
+		sum, err := transfer.Import(ctx, st, in, transfer.ImportOptions{Format: f, DryRun: *dryRun, BatchSize: *batchSize})
+		if sum != nil {
+			_ = enc.Encode(struct {
+				File string `json:"file"`
+				*transfer.ImportSummary
+			}{path, sum})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// exportCommand writes the whole catalogue to a file or stdout, e.g.
+//
+//	server export -format csv -o shishas.csv
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", transfer.FormatJSONL, "output format jsonl, csv or json")
+	out := fs.String("o", "-", "output file (- for stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: server export [-format jsonl|csv|json] [-o file]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !transfer.ValidFormat(*format) {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	st, err := openStorage(storageModeFromEnv())
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	n, err := transfer.Export(context.Background(), st, bw, *format)
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	log.Printf("exported %d shishas", n)
+	return nil
+}
+
+// backupCommand writes a snapshot archive, e.g.
+//
+//	server backup -o shisha.tar.gz
+//	server backup -dir /backups -keep 14
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("o", "", "archive file (- for stdout)")
+	dir := fs.String("dir", backupDir(), "write a timestamped archive into this directory instead")
+	keep := fs.Int("keep", backupKeep(), "with -dir: number of archives to keep (0 keeps all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	st, err := openStorage(storageModeFromEnv())
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if *out == "" {
+		if *dir == "" {
+			return fmt.Errorf("either -o or -dir (BACKUP_DIR) is required")
+		}
+		name, m, err := backup.ToDir(ctx, st, *dir, storageModeFromEnv())
+		if err != nil {
+			return err
+		}
+		log.Printf("wrote %s (%d shishas, %d ratings, %d comments, %d users, %d API tokens)", filepath.Join(*dir, name), m.Shishas, m.Ratings, m.Comments, m.Users, m.APITokens)
+		return backup.Prune(*dir, *keep)
+	}
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	m, err := backup.Write(ctx, st, w, storageModeFromEnv())
+	if err != nil {
+		return err
+	}
+	log.Printf("wrote %s (%d shishas, %d ratings, %d comments, %d users, %d API tokens)", *out, m.Shishas, m.Ratings, m.Comments, m.Users, m.APITokens)
+	return nil
+}
+
+// restoreCommand validates an archive and replays it into the (empty) configured
+// storage, e.g.
+//
+//	STORAGE=sqlite SQLITE_PATH=restored.db server restore shisha.tar.gz
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	verify := fs.Bool("verify", false, "only validate the archive and check that the target is empty")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: server restore [-verify] archive.tar.gz (- for stdin)")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("exactly one archive expected")
+	}
+	var in io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	st, err := openStorage(storageModeFromEnv())
+	if err != nil {
+		return err
+	}
+	m, err := backup.Restore(context.Background(), st, in, backup.RestoreOptions{VerifyOnly: *verify})
+	if err != nil {
+		return err
+	}
+	verb := "restored"
+	if *verify {
+		verb = "verified"
+	}
+	log.Printf("%s snapshot from %s (%s): %d shishas, %d ratings, %d comments, %d users, %d API tokens",
+		verb, m.CreatedAt.Format(time.RFC3339), m.Source, m.Shishas, m.Ratings, m.Comments, m.Users, m.APITokens)
+	return nil
+}
+
+// migrateCommand copies the catalogue from one backend to another, keeping ids, and
+// verifies the result, e.g.
+//
+//	DB_AUTO_MIGRATE=true server migrate -from couchdb -to gorm
+//
+// Both backends are configured through their usual env vars (COUCHDB_*, DATABASE_*,
+// SQLITE_PATH). An interrupted run is resumed by starting it again.
+func migrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := fs.String("from", "", "source storage: couchdb, gorm, sqlite or memory")
+	to := fs.String("to", "", "target storage: couchdb, gorm, sqlite or memory")
+	batchSize := fs.Int("batch-size", transfer.DefaultBatchSize, "entries per read and write")
+	verifyOnly := fs.Bool("verify-only", false, "only compare source and target, copy nothing")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: server migrate -from couchdb -to gorm [-batch-size n] [-verify-only]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		fs.Usage()
+		return fmt.Errorf("-from and -to are required")
+	}
+	if *from == *to {
+		return fmt.Errorf("source and target are both %q", *from)
+	}
+	src, err := openStorage(*from)
+	if err != nil {
+		return fmt.Errorf("open source: %w", err)
+	}
+	dst, err := openStorage(*to)
+	if err != nil {
+		return fmt.Errorf("open target: %w", err)
+	}
+	ctx := context.Background()
+	var verify *transfer.VerifyReport
+	if *verifyOnly {
+		verify, err = transfer.Verify(ctx, src, dst)
+		if err != nil {
+			return err
+		}
+	} else {
+		report, err := transfer.Migrate(ctx, src, dst, transfer.MigrateOptions{
+			BatchSize: *batchSize,
+			Progress: func(r transfer.MigrateReport) {
+				log.Printf("migrate: %d copied, %d updated, %d unchanged", r.Copied, r.Updated, r.Unchanged)
+			},
+		})
+		if err != nil {
+			return err
+		}
+		verify = report.Verify
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(verify)
+	if !verify.OK() {
+		return fmt.Errorf("%w: %d missing, %d extra, %d mismatched, %d manufacturers missing, %d users and %d API tokens differ",
+			transfer.ErrVerifyFailed, verify.MissingCount, verify.ExtraCount, verify.MismatchedCount, len(verify.Manufacturers), len(verify.Users), len(verify.APITokens))
+	}
+	log.Printf("migrate: verified %d shishas, the manufacturers and the accounts", verify.SourceCount)
+	return nil
+}
+
+// normalizeManufacturersCommand folds manufacturers that differ only in case or spacing
+// into one entry and prints the merged groups as JSON, e.g.
+//
+//	server normalize-manufacturers
+//
+// CouchDB runs this automatically once at startup; GORM/SQLite databases need it once
+// after upgrading.
+func normalizeManufacturersCommand(args []string) error {
+	fs := flag.NewFlagSet("normalize-manufacturers", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	st, err := openStorage(storageModeFromEnv())
+	if err != nil {
+		return err
+	}
+	merges, err := st.NormalizeManufacturers(context.Background())
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(merges)
+	log.Printf("normalize-manufacturers: %d groups changed", len(merges))
+	return nil
+}
+
+// createUserCommand creates an account, e.g. the first admin of a fresh installation:
+//
+//	USER_PASSWORD=... server create-user -role admin alice
+//
+// Without USER_PASSWORD the password is read from the first line of stdin.
+func createUserCommand(args []string) error {
+	fs := flag.NewFlagSet("create-user", flag.ContinueOnError)
+	role := fs.String("role", storage.RoleMember, "role of the account: "+strings.Join(storage.Roles, ", "))
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: server create-user [-role r] name (password from USER_PASSWORD or stdin)")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("exactly one name expected")
+	}
+	password, ok := os.LookupEnv("USER_PASSWORD")
+	if !ok {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if err := auth.CheckPasswordPolicy(password); err != nil {
+		return err
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	st, err := openStorage(storageModeFromEnv())
+	if err != nil {
+		return err
+	}
+	u, err := st.CreateUser(context.Background(), &storage.User{
+		Name:         fs.Arg(0),
+		Role:         *role,
+		PasswordHash: hash,
+		CreatedAt:    time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("create-user: created %s with role %s", u.Name, u.Role)
+	return nil
+}
+
+// setRoleCommand changes the role of an existing account, e.g. to promote a user who
+// registered through the UI:
+//
+//	server set-role alice admin
+func setRoleCommand(args []string) error {
+	fs := flag.NewFlagSet("set-role", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: server set-role name role (one of %s)\n", strings.Join(storage.Roles, ", "))
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("name and role expected")
+	}
+	st, err := openStorage(storageModeFromEnv())
+	if err != nil {
+		return err
+	}
+	u, err := st.SetUserRole(context.Background(), fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	log.Printf("set-role: %s is now %s", u.Name, u.Role)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// addComment answers POST /api/shishas/:id/comments for the logged-in user; a parentId
+// answers a top-level comment.
+func addComment(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Message  string `json:"message"`
+		ParentID uint   `json:"parentId"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	user, _ := currentUser(c)
+	out, err := storageEngine.AddComment(c.Request.Context(), id, user, req.Message, req.ParentID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusCreated, out)
+}
+
+// updateComment answers PUT /api/shishas/:id/comments/:cid with {"message"}.
+func updateComment(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	cid, ok := paramUint(c, "cid")
+	if !ok {
+		return
+	}
+	var req struct {
+		Message string `json:"message"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	author := commentAuthor(c)
+	out, err := storageEngine.UpdateComment(c.Request.Context(), id, cid, author, req.Message)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// deleteComment answers DELETE /api/shishas/:id/comments/:cid; the replies of the comment
+// are deleted with it.
+func deleteComment(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	cid, ok := paramUint(c, "cid")
+	if !ok {
+		return
+	}
+	if err := storageEngine.DeleteComment(c.Request.Context(), id, cid, commentAuthor(c)); err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// commentAuthor returns the author restriction of a comment change: empty for admins,
+// the logged-in user otherwise.
+func commentAuthor(c *gin.Context) string {
+	if isAdmin(c) {
+		return ""
+	}
+	user, _ := currentUser(c)
+	return user
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shisha-tracker/backend/storage"
+	"golang.org/x/exp/slog"
+)
+
+// statusClientClosedRequest is the non-standard status (nginx convention) recorded when
+// the client disconnected before the request finished.
+const statusClientClosedRequest = 499
+
+// errBadRequest marks malformed requests (unparsable ids or JSON bodies).
+var errBadRequest = errors.New("bad request")
+
+// errUnauthorized marks requests without valid credentials.
+var errUnauthorized = errors.New("unauthorized")
+
+// errUnavailable marks features that are switched off by configuration.
+var errUnavailable = errors.New("not available")
+
+// errorHandler is the central error mapper. Handlers record failures with c.Error and
+// return; once the handler chain finished, the last error is translated into an HTTP
+// status and a JSON body of the form {"error": "<code>", "message": "<details>"}.
+func errorHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		err := c.Errors.Last().Err
+		status, code := errorStatus(err)
+		msg := err.Error()
+		if status >= http.StatusInternalServerError {
+			slog.ErrorContext(c.Request.Context(), "request failed", "method", c.Request.Method, "route", c.FullPath(), "error", err)
+			// do not leak backend details to clients
+			msg = http.StatusText(status)
+		}
+		c.JSON(status, gin.H{"error": code, "message": msg})
+	}
+}
+
+// errorStatus maps an error to an HTTP status code and a stable machine-readable code.
+func errorStatus(err error) (int, string) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, "payload_too_large"
+	case errors.Is(err, errBadRequest):
+		return http.StatusBadRequest, "bad_request"
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized, "unauthorized"
+	case errors.Is(err, errUnavailable):
+		return http.StatusServiceUnavailable, "unavailable"
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound, "not_found"
+	case errors.Is(err, storage.ErrConflict):
+		return http.StatusConflict, "conflict"
+	case errors.Is(err, storage.ErrValidation):
+		return http.StatusUnprocessableEntity, "validation_failed"
+	case errors.Is(err, storage.ErrForbidden):
+		return http.StatusForbidden, "forbidden"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timeout"
+	case errors.Is(err, context.Canceled):
+		// the client went away; the response is never read but keeps logs accurate
+		return statusClientClosedRequest, "canceled"
+	default:
+		return http.StatusInternalServerError, "internal"
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// jobGroup tracks the background work of the server (search refresh, scheduled backups,
+// catalogue recounts) so the shutdown can cancel it and wait for it before the storage
+// is closed.
+type jobGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	stopping bool
+	wg       sync.WaitGroup
+}
+
+func newJobGroup() *jobGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobGroup{ctx: ctx, cancel: cancel}
+}
+
+// Go runs fn in its own goroutine with the group's context, unless the shutdown began.
+func (g *jobGroup) Go(fn func(ctx context.Context)) {
+	if !g.add() {
+		return
+	}
+	go func() {
+		defer g.wg.Done()
+		fn(g.ctx)
+	}()
+}
+
+// Run calls fn with the group's context in the calling goroutine and reports true, or
+// reports false without calling fn once the shutdown began.
+func (g *jobGroup) Run(fn func(ctx context.Context)) bool {
+	if !g.add() {
+		return false
+	}
+	defer g.wg.Done()
+	fn(g.ctx)
+	return true
+}
+
+func (g *jobGroup) add() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopping {
+		return false
+	}
+	g.wg.Add(1)
+	return true
+}
+
+// Cancel starts no further jobs and cancels the context of the running ones.
+func (g *jobGroup) Cancel() {
+	g.mu.Lock()
+	g.stopping = true
+	g.mu.Unlock()
+	g.cancel()
+}
+
+// Wait cancels the jobs and waits until they returned, at most until ctx is done.
+func (g *jobGroup) Wait(ctx context.Context) error {
+	g.Cancel()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,127 @@
+// Package logging configures the structured logger of the server: JSON (or text) lines
+// through slog with a level that can be changed at runtime, the request id and trace id
+// of the current request on every line logged with its context, and redaction of
+// attributes that carry secrets or user-supplied content.
+//
+// Configuration:
+//
+//	LOG_LEVEL   debug, info (default), warn or error; later changed with SetLevel
+//	LOG_FORMAT  json (default) or text
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// level is shared by all handlers created here, so SetLevel applies immediately.
+var level = new(slog.LevelVar)
+
+// redactedKeys are attribute keys whose values never reach the log: credentials and
+// content typed in by users (comments, search terms, query strings).
+var redactedKeys = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"secret":        true,
+	"authorization": true,
+	"cookie":        true,
+	"comment":       true,
+	"message":       true,
+	"query":         true,
+	"q":             true,
+}
+
+// redacted replaces the value of a redacted attribute.
+const redacted = "[redacted]"
+
+// Setup makes a handler configured from LOG_LEVEL and LOG_FORMAT the slog default. Lines
+// of the standard log package are routed through it at info level.
+func Setup(w io.Writer) error {
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := SetLevel(v); err != nil {
+			return err
+		}
+	}
+	h, err := NewHandler(w, os.Getenv("LOG_FORMAT"))
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// NewHandler returns a handler writing format ("json", the default, or "text") to w at
+// the shared level, with request ids and redaction.
+func NewHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	switch strings.ToLower(format) {
+	case "", "json":
+		return contextHandler{slog.NewJSONHandler(w, opts)}, nil
+	case "text":
+		return contextHandler{slog.NewTextHandler(w, opts)}, nil
+	default:
+		return nil, fmt.Errorf("unknown LOG_FORMAT %q (json or text)", format)
+	}
+}
+
+// Level returns the current minimum level.
+func Level() slog.Level { return level.Level() }
+
+// SetLevel changes the minimum level of all handlers; name is debug, info, warn or error.
+func SetLevel(name string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("unknown log level %q (debug, info, warn or error)", name)
+	}
+	level.Set(l)
+	return nil
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns ctx carrying the request id id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id of ctx, "" outside of requests.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request id and the trace and span id of the record's context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+)
+
+// capture makes a JSON handler writing into the returned buffer the default logger.
+func capture(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, "json")
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func lines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var out []map[string]interface{}
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if l == "" {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(l), &m); err != nil {
+			t.Fatalf("log line is not JSON: %q", l)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestHandler(t *testing.T) {
+	buf := capture(t)
+	ctx := WithRequestID(context.Background(), "req-1")
+	slog.InfoContext(ctx, "login", "user", "alice", "password", "geheim", "message", "Hallo")
+	slog.DebugContext(ctx, "hidden")
+
+	if err := SetLevel("debug"); err != nil {
+		t.Fatalf("SetLevel: %v", err)
+	}
+	t.Cleanup(func() { _ = SetLevel("info") })
+	slog.DebugContext(ctx, "shown")
+	if err := SetLevel("loud"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+
+	got := lines(t, buf)
+	if len(got) != 2 || got[1]["msg"] != "shown" {
+		t.Fatalf("expected the info and the second debug line, got %v", got)
+	}
+	first := got[0]
+	if first["request_id"] != "req-1" || first["user"] != "alice" {
+		t.Errorf("missing attributes in %v", first)
+	}
+	if first["password"] != redacted || first["message"] != redacted {
+		t.Errorf("user content not redacted in %v", first)
+	}
+	if _, err := NewHandler(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	buf := capture(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware(), Recovery())
+	r.GET("/api/search", func(c *gin.Context) {
+		slog.InfoContext(c.Request.Context(), "searching")
+		c.Status(http.StatusOK)
+	})
+	r.GET("/api/panic", func(c *gin.Context) { panic("boom") })
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/search?q=geheim", nil)
+	req.Header.Set(RequestIDHeader, "from-ingress")
+	r.ServeHTTP(rec, req)
+	if got := rec.Header().Get(RequestIDHeader); got != "from-ingress" {
+		t.Errorf("expected the caller's request id, got %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/api/panic", nil)
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	r.ServeHTTP(rec, req)
+	generated := rec.Header().Get(RequestIDHeader)
+	if rec.Code != http.StatusInternalServerError || len(generated) != 32 {
+		t.Errorf("expected 500 with a generated id, got %d and %q", rec.Code, generated)
+	}
+
+	if strings.Contains(buf.String(), "geheim") {
+		t.Errorf("query string reached the log: %s", buf)
+	}
+	got := lines(t, buf)
+	if len(got) != 4 {
+		t.Fatalf("expected 4 log lines, got %d: %s", len(got), buf)
+	}
+	for i, want := range []string{"from-ingress", "from-ingress", generated, generated} {
+		if got[i]["request_id"] != want {
+			t.Errorf("line %d (%v): expected request id %q", i, got[i]["msg"], want)
+		}
+	}
+	if got[1]["route"] != "/api/search" || got[1]["status"] != float64(http.StatusOK) {
+		t.Errorf("unexpected access line %v", got[1])
+	}
+	if got[3]["level"] != "ERROR" || got[3]["status"] != float64(http.StatusInternalServerError) {
+		t.Errorf("a panic must log the 500 at error level, got %v", got[3])
+	}
+}
@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+)
+
+// RequestIDHeader carries the request id in both directions.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen bounds request ids taken over from callers.
+const maxRequestIDLen = 128
+
+// quietPaths are polled by probes and scrapers; their access lines are debug only, or
+// warn when they fail.
+var quietPaths = map[string]bool{
+	"/api/healthz": true,
+	"/api/ready":   true,
+	"/api/metrics": true,
+}
+
+// Middleware assigns every request an id, returns it in the X-Request-ID response
+// header and logs one access line when the request is done. A well-formed X-Request-ID
+// of the caller (e.g. the ingress) is kept. The query string is never logged, since it
+// carries search terms.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), id))
+		c.Next()
+
+		status := c.Writer.Status()
+		lvl := slog.LevelInfo
+		quiet := quietPaths[c.Request.URL.Path]
+		switch {
+		case quiet && status >= http.StatusInternalServerError:
+			// failing probes are expected while shutting down
+			lvl = slog.LevelWarn
+		case quiet:
+			lvl = slog.LevelDebug
+		case status >= http.StatusInternalServerError:
+			lvl = slog.LevelError
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		slog.Default().LogAttrs(c.Request.Context(), lvl, "request",
+			slog.String("method", c.Request.Method),
+			slog.String("route", route),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Int("bytes", c.Writer.Size()),
+			slog.Float64("duration_ms", millis(time.Since(start))),
+			slog.String("client_ip", c.ClientIP()),
+		)
+	}
+}
+
+// Recovery turns a panic in a handler into a 500 and logs it with its stack.
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		slog.ErrorContext(c.Request.Context(), "panic while serving a request",
+			"panic", fmt.Sprint(err), "stack", string(debug.Stack()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, r := range id {
+		ok := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.'
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms; a time-based id still correlates
+		return fmt.Sprintf("t%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func millis(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
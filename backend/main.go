@@ -1,116 +1,124 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/shisha-tracker/backend/logging"
+	"github.com/shisha-tracker/backend/metrics"
+	"github.com/shisha-tracker/backend/search"
 	"github.com/shisha-tracker/backend/storage"
+	"github.com/shisha-tracker/backend/tracing"
+	"github.com/shisha-tracker/backend/transfer"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"golang.org/x/exp/slog"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
-type User struct {
-	ID   uint   `gorm:"primaryKey" json:"id"`
-	Name string `json:"name"`
-}
+var storageEngine storage.Storage
 
-type Manufacturer struct {
-	ID   uint   `gorm:"primaryKey" json:"id"`
-	Name string `json:"name"`
-}
+// appMetrics collects the Prometheus metrics served at /api/metrics.
+var appMetrics = metrics.New()
 
-type Shisha struct {
-	ID             uint         `gorm:"primaryKey" json:"id"`
-	Name           string       `json:"name"`
-	Flavor         string       `json:"flavor"`
-	ManufacturerID uint         `json:"manufacturer_id"`
-	Manufacturer   Manufacturer `json:"manufacturer" gorm:"foreignKey:ManufacturerID"`
-	Ratings        []Rating     `json:"ratings" gorm:"constraint:OnDelete:CASCADE;"`
-	Comments       []Comment    `json:"comments" gorm:"constraint:OnDelete:CASCADE;"`
-}
+// searchIndex serves /api/search; storageEngine keeps it current on writes.
+var searchIndex *search.Index
 
-type Rating struct {
-	ID       uint   `gorm:"primaryKey" json:"id"`
-	ShishaID uint   `json:"shisha_id"`
-	User     string `json:"user"`
-	Score    int    `json:"score"`
-}
+// maxImportBytes bounds the request body of POST /api/import.
+const maxImportBytes = 50 << 20
 
-type Comment struct {
-	ID       uint   `gorm:"primaryKey" json:"id"`
-	ShishaID uint   `json:"shisha_id"`
-	User     string `json:"user"`
-	Message  string `json:"message"`
-}
+// catalogMetricsMaxAge is how long the catalogue gauges of /api/metrics are reused
+// before the catalogue is counted again.
+const catalogMetricsMaxAge = time.Minute
 
-var db *gorm.DB
-var storageEngine storage.Storage
+// defaultListLimit is the page size of GET /api/shishas without ?limit; clients page
+// through the rest with X-Next-Cursor.
+const defaultListLimit = 100
 
-func main() {
+// maxSearchLimit caps the number of hits a client may request from /api/search.
+const maxSearchLimit = 100
 
-	// allow full DATABASE_URL or construct DSN from individual env vars (used by Helm values)
-	dsn := os.Getenv("DATABASE_URL")
-	if dsn == "" {
-		host := os.Getenv("DATABASE_HOST")
-		if host == "" {
-			host = "localhost"
-		}
-		port := os.Getenv("DATABASE_PORT")
-		if port == "" {
-			port = "26257"
-		}
-		user := os.Getenv("DATABASE_USER")
-		if user == "" {
-			user = "root"
-		}
-		name := os.Getenv("DATABASE_NAME")
-		if name == "" {
-			name = "shisha"
-		}
-		password := os.Getenv("DATABASE_PASSWORD") // optional, may be provided via secret
-		// build DSN for lib/pq (Postgres-compatible)
-		if password != "" {
-			dsn = fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s sslmode=disable", host, port, user, name, password)
-		} else {
-			dsn = fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable", host, port, user, name)
+func main() {
+	// "backend <command> ..." runs a maintenance command instead of the server
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
 		}
+		return
 	}
-	var err error
-	// choose storage backend: default CouchDB ("couchdb") or GORM (legacy)
-	storageMode := os.Getenv("STORAGE")
-	if storageMode == "" {
-		storageMode = "couchdb"
+
+	if err := logging.Setup(os.Stderr); err != nil {
+		log.Fatalf("logging: %v", err)
+	}
+	// gin's debug mode prints unstructured lines; GIN_MODE=debug still enables it
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
 	}
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		fatal("failed to initialize tracing", err)
+	}
+	defer shutdownTracing(context.Background())
 
-	if storageMode == "couchdb" {
-		couchURL := os.Getenv("COUCHDB_URL")
-		couchUser := os.Getenv("COUCHDB_USER")
-		couchPass := os.Getenv("COUCHDB_PASSWORD")
-		couchDB := os.Getenv("COUCHDB_DB")
-		adapter, err := storage.NewCouchAdapter(couchURL, couchUser, couchPass, couchDB)
-		if err != nil {
-			log.Fatalf("failed to initialize CouchDB adapter: %v", err)
-		}
-		storageEngine = adapter
-		log.Printf("Using CouchDB storage backend (%s/%s)", couchURL, couchDB)
-	} else {
-		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
-		if err != nil {
-			log.Fatalf("failed to connect database: %v", err)
-		}
-		storageEngine = storage.NewGormAdapter(db)
-		log.Println("Using GORM storage backend")
+	storageMode := storageModeFromEnv()
+	storage.CouchResponseHook = appMetrics.CouchResponse
+	adapter, err := openStorage(storageMode)
+	if err != nil {
+		fatal("failed to initialize storage", err, "mode", storageMode)
+	}
+	backend := backendName(storageMode)
+	storageSetup, _ = adapter.(storage.SetupChecker)
+	storageEngine = appMetrics.WrapStorage(tracing.WrapStorage(adapter, backend), backend)
+	// background jobs stop with the server: jobs in progress are cancelled and waited for
+	jobs := newJobGroup()
+	appMetrics.RegisterCatalog(adapter, catalogMetricsMaxAge, jobs.Run)
+	storageEngine, searchIndex = startSearch(jobs, storageEngine)
+	sessions = newSessions()
+	startBackups(jobs, storageEngine)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
 	}
+	addr := fmt.Sprintf(":%s", port)
+	cfg := serverConfigFromEnv()
+	srv := newServer(addr, newRouter(), cfg)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal("failed to listen", err, "addr", addr)
+	}
+	slog.Info("listening", "addr", addr)
 
-	// Automatic DB migrations removed (CouchDB as storage; manage migrations externally if needed).
-	log.Println("Automatic DB migrations disabled (CouchDB assumed)")
+	// a second signal during the shutdown kills the process right away
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	err = serve(ctx, stop, srv, ln, cfg, jobs)
+	if err != nil {
+		fatal("HTTP server failed", err)
+	}
+	closeStorage(adapter)
+}
 
-	r := gin.Default()
+// fatal logs msg with err and the attributes args, then exits.
+func fatal(msg string, err error, args ...any) {
+	slog.Error(msg, append([]any{"error", err}, args...)...)
+	os.Exit(1)
+}
+
+// newRouter wires all API routes to their handlers. Who may call a route is decided by
+// routePolicy.
+func newRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(traceRequests(), logging.Middleware(), logging.Recovery(), appMetrics.Middleware(), errorHandler(), authenticate(), authorize())
 	api := r.Group("/api")
 	{
 		api.GET("/healthz", healthHandler)
@@ -125,34 +133,239 @@ func main() {
 		api.GET("/db-info", dbInfoHandler)
 
 		api.GET("/shishas", listShishas)
-		api.POST("/shishas", createShisha)
 		api.GET("/shishas/:id", getShisha)
+		api.GET("/shishas/:id/stats", shishaStats)
+		api.GET("/manufacturers", listManufacturers)
+		api.GET("/manufacturers/:id", getManufacturer)
+		api.GET("/search", searchShishas)
+		api.GET("/export", exportShishas)
+
+		api.POST("/auth/register", register)
+		api.POST("/auth/login", login)
+		api.POST("/auth/logout", logout)
+
+		api.GET("/auth/me", me)
+		api.GET("/auth/tokens", listTokens)
+		api.POST("/auth/tokens", createToken)
+		api.DELETE("/auth/tokens/:tid", deleteToken)
+
+		api.POST("/shishas", createShisha)
 		api.PUT("/shishas/:id", updateShisha)
 		api.DELETE("/shishas/:id", deleteShisha)
 
 		api.POST("/shishas/:id/ratings", addRating)
+		api.DELETE("/shishas/:id/ratings/:user", deleteRating)
 		api.POST("/shishas/:id/comments", addComment)
+		api.PUT("/shishas/:id/comments/:cid", updateComment)
+		api.DELETE("/shishas/:id/comments/:cid", deleteComment)
 		api.POST("/shishas/:id/smoked", addSmoked)
+
+		api.POST("/manufacturers", createManufacturer)
+		api.PUT("/manufacturers/:id", updateManufacturer)
+		api.DELETE("/manufacturers/:id", deleteManufacturer)
+		api.POST("/manufacturers/:id/merge", mergeManufacturers)
+
+		api.POST("/import", importShishas)
+
+		api.POST("/admin/backups", createBackup)
+		api.GET("/admin/backups", listBackups)
+		api.GET("/admin/backups/:name", downloadBackup)
+		api.GET("/admin/users", listUsers)
+		api.PUT("/admin/users/:name/role", setUserRole)
+		api.GET("/admin/log-level", getLogLevel)
+		api.PUT("/admin/log-level", setLogLevel)
+	}
+	return r
+}
+
+// storageModeFromEnv returns the backend selected by STORAGE: CouchDB ("couchdb",
+// default), in-process "memory", local "sqlite" file or GORM (any other value, legacy).
+func storageModeFromEnv() string {
+	if mode := os.Getenv("STORAGE"); mode != "" {
+		return mode
 	}
+	return "couchdb"
+}
 
-	port := os.Getenv("PORT")
+// backendName returns the storage backend label of the metrics for mode.
+func backendName(mode string) string {
+	switch mode {
+	case "couchdb", "memory", "sqlite":
+		return mode
+	default:
+		return "gorm"
+	}
+}
+
+// openStorage creates the storage backend selected by mode, configured from env vars.
+func openStorage(mode string) (storage.Storage, error) {
+	switch mode {
+	case "couchdb":
+		couchURL := os.Getenv("COUCHDB_URL")
+		couchUser := os.Getenv("COUCHDB_USER")
+		couchPass := os.Getenv("COUCHDB_PASSWORD")
+		couchDB := os.Getenv("COUCHDB_DB")
+		adapter, err := storage.NewCouchAdapter(couchURL, couchUser, couchPass, couchDB)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("using CouchDB storage backend", "url", couchURL, "db", couchDB)
+		return adapter, nil
+	case "memory":
+		seed, err := memorySeed()
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("using in-memory storage backend, data is not persisted", "seed_entries", len(seed))
+		return storage.NewMemoryAdapter(seed...), nil
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "shisha.db"
+		}
+		adapter, err := storage.NewSQLiteAdapter(path)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("using SQLite storage backend", "path", path)
+		return adapter, nil
+	default:
+		db, err := gorm.Open(postgres.Open(databaseDSN()), &gorm.Config{Logger: storage.GormLogger()})
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect database: %w", err)
+		}
+		adapter := storage.NewGormAdapter(db)
+		// schema migrations are opt-in so production schemas can be managed externally
+		if os.Getenv("DB_AUTO_MIGRATE") == "true" {
+			if err := adapter.Migrate(context.Background()); err != nil {
+				return nil, fmt.Errorf("failed to migrate database: %w", err)
+			}
+			slog.Info("GORM schema migrated")
+		} else {
+			slog.Info("automatic DB migrations disabled (set DB_AUTO_MIGRATE=true to enable)")
+		}
+		slog.Info("using GORM storage backend")
+		return adapter, nil
+	}
+}
+
+// startSearch wraps s so creates, updates and deletes keep a search index current and
+// builds the index from the stored catalogue. Unless SEARCH_REFRESH_INTERVAL is "0" the
+// index is rebuilt periodically (default every 5m) to pick up writes of other replicas,
+// as a job of jobs.
+func startSearch(jobs *jobGroup, s storage.Storage) (storage.Storage, *search.Index) {
+	idx := search.NewIndex()
+	wrapped := search.Wrap(s, idx)
+	if err := idx.Rebuild(context.Background(), s); err != nil {
+		// search stays empty until the next refresh; the API itself keeps working
+		slog.Warn("search: initial index build failed", "error", err)
+	} else {
+		slog.Info("search: index built", "shishas", idx.Len())
+	}
+
+	interval := 5 * time.Minute
+	if v := os.Getenv("SEARCH_REFRESH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			slog.Warn("search: invalid SEARCH_REFRESH_INTERVAL", "value", v, "interval", interval)
+		} else {
+			interval = d
+		}
+	}
+	if interval > 0 {
+		jobs.Go(func(ctx context.Context) {
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+				if err := idx.Rebuild(ctx, s); err != nil && ctx.Err() == nil {
+					slog.Warn("search: index refresh failed", "error", err)
+				}
+			}
+		})
+	}
+	return wrapped, idx
+}
+
+// databaseDSN returns DATABASE_URL or constructs a DSN from individual env vars (used by Helm values).
+func databaseDSN() string {
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		return dsn
+	}
+	host := os.Getenv("DATABASE_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	port := os.Getenv("DATABASE_PORT")
 	if port == "" {
-		port = "8080"
+		port = "26257"
 	}
-	addr := fmt.Sprintf(":%s", port)
-	r.Run(addr)
+	user := os.Getenv("DATABASE_USER")
+	if user == "" {
+		user = "root"
+	}
+	name := os.Getenv("DATABASE_NAME")
+	if name == "" {
+		name = "shisha"
+	}
+	password := os.Getenv("DATABASE_PASSWORD") // optional, may be provided via secret
+	// build DSN for lib/pq (Postgres-compatible)
+	if password != "" {
+		return fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s sslmode=disable", host, port, user, name, password)
+	}
+	return fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable", host, port, user, name)
 }
 
-func healthHandler(c *gin.Context) {
-	c.Status(http.StatusOK)
+// memorySeed returns the initial data for STORAGE=memory: MEMORY_SEED_FILE points to a
+// JSON array of shishas, MEMORY_SEED=true loads the built-in sample catalogue.
+func memorySeed() ([]storage.Shisha, error) {
+	if path := os.Getenv("MEMORY_SEED_FILE"); path != "" {
+		return storage.LoadSeedFile(path)
+	}
+	if os.Getenv("MEMORY_SEED") == "true" {
+		return storage.SampleShishas(), nil
+	}
+	return nil, nil
 }
 
-func readyHandler(c *gin.Context) {
-	c.Status(http.StatusOK)
+// traceRequests opens a server span per request, continuing the trace of an incoming
+// traceparent header. Scrapes and liveness probes are not traced.
+func traceRequests() gin.HandlerFunc {
+	return otelgin.Middleware(tracing.ServiceName, otelgin.WithFilter(func(r *http.Request) bool {
+		return r.URL.Path != "/api/metrics" && r.URL.Path != "/api/healthz"
+	}))
+}
+
+// getLogLevel answers GET /api/admin/log-level with the current level of this replica.
+func getLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": strings.ToLower(logging.Level().String())})
 }
 
+// setLogLevel answers PUT /api/admin/log-level with {"level": "debug|info|warn|error"}.
+// The change applies to this replica until it restarts.
+func setLogLevel(c *gin.Context) {
+	var in struct {
+		Level string `json:"level"`
+	}
+	if !bindJSON(c, &in) {
+		return
+	}
+	if err := logging.SetLevel(in.Level); err != nil {
+		_ = c.Error(fmt.Errorf("%w: %v", errBadRequest, err))
+		return
+	}
+	user, _ := currentUser(c)
+	slog.WarnContext(c.Request.Context(), "log level changed", "level", logging.Level(), "by", user)
+	getLogLevel(c)
+}
+
+// metricsHandler serves the Prometheus metrics in the text exposition format.
 func metricsHandler(c *gin.Context) {
-	c.String(http.StatusOK, "# shisha mock metrics\nshisha_requests_total 0\n")
+	appMetrics.Handler().ServeHTTP(c.Writer, c.Request)
 }
 
 func infoHandler(c *gin.Context) {
@@ -171,7 +384,7 @@ func dbHealthHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"healthy": false, "error": "storage engine not initialized"})
 		return
 	}
-	if err := storageEngine.Health(); err != nil {
+	if err := storageEngine.Health(c.Request.Context()); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"healthy": false, "error": err.Error()})
 		return
 	}
@@ -184,7 +397,7 @@ func dbInfoHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "storage engine not initialized"})
 		return
 	}
-	info, err := storageEngine.DBInfo()
+	info, err := storageEngine.DBInfo(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -210,156 +423,316 @@ func containerIDHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"container_id": containerID})
 }
 
+// listShishas returns one page of the catalogue as a JSON array, with rating stats but
+// without the single ratings. Optional query parameters: limit (page size,
+// defaultListLimit if unset), cursor (from the X-Next-Cursor header of the previous
+// page), sort (id|name|rating|smoked|manufacturer), order (asc|desc), manufacturer,
+// flavor and ratings=true for the single ratings.
 func listShishas(c *gin.Context) {
-	log.Printf("GET /api/shishas start remote=%s", c.ClientIP())
-	shishas, err := storageEngine.ListShishas()
+	opts, err := listOptionsFromQuery(c)
 	if err != nil {
-		log.Printf("GET /api/shishas storage error: %v", err)
-		c.Status(http.StatusInternalServerError)
+		_ = c.Error(err)
 		return
 	}
+	// the rating stats are enough for overviews; the single ratings are opt-in
+	withRatings := false
+	if v := c.Query("ratings"); v != "" {
+		if withRatings, err = strconv.ParseBool(v); err != nil {
+			_ = c.Error(fmt.Errorf("%w: ratings must be true or false", errBadRequest))
+			return
+		}
+	}
+	page, err := storageEngine.ListShishas(c.Request.Context(), opts)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	shishas := page.Items
 	if shishas == nil {
-		log.Printf("GET /api/shishas: storage returned nil slice - normalizing to empty")
 		shishas = make([]storage.Shisha, 0)
 	}
-	log.Printf("GET /api/shishas ok count=%d", len(shishas))
+	if !withRatings {
+		for i := range shishas {
+			shishas[i].Ratings = nil
+		}
+	}
+	if page.NextCursor != "" {
+		c.Header("X-Next-Cursor", page.NextCursor)
+	}
+	slog.DebugContext(c.Request.Context(), "listed shishas", "count", len(shishas))
 	c.JSON(http.StatusOK, shishas)
 }
 
-func getShisha(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+// searchShishas answers GET /api/search?q=...&limit=... with the best matching entries
+// of the search index, most relevant first.
+func searchShishas(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		_ = c.Error(fmt.Errorf("%w: query parameter q is required", errBadRequest))
+		return
+	}
+	limit := search.DefaultLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			_ = c.Error(fmt.Errorf("%w: limit must be a positive integer", errBadRequest))
+			return
+		}
+		limit = n
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	c.JSON(http.StatusOK, searchIndex.Search(q, limit))
+}
+
+// importShishas answers POST /api/import: the body is scraper JSONL (one shisha per
+// line) or an export in ?format=jsonl|csv|json, ?dryRun=true only reports what would
+// happen. The response is the import summary.
+func importShishas(c *gin.Context) {
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dryRun", "false"))
 	if err != nil {
-		c.Status(http.StatusBadRequest)
+		_ = c.Error(fmt.Errorf("%w: dryRun must be true or false", errBadRequest))
+		return
+	}
+	format, ok := formatParam(c)
+	if !ok {
 		return
 	}
-	s, err := storageEngine.GetShisha(uint(id))
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	opts := transfer.ImportOptions{Format: format, DryRun: dryRun}
+	sum, err := transfer.Import(c.Request.Context(), storageEngine, body, opts)
 	if err != nil {
-		log.Printf("storage.GetShisha id=%d error: %v", id, err)
-		c.Status(http.StatusInternalServerError)
+		_ = c.Error(err)
 		return
 	}
-	if s == nil {
-		c.Status(http.StatusNotFound)
+	slog.InfoContext(c.Request.Context(), "import finished", "dry_run", dryRun, "created", sum.Created, "skipped", sum.Skipped, "failed", sum.Failed)
+	c.JSON(http.StatusOK, sum)
+}
+
+// exportShishas streams the whole catalogue as a download in ?format=jsonl|csv|json
+// (default jsonl). The output can be fed back into POST /api/import.
+func exportShishas(c *gin.Context) {
+	format, ok := formatParam(c)
+	if !ok {
+		return
+	}
+	filename := fmt.Sprintf("shishas-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+	c.Header("Content-Type", transfer.ContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+	n, err := transfer.Export(c.Request.Context(), storageEngine, c.Writer, format)
+	if err != nil {
+		// the status line is already sent; the truncated body is all the client gets
+		slog.WarnContext(c.Request.Context(), "export aborted", "format", format, "written", n, "error", err)
+		return
+	}
+	slog.InfoContext(c.Request.Context(), "export finished", "format", format, "count", n)
+}
+
+// formatParam reads the ?format= parameter of import and export (default jsonl). On an
+// unknown value the error is recorded on the context and ok is false.
+func formatParam(c *gin.Context) (string, bool) {
+	format := c.DefaultQuery("format", transfer.FormatJSONL)
+	if !transfer.ValidFormat(format) {
+		_ = c.Error(fmt.Errorf("%w: format must be jsonl, csv or json", errBadRequest))
+		return "", false
+	}
+	return format, true
+}
+
+// listOptionsFromQuery parses the paging, sorting and filter query parameters. Without
+// limit a page holds defaultListLimit entries.
+func listOptionsFromQuery(c *gin.Context) (storage.ListOptions, error) {
+	opts := storage.ListOptions{
+		Limit:        defaultListLimit,
+		Cursor:       c.Query("cursor"),
+		Sort:         c.Query("sort"),
+		Manufacturer: c.Query("manufacturer"),
+		Flavor:       c.Query("flavor"),
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("%w: limit must be a positive integer", errBadRequest)
+		}
+		opts.Limit = n
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, fmt.Errorf("%w: order must be asc or desc", errBadRequest)
+	}
+	return opts, nil
+}
+
+// paramID parses the numeric :id path parameter. On failure the error is recorded on
+// the context and ok is false.
+func paramID(c *gin.Context) (uint, bool) {
+	return paramUint(c, "id")
+}
+
+// paramUint parses the numeric path parameter name like paramID.
+func paramUint(c *gin.Context, name string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param(name), 10, 0)
+	if err != nil {
+		_ = c.Error(fmt.Errorf("%w: invalid %s %q", errBadRequest, name, c.Param(name)))
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// bindJSON decodes the request body into v. On failure the error is recorded on the
+// context and false is returned.
+func bindJSON(c *gin.Context, v interface{}) bool {
+	if err := c.ShouldBindJSON(v); err != nil {
+		_ = c.Error(fmt.Errorf("%w: %v", errBadRequest, err))
+		return false
+	}
+	return true
+}
+
+func getShisha(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	s, err := storageEngine.GetShisha(c.Request.Context(), id)
+	if err != nil {
+		_ = c.Error(err)
 		return
 	}
 	c.JSON(http.StatusOK, s)
 }
 
+// shishaStats answers GET /api/shishas/:id/stats with the rating statistics of a shisha.
+func shishaStats(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	st, err := storageEngine.RatingStats(c.Request.Context(), id)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, st)
+}
+
 func createShisha(c *gin.Context) {
 	var in storage.Shisha
-	if err := c.BindJSON(&in); err != nil {
-		c.Status(http.StatusBadRequest)
+	if !bindJSON(c, &in) {
 		return
 	}
-
-	out, err := storageEngine.CreateShisha(&in)
+	// ratings, comments and the smoked counter come only from their own endpoints, which
+	// enforce the author and the score rules
+	create := storage.Shisha{Name: in.Name, Flavor: in.Flavor, Manufacturer: in.Manufacturer}
+	out, err := storageEngine.CreateShisha(c.Request.Context(), &create)
 	if err != nil {
-		log.Printf("storage.CreateShisha input=%+v error: %v", in, err)
-		c.Status(http.StatusInternalServerError)
+		_ = c.Error(err)
 		return
 	}
 	c.JSON(http.StatusCreated, out)
 }
 
 func updateShisha(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		c.Status(http.StatusBadRequest)
+	id, ok := paramID(c)
+	if !ok {
 		return
 	}
 	var in storage.Shisha
-	if err := c.BindJSON(&in); err != nil {
-		c.Status(http.StatusBadRequest)
+	if !bindJSON(c, &in) {
 		return
 	}
-	out, err := storageEngine.UpdateShisha(uint(id), &in)
+	out, err := storageEngine.UpdateShisha(c.Request.Context(), id, &in)
 	if err != nil {
-		log.Printf("storage.UpdateShisha id=%d input=%+v error: %v", id, in, err)
-		c.Status(http.StatusInternalServerError)
+		_ = c.Error(err)
 		return
 	}
 	c.JSON(http.StatusOK, out)
 }
 
 func deleteShisha(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		c.Status(http.StatusBadRequest)
+	id, ok := paramID(c)
+	if !ok {
 		return
 	}
-	if err := storageEngine.DeleteShisha(uint(id)); err != nil {
-		log.Printf("storage.DeleteShisha id=%d error: %v", id, err)
-		c.Status(http.StatusInternalServerError)
+	if err := storageEngine.DeleteShisha(c.Request.Context(), id); err != nil {
+		_ = c.Error(err)
 		return
 	}
 	c.Status(http.StatusNoContent)
 }
 
+// addRating answers POST /api/shishas/:id/ratings for the logged-in user. A user rates a
+// shisha once; rating again replaces the score.
 func addRating(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		c.Status(http.StatusBadRequest)
+	id, ok := paramID(c)
+	if !ok {
 		return
 	}
 	var req struct {
-		User  string `json:"user"`
-		Score int    `json:"score"`
+		// decoded as a number so that half stars sent as 3.5 are rejected, not truncated
+		Score *float64 `json:"score"`
 	}
-	if err := c.BindJSON(&req); err != nil {
-		c.Status(http.StatusBadRequest)
+	if !bindJSON(c, &req) {
 		return
 	}
-	if err := storageEngine.AddRating(uint(id), req.User, req.Score); err != nil {
-		log.Printf("storage.AddRating id=%d user=%s score=%d error: %v", id, req.User, req.Score, err)
-		c.Status(http.StatusInternalServerError)
+	if req.Score == nil {
+		_ = c.Error(fmt.Errorf("%w: score is required", storage.ErrValidation))
 		return
 	}
-	c.JSON(http.StatusCreated, gin.H{"user": req.User, "score": req.Score})
-}
-
-func addComment(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		c.Status(http.StatusBadRequest)
+	score := int(*req.Score)
+	if float64(score) != *req.Score {
+		_ = c.Error(fmt.Errorf("%w: score must be a whole number (half stars times two)", storage.ErrValidation))
 		return
 	}
-	var req struct {
-		User    string `json:"user"`
-		Message string `json:"message"`
+	user, _ := currentUser(c)
+	if err := storageEngine.AddRating(c.Request.Context(), id, user, score); err != nil {
+		_ = c.Error(err)
+		return
 	}
-	if err := c.BindJSON(&req); err != nil {
-		c.Status(http.StatusBadRequest)
+	c.JSON(http.StatusCreated, gin.H{"user": user, "score": score})
+}
+
+// deleteRating answers DELETE /api/shishas/:id/ratings/:user; users may only delete
+// their own rating. Names match case-insensitively here and in storage.
+func deleteRating(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
 		return
 	}
-	if err := storageEngine.AddComment(uint(id), req.User, req.Message); err != nil {
-		log.Printf("storage.AddComment id=%d user=%s error: %v", id, req.User, err)
-		c.Status(http.StatusInternalServerError)
+	user, _ := currentUser(c)
+	if target := strings.TrimSpace(c.Param("user")); !strings.EqualFold(target, user) {
+		if !isAdmin(c) {
+			_ = c.Error(fmt.Errorf("%w: only the own rating can be deleted", storage.ErrForbidden))
+			return
+		}
+		user = target
+	}
+	if err := storageEngine.DeleteRating(c.Request.Context(), id, user); err != nil {
+		_ = c.Error(err)
 		return
 	}
-	c.JSON(http.StatusCreated, gin.H{"user": req.User, "message": req.Message})
+	c.Status(http.StatusNoContent)
 }
 
 func addSmoked(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		c.Status(http.StatusBadRequest)
+	id, ok := paramID(c)
+	if !ok {
 		return
 	}
-	if err := storageEngine.AddSmoked(uint(id)); err != nil {
-		log.Printf("storage.AddSmoked id=%d error: %v", id, err)
-		c.Status(http.StatusInternalServerError)
+	if err := storageEngine.AddSmoked(c.Request.Context(), id); err != nil {
+		_ = c.Error(err)
 		return
 	}
 
 	// fetch updated shisha and return smoked count to the client
-	s, err := storageEngine.GetShisha(uint(id))
+	s, err := storageEngine.GetShisha(c.Request.Context(), id)
 	if err != nil {
-		log.Printf("storage.GetShisha id=%d error: %v", id, err)
-		c.Status(http.StatusInternalServerError)
-		return
-	}
-	if s == nil {
-		c.Status(http.StatusNotFound)
+		_ = c.Error(err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"smokedCount": s.Smoked})
@@ -0,0 +1,898 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shisha-tracker/backend/auth"
+	"github.com/shisha-tracker/backend/backup"
+	"github.com/shisha-tracker/backend/search"
+	"github.com/shisha-tracker/backend/storage"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	sessions = auth.NewSessions([]byte("test-key"), time.Hour)
+}
+
+const testPassword = "geheim123"
+
+// loginClient registers name on ts with the given role and returns a client sending its
+// session cookie.
+func loginClient(t *testing.T, ts *httptest.Server, name, role string) *http.Client {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.Post(ts.URL+"/api/auth/register", "application/json",
+		strings.NewReader(`{"name":"`+name+`","password":"`+testPassword+`"}`))
+	if err != nil {
+		t.Fatalf("register %s: %v", name, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register %s: status %d", name, resp.StatusCode)
+	}
+	if role != storage.RoleMember {
+		if _, err := storageEngine.SetUserRole(context.Background(), name, role); err != nil {
+			t.Fatalf("set role of %s: %v", name, err)
+		}
+	}
+	return client
+}
+
+// newTestServer runs the real router against a seeded in-memory store.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	useStorage(storage.NewMemoryAdapter(storage.SampleShishas()...))
+	ts := httptest.NewServer(newRouter())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// useStorage installs s (with a search index) as the storage behind the handlers.
+func useStorage(s storage.Storage) {
+	searchIndex = search.NewIndex()
+	searchIndex.Replace(mustList(s))
+	storageEngine = search.Wrap(s, searchIndex)
+}
+
+func mustList(s storage.Storage) []storage.Shisha {
+	page, err := s.ListShishas(context.Background(), storage.ListOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return page.Items
+}
+
+func TestHandlers_SmokedAndErrors(t *testing.T) {
+	ts := newTestServer(t)
+	client := loginClient(t, ts, "carol", storage.RoleCurator)
+
+	resp, err := client.Post(ts.URL+"/api/shishas/1/smoked", "application/json", nil)
+	if err != nil {
+		t.Fatalf("POST smoked: %v", err)
+	}
+	var smoked struct {
+		SmokedCount int `json:"smokedCount"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&smoked); err != nil {
+		t.Fatalf("decode smoked response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || smoked.SmokedCount != 1 {
+		t.Fatalf("expected 200 with smokedCount=1, got %d %+v", resp.StatusCode, smoked)
+	}
+
+	cases := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{http.MethodGet, "/api/shishas/99", "", http.StatusNotFound, "not_found"},
+		{http.MethodPost, "/api/shishas/99/ratings", `{"user":"a","score":4}`, http.StatusNotFound, "not_found"},
+		{http.MethodPost, "/api/shishas/1/ratings", `{"user":"a","score":9999}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{http.MethodPost, "/api/shishas/1/ratings", `{"user":"a","score":3.5}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{http.MethodPost, "/api/shishas/1/ratings", `{"user":"a"}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{http.MethodDelete, "/api/shishas/1/ratings/carol", "", http.StatusNotFound, "not_found"},
+		{http.MethodDelete, "/api/shishas/1/ratings/alice", "", http.StatusForbidden, "forbidden"},
+		{http.MethodGet, "/api/shishas/99/stats", "", http.StatusNotFound, "not_found"},
+		{http.MethodGet, "/api/shishas?ratings=maybe", "", http.StatusBadRequest, "bad_request"},
+		{http.MethodGet, "/api/shishas/abc", "", http.StatusBadRequest, "bad_request"},
+		{http.MethodPost, "/api/shishas", `{"name":""}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{http.MethodGet, "/api/shishas?limit=0", "", http.StatusBadRequest, "bad_request"},
+		{http.MethodGet, "/api/shishas?order=up", "", http.StatusBadRequest, "bad_request"},
+		{http.MethodGet, "/api/shishas?sort=color", "", http.StatusUnprocessableEntity, "validation_failed"},
+		{http.MethodGet, "/api/shishas?cursor=bogus", "", http.StatusUnprocessableEntity, "validation_failed"},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, ts.URL+tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.method, tc.path, err)
+		}
+		var body struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || body.Error != tc.code {
+			t.Errorf("%s %s: expected %d/%s, got %d/%s", tc.method, tc.path, tc.status, tc.code, resp.StatusCode, body.Error)
+		}
+	}
+}
+
+func TestHandlers_ListPaging(t *testing.T) {
+	useStorage(storage.NewMemoryAdapter(
+		storage.Shisha{Name: "Mint", Manufacturer: storage.Manufacturer{Name: "Al Fakher"}},
+		storage.Shisha{Name: "Grape", Manufacturer: storage.Manufacturer{Name: "Adalya"}},
+		storage.Shisha{Name: "Love 66", Manufacturer: storage.Manufacturer{Name: "Adalya"}},
+	))
+	ts := httptest.NewServer(newRouter())
+	defer ts.Close()
+
+	var names []string
+	url := ts.URL + "/api/shishas?limit=2&sort=name&order=desc"
+	for url != "" {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		var page []storage.Shisha
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatalf("decode list: %v", err)
+		}
+		resp.Body.Close()
+		for _, s := range page {
+			names = append(names, s.Name)
+		}
+		url = ""
+		if next := resp.Header.Get("X-Next-Cursor"); next != "" {
+			url = ts.URL + "/api/shishas?limit=2&sort=name&order=desc&cursor=" + next
+		}
+	}
+	if strings.Join(names, ",") != "Mint,Love 66,Grape" {
+		t.Fatalf("unexpected paged listing %v", names)
+	}
+
+	resp, err := http.Get(ts.URL + "/api/shishas?manufacturer=adalya")
+	if err != nil {
+		t.Fatalf("GET filtered: %v", err)
+	}
+	var filtered []storage.Shisha
+	_ = json.NewDecoder(resp.Body).Decode(&filtered)
+	resp.Body.Close()
+	if len(filtered) != 2 || resp.Header.Get("X-Next-Cursor") != "" {
+		t.Fatalf("expected 2 Adalya entries on one page, got %d", len(filtered))
+	}
+}
+
+func TestHandlers_ListDefaultLimit(t *testing.T) {
+	many := make([]storage.Shisha, defaultListLimit+1)
+	for i := range many {
+		many[i] = storage.Shisha{Name: "Shisha " + strconv.Itoa(i+1), Manufacturer: storage.Manufacturer{Name: "Al Fakher"}}
+	}
+	useStorage(storage.NewMemoryAdapter(many...))
+	ts := httptest.NewServer(newRouter())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/shishas")
+	if err != nil {
+		t.Fatalf("GET list: %v", err)
+	}
+	var page []storage.Shisha
+	_ = json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+	if len(page) != defaultListLimit || resp.Header.Get("X-Next-Cursor") == "" {
+		t.Fatalf("expected a page of %d entries with a cursor, got %d", defaultListLimit, len(page))
+	}
+}
+
+func TestHandlers_SearchFollowsWrites(t *testing.T) {
+	ts := newTestServer(t)
+	client := loginClient(t, ts, "carol", storage.RoleAdmin)
+
+	resp, err := client.Post(ts.URL+"/api/shishas", "application/json",
+		strings.NewReader(`{"name":"Wassermelone","flavor":"Melone, Minze","manufacturer":{"name":"Al Fakher"}}`))
+	if err != nil {
+		t.Fatalf("POST shisha: %v", err)
+	}
+	var created storage.Shisha
+	_ = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+
+	find := func(q string) []search.Hit {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/api/search?q=" + q)
+		if err != nil {
+			t.Fatalf("GET search: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("search %q: status %d", q, resp.StatusCode)
+		}
+		var hits []search.Hit
+		_ = json.NewDecoder(resp.Body).Decode(&hits)
+		return hits
+	}
+	if hits := find("wasermelone"); len(hits) != 1 || hits[0].ID != created.ID {
+		t.Fatalf("expected the new entry for a misspelt query, got %+v", hits)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/shishas/"+strconv.Itoa(int(created.ID)), nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE: %v", err)
+	}
+	resp.Body.Close()
+	if hits := find("wassermelone"); len(hits) != 0 {
+		t.Fatalf("deleted entry still found: %+v", hits)
+	}
+
+	resp, err = http.Get(ts.URL + "/api/search")
+	if err != nil {
+		t.Fatalf("GET search: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("missing q: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlers_Import(t *testing.T) {
+	ts := newTestServer(t)
+	client := loginClient(t, ts, "carol", storage.RoleAdmin)
+	body := `{"name":"Wassermelone","flavor":"Melone","manufacturer":{"name":"Al Fakher"}}
+{"name":"Mint Breeze","manufacturer":{"name":"Al Fakher"}}
+`
+	for _, tc := range []struct {
+		query   string
+		created int
+		hits    int
+	}{
+		{"?dryRun=true", 1, 0},
+		{"", 1, 1},
+	} {
+		resp, err := client.Post(ts.URL+"/api/import"+tc.query, "application/x-ndjson", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST import: %v", err)
+		}
+		var sum struct {
+			Created int `json:"created"`
+			Skipped int `json:"skipped"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&sum)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || sum.Created != tc.created || sum.Skipped != 1 {
+			t.Fatalf("import%s: unexpected %d %+v", tc.query, resp.StatusCode, sum)
+		}
+		if hits := searchIndex.Search("wassermelone", 0); len(hits) != tc.hits {
+			t.Fatalf("import%s: expected %d search hits, got %d", tc.query, tc.hits, len(hits))
+		}
+	}
+}
+
+func TestHandlers_Export(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/api/export?format=csv")
+	if err != nil {
+		t.Fatalf("GET export: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/csv") {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(resp.Header.Get("Content-Disposition"), "attachment") || !strings.Contains(string(body), "Mint Breeze") {
+		t.Fatalf("unexpected export %q", body)
+	}
+
+	resp, err = http.Get(ts.URL + "/api/export?format=xml")
+	if err != nil {
+		t.Fatalf("GET export: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown format: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlers_Backups(t *testing.T) {
+	ts := newTestServer(t)
+	client := loginClient(t, ts, "carol", storage.RoleAdmin)
+
+	t.Setenv("BACKUP_DIR", "")
+	resp, err := client.Post(ts.URL+"/api/admin/backups", "application/json", nil)
+	if err != nil {
+		t.Fatalf("POST backups: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("disabled backups: expected 503, got %d", resp.StatusCode)
+	}
+
+	t.Setenv("BACKUP_DIR", t.TempDir())
+	resp, err = client.Post(ts.URL+"/api/admin/backups", "application/json", nil)
+	if err != nil {
+		t.Fatalf("POST backups: %v", err)
+	}
+	var created struct {
+		Name     string          `json:"name"`
+		Manifest backup.Manifest `json:"manifest"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || created.Manifest.Shishas != 1 {
+		t.Fatalf("unexpected create response %d %+v", resp.StatusCode, created)
+	}
+
+	resp, err = client.Get(ts.URL + "/api/admin/backups/" + created.Name)
+	if err != nil {
+		t.Fatalf("GET backup: %v", err)
+	}
+	m, snap, err := backup.Read(resp.Body)
+	resp.Body.Close()
+	if err != nil || m.SHA256 != created.Manifest.SHA256 || len(snap.Shishas) != 1 || len(snap.Users) == 0 {
+		t.Fatalf("downloaded archive invalid: %v", err)
+	}
+
+	resp, err = client.Get(ts.URL + "/api/admin/backups/shisha-backup-nope.tar.gz")
+	if err != nil {
+		t.Fatalf("GET backup: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown archive: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlers_Manufacturers(t *testing.T) {
+	useStorage(storage.NewMemoryAdapter(
+		storage.Shisha{Name: "Mint", Manufacturer: storage.Manufacturer{Name: "Al Fakher"}},
+		storage.Shisha{Name: "Grape", Manufacturer: storage.Manufacturer{Name: "Alfakher"}},
+	))
+	ts := httptest.NewServer(newRouter())
+	defer ts.Close()
+	client := loginClient(t, ts, "carol", storage.RoleAdmin)
+
+	do := func(method, path, body string, out interface{}) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			_ = json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	var list []storage.Manufacturer
+	if status := do(http.MethodGet, "/api/manufacturers", "", &list); status != http.StatusOK || len(list) != 2 {
+		t.Fatalf("list: got %d %+v", status, list)
+	}
+	var created storage.Manufacturer
+	if status := do(http.MethodPost, "/api/manufacturers", `{"name":" Adalya "}`, &created); status != http.StatusCreated || created.Name != "Adalya" {
+		t.Fatalf("create: got %d %+v", status, created)
+	}
+	if status := do(http.MethodPost, "/api/manufacturers", `{"name":"adalya"}`, nil); status != http.StatusConflict {
+		t.Fatalf("duplicate create: expected 409, got %d", status)
+	}
+
+	into, from := list[0], list[1]
+	var merged storage.Manufacturer
+	path := "/api/manufacturers/" + strconv.Itoa(int(into.ID)) + "/merge"
+	if status := do(http.MethodPost, path, `{"ids":[`+strconv.Itoa(int(from.ID))+`]}`, &merged); status != http.StatusOK || merged != into {
+		t.Fatalf("merge: got %d %+v", status, merged)
+	}
+	if status := do(http.MethodGet, "/api/manufacturers/"+strconv.Itoa(int(from.ID)), "", nil); status != http.StatusNotFound {
+		t.Fatalf("merged manufacturer: expected 404, got %d", status)
+	}
+	if status := do(http.MethodDelete, "/api/manufacturers/"+strconv.Itoa(int(into.ID)), "", nil); status != http.StatusConflict {
+		t.Fatalf("delete used: expected 409, got %d", status)
+	}
+
+	// a rename is visible in the shisha list and the search index
+	if status := do(http.MethodPut, "/api/manufacturers/"+strconv.Itoa(int(into.ID)), `{"name":"Al Fakher Tobacco"}`, nil); status != http.StatusOK {
+		t.Fatalf("rename: got %d", status)
+	}
+	var shishas []storage.Shisha
+	do(http.MethodGet, "/api/shishas?manufacturer=al%20fakher%20tobacco", "", &shishas)
+	if len(shishas) != 2 {
+		t.Fatalf("expected both shishas under the new name, got %+v", shishas)
+	}
+	var hits []search.Hit
+	do(http.MethodGet, "/api/search?q=tobacco", "", &hits)
+	if len(hits) != 2 || hits[0].Manufacturer.Name != "Al Fakher Tobacco" {
+		t.Fatalf("search index not updated after rename: %+v", hits)
+	}
+}
+
+func TestHandlers_RatingStats(t *testing.T) {
+	useStorage(storage.NewMemoryAdapter(
+		storage.Shisha{Name: "Mint", Ratings: []storage.Rating{{User: "alice", Score: 10}}},
+		storage.Shisha{Name: "Grape", Ratings: []storage.Rating{{User: "alice", Score: 4}, {User: "bob", Score: 6}}},
+	))
+	ts := httptest.NewServer(newRouter())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/shishas/2/stats")
+	if err != nil {
+		t.Fatalf("GET stats: %v", err)
+	}
+	var st storage.ShishaStats
+	_ = json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	// prior: mean 20/3 over 3 ratings with weight 5
+	want := storage.ShishaStats{
+		ShishaID: 2,
+		RatingStats: storage.RatingStats{
+			RatingCount:     2,
+			RatingAvg:       5,
+			RatingWeighted:  (5*20.0/3 + 10) / 7,
+			RatingHistogram: []int{0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0},
+		},
+		PriorAvg:     20.0 / 3,
+		PriorWeight:  storage.RatingPriorWeight,
+		TotalRatings: 3,
+	}
+	if resp.StatusCode != http.StatusOK || !reflect.DeepEqual(st, want) {
+		t.Fatalf("stats: got %d %+v, want %+v", resp.StatusCode, st, want)
+	}
+
+	resp, err = http.Get(ts.URL + "/api/shishas?sort=id")
+	if err != nil {
+		t.Fatalf("GET list: %v", err)
+	}
+	var list []map[string]interface{}
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 2 || list[0]["ratings"] != nil || list[0]["ratingCount"] != float64(1) || list[0]["ratingAvg"] != float64(10) {
+		t.Fatalf("list without ratings by default: %+v", list)
+	}
+	resp, err = http.Get(ts.URL + "/api/shishas?ratings=true&sort=id")
+	if err != nil {
+		t.Fatalf("GET list with ratings: %v", err)
+	}
+	var full []storage.Shisha
+	_ = json.NewDecoder(resp.Body).Decode(&full)
+	resp.Body.Close()
+	if len(full) != 2 || len(full[1].Ratings) != 2 {
+		t.Fatalf("list with ratings: %+v", full)
+	}
+	// a single 10 is pulled towards the catalogue mean
+	if w := list[0]["ratingWeighted"].(float64); w <= 20.0/3 || w >= 10 {
+		t.Fatalf("weighted score of a single 10 should lie between the mean and 10, got %v", w)
+	}
+}
+
+func TestHandlers_Comments(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := loginClient(t, ts, "alice", storage.RoleMember), loginClient(t, ts, "bob", storage.RoleMember)
+	mod := loginClient(t, ts, "mod", storage.RoleAdmin)
+
+	do := func(client *http.Client, method, path, body string, out interface{}) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			_ = json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	// the sample shisha carries bob's comment 1
+	var reply storage.Comment
+	if status := do(alice, http.MethodPost, "/api/shishas/1/comments", `{"message":"Stimmt","parentId":1}`, &reply); status != http.StatusCreated || reply.User != "alice" || reply.ParentID != 1 || reply.ID == 0 || reply.CreatedAt == 0 {
+		t.Fatalf("reply: got %d %+v", status, reply)
+	}
+	path := "/api/shishas/1/comments/" + strconv.Itoa(int(reply.ID))
+	if status := do(bob, http.MethodPost, "/api/shishas/1/comments", `{"message":"Nein","parentId":`+strconv.Itoa(int(reply.ID))+`}`, nil); status != http.StatusUnprocessableEntity {
+		t.Fatalf("reply to a reply: expected 422, got %d", status)
+	}
+
+	cases := []struct {
+		client             *http.Client
+		method, path, body string
+		status             int
+	}{
+		{http.DefaultClient, http.MethodPost, "/api/shishas/1/comments", `{"message":"x"}`, http.StatusUnauthorized},
+		{alice, http.MethodPut, "/api/shishas/1/comments/1", `{"message":"x"}`, http.StatusForbidden},
+		{bob, http.MethodPut, "/api/shishas/1/comments/1", `{"message":" "}`, http.StatusUnprocessableEntity},
+		{bob, http.MethodPut, "/api/shishas/1/comments/abc", `{"message":"x"}`, http.StatusBadRequest},
+		{bob, http.MethodPut, "/api/shishas/1/comments/99", `{"message":"x"}`, http.StatusNotFound},
+		{bob, http.MethodDelete, path, "", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		if status := do(tc.client, tc.method, tc.path, tc.body, nil); status != tc.status {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, tc.status, status)
+		}
+	}
+
+	var edited storage.Comment
+	if status := do(bob, http.MethodPut, "/api/shishas/1/comments/1", `{"message":"Leicht, frisch"}`, &edited); status != http.StatusOK || edited.Message != "Leicht, frisch" || edited.EditedAt == 0 {
+		t.Fatalf("edit by author: got %d %+v", status, edited)
+	}
+	if status := do(mod, http.MethodDelete, path, "", nil); status != http.StatusNoContent {
+		t.Fatalf("delete as admin: expected 204, got %d", status)
+	}
+	if status := do(bob, http.MethodDelete, "/api/shishas/1/comments/1", "", nil); status != http.StatusNoContent {
+		t.Fatalf("delete by author: expected 204, got %d", status)
+	}
+	var got storage.Shisha
+	do(http.DefaultClient, http.MethodGet, "/api/shishas/1", "", &got)
+	if len(got.Comments) != 0 {
+		t.Fatalf("expected no comments left, got %+v", got.Comments)
+	}
+}
+
+func TestHandlers_Auth(t *testing.T) {
+	ts := newTestServer(t)
+
+	do := func(method, path, body, bearer string, out interface{}) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			_ = json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp
+	}
+
+	var sess struct {
+		User  storage.User `json:"user"`
+		Token string       `json:"token"`
+	}
+	resp := do(http.MethodPost, "/api/auth/register", `{"name":"Dora","password":"`+testPassword+`"}`, "", &sess)
+	if resp.StatusCode != http.StatusCreated || sess.User.Name != "Dora" || sess.Token == "" {
+		t.Fatalf("register: got %d %+v", resp.StatusCode, sess)
+	}
+	if len(resp.Cookies()) == 0 || resp.Cookies()[0].Name != sessionCookie || !resp.Cookies()[0].HttpOnly {
+		t.Fatalf("register should set an HttpOnly session cookie, got %+v", resp.Cookies())
+	}
+
+	cases := []struct {
+		method, path, body, bearer string
+		status                     int
+	}{
+		{http.MethodPost, "/api/auth/register", `{"name":"dora","password":"` + testPassword + `"}`, "", http.StatusConflict},
+		{http.MethodPost, "/api/auth/register", `{"name":"eve","password":"kurz"}`, "", http.StatusUnprocessableEntity},
+		{http.MethodPost, "/api/auth/register", `{"name":"e v e","password":"` + testPassword + `"}`, "", http.StatusUnprocessableEntity},
+		{http.MethodPost, "/api/auth/login", `{"name":"dora","password":"falsch123"}`, "", http.StatusUnauthorized},
+		{http.MethodPost, "/api/auth/login", `{"name":"nobody","password":"` + testPassword + `"}`, "", http.StatusUnauthorized},
+		{http.MethodPost, "/api/auth/login", `{"name":"dora","password":"` + testPassword + `"}`, "", http.StatusOK},
+		{http.MethodGet, "/api/auth/me", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/auth/me", "", sess.Token, http.StatusOK},
+		{http.MethodGet, "/api/shishas", "", "sht_0000_forged", http.StatusUnauthorized},
+		{http.MethodPost, "/api/shishas/1/ratings", `{"score":5}`, "", http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		if resp := do(tc.method, tc.path, tc.body, tc.bearer, nil); resp.StatusCode != tc.status {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, tc.status, resp.StatusCode)
+		}
+	}
+
+	var token struct {
+		storage.APIToken
+		Token string `json:"token"`
+	}
+	if resp := do(http.MethodPost, "/api/auth/tokens", `{"name":"script"}`, sess.Token, &token); resp.StatusCode != http.StatusCreated || !strings.HasPrefix(token.Token, "sht_") || token.User != "Dora" {
+		t.Fatalf("create token: got %d %+v", resp.StatusCode, token)
+	}
+	var rating storage.Rating
+	if resp := do(http.MethodPost, "/api/shishas/1/ratings", `{"user":"alice","score":5}`, token.Token, &rating); resp.StatusCode != http.StatusCreated || rating.User != "Dora" {
+		t.Fatalf("rating via API token: got %d %+v", resp.StatusCode, rating)
+	}
+	var tokens []map[string]interface{}
+	do(http.MethodGet, "/api/auth/tokens", "", token.Token, &tokens)
+	if len(tokens) != 1 || tokens[0]["id"] != token.ID || tokens[0]["token"] != nil {
+		t.Fatalf("list tokens: got %+v", tokens)
+	}
+	if resp := do(http.MethodDelete, "/api/auth/tokens/"+token.ID, "", sess.Token, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete token: expected 204, got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodGet, "/api/auth/me", "", token.Token, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("deleted token: expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestRoutePolicyCoversAllRoutes(t *testing.T) {
+	for _, route := range newRouter().Routes() {
+		if _, ok := routePolicy[route.Method+" "+route.Path]; !ok {
+			t.Errorf("route %s %s has no entry in routePolicy", route.Method, route.Path)
+		}
+	}
+}
+
+func TestHandlers_Roles(t *testing.T) {
+	ts := newTestServer(t)
+	clients := map[string]*http.Client{"anonymous": http.DefaultClient}
+	for _, role := range storage.Roles {
+		clients[role] = loginClient(t, ts, role+"-user", role)
+	}
+
+	do := func(as, method, path, body string, out interface{}) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := clients[as].Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			_ = json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	cases := []struct {
+		as, method, path, body string
+		status                 int
+	}{
+		{"anonymous", http.MethodGet, "/api/shishas/1", "", http.StatusOK},
+		{"anonymous", http.MethodPut, "/api/shishas/1", `{"name":"x"}`, http.StatusUnauthorized},
+		{storage.RoleViewer, http.MethodGet, "/api/auth/me", "", http.StatusOK},
+		{storage.RoleViewer, http.MethodPost, "/api/shishas/1/ratings", `{"score":4}`, http.StatusForbidden},
+		{storage.RoleMember, http.MethodPost, "/api/shishas/1/ratings", `{"score":4}`, http.StatusCreated},
+		{storage.RoleMember, http.MethodPut, "/api/shishas/1", `{"name":"x"}`, http.StatusForbidden},
+		{storage.RoleCurator, http.MethodPost, "/api/manufacturers", `{"name":"Darkside"}`, http.StatusCreated},
+		{storage.RoleCurator, http.MethodDelete, "/api/shishas/1", "", http.StatusForbidden},
+		{storage.RoleCurator, http.MethodDelete, "/api/shishas/1/ratings/alice", "", http.StatusForbidden},
+		{storage.RoleCurator, http.MethodGet, "/api/admin/users", "", http.StatusForbidden},
+		{storage.RoleAdmin, http.MethodGet, "/api/admin/users", "", http.StatusOK},
+		{storage.RoleAdmin, http.MethodDelete, "/api/shishas/1/ratings/Alice", "", http.StatusNoContent},
+		{storage.RoleAdmin, http.MethodPut, "/api/admin/users/admin-user/role", `{"role":"member"}`, http.StatusForbidden},
+		{storage.RoleAdmin, http.MethodPut, "/api/admin/users/member-user/role", `{"role":"root"}`, http.StatusUnprocessableEntity},
+		{storage.RoleAdmin, http.MethodPut, "/api/admin/users/nobody/role", `{"role":"member"}`, http.StatusNotFound},
+		{storage.RoleCurator, http.MethodPut, "/api/admin/log-level", `{"level":"info"}`, http.StatusForbidden},
+		{storage.RoleAdmin, http.MethodPut, "/api/admin/log-level", `{"level":"verbose"}`, http.StatusBadRequest},
+		{storage.RoleAdmin, http.MethodPut, "/api/admin/log-level", `{"level":"info"}`, http.StatusOK},
+	}
+	for _, tc := range cases {
+		if status := do(tc.as, tc.method, tc.path, tc.body, nil); status != tc.status {
+			t.Errorf("%s %s as %s: expected %d, got %d", tc.method, tc.path, tc.as, tc.status, status)
+		}
+	}
+
+	// a curator edits catalogue fields only; ratings, comments and smoked survive
+	var before, updated storage.Shisha
+	do("anonymous", http.MethodGet, "/api/shishas/1", "", &before)
+	body := `{"name":"Love 66","flavor":"Melone","manufacturer":{"name":"Adalya"},"ratings":[],"comments":[],"smoked":0}`
+	if status := do(storage.RoleCurator, http.MethodPut, "/api/shishas/1", body, &updated); status != http.StatusOK {
+		t.Fatalf("PUT as curator: expected 200, got %d", status)
+	}
+	if updated.Flavor != "Melone" || len(updated.Ratings) != len(before.Ratings) || len(updated.Comments) != len(before.Comments) || updated.Smoked != before.Smoked {
+		t.Fatalf("PUT must not overwrite ratings, comments or smoked: before %+v, after %+v", before, updated)
+	}
+
+	// ratings, comments and smoked are not taken over on create either
+	var created storage.Shisha
+	body = `{"name":"Cheat","ratings":[{"user":"alice","score":9999},{"user":"alice","score":10}],"comments":[{"user":"alice","message":"x"}],"smoked":50}`
+	if status := do(storage.RoleCurator, http.MethodPost, "/api/shishas", body, &created); status != http.StatusCreated {
+		t.Fatalf("POST as curator: expected 201, got %d", status)
+	}
+	if len(created.Ratings) != 0 || len(created.Comments) != 0 || created.Smoked != 0 {
+		t.Fatalf("POST must not store ratings, comments or smoked: %+v", created)
+	}
+
+	// role changes apply to running sessions
+	var promoted storage.User
+	if status := do(storage.RoleAdmin, http.MethodPut, "/api/admin/users/member-user/role", `{"role":"viewer"}`, &promoted); status != http.StatusOK || promoted.Role != storage.RoleViewer {
+		t.Fatalf("set role: got %d %+v", status, promoted)
+	}
+	if status := do(storage.RoleMember, http.MethodPost, "/api/shishas/1/smoked", "", nil); status != http.StatusForbidden {
+		t.Fatalf("demoted member: expected 403, got %d", status)
+	}
+	if status := do(storage.RoleAdmin, http.MethodDelete, "/api/shishas/1", "", nil); status != http.StatusNoContent {
+		t.Fatalf("DELETE as admin: expected 204, got %d", status)
+	}
+}
+
+func TestServe_DrainsInFlightRequests(t *testing.T) {
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	useStorage(storage.NewMemoryAdapter())
+	readiness.reset()
+	started, release := make(chan struct{}), make(chan struct{})
+	r := gin.New()
+	r.Use(errorHandler())
+	r.GET("/api/ready", readyHandler)
+	r.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.String(http.StatusOK, "done")
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	base := "http://" + ln.Addr().String()
+	cfg := serverConfig{ShutdownDelay: 300 * time.Millisecond, ShutdownTimeout: 5 * time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	// serve must release the signal handler before draining, so a second signal kills
+	stopped := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(stopped) }) }
+	// a background job winding down must finish before serve returns
+	jobs := newJobGroup()
+	jobCancelled, jobRelease := make(chan struct{}), make(chan struct{})
+	jobs.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		close(jobCancelled)
+		<-jobRelease
+	})
+	go func() { served <- serve(ctx, stop, newServer("", r, cfg), ln, cfg, jobs) }()
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		slow <- string(b)
+	}()
+	<-started
+	cancel()
+
+	// during the delay the server still answers, but no longer as ready
+	deadline := time.Now().Add(cfg.ShutdownDelay)
+	for {
+		resp, err := http.Get(base + "/api/ready")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusServiceUnavailable {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/api/ready did not turn 503 (last error %v)", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-stopped:
+	default:
+		t.Errorf("stop was not called before draining")
+	}
+
+	select {
+	case <-jobCancelled:
+	default:
+		t.Errorf("background jobs were not cancelled when the shutdown began")
+	}
+
+	close(release)
+	if got := <-slow; got != "done" {
+		t.Errorf("in-flight request was cut: %q", got)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned before the background job finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(jobRelease)
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+	if jobs.Run(func(context.Context) {}) {
+		t.Errorf("job started after the shutdown")
+	}
+}
+
+// fakeSetup is a storage.SetupChecker with canned results. CheckIndexes waits for
+// block, if set, ignoring the context like a hanging driver.
+type fakeSetup struct {
+	indexErr error
+	pending  []string
+	block    chan struct{}
+}
+
+func (f *fakeSetup) CheckIndexes(context.Context) error {
+	if f.block != nil {
+		<-f.block
+	}
+	return f.indexErr
+}
+
+func (f *fakeSetup) PendingMigrations(context.Context) ([]string, error) { return f.pending, nil }
+
+func TestReadyHandler_ReportsChecks(t *testing.T) {
+	ts := newTestServer(t)
+	setup := &fakeSetup{pending: []string{"comment_ids"}}
+	storageSetup = setup
+	t.Cleanup(func() { storageSetup = nil; shuttingDown.Store(false); readiness.reset() })
+	readiness.reset()
+
+	probe := func() (int, readinessReport) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/api/ready")
+		if err != nil {
+			t.Fatalf("GET /api/ready: %v", err)
+		}
+		defer resp.Body.Close()
+		var report readinessReport
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return resp.StatusCode, report
+	}
+
+	status, report := probe()
+	if status != http.StatusServiceUnavailable || report.Ready {
+		t.Fatalf("pending migration: expected 503, got %d %+v", status, report)
+	}
+	if got := report.Checks["migrations"]; got.Status != "pending" || !reflect.DeepEqual(got.Pending, []string{"comment_ids"}) {
+		t.Fatalf("migrations check: %+v", got)
+	}
+	if report.Checks["storage"].Status != "ok" || report.Checks["indexes"].Status != "ok" || report.Checks["draining"].Status != "ok" {
+		t.Fatalf("other checks: %+v", report.Checks)
+	}
+
+	// the report is reused until it expires
+	setup.pending = nil
+	if status, _ := probe(); status != http.StatusServiceUnavailable {
+		t.Fatalf("cached report: expected 503, got %d", status)
+	}
+	readiness.reset()
+	if status, report := probe(); status != http.StatusOK || !report.Ready {
+		t.Fatalf("after migrating: expected 200, got %d %+v", status, report)
+	}
+
+	// draining is not cached
+	shuttingDown.Store(true)
+	if status, report := probe(); status != http.StatusServiceUnavailable || report.Checks["draining"].Status != "failed" {
+		t.Fatalf("draining: expected 503, got %d %+v", status, report.Checks)
+	}
+}
+
+func TestCheckReadiness_Deadline(t *testing.T) {
+	setup := &fakeSetup{block: make(chan struct{})}
+	t.Cleanup(func() { close(setup.block) })
+
+	start := time.Now()
+	report := checkReadiness(context.Background(), storage.NewMemoryAdapter(), setup)
+	if took := time.Since(start); took > readinessTimeout+500*time.Millisecond {
+		t.Fatalf("checks took %v, more than the deadline", took)
+	}
+	if report.Ready || report.Checks["indexes"].Status != "failed" {
+		t.Fatalf("hanging check: expected not ready, got %+v", report)
+	}
+	if report.Checks["storage"].Status != "ok" || report.Checks["migrations"].Status != "ok" {
+		t.Fatalf("the other checks must still finish: %+v", report.Checks)
+	}
+}
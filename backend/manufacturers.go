@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shisha-tracker/backend/storage"
+)
+
+// listManufacturers answers GET /api/manufacturers with all manufacturers sorted by name.
+func listManufacturers(c *gin.Context) {
+	out, err := storageEngine.ListManufacturers(c.Request.Context())
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func getManufacturer(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	out, err := storageEngine.GetManufacturer(c.Request.Context(), id)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func createManufacturer(c *gin.Context) {
+	var in storage.Manufacturer
+	if !bindJSON(c, &in) {
+		return
+	}
+	out, err := storageEngine.CreateManufacturer(c.Request.Context(), &in)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusCreated, out)
+}
+
+// updateManufacturer answers PUT /api/manufacturers/:id. Renaming updates every shisha
+// of the manufacturer.
+func updateManufacturer(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	var in storage.Manufacturer
+	if !bindJSON(c, &in) {
+		return
+	}
+	out, err := storageEngine.UpdateManufacturer(c.Request.Context(), id, &in)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// deleteManufacturer answers DELETE /api/manufacturers/:id; 409 while shishas use it.
+func deleteManufacturer(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	if err := storageEngine.DeleteManufacturer(c.Request.Context(), id); err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// mergeManufacturers answers POST /api/manufacturers/:id/merge: moves the shishas of the
+// manufacturers listed in {"ids": [...]} to :id and deletes them.
+func mergeManufacturers(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		IDs []uint `json:"ids"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	out, err := storageEngine.MergeManufacturers(c.Request.Context(), id, req.IDs)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shisha-tracker/backend/storage"
+	"golang.org/x/exp/slog"
+)
+
+// catalogPageSize is the page size used to walk the catalogue for the gauges.
+const catalogPageSize = 500
+
+// CatalogTotals are the domain gauges derived from the stored catalogue.
+type CatalogTotals struct {
+	Shishas       int
+	Ratings       int
+	Comments      int
+	Smoked        int
+	Manufacturers int
+}
+
+// CountCatalog walks the whole catalogue of s and sums it up.
+func CountCatalog(ctx context.Context, s storage.Storage) (CatalogTotals, error) {
+	var t CatalogTotals
+	opts := storage.ListOptions{Limit: catalogPageSize, Sort: storage.SortID}
+	for {
+		page, err := s.ListShishas(ctx, opts)
+		if err != nil {
+			return t, err
+		}
+		for _, sh := range page.Items {
+			t.Shishas++
+			t.Ratings += len(sh.Ratings)
+			t.Comments += len(sh.Comments)
+			t.Smoked += sh.Smoked
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	mfs, err := s.ListManufacturers(ctx)
+	if err != nil {
+		return t, err
+	}
+	t.Manufacturers = len(mfs)
+	return t, nil
+}
+
+// catalogCollector reports CatalogTotals at scrape time. Walking the catalogue is
+// expensive on CouchDB, so a result is reused for maxAge. A failed count keeps serving
+// the last good values and is not retried for maxAge either, so scrapes during an
+// outage do not each walk the catalogue until the timeout.
+type catalogCollector struct {
+	count  func(ctx context.Context) (CatalogTotals, error)
+	maxAge time.Duration
+	// run runs a recount as background work, see JobRunner; nil runs it directly.
+	run JobRunner
+
+	mu      sync.Mutex
+	totals  CatalogTotals
+	counted time.Time
+	failed  time.Time
+
+	shishas, ratings, comments, smoked, manufacturers *prometheus.Desc
+}
+
+// JobRunner runs fn as tracked background work, with a context cancelled when the
+// server shuts down, so the shutdown can wait for it before closing the storage. It
+// reports false, without calling fn, once the shutdown began.
+type JobRunner func(fn func(ctx context.Context)) bool
+
+// RegisterCatalog adds the catalogue gauges of s, recounted at most every maxAge through
+// run. Pass the bare adapter, not the instrumented storage: the counting walk would
+// otherwise show up in the request metrics and traces.
+func (m *Metrics) RegisterCatalog(s storage.Storage, maxAge time.Duration, run JobRunner) {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "catalog", name), help, nil, nil)
+	}
+	m.registry.MustRegister(&catalogCollector{
+		count:         func(ctx context.Context) (CatalogTotals, error) { return CountCatalog(ctx, s) },
+		maxAge:        maxAge,
+		run:           run,
+		shishas:       desc("shishas", "Number of shishas in the catalogue."),
+		ratings:       desc("ratings", "Number of ratings over all shishas."),
+		comments:      desc("comments", "Number of comments over all shishas."),
+		smoked:        desc("smoked_sessions", "Sum of the smoked counters over all shishas."),
+		manufacturers: desc("manufacturers", "Number of manufacturers."),
+	})
+}
+
+func (c *catalogCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.shishas
+	ch <- c.ratings
+	ch <- c.comments
+	ch <- c.smoked
+	ch <- c.manufacturers
+}
+
+func (c *catalogCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stale(c.counted) && c.stale(c.failed) {
+		run := c.run
+		if run == nil {
+			run = func(fn func(ctx context.Context)) bool { fn(context.Background()); return true }
+		}
+		// during the shutdown the last values are served without a recount
+		run(c.recount)
+	}
+	if c.counted.IsZero() {
+		return
+	}
+	gauge := func(d *prometheus.Desc, v int) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v))
+	}
+	gauge(c.shishas, c.totals.Shishas)
+	gauge(c.ratings, c.totals.Ratings)
+	gauge(c.comments, c.totals.Comments)
+	gauge(c.smoked, c.totals.Smoked)
+	gauge(c.manufacturers, c.totals.Manufacturers)
+}
+
+// recount counts the catalogue; c.mu must be held.
+func (c *catalogCollector) recount(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	t, err := c.count(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "metrics: counting the catalogue failed", "error", err)
+		c.failed = time.Now()
+		return
+	}
+	c.totals, c.counted, c.failed = t, time.Now(), time.Time{}
+}
+
+// stale reports whether t is unset or at least maxAge ago.
+func (c *catalogCollector) stale(t time.Time) bool {
+	return t.IsZero() || time.Since(t) >= c.maxAge
+}
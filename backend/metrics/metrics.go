@@ -0,0 +1,137 @@
+// Package metrics exposes the Prometheus instrumentation of the backend: HTTP requests
+// per gin route, storage operations per backend, CouchDB responses and catalogue gauges.
+//
+// All collectors live in the registry of a Metrics value, so tests and the CLI commands
+// do not share global state with the server.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/shisha-tracker/backend/storage"
+)
+
+// namespace prefixes every metric of the backend.
+const namespace = "shisha"
+
+// Metrics holds the collectors of one server.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+
+	couchResponses *prometheus.CounterVec
+}
+
+// New returns a Metrics with the Go runtime and process collectors registered.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by method, gin route and status code.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by method, gin route and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Latency of storage.Storage calls by backend and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"backend", "operation"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_errors_total",
+			Help:      "Failed storage.Storage calls by backend, method and error class.",
+		}, []string{"backend", "operation", "error"}),
+		couchResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "couchdb_responses_total",
+			Help:      "CouchDB HTTP responses by request method and status code (\"error\" when no response arrived).",
+		}, []string{"method", "status"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpDuration,
+		m.storageDuration, m.storageErrors,
+		m.couchResponses,
+	)
+	return m
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware records count and latency of every request. Requests that match no route
+// share the route label "unmatched" so scanners cannot blow up the label cardinality.
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		m.httpRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+		m.httpDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// CouchResponse counts one CouchDB response; status 0 means the request failed before a
+// response arrived. It fits storage.CouchResponseHook.
+func (m *Metrics) CouchResponse(method string, status int) {
+	label := "error"
+	if status > 0 {
+		label = strconv.Itoa(status)
+	}
+	m.couchResponses.WithLabelValues(method, label).Inc()
+}
+
+// observe records one storage call started at start.
+func (m *Metrics) observe(backend, op string, start time.Time, err error) {
+	m.storageDuration.WithLabelValues(backend, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.storageErrors.WithLabelValues(backend, op, errorClass(err)).Inc()
+	}
+}
+
+// errorClass maps a storage error to a small, fixed set of label values.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, storage.ErrConflict):
+		return "conflict"
+	case errors.Is(err, storage.ErrValidation):
+		return "validation"
+	case errors.Is(err, storage.ErrForbidden):
+		return "forbidden"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "internal"
+	}
+}
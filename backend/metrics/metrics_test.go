@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shisha-tracker/backend/storage"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := New()
+	r := gin.New()
+	r.Use(m.Middleware())
+	r.GET("/api/shishas/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, path := range []string{"/api/shishas/1", "/api/shishas/2", "/nope"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if got := testutil.ToFloat64(m.httpRequests.WithLabelValues("GET", "/api/shishas/:id", "200")); got != 2 {
+		t.Errorf("requests of the route: expected 2, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.httpRequests.WithLabelValues("GET", "unmatched", "404")); got != 1 {
+		t.Errorf("unmatched requests: expected 1, got %v", got)
+	}
+}
+
+func TestWrapStorage(t *testing.T) {
+	m := New()
+	s := m.WrapStorage(storage.NewMemoryAdapter(storage.SampleShishas()...), "memory")
+	ctx := context.Background()
+
+	if _, err := s.GetShisha(ctx, 1); err != nil {
+		t.Fatalf("GetShisha: %v", err)
+	}
+	if _, err := s.GetShisha(ctx, 99); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetShisha missing: expected ErrNotFound, got %v", err)
+	}
+	if n := testutil.CollectAndCount(m.storageDuration, "shisha_storage_operation_duration_seconds"); n != 1 {
+		t.Errorf("expected one latency series, got %d", n)
+	}
+	if got := testutil.ToFloat64(m.storageErrors.WithLabelValues("memory", "GetShisha", "not_found")); got != 1 {
+		t.Errorf("not_found errors: expected 1, got %v", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+	s := storage.NewMemoryAdapter(storage.SampleShishas()...)
+	if err := s.AddSmoked(context.Background(), 1); err != nil {
+		t.Fatalf("AddSmoked: %v", err)
+	}
+	want, err := CountCatalog(context.Background(), s)
+	if err != nil {
+		t.Fatalf("CountCatalog: %v", err)
+	}
+	if want.Shishas == 0 || want.Smoked != 1 || want.Manufacturers == 0 {
+		t.Fatalf("unexpected totals %+v", want)
+	}
+	m.RegisterCatalog(s, time.Minute, nil)
+	m.CouchResponse("GET", http.StatusNotFound)
+	m.CouchResponse("PUT", 0)
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, line := range []string{
+		`shisha_couchdb_responses_total{method="GET",status="404"} 1`,
+		`shisha_couchdb_responses_total{method="PUT",status="error"} 1`,
+		`shisha_catalog_smoked_sessions 1`,
+		"shisha_catalog_shishas ",
+		"go_goroutines ",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("metrics output lacks %q", line)
+		}
+	}
+}
+
+func TestCatalogCollector_BacksOffAfterFailure(t *testing.T) {
+	calls := 0
+	c := &catalogCollector{
+		count: func(context.Context) (CatalogTotals, error) {
+			calls++
+			return CatalogTotals{}, errors.New("database down")
+		},
+		maxAge: time.Minute,
+	}
+	for i := 0; i < 3; i++ {
+		ch := make(chan prometheus.Metric, 5)
+		c.Collect(ch)
+		close(ch)
+		if len(ch) != 0 {
+			t.Errorf("scrape %d: expected no gauges without a good count, got %d", i+1, len(ch))
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected one count attempt within maxAge, got %d", calls)
+	}
+}
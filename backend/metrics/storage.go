@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+// Storage wraps a storage.Storage and records latency and errors of every call, labelled
+// with the backend name. It adds no behaviour of its own. The wrapped storage is not
+// embedded, so a method added to the interface fails to compile here instead of going
+// unmeasured.
+type Storage struct {
+	inner   storage.Storage
+	metrics *Metrics
+	backend string
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+// WrapStorage returns s instrumented under the given backend label (couchdb, gorm,
+// sqlite or memory).
+func (m *Metrics) WrapStorage(s storage.Storage, backend string) *Storage {
+	return &Storage{inner: s, metrics: m, backend: backend}
+}
+
+// Unwrap returns the wrapped storage (storage.Unwrapper).
+func (s *Storage) Unwrap() storage.Storage { return s.inner }
+
+func (s *Storage) observe(op string, start time.Time, err *error) {
+	s.metrics.observe(s.backend, op, start, *err)
+}
+
+func (s *Storage) ListShishas(ctx context.Context, opts storage.ListOptions) (_ *storage.ShishaPage, err error) {
+	defer s.observe("ListShishas", time.Now(), &err)
+	return s.inner.ListShishas(ctx, opts)
+}
+
+func (s *Storage) GetShisha(ctx context.Context, id uint) (_ *storage.Shisha, err error) {
+	defer s.observe("GetShisha", time.Now(), &err)
+	return s.inner.GetShisha(ctx, id)
+}
+
+func (s *Storage) CreateShisha(ctx context.Context, sh *storage.Shisha) (_ *storage.Shisha, err error) {
+	defer s.observe("CreateShisha", time.Now(), &err)
+	return s.inner.CreateShisha(ctx, sh)
+}
+
+func (s *Storage) CreateShishas(ctx context.Context, items []storage.Shisha) (_ []storage.BatchResult, err error) {
+	defer s.observe("CreateShishas", time.Now(), &err)
+	return s.inner.CreateShishas(ctx, items)
+}
+
+func (s *Storage) RestoreShishas(ctx context.Context, items []storage.Shisha) (_ []storage.BatchResult, err error) {
+	defer s.observe("RestoreShishas", time.Now(), &err)
+	return s.inner.RestoreShishas(ctx, items)
+}
+
+func (s *Storage) UpdateShisha(ctx context.Context, id uint, sh *storage.Shisha) (_ *storage.Shisha, err error) {
+	defer s.observe("UpdateShisha", time.Now(), &err)
+	return s.inner.UpdateShisha(ctx, id, sh)
+}
+
+func (s *Storage) ReplaceShisha(ctx context.Context, id uint, sh *storage.Shisha) (_ *storage.Shisha, err error) {
+	defer s.observe("ReplaceShisha", time.Now(), &err)
+	return s.inner.ReplaceShisha(ctx, id, sh)
+}
+
+func (s *Storage) DeleteShisha(ctx context.Context, id uint) (err error) {
+	defer s.observe("DeleteShisha", time.Now(), &err)
+	return s.inner.DeleteShisha(ctx, id)
+}
+
+func (s *Storage) AddRating(ctx context.Context, id uint, user string, score int) (err error) {
+	defer s.observe("AddRating", time.Now(), &err)
+	return s.inner.AddRating(ctx, id, user, score)
+}
+
+func (s *Storage) RatingStats(ctx context.Context, id uint) (_ *storage.ShishaStats, err error) {
+	defer s.observe("RatingStats", time.Now(), &err)
+	return s.inner.RatingStats(ctx, id)
+}
+
+func (s *Storage) DeleteRating(ctx context.Context, id uint, user string) (err error) {
+	defer s.observe("DeleteRating", time.Now(), &err)
+	return s.inner.DeleteRating(ctx, id, user)
+}
+
+func (s *Storage) AddComment(ctx context.Context, id uint, user, message string, parentID uint) (_ *storage.Comment, err error) {
+	defer s.observe("AddComment", time.Now(), &err)
+	return s.inner.AddComment(ctx, id, user, message, parentID)
+}
+
+func (s *Storage) UpdateComment(ctx context.Context, id, cid uint, author, message string) (_ *storage.Comment, err error) {
+	defer s.observe("UpdateComment", time.Now(), &err)
+	return s.inner.UpdateComment(ctx, id, cid, author, message)
+}
+
+func (s *Storage) DeleteComment(ctx context.Context, id, cid uint, author string) (err error) {
+	defer s.observe("DeleteComment", time.Now(), &err)
+	return s.inner.DeleteComment(ctx, id, cid, author)
+}
+
+func (s *Storage) AddSmoked(ctx context.Context, id uint) (err error) {
+	defer s.observe("AddSmoked", time.Now(), &err)
+	return s.inner.AddSmoked(ctx, id)
+}
+
+func (s *Storage) ListManufacturers(ctx context.Context) (_ []storage.Manufacturer, err error) {
+	defer s.observe("ListManufacturers", time.Now(), &err)
+	return s.inner.ListManufacturers(ctx)
+}
+
+func (s *Storage) GetManufacturer(ctx context.Context, id uint) (_ *storage.Manufacturer, err error) {
+	defer s.observe("GetManufacturer", time.Now(), &err)
+	return s.inner.GetManufacturer(ctx, id)
+}
+
+func (s *Storage) CreateManufacturer(ctx context.Context, m *storage.Manufacturer) (_ *storage.Manufacturer, err error) {
+	defer s.observe("CreateManufacturer", time.Now(), &err)
+	return s.inner.CreateManufacturer(ctx, m)
+}
+
+func (s *Storage) UpdateManufacturer(ctx context.Context, id uint, m *storage.Manufacturer) (_ *storage.Manufacturer, err error) {
+	defer s.observe("UpdateManufacturer", time.Now(), &err)
+	return s.inner.UpdateManufacturer(ctx, id, m)
+}
+
+func (s *Storage) DeleteManufacturer(ctx context.Context, id uint) (err error) {
+	defer s.observe("DeleteManufacturer", time.Now(), &err)
+	return s.inner.DeleteManufacturer(ctx, id)
+}
+
+func (s *Storage) MergeManufacturers(ctx context.Context, into uint, ids []uint) (_ *storage.Manufacturer, err error) {
+	defer s.observe("MergeManufacturers", time.Now(), &err)
+	return s.inner.MergeManufacturers(ctx, into, ids)
+}
+
+func (s *Storage) NormalizeManufacturers(ctx context.Context) (_ []storage.ManufacturerMerge, err error) {
+	defer s.observe("NormalizeManufacturers", time.Now(), &err)
+	return s.inner.NormalizeManufacturers(ctx)
+}
+
+func (s *Storage) CreateUser(ctx context.Context, u *storage.User) (_ *storage.User, err error) {
+	defer s.observe("CreateUser", time.Now(), &err)
+	return s.inner.CreateUser(ctx, u)
+}
+
+func (s *Storage) GetUser(ctx context.Context, name string) (_ *storage.User, err error) {
+	defer s.observe("GetUser", time.Now(), &err)
+	return s.inner.GetUser(ctx, name)
+}
+
+func (s *Storage) ListUsers(ctx context.Context) (_ []storage.User, err error) {
+	defer s.observe("ListUsers", time.Now(), &err)
+	return s.inner.ListUsers(ctx)
+}
+
+func (s *Storage) SetUserRole(ctx context.Context, name, role string) (_ *storage.User, err error) {
+	defer s.observe("SetUserRole", time.Now(), &err)
+	return s.inner.SetUserRole(ctx, name, role)
+}
+
+func (s *Storage) CreateAPIToken(ctx context.Context, t *storage.APIToken) (_ *storage.APIToken, err error) {
+	defer s.observe("CreateAPIToken", time.Now(), &err)
+	return s.inner.CreateAPIToken(ctx, t)
+}
+
+func (s *Storage) GetAPIToken(ctx context.Context, id string) (_ *storage.APIToken, err error) {
+	defer s.observe("GetAPIToken", time.Now(), &err)
+	return s.inner.GetAPIToken(ctx, id)
+}
+
+func (s *Storage) ListAPITokens(ctx context.Context, user string) (_ []storage.APIToken, err error) {
+	defer s.observe("ListAPITokens", time.Now(), &err)
+	return s.inner.ListAPITokens(ctx, user)
+}
+
+func (s *Storage) DeleteAPIToken(ctx context.Context, user, id string) (err error) {
+	defer s.observe("DeleteAPIToken", time.Now(), &err)
+	return s.inner.DeleteAPIToken(ctx, user, id)
+}
+
+func (s *Storage) Health(ctx context.Context) (err error) {
+	defer s.observe("Health", time.Now(), &err)
+	return s.inner.Health(ctx)
+}
+
+func (s *Storage) DBInfo(ctx context.Context) (_ *storage.DBInfo, err error) {
+	defer s.observe("DBInfo", time.Now(), &err)
+	return s.inner.DBInfo(ctx)
+}
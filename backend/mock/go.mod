@@ -1,5 +0,0 @@
-module github.com/shisha-tracker/backend/mock
-
-go 1.20
-
-require github.com/gin-gonic/gin v1.9.0
\ No newline at end of file
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shisha-tracker/backend/storage"
+	"golang.org/x/exp/slog"
+)
+
+// rolePublic marks routes that anonymous callers may use.
+const rolePublic = ""
+
+// routePolicy maps every route ("METHOD /full/path") to the least role allowed to call
+// it; a higher role includes the rights of the lower ones (see storage.Roles). Routes
+// missing here are denied, so a new route stays admin-only until it is listed.
+var routePolicy = map[string]string{
+	"GET /api/healthz":      rolePublic,
+	"GET /api/ready":        rolePublic,
+	"GET /api/metrics":      rolePublic,
+	"GET /api/info":         rolePublic,
+	"GET /api/container-id": rolePublic,
+	"GET /api/db-health":    rolePublic,
+	"GET /api/db-info":      rolePublic,
+
+	"GET /api/shishas":           rolePublic,
+	"GET /api/shishas/:id":       rolePublic,
+	"GET /api/shishas/:id/stats": rolePublic,
+	"GET /api/manufacturers":     rolePublic,
+	"GET /api/manufacturers/:id": rolePublic,
+	"GET /api/search":            rolePublic,
+	"GET /api/export":            rolePublic,
+
+	"POST /api/auth/register":      rolePublic,
+	"POST /api/auth/login":         rolePublic,
+	"POST /api/auth/logout":        rolePublic,
+	"GET /api/auth/me":             storage.RoleViewer,
+	"GET /api/auth/tokens":         storage.RoleViewer,
+	"POST /api/auth/tokens":        storage.RoleViewer,
+	"DELETE /api/auth/tokens/:tid": storage.RoleViewer,
+
+	// members change their own entries; admins moderate those of others
+	"POST /api/shishas/:id/ratings":         storage.RoleMember,
+	"DELETE /api/shishas/:id/ratings/:user": storage.RoleMember,
+	"POST /api/shishas/:id/comments":        storage.RoleMember,
+	"PUT /api/shishas/:id/comments/:cid":    storage.RoleMember,
+	"DELETE /api/shishas/:id/comments/:cid": storage.RoleMember,
+	"POST /api/shishas/:id/smoked":          storage.RoleMember,
+
+	"POST /api/shishas":                 storage.RoleCurator,
+	"PUT /api/shishas/:id":              storage.RoleCurator,
+	"DELETE /api/shishas/:id":           storage.RoleAdmin,
+	"POST /api/manufacturers":           storage.RoleCurator,
+	"PUT /api/manufacturers/:id":        storage.RoleCurator,
+	"DELETE /api/manufacturers/:id":     storage.RoleAdmin,
+	"POST /api/manufacturers/:id/merge": storage.RoleAdmin,
+	"POST /api/import":                  storage.RoleAdmin,
+
+	"POST /api/admin/backups":         storage.RoleAdmin,
+	"GET /api/admin/backups":          storage.RoleAdmin,
+	"GET /api/admin/backups/:name":    storage.RoleAdmin,
+	"GET /api/admin/users":            storage.RoleAdmin,
+	"PUT /api/admin/users/:name/role": storage.RoleAdmin,
+	"GET /api/admin/log-level":        storage.RoleAdmin,
+	"PUT /api/admin/log-level":        storage.RoleAdmin,
+}
+
+// authorize enforces routePolicy. It runs after authenticate: anonymous callers of a
+// protected route get 401, callers whose role is too low 403. Unmatched requests pass
+// through to gin's 404.
+func authorize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" {
+			c.Next()
+			return
+		}
+		key := c.Request.Method + " " + route
+		need, ok := routePolicy[key]
+		if !ok {
+			slog.WarnContext(c.Request.Context(), "authz: no policy for route, admins only", "route", key)
+			need = storage.RoleAdmin
+		}
+		if need == rolePublic {
+			c.Next()
+			return
+		}
+		id, ok := currentIdentity(c)
+		if !ok {
+			_ = c.Error(fmt.Errorf("%w: login required", errUnauthorized))
+			c.Abort()
+			return
+		}
+		if !hasRole(id, need) {
+			_ = c.Error(fmt.Errorf("%w: requires role %s", storage.ErrForbidden, need))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// hasRole reports whether id holds role or a higher one.
+func hasRole(id identity, role string) bool {
+	return storage.RoleRank(id.Role) >= storage.RoleRank(role)
+}
+
+// isAdmin reports whether the caller is logged in with the admin role.
+func isAdmin(c *gin.Context) bool {
+	id, ok := currentIdentity(c)
+	return ok && hasRole(id, storage.RoleAdmin)
+}
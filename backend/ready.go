@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shisha-tracker/backend/storage"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// readinessMaxAge is how long a readiness report is reused, so probes of several
+	// kubelets and load balancers do not each hit the database.
+	readinessMaxAge = 2 * time.Second
+	// readinessTimeout bounds all storage checks together; it stays below the probe's
+	// timeoutSeconds (2s), so a slow database fails the check instead of the probe.
+	readinessTimeout = 1500 * time.Millisecond
+)
+
+// storageSetup checks indexes and migrations of the storage adapter; nil when the
+// adapter has neither (in-memory storage).
+var storageSetup storage.SetupChecker
+
+// readiness caches the last report of the storage checks.
+var readiness readinessCache
+
+// readinessCheck is the result of one component check.
+type readinessCheck struct {
+	// Status is "ok", "failed", "pending" (migrations not yet run) or "skipped".
+	Status  string   `json:"status"`
+	Error   string   `json:"error,omitempty"`
+	Pending []string `json:"pending,omitempty"`
+}
+
+// readinessReport is the body of /api/ready.
+type readinessReport struct {
+	Ready     bool                      `json:"ready"`
+	Checks    map[string]readinessCheck `json:"checks"`
+	CheckedAt time.Time                 `json:"checkedAt"`
+}
+
+type readinessCache struct {
+	mu     sync.Mutex
+	report readinessReport
+}
+
+// get returns the cached storage checks, running them again once they are older than
+// readinessMaxAge. Concurrent probes wait for the one running check instead of starting
+// their own.
+func (rc *readinessCache) get(ctx context.Context) readinessReport {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if time.Since(rc.report.CheckedAt) < readinessMaxAge {
+		return rc.report
+	}
+	// not the request context: a probe that gave up must not fail the checks the next
+	// probe reuses
+	prev := rc.report
+	rc.report = checkReadiness(context.Background(), storageEngine, storageSetup)
+	switch {
+	case !rc.report.Ready && (prev.Ready || prev.CheckedAt.IsZero()):
+		slog.WarnContext(ctx, "not ready", "checks", rc.report.Checks)
+	case rc.report.Ready && !prev.Ready && !prev.CheckedAt.IsZero():
+		slog.InfoContext(ctx, "ready again")
+	}
+	return rc.report
+}
+
+// reset drops the cached report.
+func (rc *readinessCache) reset() {
+	rc.mu.Lock()
+	rc.report = readinessReport{}
+	rc.mu.Unlock()
+}
+
+// checkReadiness runs the storage checks in parallel: the connection (Health), the
+// indexes and views the queries rely on, and migrations that did not run yet. A check
+// still running at the deadline fails.
+func checkReadiness(ctx context.Context, s storage.Storage, setup storage.SetupChecker) readinessReport {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) readinessCheck{
+		"storage": func(ctx context.Context) readinessCheck {
+			if s == nil {
+				return readinessCheck{Status: "failed", Error: "storage engine not initialized"}
+			}
+			return errCheck(s.Health(ctx))
+		},
+	}
+	if setup != nil {
+		checks["indexes"] = func(ctx context.Context) readinessCheck {
+			return errCheck(setup.CheckIndexes(ctx))
+		}
+		checks["migrations"] = func(ctx context.Context) readinessCheck {
+			pending, err := setup.PendingMigrations(ctx)
+			if err == nil && len(pending) > 0 {
+				return readinessCheck{Status: "pending", Pending: pending}
+			}
+			return errCheck(err)
+		}
+	}
+
+	type result struct {
+		name  string
+		check readinessCheck
+	}
+	// buffered: a check that outlives the deadline must not block on sending
+	results := make(chan result, len(checks))
+	for name, run := range checks {
+		name, run := name, run
+		go func() { results <- result{name, run(ctx)} }()
+	}
+
+	report := readinessReport{Ready: true, Checks: map[string]readinessCheck{}, CheckedAt: time.Now()}
+	if setup == nil {
+		report.Checks["indexes"] = readinessCheck{Status: "skipped"}
+		report.Checks["migrations"] = readinessCheck{Status: "skipped"}
+	}
+collect:
+	for range checks {
+		select {
+		case r := <-results:
+			report.Checks[r.name] = r.check
+		case <-ctx.Done():
+			break collect
+		}
+	}
+	for name := range checks {
+		if _, ok := report.Checks[name]; !ok {
+			report.Checks[name] = readinessCheck{Status: "failed", Error: "timed out after " + readinessTimeout.String()}
+		}
+		if st := report.Checks[name].Status; st != "ok" {
+			report.Ready = false
+		}
+	}
+	return report
+}
+
+func errCheck(err error) readinessCheck {
+	if err != nil {
+		return readinessCheck{Status: "failed", Error: err.Error()}
+	}
+	return readinessCheck{Status: "ok"}
+}
+
+// readyHandler answers the readiness probe with the report of the component checks:
+// 200 when all pass, 503 when one fails or the server is shutting down. The draining
+// flag is never cached, so the pod leaves the load balancer on the next probe.
+func readyHandler(c *gin.Context) {
+	cached := readiness.get(c.Request.Context())
+	report := readinessReport{Ready: cached.Ready, Checks: make(map[string]readinessCheck, len(cached.Checks)+1), CheckedAt: cached.CheckedAt}
+	for name, check := range cached.Checks {
+		report.Checks[name] = check
+	}
+	if shuttingDown.Load() {
+		report.Ready = false
+		report.Checks["draining"] = readinessCheck{Status: "failed", Error: "shutting down"}
+	} else {
+		report.Checks["draining"] = readinessCheck{Status: "ok"}
+	}
+	// answered here, not via errorHandler: an expected 503 is no server error
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
+
+// healthHandler is the liveness probe. It checks nothing beyond the process serving
+// HTTP, so a database outage makes the pod unready but never restarts it.
+func healthHandler(c *gin.Context) {
+	c.Status(http.StatusOK)
+}
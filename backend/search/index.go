@@ -0,0 +1,274 @@
+// Package search maintains an in-process full-text index over the shisha catalogue. The
+// index covers name, flavor and manufacturer name and tolerates case, umlaut spelling
+// and small typos.
+package search
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+// DefaultLimit is the number of hits returned when the caller does not ask for a limit.
+const DefaultLimit = 20
+
+// field identifies where a term occurred; the values are bit flags.
+type field uint8
+
+const (
+	fieldName field = 1 << iota
+	fieldManufacturer
+	fieldFlavor
+)
+
+// weight ranks matches in the name above the manufacturer above the flavor.
+func (f field) weight() float64 {
+	switch {
+	case f&fieldName != 0:
+		return 3
+	case f&fieldManufacturer != 0:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Hit is one search result. It carries the indexed fields only; ratings and comments
+// are loaded via GET /api/shishas/:id.
+type Hit struct {
+	ID           uint                 `json:"id"`
+	Name         string               `json:"name"`
+	Flavor       string               `json:"flavor"`
+	Manufacturer storage.Manufacturer `json:"manufacturer"`
+	Score        float64              `json:"score"`
+}
+
+// Index is an inverted index from normalised terms to shisha ids. It is safe for
+// concurrent use.
+type Index struct {
+	mu       sync.RWMutex
+	docs     map[uint]Hit
+	postings map[string]map[uint]field
+	// rebuilds counts the Rebuild calls in progress. While there are any, Put and Remove
+	// are also recorded in pending (nil for a removal) and applied again on top of the
+	// listing, which may have been read before them.
+	rebuilds int
+	pending  map[uint]*storage.Shisha
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	return &Index{docs: make(map[uint]Hit), postings: make(map[string]map[uint]field)}
+}
+
+// Rebuild replaces the index content with every shisha currently in s. Puts and
+// removes made while the listing is read are kept.
+func (i *Index) Rebuild(ctx context.Context, s storage.Storage) error {
+	i.mu.Lock()
+	if i.rebuilds == 0 {
+		i.pending = make(map[uint]*storage.Shisha)
+	}
+	i.rebuilds++
+	i.mu.Unlock()
+
+	page, err := s.ListShishas(ctx, storage.ListOptions{})
+	var docs map[uint]Hit
+	var postings map[string]map[uint]field
+	if err == nil {
+		docs, postings = build(page.Items)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rebuilds--
+	pending := i.pending
+	if i.rebuilds == 0 {
+		i.pending = nil
+	}
+	if err != nil {
+		return err
+	}
+	i.docs, i.postings = docs, postings
+	for id, s := range pending {
+		i.remove(id)
+		if s != nil {
+			i.docs[id] = hitFor(*s)
+			addPostings(i.postings, *s)
+		}
+	}
+	return nil
+}
+
+// Replace swaps the whole index content for all.
+func (i *Index) Replace(all []storage.Shisha) {
+	docs, postings := build(all)
+	i.mu.Lock()
+	i.docs, i.postings = docs, postings
+	i.mu.Unlock()
+}
+
+func build(all []storage.Shisha) (map[uint]Hit, map[string]map[uint]field) {
+	docs := make(map[uint]Hit, len(all))
+	postings := make(map[string]map[uint]field)
+	for _, s := range all {
+		docs[s.ID] = hitFor(s)
+		addPostings(postings, s)
+	}
+	return docs, postings
+}
+
+// Put adds s to the index or refreshes its entry.
+func (i *Index) Put(s storage.Shisha) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.rebuilds > 0 {
+		c := s
+		i.pending[s.ID] = &c
+	}
+	i.remove(s.ID)
+	i.docs[s.ID] = hitFor(s)
+	addPostings(i.postings, s)
+}
+
+// Remove drops the shisha with the given id from the index.
+func (i *Index) Remove(id uint) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.rebuilds > 0 {
+		i.pending[id] = nil
+	}
+	i.remove(id)
+}
+
+// Len returns the number of indexed shishas.
+func (i *Index) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return len(i.docs)
+}
+
+func (i *Index) remove(id uint) {
+	old, ok := i.docs[id]
+	if !ok {
+		return
+	}
+	delete(i.docs, id)
+	for _, text := range []string{old.Name, old.Manufacturer.Name, old.Flavor} {
+		for _, term := range tokenize(text) {
+			if ids := i.postings[term]; ids != nil {
+				delete(ids, id)
+				if len(ids) == 0 {
+					delete(i.postings, term)
+				}
+			}
+		}
+	}
+}
+
+func hitFor(s storage.Shisha) Hit {
+	return Hit{ID: s.ID, Name: s.Name, Flavor: s.Flavor, Manufacturer: s.Manufacturer}
+}
+
+func addPostings(postings map[string]map[uint]field, s storage.Shisha) {
+	add := func(text string, f field) {
+		for _, term := range tokenize(text) {
+			ids := postings[term]
+			if ids == nil {
+				ids = make(map[uint]field)
+				postings[term] = ids
+			}
+			ids[s.ID] |= f
+		}
+	}
+	add(s.Name, fieldName)
+	add(s.Manufacturer.Name, fieldManufacturer)
+	add(s.Flavor, fieldFlavor)
+}
+
+// Search returns up to limit hits matching every term of query, best first. Each query
+// term may match an indexed term exactly, as a prefix, inside a compound word
+// ("melone" in "Wassermelone") or with a few typos, in decreasing order of relevance.
+func (i *Index) Search(query string, limit int) []Hit {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return []Hit{}
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	// best[id][n] is the best score of query term n within shisha id
+	best := make(map[uint][]float64)
+	for n, q := range terms {
+		for term, ids := range i.postings {
+			quality := matchQuality(q, term)
+			if quality == 0 {
+				continue
+			}
+			for id, f := range ids {
+				scores := best[id]
+				if scores == nil {
+					scores = make([]float64, len(terms))
+					best[id] = scores
+				}
+				if s := quality * f.weight(); s > scores[n] {
+					scores[n] = s
+				}
+			}
+		}
+	}
+
+	hits := make([]Hit, 0, len(best))
+	for id, scores := range best {
+		total := 0.0
+		for _, s := range scores {
+			if s == 0 {
+				total = 0
+				break
+			}
+			total += s
+		}
+		if total == 0 {
+			continue
+		}
+		h := i.docs[id]
+		h.Score = total
+		hits = append(hits, h)
+	}
+	sort.Slice(hits, func(a, b int) bool {
+		if hits[a].Score != hits[b].Score {
+			return hits[a].Score > hits[b].Score
+		}
+		if x, y := strings.ToLower(hits[a].Name), strings.ToLower(hits[b].Name); x != y {
+			return x < y
+		}
+		return hits[a].ID < hits[b].ID
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// matchQuality rates how well the query term q matches the indexed term; 0 means no match.
+func matchQuality(q, term string) float64 {
+	switch {
+	case q == term:
+		return 1
+	case len(q) >= 2 && strings.HasPrefix(term, q):
+		return 0.8
+	case len(q) >= 3 && strings.Contains(term, q):
+		return 0.6
+	}
+	if limit := maxEdits(len([]rune(q))); limit > 0 {
+		if d := editDistance(q, term, limit); d <= limit {
+			return 0.5 - 0.1*float64(d-1)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package search
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+func testIndex() *Index {
+	idx := NewIndex()
+	idx.Replace([]storage.Shisha{
+		{ID: 1, Name: "Wassermelone", Flavor: "Melone", Manufacturer: storage.Manufacturer{Name: "Al Fakher"}},
+		{ID: 2, Name: "Love 66", Flavor: "Honigmelone, Maracuja, Minze", Manufacturer: storage.Manufacturer{Name: "Adalya"}},
+		{ID: 3, Name: "Äpfel Doppel", Flavor: "Apfel, Anis", Manufacturer: storage.Manufacturer{Name: "Nakhla"}},
+		{ID: 4, Name: "Mint Breeze", Flavor: "Minze", Manufacturer: storage.Manufacturer{Name: "Al Fakher"}},
+	})
+	return idx
+}
+
+func ids(hits []Hit) []uint {
+	out := make([]uint, 0, len(hits))
+	for _, h := range hits {
+		out = append(out, h.ID)
+	}
+	return out
+}
+
+func TestSearch(t *testing.T) {
+	idx := testIndex()
+	cases := []struct {
+		query string
+		want  []uint
+	}{
+		{"wassermelone", []uint{1}},
+		{"WASSERMELONE", []uint{1}},
+		{"wasermelone", []uint{1}},  // typo
+		{"wassermleone", []uint{1}}, // swapped letters
+		{"melone", []uint{1, 2}},    // exact flavor beats compound word
+		{"aepfel", []uint{3}},       // umlaut spelt out
+		{"äpfel", []uint{3}},        // umlaut typed
+		{"minze fakher", []uint{4}}, // every term must match
+		{"al fakher", []uint{4, 1}}, // manufacturer, ties ordered by name
+		{"lov", []uint{2}},          // prefix while typing
+		{"xyz", []uint{}},           // no match
+		{"  ,  ", []uint{}},         // no terms
+	}
+	for _, tc := range cases {
+		got := ids(idx.Search(tc.query, 0))
+		if len(got) != len(tc.want) {
+			t.Errorf("Search(%q) = %v, want %v", tc.query, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("Search(%q) = %v, want %v", tc.query, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSearch_NameRanksAboveFlavor(t *testing.T) {
+	idx := NewIndex()
+	idx.Replace([]storage.Shisha{
+		{ID: 1, Name: "Blue Dream", Flavor: "Minze"},
+		{ID: 2, Name: "Minze", Flavor: "Minze"},
+	})
+	hits := idx.Search("minze", 10)
+	if len(hits) != 2 || hits[0].ID != 2 || hits[0].Score <= hits[1].Score {
+		t.Fatalf("expected name match first, got %+v", hits)
+	}
+	if hits := idx.Search("minze", 1); len(hits) != 1 {
+		t.Fatalf("limit ignored: %+v", hits)
+	}
+}
+
+func TestIndex_PutAndRemove(t *testing.T) {
+	idx := testIndex()
+	idx.Put(storage.Shisha{ID: 1, Name: "Zitrone", Flavor: "Zitrone"})
+	if hits := idx.Search("wassermelone", 0); len(hits) != 0 {
+		t.Fatalf("stale terms after update: %+v", hits)
+	}
+	if hits := idx.Search("zitrone", 0); len(hits) != 1 || hits[0].Name != "Zitrone" {
+		t.Fatalf("updated entry not found: %+v", hits)
+	}
+	idx.Remove(1)
+	if hits := idx.Search("zitrone", 0); len(hits) != 0 {
+		t.Fatalf("removed entry still found: %+v", hits)
+	}
+	if idx.Len() != 3 {
+		t.Fatalf("expected 3 entries, got %d", idx.Len())
+	}
+}
+
+// listHook is a storage whose ListShishas runs hook after reading the listing.
+type listHook struct {
+	storage.Storage
+	hook func()
+}
+
+func (l listHook) ListShishas(ctx context.Context, opts storage.ListOptions) (*storage.ShishaPage, error) {
+	page, err := l.Storage.ListShishas(ctx, opts)
+	l.hook()
+	return page, err
+}
+
+func TestIndex_RebuildKeepsConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMemoryAdapter(
+		storage.Shisha{ID: 1, Name: "Wassermelone"},
+		storage.Shisha{ID: 2, Name: "Love 66"},
+	)
+	idx := NewIndex()
+	// a write lands after the listing was read, before the rebuild swaps it in
+	err := idx.Rebuild(ctx, listHook{st, func() {
+		created, _ := st.CreateShisha(ctx, &storage.Shisha{Name: "Zitrone"})
+		idx.Put(*created)
+		_ = st.DeleteShisha(ctx, 1)
+		idx.Remove(1)
+	}})
+	if err != nil {
+		t.Fatalf("Rebuild: %v", err)
+	}
+	if hits := idx.Search("zitrone", 0); len(hits) != 1 {
+		t.Fatalf("shisha created during the rebuild is missing: %+v", hits)
+	}
+	if hits := idx.Search("wassermelone", 0); len(hits) != 0 {
+		t.Fatalf("shisha deleted during the rebuild reappeared: %+v", hits)
+	}
+	if idx.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", idx.Len())
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a, b  string
+		limit int
+		want  int
+	}{
+		{"minze", "minze", 2, 0},
+		{"minze", "minz", 2, 1},
+		{"minze", "mnize", 2, 1},
+		{"minze", "mango", 2, 3},
+		{"a", "abcdef", 1, 2},
+	}
+	for _, tc := range cases {
+		if got := editDistance(tc.a, tc.b, tc.limit); got != tc.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", tc.a, tc.b, tc.limit, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package search
+
+import (
+	"context"
+
+	"github.com/shisha-tracker/backend/storage"
+	"golang.org/x/exp/slog"
+)
+
+// Storage wraps a storage.Storage and mirrors every create, update and delete made
+// through it into an Index. Writes by other replicas are only picked up by the next
+// Index.Rebuild.
+type Storage struct {
+	storage.Storage
+	index *Index
+}
+
+// Wrap returns s with idx kept current on writes.
+func Wrap(s storage.Storage, idx *Index) *Storage {
+	return &Storage{Storage: s, index: idx}
+}
+
+// Unwrap returns the wrapped storage (storage.Unwrapper).
+func (s *Storage) Unwrap() storage.Storage { return s.Storage }
+
+func (s *Storage) CreateShisha(ctx context.Context, sh *storage.Shisha) (*storage.Shisha, error) {
+	out, err := s.Storage.CreateShisha(ctx, sh)
+	if err != nil {
+		return nil, err
+	}
+	s.index.Put(*out)
+	return out, nil
+}
+
+func (s *Storage) CreateShishas(ctx context.Context, items []storage.Shisha) ([]storage.BatchResult, error) {
+	return s.indexResults(s.Storage.CreateShishas(ctx, items))
+}
+
+func (s *Storage) RestoreShishas(ctx context.Context, items []storage.Shisha) ([]storage.BatchResult, error) {
+	return s.indexResults(s.Storage.RestoreShishas(ctx, items))
+}
+
+// indexResults adds the successfully stored entries of a batch write to the index.
+func (s *Storage) indexResults(results []storage.BatchResult, err error) ([]storage.BatchResult, error) {
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			s.index.Put(*r.Shisha)
+		}
+	}
+	return results, nil
+}
+
+func (s *Storage) UpdateShisha(ctx context.Context, id uint, sh *storage.Shisha) (*storage.Shisha, error) {
+	out, err := s.Storage.UpdateShisha(ctx, id, sh)
+	if err != nil {
+		return nil, err
+	}
+	s.index.Put(*out)
+	return out, nil
+}
+
+func (s *Storage) ReplaceShisha(ctx context.Context, id uint, sh *storage.Shisha) (*storage.Shisha, error) {
+	out, err := s.Storage.ReplaceShisha(ctx, id, sh)
+	if err != nil {
+		return nil, err
+	}
+	s.index.Put(*out)
+	return out, nil
+}
+
+func (s *Storage) DeleteShisha(ctx context.Context, id uint) error {
+	if err := s.Storage.DeleteShisha(ctx, id); err != nil {
+		return err
+	}
+	s.index.Remove(id)
+	return nil
+}
+
+// Renames and merges change the manufacturer shown by many entries at once, so the
+// index is rebuilt from the wrapped storage afterwards. A failed rebuild does not fail
+// the write; the next periodic refresh catches up.
+
+func (s *Storage) UpdateManufacturer(ctx context.Context, id uint, m *storage.Manufacturer) (*storage.Manufacturer, error) {
+	out, err := s.Storage.UpdateManufacturer(ctx, id, m)
+	if err != nil {
+		return nil, err
+	}
+	s.rebuild(ctx)
+	return out, nil
+}
+
+func (s *Storage) MergeManufacturers(ctx context.Context, into uint, ids []uint) (*storage.Manufacturer, error) {
+	out, err := s.Storage.MergeManufacturers(ctx, into, ids)
+	if err != nil {
+		return nil, err
+	}
+	s.rebuild(ctx)
+	return out, nil
+}
+
+func (s *Storage) NormalizeManufacturers(ctx context.Context) ([]storage.ManufacturerMerge, error) {
+	out, err := s.Storage.NormalizeManufacturers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.rebuild(ctx)
+	return out, nil
+}
+
+func (s *Storage) rebuild(ctx context.Context) {
+	if err := s.index.Rebuild(ctx, s.Storage); err != nil {
+		slog.WarnContext(ctx, "search: index rebuild failed", "error", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/shisha-tracker/backend/storage"
+	"golang.org/x/exp/slog"
+)
+
+// shuttingDown is set once the server received SIGTERM or SIGINT; /api/ready then
+// fails so the load balancer stops routing new requests here.
+var shuttingDown atomic.Bool
+
+// serverConfig holds the HTTP timeouts and the shutdown phases.
+type serverConfig struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ShutdownDelay is how long the server keeps serving after readiness flipped to 503,
+	// so endpoints and ingress stop sending new requests before it stops accepting.
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds draining the in-flight requests.
+	ShutdownTimeout time.Duration
+}
+
+// serverConfigFromEnv reads HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT, HTTP_IDLE_TIMEOUT,
+// SHUTDOWN_DELAY and SHUTDOWN_TIMEOUT. The write timeout covers whole exports and backup
+// downloads; delay plus timeout must fit into the pod's terminationGracePeriodSeconds.
+func serverConfigFromEnv() serverConfig {
+	return serverConfig{
+		ReadTimeout:     durationFromEnv("HTTP_READ_TIMEOUT", time.Minute),
+		WriteTimeout:    durationFromEnv("HTTP_WRITE_TIMEOUT", 2*time.Minute),
+		IdleTimeout:     durationFromEnv("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+		ShutdownDelay:   durationFromEnv("SHUTDOWN_DELAY", 5*time.Second),
+		ShutdownTimeout: durationFromEnv("SHUTDOWN_TIMEOUT", 20*time.Second),
+	}
+}
+
+// durationFromEnv parses the Go duration in the variable name; unset, invalid or
+// negative values give def.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		slog.Warn("invalid duration, using the default", "variable", name, "value", v, "default", def)
+		return def
+	}
+	return d
+}
+
+// newServer returns the HTTP server for h with the timeouts of cfg.
+func newServer(addr string, h http.Handler, cfg serverConfig) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// serve runs srv on ln until ctx is done, then shuts down in phases: /api/ready answers
+// 503, keep-alive ends and the background jobs are cancelled, after ShutdownDelay the
+// listener closes and in-flight requests get ShutdownTimeout to finish before their
+// connections are cut. Jobs still winding down get the rest of that timeout; the storage
+// may be closed once serve returned. stop is called as soon as the shutdown begins; for
+// a signal context it restores the default handling, so a second signal kills the
+// process during the drain.
+func serve(ctx context.Context, stop context.CancelFunc, srv *http.Server, ln net.Listener, cfg serverConfig, jobs *jobGroup) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+
+	select {
+	case err := <-errc:
+		stop()
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	shuttingDown.Store(true)
+	srv.SetKeepAlivesEnabled(false)
+	jobs.Cancel()
+	slog.Info("shutdown: not ready anymore, draining", "delay", cfg.ShutdownDelay.String(), "timeout", cfg.ShutdownTimeout.String())
+	time.Sleep(cfg.ShutdownDelay)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		slog.Warn("shutdown: requests still running after the timeout, closing connections", "error", err)
+		srv.Close()
+	}
+	if err := jobs.Wait(drainCtx); err != nil {
+		slog.Warn("shutdown: background jobs still running after the timeout", "error", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	slog.Info("shutdown: HTTP server stopped")
+	return nil
+}
+
+// closeStorage releases the connections of an adapter that holds any (GORM pool, idle
+// CouchDB connections).
+func closeStorage(s storage.Storage) {
+	c, ok := s.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		slog.Warn("shutdown: closing the storage failed", "error", err)
+		return
+	}
+	slog.Info("shutdown: storage closed")
+}
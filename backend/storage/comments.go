@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxCommentLength bounds the length of a comment message.
+const maxCommentLength = 2000
+
+// validateComment checks the input of AddComment and trims user and message in place.
+func validateComment(user, message *string) error {
+	*user = strings.TrimSpace(*user)
+	if *user == "" {
+		return fmt.Errorf("%w: user is required", ErrValidation)
+	}
+	if len(*user) > maxRatingUser {
+		return fmt.Errorf("%w: user must be at most %d characters", ErrValidation, maxRatingUser)
+	}
+	return validateMessage(message)
+}
+
+// validateMessage checks and trims a comment message in place.
+func validateMessage(message *string) error {
+	*message = strings.TrimSpace(*message)
+	if *message == "" {
+		return fmt.Errorf("%w: message is required", ErrValidation)
+	}
+	if len(*message) > maxCommentLength {
+		return fmt.Errorf("%w: message must be at most %d characters", ErrValidation, maxCommentLength)
+	}
+	return nil
+}
+
+// numberComments returns comments with an id assigned to every comment that has none,
+// continuing after the highest id present. Comments stored or imported before comments
+// had ids become addressable this way; the input slice is left untouched.
+func numberComments(comments []Comment) []Comment {
+	next := nextCommentID(comments)
+	var out []Comment
+	for i, c := range comments {
+		if c.ID != 0 {
+			continue
+		}
+		if out == nil {
+			out = append([]Comment(nil), comments...)
+		}
+		out[i].ID = next
+		next++
+	}
+	if out == nil {
+		return comments
+	}
+	return out
+}
+
+// nextCommentID returns the id the next comment of a shisha gets.
+func nextCommentID(comments []Comment) uint {
+	next := uint(1)
+	for _, c := range comments {
+		if c.ID >= next {
+			next = c.ID + 1
+		}
+	}
+	return next
+}
+
+// appendComment returns comments with a new comment of user appended under the next free
+// id, and that comment. parentID 0 starts a thread; otherwise it must name a top-level
+// comment, as replies are only one level deep.
+func appendComment(comments []Comment, user, message string, parentID uint, now int64) ([]Comment, Comment, error) {
+	if parentID != 0 {
+		i := indexComment(comments, parentID)
+		if i < 0 {
+			return nil, Comment{}, fmt.Errorf("%w: unknown parent comment %d", ErrValidation, parentID)
+		}
+		if comments[i].ParentID != 0 {
+			return nil, Comment{}, fmt.Errorf("%w: comment %d is a reply and cannot be answered", ErrValidation, parentID)
+		}
+	}
+	c := Comment{ID: nextCommentID(comments), ParentID: parentID, User: user, Message: message, CreatedAt: now}
+	return append(comments, c), c, nil
+}
+
+// editComment replaces the message of comment cid in place and returns the edited comment.
+func editComment(comments []Comment, id, cid uint, author, message string, now int64) (Comment, error) {
+	i, err := commentOf(comments, id, cid, author)
+	if err != nil {
+		return Comment{}, err
+	}
+	comments[i].Message = message
+	comments[i].EditedAt = now
+	return comments[i], nil
+}
+
+// removeComment returns comments without comment cid and its replies.
+func removeComment(comments []Comment, id, cid uint, author string) ([]Comment, error) {
+	if _, err := commentOf(comments, id, cid, author); err != nil {
+		return nil, err
+	}
+	out := comments[:0:0]
+	for _, c := range comments {
+		if c.ID != cid && c.ParentID != cid {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// commentOf returns the index of comment cid of shisha id. A non-empty author restricts
+// the lookup to comments written by author: others yield ErrForbidden.
+func commentOf(comments []Comment, id, cid uint, author string) (int, error) {
+	i := indexComment(comments, cid)
+	if i < 0 {
+		return -1, fmt.Errorf("comment %d on shisha %d: %w", cid, id, ErrNotFound)
+	}
+	if author != "" && comments[i].User != strings.TrimSpace(author) {
+		return -1, fmt.Errorf("comment %d on shisha %d: %w: only its author may change it", cid, id, ErrForbidden)
+	}
+	return i, nil
+}
+
+func indexComment(comments []Comment, cid uint) int {
+	for i, c := range comments {
+		if c.ID == cid {
+			return i
+		}
+	}
+	return -1
+}
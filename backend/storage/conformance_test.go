@@ -0,0 +1,1026 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storageFactory returns a fresh, empty Storage for one conformance sub-test.
+type storageFactory func(t *testing.T) Storage
+
+// runConformance checks the full Storage contract against the implementation built by
+// newStorage. Every adapter in this package must pass it.
+func runConformance(t *testing.T, newStorage storageFactory) {
+	t.Run("CreateGetUpdateDelete", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+
+		created, err := s.CreateShisha(ctx, &Shisha{Name: "Mint Breeze", Flavor: "Minze", Manufacturer: Manufacturer{Name: "Al Fakher"}})
+		if err != nil {
+			t.Fatalf("CreateShisha: %v", err)
+		}
+		if created.ID == 0 {
+			t.Fatalf("CreateShisha: expected an id to be assigned")
+		}
+		got, err := s.GetShisha(ctx, created.ID)
+		if err != nil {
+			t.Fatalf("GetShisha: %v", err)
+		}
+		if got.ID != created.ID || got.Name != "Mint Breeze" || got.Flavor != "Minze" || got.Manufacturer.Name != "Al Fakher" {
+			t.Fatalf("GetShisha: unexpected %+v", got)
+		}
+
+		updated, err := s.UpdateShisha(ctx, created.ID, &Shisha{Name: "Mint Storm", Flavor: "Minze, Eis", Manufacturer: Manufacturer{Name: "Adalya"}})
+		if err != nil {
+			t.Fatalf("UpdateShisha: %v", err)
+		}
+		if updated.ID != created.ID || updated.Name != "Mint Storm" {
+			t.Fatalf("UpdateShisha: unexpected %+v", updated)
+		}
+		got, err = s.GetShisha(ctx, created.ID)
+		if err != nil {
+			t.Fatalf("GetShisha after update: %v", err)
+		}
+		if got.Name != "Mint Storm" || got.Flavor != "Minze, Eis" || got.Manufacturer.Name != "Adalya" {
+			t.Fatalf("update not persisted: %+v", got)
+		}
+
+		if err := s.DeleteShisha(ctx, created.ID); err != nil {
+			t.Fatalf("DeleteShisha: %v", err)
+		}
+		if _, err := s.GetShisha(ctx, created.ID); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("GetShisha after delete: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+
+		page, err := s.ListShishas(ctx, ListOptions{})
+		if err != nil {
+			t.Fatalf("ListShishas on empty store: %v", err)
+		}
+		if len(page.Items) != 0 || page.NextCursor != "" {
+			t.Fatalf("expected empty list, got %+v", page)
+		}
+		want := map[string]bool{"Mint": true, "Love 66": true, "Grape": true}
+		for name := range want {
+			if _, err := s.CreateShisha(ctx, &Shisha{Name: name}); err != nil {
+				t.Fatalf("CreateShisha %s: %v", name, err)
+			}
+		}
+		page, err = s.ListShishas(ctx, ListOptions{})
+		if err != nil {
+			t.Fatalf("ListShishas: %v", err)
+		}
+		if len(page.Items) != len(want) {
+			t.Fatalf("expected %d entries, got %d", len(want), len(page.Items))
+		}
+		for _, sh := range page.Items {
+			if !want[sh.Name] {
+				t.Fatalf("unexpected entry %+v", sh)
+			}
+		}
+	})
+
+	t.Run("CreateShishas", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		existing := mustCreate(t, s, "Existing")
+
+		results, err := s.CreateShishas(ctx, []Shisha{
+			{Name: "Mint", Flavor: "Minze", Manufacturer: Manufacturer{Name: "Al Fakher"}},
+			{Name: " "},
+			{Name: "Grape", Manufacturer: Manufacturer{Name: "Al Fakher"}, Ratings: []Rating{{User: "alice", Score: 6}}},
+			{Name: "Cheat", Ratings: []Rating{{User: "mallory", Score: 9999}}},
+		})
+		if err != nil {
+			t.Fatalf("CreateShishas: %v", err)
+		}
+		if len(results) != 4 {
+			t.Fatalf("expected 4 results, got %d", len(results))
+		}
+		if !errors.Is(results[1].Err, ErrValidation) || results[1].Shisha != nil {
+			t.Fatalf("invalid item: expected ErrValidation, got %+v", results[1])
+		}
+		if !errors.Is(results[3].Err, ErrValidation) || results[3].Shisha != nil {
+			t.Fatalf("score out of range: expected ErrValidation, got %+v", results[3])
+		}
+		ids := map[uint]bool{existing.ID: true}
+		for _, i := range []int{0, 2} {
+			r := results[i]
+			if r.Err != nil || r.Shisha == nil || r.Shisha.ID == 0 {
+				t.Fatalf("item %d: unexpected %+v", i, r)
+			}
+			if ids[r.Shisha.ID] {
+				t.Fatalf("item %d: id %d assigned twice", i, r.Shisha.ID)
+			}
+			ids[r.Shisha.ID] = true
+		}
+		got, err := s.GetShisha(ctx, results[2].Shisha.ID)
+		if err != nil {
+			t.Fatalf("GetShisha: %v", err)
+		}
+		if got.Name != "Grape" || got.Manufacturer.Name != "Al Fakher" || len(got.Ratings) != 1 {
+			t.Fatalf("batch entry not stored completely: %+v", got)
+		}
+		if results, err := s.CreateShishas(ctx, nil); err != nil || len(results) != 0 {
+			t.Fatalf("empty batch: %v %v", results, err)
+		}
+	})
+
+	t.Run("RestoreShishas", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		existing := mustCreate(t, s, "Existing")
+
+		results, err := s.RestoreShishas(ctx, []Shisha{
+			{ID: 10, Name: "Mint", Manufacturer: Manufacturer{Name: "Al Fakher"}, Smoked: 2, Ratings: []Rating{{User: "alice", Score: 8, Timestamp: 1700000000}}},
+			{ID: existing.ID, Name: "Clash"},
+			{Name: "No id"},
+			{ID: 5, Name: "Grape", Comments: []Comment{{User: "bob", Message: "lecker"}}},
+			{ID: 5, Name: "Grape again"},
+		})
+		if err != nil {
+			t.Fatalf("RestoreShishas: %v", err)
+		}
+		for _, i := range []int{0, 3} {
+			if results[i].Err != nil || results[i].Shisha == nil {
+				t.Fatalf("item %d: unexpected %+v", i, results[i])
+			}
+		}
+		if !errors.Is(results[1].Err, ErrConflict) || !errors.Is(results[4].Err, ErrConflict) {
+			t.Fatalf("taken ids: expected ErrConflict, got %v / %v", results[1].Err, results[4].Err)
+		}
+		if !errors.Is(results[2].Err, ErrValidation) {
+			t.Fatalf("missing id: expected ErrValidation, got %v", results[2].Err)
+		}
+
+		got, err := s.GetShisha(ctx, 10)
+		if err != nil {
+			t.Fatalf("GetShisha: %v", err)
+		}
+		if got.Name != "Mint" || got.Smoked != 2 || len(got.Ratings) != 1 || got.Ratings[0].Timestamp != 1700000000 {
+			t.Fatalf("restored entry incomplete: %+v", got)
+		}
+		if got, err := s.GetShisha(ctx, 5); err != nil || len(got.Comments) != 1 || got.Comments[0].ID != 1 {
+			t.Fatalf("restored comment not numbered: %+v %v", got, err)
+		}
+		if got, err := s.GetShisha(ctx, existing.ID); err != nil || got.Name != "Existing" {
+			t.Fatalf("existing entry changed: %+v %v", got, err)
+		}
+		next := mustCreate(t, s, "After restore")
+		if next.ID <= 10 {
+			t.Fatalf("id allocation not moved past restored ids: got %d", next.ID)
+		}
+	})
+
+	t.Run("ListPaging", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		for i := 0; i < 5; i++ {
+			mustCreate(t, s, fmt.Sprintf("Shisha %d", i))
+		}
+
+		seen := make(map[uint]bool)
+		opts := ListOptions{Limit: 2}
+		for pages := 1; ; pages++ {
+			page, err := s.ListShishas(ctx, opts)
+			if err != nil {
+				t.Fatalf("ListShishas page %d: %v", pages, err)
+			}
+			if len(page.Items) > 2 {
+				t.Fatalf("page %d: limit ignored, got %d entries", pages, len(page.Items))
+			}
+			for _, sh := range page.Items {
+				if seen[sh.ID] {
+					t.Fatalf("page %d: id %d returned twice", pages, sh.ID)
+				}
+				seen[sh.ID] = true
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			if pages > 5 {
+				t.Fatalf("cursor never ran out")
+			}
+			opts.Cursor = page.NextCursor
+		}
+		if len(seen) != 5 {
+			t.Fatalf("expected 5 entries across pages, got %d", len(seen))
+		}
+	})
+
+	t.Run("ListSortAndFilter", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		grape, err := s.CreateShisha(ctx, &Shisha{Name: "grape", Flavor: "Traube", Manufacturer: Manufacturer{Name: "Adalya"}})
+		if err != nil {
+			t.Fatalf("CreateShisha: %v", err)
+		}
+		mint, err := s.CreateShisha(ctx, &Shisha{Name: "Mint", Flavor: "Minze, Eis", Manufacturer: Manufacturer{Name: "Al Fakher"}})
+		if err != nil {
+			t.Fatalf("CreateShisha: %v", err)
+		}
+		love, err := s.CreateShisha(ctx, &Shisha{Name: "Love 66", Flavor: "Melone, Minze", Manufacturer: Manufacturer{Name: "Adalya"}})
+		if err != nil {
+			t.Fatalf("CreateShisha: %v", err)
+		}
+		for _, step := range []error{
+			s.AddRating(ctx, mint.ID, "alice", 9),
+			s.AddRating(ctx, love.ID, "alice", 4),
+			s.AddSmoked(ctx, love.ID),
+			s.AddSmoked(ctx, love.ID),
+			s.AddSmoked(ctx, grape.ID),
+		} {
+			if step != nil {
+				t.Fatalf("setup: %v", step)
+			}
+		}
+
+		names := func(opts ListOptions) []string {
+			t.Helper()
+			page, err := s.ListShishas(ctx, opts)
+			if err != nil {
+				t.Fatalf("ListShishas(%+v): %v", opts, err)
+			}
+			out := make([]string, 0, len(page.Items))
+			for _, sh := range page.Items {
+				out = append(out, sh.Name)
+			}
+			return out
+		}
+		cases := []struct {
+			opts ListOptions
+			want []string
+		}{
+			{ListOptions{Sort: SortName}, []string{"grape", "Love 66", "Mint"}},
+			{ListOptions{Sort: SortName, Desc: true}, []string{"Mint", "Love 66", "grape"}},
+			{ListOptions{Sort: SortRating, Desc: true}, []string{"Mint", "Love 66", "grape"}},
+			{ListOptions{Sort: SortSmoked}, []string{"Mint", "grape", "Love 66"}},
+			{ListOptions{Sort: SortID, Desc: true}, []string{"Love 66", "Mint", "grape"}},
+			{ListOptions{Manufacturer: "adalya", Sort: SortName}, []string{"grape", "Love 66"}},
+			{ListOptions{Flavor: "minze", Sort: SortName}, []string{"Love 66", "Mint"}},
+			{ListOptions{Flavor: "minze", Manufacturer: "Al Fakher"}, []string{"Mint"}},
+			{ListOptions{Manufacturer: "Unknown"}, []string{}},
+		}
+		for _, tc := range cases {
+			if got := names(tc.opts); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ListShishas(%+v) = %v, want %v", tc.opts, got, tc.want)
+			}
+		}
+
+		if _, err := s.ListShishas(ctx, ListOptions{Sort: "color"}); !errors.Is(err, ErrValidation) {
+			t.Errorf("unknown sort: expected ErrValidation, got %v", err)
+		}
+		if _, err := s.ListShishas(ctx, ListOptions{Limit: -1}); !errors.Is(err, ErrValidation) {
+			t.Errorf("negative limit: expected ErrValidation, got %v", err)
+		}
+	})
+
+	t.Run("RatingCommentSmoked", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		created := mustCreate(t, s, "Mint")
+
+		if err := s.AddRating(ctx, created.ID, "alice", 8); err != nil {
+			t.Fatalf("AddRating: %v", err)
+		}
+		if err := s.AddRating(ctx, created.ID, "bob", 3); err != nil {
+			t.Fatalf("AddRating: %v", err)
+		}
+		if _, err := s.AddComment(ctx, created.ID, "bob", "Leicht und frisch", 0); err != nil {
+			t.Fatalf("AddComment: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := s.AddSmoked(ctx, created.ID); err != nil {
+				t.Fatalf("AddSmoked: %v", err)
+			}
+		}
+
+		got, err := s.GetShisha(ctx, created.ID)
+		if err != nil {
+			t.Fatalf("GetShisha: %v", err)
+		}
+		if len(got.Ratings) != 2 || got.Ratings[0].User != "alice" || got.Ratings[0].Score != 8 || got.Ratings[1].User != "bob" {
+			t.Fatalf("ratings not appended in order: %+v", got.Ratings)
+		}
+		if got.Ratings[0].Timestamp == 0 {
+			t.Fatalf("rating timestamp not set")
+		}
+		if len(got.Comments) != 1 || got.Comments[0].User != "bob" || got.Comments[0].Message != "Leicht und frisch" {
+			t.Fatalf("comment not appended: %+v", got.Comments)
+		}
+		if got.Smoked != 2 {
+			t.Fatalf("expected smoked=2, got %d", got.Smoked)
+		}
+	})
+
+	t.Run("UpdateKeepsEntries", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		created := mustCreate(t, s, "Mint")
+		if err := s.AddRating(ctx, created.ID, "alice", 8); err != nil {
+			t.Fatalf("AddRating: %v", err)
+		}
+		if _, err := s.AddComment(ctx, created.ID, "bob", "Frisch", 0); err != nil {
+			t.Fatalf("AddComment: %v", err)
+		}
+		if err := s.AddSmoked(ctx, created.ID); err != nil {
+			t.Fatalf("AddSmoked: %v", err)
+		}
+
+		updated, err := s.UpdateShisha(ctx, created.ID, &Shisha{
+			Name:     "Mint Storm",
+			Smoked:   0,
+			Ratings:  []Rating{{User: "mallory", Score: 0}},
+			Comments: []Comment{{User: "mallory", Message: "überschrieben"}},
+		})
+		if err != nil {
+			t.Fatalf("UpdateShisha: %v", err)
+		}
+		if updated.Name != "Mint Storm" || len(updated.Ratings) != 1 || updated.Ratings[0].User != "alice" ||
+			len(updated.Comments) != 1 || updated.Comments[0].User != "bob" || updated.Smoked != 1 || updated.RatingCount != 1 {
+			t.Fatalf("UpdateShisha must only change catalogue fields, got %+v", updated)
+		}
+
+		replaced, err := s.ReplaceShisha(ctx, created.ID, &Shisha{
+			Name:     "Mint Storm",
+			Smoked:   5,
+			Ratings:  []Rating{{User: "carol", Score: 6, Timestamp: 1700000000}},
+			Comments: []Comment{{ID: 3, User: "carol", Message: "Neu"}},
+		})
+		if err != nil {
+			t.Fatalf("ReplaceShisha: %v", err)
+		}
+		got, err := s.GetShisha(ctx, created.ID)
+		if err != nil {
+			t.Fatalf("GetShisha: %v", err)
+		}
+		for _, sh := range []*Shisha{replaced, got} {
+			if len(sh.Ratings) != 1 || sh.Ratings[0].User != "carol" || len(sh.Comments) != 1 || sh.Comments[0].ID != 3 || sh.Smoked != 5 {
+				t.Fatalf("ReplaceShisha must overwrite everything, got %+v", sh)
+			}
+		}
+		if _, err := s.ReplaceShisha(ctx, created.ID+100, &Shisha{Name: "x"}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("ReplaceShisha: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Comments", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		created := mustCreate(t, s, "Mint")
+
+		top, err := s.AddComment(ctx, created.ID, " bob ", "Leicht und frisch", 0)
+		if err != nil {
+			t.Fatalf("AddComment: %v", err)
+		}
+		if top.ID == 0 || top.User != "bob" || top.CreatedAt == 0 || top.EditedAt != 0 {
+			t.Fatalf("unexpected comment: %+v", top)
+		}
+		reply, err := s.AddComment(ctx, created.ID, "alice", "Finde ich auch", top.ID)
+		if err != nil {
+			t.Fatalf("AddComment reply: %v", err)
+		}
+		if reply.ID == top.ID || reply.ParentID != top.ID {
+			t.Fatalf("unexpected reply: %+v", reply)
+		}
+		other, err := s.AddComment(ctx, created.ID, "carol", "Zu süß", 0)
+		if err != nil {
+			t.Fatalf("AddComment: %v", err)
+		}
+		for _, bad := range []struct {
+			user, message string
+			parent        uint
+		}{{"", "x", 0}, {"bob", " ", 0}, {"bob", "x", reply.ID}, {"bob", "x", 999}} {
+			if _, err := s.AddComment(ctx, created.ID, bad.user, bad.message, bad.parent); !errors.Is(err, ErrValidation) {
+				t.Errorf("AddComment(%q, %q, %d): expected ErrValidation, got %v", bad.user, bad.message, bad.parent, err)
+			}
+		}
+
+		if _, err := s.UpdateComment(ctx, created.ID, top.ID, "alice", "gekapert"); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("UpdateComment by other user: expected ErrForbidden, got %v", err)
+		}
+		if _, err := s.UpdateComment(ctx, created.ID, 999, "bob", "x"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("UpdateComment missing comment: expected ErrNotFound, got %v", err)
+		}
+		edited, err := s.UpdateComment(ctx, created.ID, top.ID, "bob", "Leicht, frisch und lange")
+		if err != nil {
+			t.Fatalf("UpdateComment: %v", err)
+		}
+		if edited.Message != "Leicht, frisch und lange" || edited.EditedAt == 0 || edited.CreatedAt != top.CreatedAt {
+			t.Fatalf("unexpected edited comment: %+v", edited)
+		}
+		if _, err := s.UpdateComment(ctx, created.ID, other.ID, "", "moderiert"); err != nil {
+			t.Fatalf("UpdateComment as admin: %v", err)
+		}
+
+		if err := s.DeleteComment(ctx, created.ID, top.ID, "carol"); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("DeleteComment by other user: expected ErrForbidden, got %v", err)
+		}
+		if err := s.DeleteComment(ctx, created.ID, top.ID, "bob"); err != nil {
+			t.Fatalf("DeleteComment: %v", err)
+		}
+		got, err := s.GetShisha(ctx, created.ID)
+		if err != nil {
+			t.Fatalf("GetShisha: %v", err)
+		}
+		if len(got.Comments) != 1 || got.Comments[0].ID != other.ID || got.Comments[0].Message != "moderiert" {
+			t.Fatalf("expected only the moderated comment to remain, got %+v", got.Comments)
+		}
+		if err := s.DeleteComment(ctx, created.ID, reply.ID, ""); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("reply not deleted with its parent: %v", err)
+		}
+		next, err := s.AddComment(ctx, created.ID, "bob", "Nochmal", 0)
+		if err != nil || next.ID == other.ID {
+			t.Fatalf("AddComment after delete: %+v %v", next, err)
+		}
+	})
+
+	t.Run("Users", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+
+		u, err := s.CreateUser(ctx, &User{Name: " Jürgen ", PasswordHash: "hash", CreatedAt: 1700000000})
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		if u.Name != "Jürgen" || u.Role != RoleMember {
+			t.Fatalf("name not trimmed or role not defaulted: %+v", u)
+		}
+		if _, err := s.CreateUser(ctx, &User{Name: "JÜRGEN", PasswordHash: "other"}); !errors.Is(err, ErrConflict) {
+			t.Fatalf("duplicate name: expected ErrConflict, got %v", err)
+		}
+		for _, bad := range []User{{Name: "a", PasswordHash: "h"}, {Name: "bob smith", PasswordHash: "h"}, {Name: "bob"}, {Name: "bob", PasswordHash: "h", Role: "root"}} {
+			if _, err := s.CreateUser(ctx, &bad); !errors.Is(err, ErrValidation) {
+				t.Errorf("CreateUser(%+v): expected ErrValidation, got %v", bad, err)
+			}
+		}
+		got, err := s.GetUser(ctx, "jürgen")
+		if err != nil || *got != (User{Name: "Jürgen", Role: RoleMember, PasswordHash: "hash", CreatedAt: 1700000000}) {
+			t.Fatalf("GetUser: %+v %v", got, err)
+		}
+		if _, err := s.GetUser(ctx, "nobody"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("GetUser missing: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.CreateUser(ctx, &User{Name: "alice", Role: RoleAdmin, PasswordHash: "h"}); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		if promoted, err := s.SetUserRole(ctx, "JÜRGEN", RoleCurator); err != nil || promoted.Role != RoleCurator || promoted.Name != "Jürgen" {
+			t.Fatalf("SetUserRole: %+v %v", promoted, err)
+		}
+		if _, err := s.SetUserRole(ctx, "jürgen", "root"); !errors.Is(err, ErrValidation) {
+			t.Fatalf("SetUserRole unknown role: expected ErrValidation, got %v", err)
+		}
+		if _, err := s.SetUserRole(ctx, "nobody", RoleAdmin); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("SetUserRole missing user: expected ErrNotFound, got %v", err)
+		}
+		users, err := s.ListUsers(ctx)
+		if err != nil || len(users) != 2 || users[0].Name != "alice" || users[0].Role != RoleAdmin ||
+			users[1].Name != "Jürgen" || users[1].Role != RoleCurator {
+			t.Fatalf("ListUsers: %+v %v", users, err)
+		}
+
+		if _, err := s.CreateAPIToken(ctx, &APIToken{ID: "t0", User: "nobody", SecretHash: "x"}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("token of missing user: expected ErrNotFound, got %v", err)
+		}
+		tok, err := s.CreateAPIToken(ctx, &APIToken{ID: "t1", User: "jürgen", Name: "cron", SecretHash: "x", CreatedAt: 1})
+		if err != nil {
+			t.Fatalf("CreateAPIToken: %v", err)
+		}
+		if tok.User != "Jürgen" {
+			t.Fatalf("token should carry the account name, got %+v", tok)
+		}
+		if _, err := s.CreateAPIToken(ctx, &APIToken{ID: "t2", User: "Jürgen", SecretHash: "y", CreatedAt: 2}); err != nil {
+			t.Fatalf("CreateAPIToken: %v", err)
+		}
+		if _, err := s.CreateAPIToken(ctx, &APIToken{ID: "t3", User: "alice", SecretHash: "z", CreatedAt: 3}); err != nil {
+			t.Fatalf("CreateAPIToken: %v", err)
+		}
+		if got, err := s.GetAPIToken(ctx, "t1"); err != nil || *got != *tok {
+			t.Fatalf("GetAPIToken: %+v %v", got, err)
+		}
+		list, err := s.ListAPITokens(ctx, "JÜRGEN")
+		if err != nil || len(list) != 2 || list[0].ID != "t1" || list[1].ID != "t2" {
+			t.Fatalf("ListAPITokens: %+v %v", list, err)
+		}
+		if err := s.DeleteAPIToken(ctx, "alice", "t1"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("deleting another user's token: expected ErrNotFound, got %v", err)
+		}
+		if err := s.DeleteAPIToken(ctx, "Jürgen", "t1"); err != nil {
+			t.Fatalf("DeleteAPIToken: %v", err)
+		}
+		if _, err := s.GetAPIToken(ctx, "t1"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("deleted token: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("RatingPerUser", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		created := mustCreate(t, s, "Mint")
+
+		for _, r := range []struct {
+			user  string
+			score int
+		}{{"alice", 8}, {"bob", 3}, {" Alice ", 5}, {"alice", 10}} {
+			if err := s.AddRating(ctx, created.ID, r.user, r.score); err != nil {
+				t.Fatalf("AddRating(%q, %d): %v", r.user, r.score, err)
+			}
+		}
+		got, err := s.GetShisha(ctx, created.ID)
+		if err != nil {
+			t.Fatalf("GetShisha: %v", err)
+		}
+		if len(got.Ratings) != 2 || got.Ratings[0].User != "alice" || got.Ratings[0].Score != 10 || got.Ratings[1].User != "bob" {
+			t.Fatalf("re-rating should replace the score in place: %+v", got.Ratings)
+		}
+		var history []int
+		for _, h := range got.Ratings[0].History {
+			history = append(history, h.Score)
+		}
+		if !reflect.DeepEqual(history, []int{8, 5}) {
+			t.Fatalf("history: got %v, want [8 5]", history)
+		}
+
+		for _, bad := range []struct {
+			user  string
+			score int
+		}{{"alice", -1}, {"alice", 11}, {"alice", 9999}, {"  ", 4}, {strings.Repeat("x", 101), 4}} {
+			if err := s.AddRating(ctx, created.ID, bad.user, bad.score); !errors.Is(err, ErrValidation) {
+				t.Errorf("AddRating(%q, %d): expected ErrValidation, got %v", bad.user, bad.score, err)
+			}
+		}
+
+		if err := s.DeleteRating(ctx, created.ID, "ALICE"); err != nil {
+			t.Fatalf("DeleteRating in other case: %v", err)
+		}
+		if err := s.DeleteRating(ctx, created.ID, "alice"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("DeleteRating twice: expected ErrNotFound, got %v", err)
+		}
+		got, _ = s.GetShisha(ctx, created.ID)
+		if len(got.Ratings) != 1 || got.Ratings[0].User != "bob" {
+			t.Fatalf("ratings after delete: %+v", got.Ratings)
+		}
+	})
+
+	t.Run("RatingStats", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		mint := mustCreate(t, s, "Mint")
+		grape := mustCreate(t, s, "Grape")
+		for _, r := range []struct {
+			id    uint
+			user  string
+			score int
+		}{{mint.ID, "alice", 10}, {grape.ID, "alice", 4}, {grape.ID, "bob", 6}, {grape.ID, "carol", 6}} {
+			if err := s.AddRating(ctx, r.id, r.user, r.score); err != nil {
+				t.Fatalf("AddRating: %v", err)
+			}
+		}
+
+		st, err := s.RatingStats(ctx, grape.ID)
+		if err != nil {
+			t.Fatalf("RatingStats: %v", err)
+		}
+		// prior: 4 ratings summing up to 26
+		want := ShishaStats{
+			ShishaID: grape.ID,
+			RatingStats: RatingStats{
+				RatingCount:     3,
+				RatingAvg:       16.0 / 3,
+				RatingWeighted:  (RatingPriorWeight*26.0/4 + 16) / (RatingPriorWeight + 3),
+				RatingHistogram: []int{0, 0, 0, 0, 1, 0, 2, 0, 0, 0, 0},
+			},
+			PriorAvg:     26.0 / 4,
+			PriorWeight:  RatingPriorWeight,
+			TotalRatings: 4,
+		}
+		if !reflect.DeepEqual(*st, want) {
+			t.Fatalf("RatingStats:\ngot  %+v\nwant %+v", *st, want)
+		}
+		got, err := s.GetShisha(ctx, grape.ID)
+		if err != nil || !reflect.DeepEqual(got.RatingStats, want.RatingStats) {
+			t.Fatalf("GetShisha stats: got %+v (%v)", got.RatingStats, err)
+		}
+		page, err := s.ListShishas(ctx, ListOptions{Sort: SortRating, Desc: true})
+		if err != nil {
+			t.Fatalf("ListShishas: %v", err)
+		}
+		if page.Items[0].ID != mint.ID || page.Items[0].RatingCount != 1 || page.Items[0].RatingWeighted != (RatingPriorWeight*26.0/4+10)/(RatingPriorWeight+1) {
+			t.Fatalf("list stats: %+v", page.Items[0].RatingStats)
+		}
+
+		empty, err := s.RatingStats(ctx, mustCreate(t, s, "Unrated").ID)
+		if err != nil || empty.RatingCount != 0 || empty.RatingWeighted != 26.0/4 || len(empty.RatingHistogram) != MaxScore-MinScore+1 {
+			t.Fatalf("stats without ratings: %+v (%v)", empty, err)
+		}
+		if _, err := s.RatingStats(ctx, 4242); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("RatingStats unknown: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		const missing = 4242
+
+		if _, err := s.GetShisha(ctx, missing); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetShisha: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.UpdateShisha(ctx, missing, &Shisha{Name: "x"}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdateShisha: expected ErrNotFound, got %v", err)
+		}
+		if err := s.DeleteShisha(ctx, missing); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeleteShisha: expected ErrNotFound, got %v", err)
+		}
+		if err := s.AddRating(ctx, missing, "alice", 4); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AddRating: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.AddComment(ctx, missing, "bob", "hi", 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AddComment: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.UpdateComment(ctx, missing, 1, "bob", "hi"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdateComment: expected ErrNotFound, got %v", err)
+		}
+		if err := s.DeleteComment(ctx, missing, 1, "bob"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeleteComment: expected ErrNotFound, got %v", err)
+		}
+		if err := s.AddSmoked(ctx, missing); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AddSmoked: expected ErrNotFound, got %v", err)
+		}
+		if err := s.DeleteRating(ctx, missing, "alice"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeleteRating: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+
+		if _, err := s.CreateShisha(ctx, &Shisha{Name: "  "}); !errors.Is(err, ErrValidation) {
+			t.Errorf("CreateShisha: expected ErrValidation, got %v", err)
+		}
+		created := mustCreate(t, s, "Mint")
+		if _, err := s.UpdateShisha(ctx, created.ID, &Shisha{}); !errors.Is(err, ErrValidation) {
+			t.Errorf("UpdateShisha: expected ErrValidation, got %v", err)
+		}
+	})
+
+	t.Run("ConcurrentCreate", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+
+		const n = 10
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		ids := make(map[uint]bool)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				created, err := s.CreateShisha(ctx, &Shisha{Name: "Mint"})
+				if err != nil {
+					t.Errorf("CreateShisha: %v", err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if ids[created.ID] {
+					t.Errorf("id %d assigned twice", created.ID)
+				}
+				ids[created.ID] = true
+			}()
+		}
+		wg.Wait()
+		if len(ids) != n {
+			t.Fatalf("expected %d distinct ids, got %d", n, len(ids))
+		}
+	})
+
+	t.Run("ConcurrentUpdates", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		created := mustCreate(t, s, "Mint")
+
+		// concurrent writes may be rejected with ErrConflict, but must never be lost silently
+		const n = 10
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		smoked, rated := 0, 0
+		for i := 0; i < n; i++ {
+			wg.Add(2)
+			user := fmt.Sprintf("user%d", i)
+			go func() {
+				defer wg.Done()
+				err := s.AddSmoked(ctx, created.ID)
+				if err != nil && !errors.Is(err, ErrConflict) {
+					t.Errorf("AddSmoked: %v", err)
+				}
+				if err == nil {
+					mu.Lock()
+					smoked++
+					mu.Unlock()
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				// one rating per user, so every successful write must add an entry
+				err := s.AddRating(ctx, created.ID, user, 6)
+				if err != nil && !errors.Is(err, ErrConflict) {
+					t.Errorf("AddRating: %v", err)
+				}
+				if err == nil {
+					mu.Lock()
+					rated++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		got, err := s.GetShisha(ctx, created.ID)
+		if err != nil {
+			t.Fatalf("GetShisha: %v", err)
+		}
+		if got.Smoked != smoked {
+			t.Fatalf("smoked=%d but %d increments succeeded", got.Smoked, smoked)
+		}
+		if len(got.Ratings) != rated {
+			t.Fatalf("%d ratings stored but %d succeeded", len(got.Ratings), rated)
+		}
+		if smoked == 0 || rated == 0 {
+			t.Fatalf("no concurrent write succeeded (smoked=%d rated=%d)", smoked, rated)
+		}
+	})
+
+	t.Run("Manufacturers", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+
+		first, err := s.CreateShisha(ctx, &Shisha{Name: "Mint", Manufacturer: Manufacturer{Name: "Al Fakher"}})
+		if err != nil {
+			t.Fatalf("CreateShisha: %v", err)
+		}
+		af := first.Manufacturer
+		if af.ID == 0 || af.Name != "Al Fakher" {
+			t.Fatalf("manufacturer not stored: %+v", af)
+		}
+		byName, err := s.CreateShisha(ctx, &Shisha{Name: "Grape", Manufacturer: Manufacturer{Name: "  al   FAKHER "}})
+		if err != nil || byName.Manufacturer != af {
+			t.Fatalf("name should resolve to %+v, got %+v (%v)", af, byName, err)
+		}
+		byID, err := s.CreateShisha(ctx, &Shisha{Name: "Lemon", Manufacturer: Manufacturer{ID: af.ID}})
+		if err != nil || byID.Manufacturer != af {
+			t.Fatalf("id should resolve to %+v, got %+v (%v)", af, byID, err)
+		}
+		if _, err := s.CreateShisha(ctx, &Shisha{Name: "X", Manufacturer: Manufacturer{ID: 9999}}); !errors.Is(err, ErrValidation) {
+			t.Fatalf("unknown manufacturer id: expected ErrValidation, got %v", err)
+		}
+		if list, err := s.ListManufacturers(ctx); err != nil || !reflect.DeepEqual(list, []Manufacturer{af}) {
+			t.Fatalf("ListManufacturers: got %+v (%v)", list, err)
+		}
+
+		adalya, err := s.CreateManufacturer(ctx, &Manufacturer{Name: " Adalya "})
+		if err != nil || adalya.ID == 0 || adalya.Name != "Adalya" {
+			t.Fatalf("CreateManufacturer: got %+v (%v)", adalya, err)
+		}
+		if _, err := s.CreateManufacturer(ctx, &Manufacturer{Name: "ADALYA"}); !errors.Is(err, ErrConflict) {
+			t.Fatalf("duplicate name: expected ErrConflict, got %v", err)
+		}
+		if _, err := s.CreateManufacturer(ctx, &Manufacturer{Name: " "}); !errors.Is(err, ErrValidation) {
+			t.Fatalf("empty name: expected ErrValidation, got %v", err)
+		}
+		if got, err := s.GetManufacturer(ctx, adalya.ID); err != nil || *got != *adalya {
+			t.Fatalf("GetManufacturer: got %+v (%v)", got, err)
+		}
+		if _, err := s.GetManufacturer(ctx, 9999); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("GetManufacturer unknown: expected ErrNotFound, got %v", err)
+		}
+
+		renamed, err := s.UpdateManufacturer(ctx, af.ID, &Manufacturer{Name: "Al Fakher Tobacco"})
+		if err != nil || renamed.ID != af.ID || renamed.Name != "Al Fakher Tobacco" {
+			t.Fatalf("UpdateManufacturer: got %+v (%v)", renamed, err)
+		}
+		if got, _ := s.GetShisha(ctx, first.ID); got.Manufacturer != *renamed {
+			t.Fatalf("rename not visible on shisha: %+v", got.Manufacturer)
+		}
+		page, err := s.ListShishas(ctx, ListOptions{Manufacturer: "al fakher tobacco"})
+		if err != nil || len(page.Items) != 3 {
+			t.Fatalf("filter by new name: got %+v (%v)", page, err)
+		}
+		if _, err := s.UpdateManufacturer(ctx, adalya.ID, &Manufacturer{Name: "al fakher tobacco"}); !errors.Is(err, ErrConflict) {
+			t.Fatalf("rename to taken name: expected ErrConflict, got %v", err)
+		}
+		if _, err := s.UpdateManufacturer(ctx, 9999, &Manufacturer{Name: "Nope"}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("rename unknown: expected ErrNotFound, got %v", err)
+		}
+
+		if err := s.DeleteManufacturer(ctx, af.ID); !errors.Is(err, ErrConflict) {
+			t.Fatalf("delete used manufacturer: expected ErrConflict, got %v", err)
+		}
+		if err := s.DeleteManufacturer(ctx, adalya.ID); err != nil {
+			t.Fatalf("DeleteManufacturer: %v", err)
+		}
+		if _, err := s.GetManufacturer(ctx, adalya.ID); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("deleted manufacturer still there: %v", err)
+		}
+
+		// restores keep the manufacturer id when it is free
+		results, err := s.RestoreShishas(ctx, []Shisha{{ID: 50, Name: "Restored", Manufacturer: Manufacturer{ID: 40, Name: "Tangiers"}}})
+		if err != nil || results[0].Err != nil {
+			t.Fatalf("RestoreShishas: %v / %+v", err, results)
+		}
+		if got := results[0].Shisha.Manufacturer; got != (Manufacturer{ID: 40, Name: "Tangiers"}) {
+			t.Fatalf("restored manufacturer: got %+v", got)
+		}
+		next, err := s.CreateManufacturer(ctx, &Manufacturer{Name: "Darkside"})
+		if err != nil || next.ID <= 40 {
+			t.Fatalf("manufacturer ids not moved past restored ones: %+v (%v)", next, err)
+		}
+	})
+
+	t.Run("MergeManufacturers", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+		var shishas []*Shisha
+		for _, m := range []string{"Al Fakher", "Alfakher", "AF"} {
+			created, err := s.CreateShisha(ctx, &Shisha{Name: "Mint " + m, Manufacturer: Manufacturer{Name: m}})
+			if err != nil {
+				t.Fatalf("CreateShisha: %v", err)
+			}
+			shishas = append(shishas, created)
+		}
+		into := shishas[0].Manufacturer
+
+		if _, err := s.MergeManufacturers(ctx, into.ID, []uint{9999}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("merge unknown: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.MergeManufacturers(ctx, into.ID, []uint{into.ID}); !errors.Is(err, ErrValidation) {
+			t.Fatalf("merge nothing: expected ErrValidation, got %v", err)
+		}
+		merged, err := s.MergeManufacturers(ctx, into.ID, []uint{shishas[1].Manufacturer.ID, shishas[2].Manufacturer.ID, into.ID})
+		if err != nil || *merged != into {
+			t.Fatalf("MergeManufacturers: got %+v (%v)", merged, err)
+		}
+		for _, sh := range shishas {
+			if got, _ := s.GetShisha(ctx, sh.ID); got.Manufacturer != into {
+				t.Fatalf("shisha %d not moved: %+v", sh.ID, got.Manufacturer)
+			}
+		}
+		if list, _ := s.ListManufacturers(ctx); !reflect.DeepEqual(list, []Manufacturer{into}) {
+			t.Fatalf("merged manufacturers not deleted: %+v", list)
+		}
+		if report, err := s.NormalizeManufacturers(ctx); err != nil || len(report) != 0 {
+			t.Fatalf("NormalizeManufacturers on clean data: got %+v (%v)", report, err)
+		}
+	})
+
+	t.Run("CanceledContext", func(t *testing.T) {
+		s := newStorage(t)
+		created := mustCreate(t, s, "Mint")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := s.ListShishas(ctx, ListOptions{}); !errors.Is(err, context.Canceled) {
+			t.Errorf("ListShishas: expected context.Canceled, got %v", err)
+		}
+		if err := s.AddSmoked(ctx, created.ID); !errors.Is(err, context.Canceled) {
+			t.Errorf("AddSmoked: expected context.Canceled, got %v", err)
+		}
+	})
+
+	t.Run("HealthAndInfo", func(t *testing.T) {
+		ctx := context.Background()
+		s := newStorage(t)
+
+		if err := s.Health(ctx); err != nil {
+			t.Fatalf("Health: %v", err)
+		}
+		info, err := s.DBInfo(ctx)
+		if err != nil {
+			t.Fatalf("DBInfo: %v", err)
+		}
+		if info == nil || info.Nodes < 1 {
+			t.Fatalf("DBInfo: unexpected %+v", info)
+		}
+		// a freshly set up database has everything readiness checks for
+		if sc, ok := s.(SetupChecker); ok {
+			if err := sc.CheckIndexes(ctx); err != nil {
+				t.Fatalf("CheckIndexes: %v", err)
+			}
+			if pending, err := sc.PendingMigrations(ctx); err != nil || len(pending) != 0 {
+				t.Fatalf("PendingMigrations: got %v (%v)", pending, err)
+			}
+		}
+	})
+}
+
+func mustCreate(t *testing.T, s Storage, name string) *Shisha {
+	t.Helper()
+	created, err := s.CreateShisha(context.Background(), &Shisha{Name: name})
+	if err != nil {
+		t.Fatalf("CreateShisha: %v", err)
+	}
+	return created
+}
+
+func TestConformance_Memory(t *testing.T) {
+	runConformance(t, func(t *testing.T) Storage {
+		return NewMemoryAdapter()
+	})
+}
+
+func TestConformance_SQLite(t *testing.T) {
+	runConformance(t, func(t *testing.T) Storage {
+		return newTestSQLiteAdapter(t, ":memory:")
+	})
+}
+
+func TestConformance_CouchDB(t *testing.T) {
+	defer func(d time.Duration) { conflictBackoff = d }(conflictBackoff)
+	conflictBackoff = time.Millisecond
+
+	runConformance(t, func(t *testing.T) Storage {
+		c, _ := newFakeCouchAdapter(t)
+		return c
+	})
+}
+
+// TestListShishas_KeysetCursor checks the cursors of the adapters that page in SQL or
+// memory: they continue after the last entry, not at an offset. CouchDB pages with its
+// own bookmarks.
+func TestListShishas_KeysetCursor(t *testing.T) {
+	for name, newStorage := range map[string]storageFactory{
+		"Memory": func(t *testing.T) Storage { return NewMemoryAdapter() },
+		"SQLite": func(t *testing.T) Storage { return newTestSQLiteAdapter(t, ":memory:") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newStorage(t)
+			created := make(map[string]*Shisha)
+			for _, n := range []string{"a", "b", "c", "d", "e"} {
+				created[n] = mustCreate(t, s, n)
+			}
+			// b and d share an average that is no exact decimal
+			for _, n := range []string{"b", "d"} {
+				for i, score := range []int{6, 7, 7} {
+					if err := s.AddRating(ctx, created[n].ID, fmt.Sprintf("user%d", i), score); err != nil {
+						t.Fatalf("AddRating: %v", err)
+					}
+				}
+			}
+			names := func(page *ShishaPage) []string {
+				out := make([]string, 0, len(page.Items))
+				for _, sh := range page.Items {
+					out = append(out, sh.Name)
+				}
+				return out
+			}
+
+			opts := ListOptions{Sort: SortName, Limit: 2}
+			first, err := s.ListShishas(ctx, opts)
+			if err != nil || !reflect.DeepEqual(names(first), []string{"a", "b"}) {
+				t.Fatalf("first page: %v (%v)", names(first), err)
+			}
+			// an entry of the first page disappears before the next page is read
+			if err := s.DeleteShisha(ctx, created["a"].ID); err != nil {
+				t.Fatalf("DeleteShisha: %v", err)
+			}
+			opts.Cursor = first.NextCursor
+			second, err := s.ListShishas(ctx, opts)
+			if err != nil || !reflect.DeepEqual(names(second), []string{"c", "d"}) {
+				t.Fatalf("second page after a delete: %v (%v)", names(second), err)
+			}
+
+			var got []string
+			opts = ListOptions{Sort: SortRating, Desc: true, Limit: 1}
+			for pages := 0; ; pages++ {
+				page, err := s.ListShishas(ctx, opts)
+				if err != nil {
+					t.Fatalf("ListShishas by rating: %v", err)
+				}
+				got = append(got, names(page)...)
+				if page.NextCursor == "" || pages > 5 {
+					break
+				}
+				opts.Cursor = page.NextCursor
+			}
+			if !reflect.DeepEqual(got, []string{"d", "b", "e", "c"}) {
+				t.Fatalf("pages by rating: got %v", got)
+			}
+
+			if _, err := s.ListShishas(ctx, ListOptions{Sort: SortSmoked, Limit: 1, Cursor: first.NextCursor}); !errors.Is(err, ErrValidation) {
+				t.Fatalf("cursor of another sort: expected ErrValidation, got %v", err)
+			}
+		})
+	}
+}
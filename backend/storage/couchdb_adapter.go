@@ -2,24 +2,39 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"reflect"
+	"regexp"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
 )
 
+// CouchResponseHook, when set, is called with the method and status code of every
+// CouchDB request, status 0 if no response arrived (metrics). Set it before creating
+// adapters.
+var CouchResponseHook func(method string, status int)
+
 // CouchAdapter implements Storage backed by CouchDB HTTP API.
 type CouchAdapter struct {
-	client  *http.Client
-	baseURL string
-	dbName  string
-	user    string
-	pass    string
+	client *http.Client
+	// transport is the connection pool of client, drained by Close
+	transport *http.Transport
+	baseURL   string
+	dbName    string
+	user      string
+	pass      string
 }
 
 // NewCouchAdapter creates adapter and ensures database exists.
@@ -43,24 +58,60 @@ func NewCouchAdapter(baseURL, user, pass, dbName string) (*CouchAdapter, error)
 			dbName = "shisha"
 		}
 	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
 	c := &CouchAdapter{
-		client:  &http.Client{Timeout: 10 * time.Second},
-		baseURL: baseURL,
-		dbName:  dbName,
-		user:    user,
-		pass:    pass,
-	}
+		client:    &http.Client{Timeout: 10 * time.Second, Transport: couchTransport(transport)},
+		transport: transport,
+		baseURL:   baseURL,
+		dbName:    dbName,
+		user:      user,
+		pass:      pass,
+	}
+	// setup runs once at startup; the client timeout bounds each request
+	ctx := context.Background()
 	// ensure DB exists
-	if err := c.ensureDB(); err != nil {
+	if err := c.ensureDB(ctx); err != nil {
 		return nil, err
 	}
-	// ensure required Mango indexes exist (needed for sorted _find used by nextID)
-	if err := c.ensureIndexes(); err != nil {
+	// ensure required Mango indexes exist (needed for sorted _find used by maxNumericID)
+	if err := c.ensureIndexes(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.ensureViews(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.migrate(ctx); err != nil {
 		return nil, err
 	}
 	return c, nil
 }
 
+// couchTransport traces every CouchDB request as a client span "couchdb <METHOD>" with
+// method, URL, path and status code as attributes. Without a tracer provider the spans
+// are no-ops.
+func couchTransport(base http.RoundTripper) http.RoundTripper {
+	// otelhttp hands the request to the inner transport with its span in the context
+	withPath := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("couchdb.path", r.URL.Path))
+		return base.RoundTrip(r)
+	})
+	return otelhttp.NewTransport(withPath,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "couchdb " + r.Method
+		}))
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// Close drops the idle connections to CouchDB. Call it once no request uses the adapter
+// anymore.
+func (c *CouchAdapter) Close() error {
+	c.transport.CloseIdleConnections()
+	return nil
+}
+
 func (c *CouchAdapter) url(path string) string {
 	// handle empty baseURL defensively (should not normally happen)
 	if c.baseURL == "" {
@@ -73,7 +124,7 @@ func (c *CouchAdapter) url(path string) string {
 	return c.baseURL + "/" + path
 }
 
-func (c *CouchAdapter) doRequest(method, path string, body interface{}) (*http.Response, error) {
+func (c *CouchAdapter) doRequest(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
 	var r io.Reader
 	if body != nil {
 		b, err := json.Marshal(body)
@@ -82,7 +133,7 @@ func (c *CouchAdapter) doRequest(method, path string, body interface{}) (*http.R
 		}
 		r = bytes.NewReader(b)
 	}
-	req, err := http.NewRequest(method, c.url(path), r)
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path), r)
 	if err != nil {
 		return nil, err
 	}
@@ -92,16 +143,64 @@ func (c *CouchAdapter) doRequest(method, path string, body interface{}) (*http.R
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	start := time.Now()
 	resp, err := c.client.Do(req)
+	if hook := CouchResponseHook; hook != nil {
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+		}
+		hook(method, status)
+	}
 	if err != nil {
+		if ctx.Err() == nil {
+			slog.WarnContext(ctx, "couchdb: request failed", "method", method, "path", path, "error", err)
+		}
 		return nil, err
 	}
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		c.logExchange(ctx, method, path, body, resp, time.Since(start))
+	}
 	return resp, nil
 }
 
-func (c *CouchAdapter) ensureDB() error {
+// maxLoggedBody bounds the CouchDB bodies written to the debug log.
+const maxLoggedBody = 4 << 10
+
+// loggedSecrets matches the hash fields of user and token documents, wherever they occur
+// in a body (single documents, _find results, _bulk_docs).
+var loggedSecrets = regexp.MustCompile(`"(passwordHash|secretHash)"\s*:\s*"(?:[^"\\]|\\.)*"`)
+
+// logExchange writes a CouchDB request and its response to the debug log. The bodies
+// hold user content and are never logged at higher levels; password and token hashes
+// are masked. The response body is read and replaced by an in-memory copy.
+func (c *CouchAdapter) logExchange(ctx context.Context, method, path string, body interface{}, resp *http.Response, elapsed time.Duration) {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	if err != nil {
+		slog.DebugContext(ctx, "couchdb: reading response failed", "method", method, "path", path, "error", err)
+	}
+	slog.DebugContext(ctx, "couchdb: request", "method", method, "path", path, "status", resp.StatusCode,
+		"duration_ms", elapsed.Seconds()*1000, "request_body", loggedBody(reqBody), "response_body", loggedBody(respBody))
+}
+
+// loggedBody prepares a body for the log: hashes masked, length bounded.
+func loggedBody(b []byte) string {
+	b = loggedSecrets.ReplaceAll(b, []byte(`"$1":"[redacted]"`))
+	if len(b) > maxLoggedBody {
+		return string(b[:maxLoggedBody]) + "...(truncated)"
+	}
+	return string(b)
+}
+
+func (c *CouchAdapter) ensureDB(ctx context.Context) error {
 	// PUT /{db}
-	resp, err := c.doRequest("PUT", c.dbName, nil)
+	resp, err := c.doRequest(ctx, "PUT", c.dbName, nil)
 	if err != nil {
 		return err
 	}
@@ -114,41 +213,95 @@ func (c *CouchAdapter) ensureDB() error {
 	return fmt.Errorf("ensureDB failed: %s: %s", resp.Status, string(b))
 }
 
+// couchIndexes lists the Mango indexes used by the adapter. idx_type_id_desc serves the
+// id-sorted lookups (maxNumericID, default listing); the others back the sort options
+// of ListShishas. CouchDB only uses an index for sorting when every sort field is part
+// of it, hence one index per sort field next to "type".
+var couchIndexes = []struct {
+	name   string
+	fields []interface{}
+}{
+	// CouchDB requires a single sort direction for all fields in a multi-field sort.
+	// Both fields are descending to match maxNumericID() which sorts by id desc.
+	{"idx_type_id_desc", []interface{}{map[string]string{"type": "desc"}, map[string]string{"id": "desc"}}},
+	{"idx_type_name", []interface{}{"type", "name"}},
+	{"idx_type_manufacturer", []interface{}{"type", "manufacturer.name"}},
+	{"idx_type_smoked", []interface{}{"type", "smoked"}},
+	{"idx_type_rating", []interface{}{"type", "ratingAvg"}},
+	// manufacturer lookups by name and the shishas referencing a manufacturer
+	{"idx_type_name_key", []interface{}{"type", "nameKey"}},
+	{"idx_type_manufacturer_id", []interface{}{"type", "manufacturer.id"}},
+}
+
 // ensureIndexes creates necessary Mango indexes used by the adapter. It's safe to call
 // repeatedly; if the index already exists CouchDB will return a non-error response.
-func (c *CouchAdapter) ensureIndexes() error {
-	// Create a Mango index suitable for sorting by "id" (desc) while selecting by "type".
-	// CouchDB requires a single sort direction for all fields in a multi-field sort.
-	// Create an index with both fields descending to match nextID() which sorts by id desc.
-	idx := map[string]interface{}{
-		"index": map[string]interface{}{
-			"fields": []interface{}{
-				map[string]string{"type": "desc"},
-				map[string]string{"id": "desc"},
-			},
-		},
-		"name": "idx_type_id_desc",
-		"type": "json",
-		"ddoc": "ddoc_idx_type_id_desc",
+func (c *CouchAdapter) ensureIndexes(ctx context.Context) error {
+	for _, ix := range couchIndexes {
+		idx := map[string]interface{}{
+			"index": map[string]interface{}{"fields": ix.fields},
+			"name":  ix.name,
+			"type":  "json",
+			"ddoc":  "ddoc_" + ix.name,
+		}
+		resp, err := c.doRequest(ctx, "POST", c.dbName+"/_index", idx)
+		if err != nil {
+			return err
+		}
+		// Accept 200/201 as success. For other 4xx/5xx return error.
+		if resp.StatusCode >= 400 {
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return fmt.Errorf("ensureIndexes %s failed: %s: %s", ix.name, resp.Status, string(b))
+		}
+		resp.Body.Close()
 	}
-	resp, err := c.doRequest("POST", c.dbName+"/_index", idx)
-	if err != nil {
+	return nil
+}
+
+var _ SetupChecker = (*CouchAdapter)(nil)
+
+// CheckIndexes verifies that the Mango indexes and the ratings view created at startup
+// are present and current.
+func (c *CouchAdapter) CheckIndexes(ctx context.Context) error {
+	var out struct {
+		Indexes []struct {
+			Name string `json:"name"`
+		} `json:"indexes"`
+	}
+	if err := c.getJSONDoc(ctx, "CheckIndexes", c.dbName+"/_index", &out); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	// Accept 200/201 as success. For other 4xx/5xx return error.
-	if resp.StatusCode >= 400 {
-		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("ensureIndexes failed: %s: %s", resp.Status, string(b))
+	have := make(map[string]bool, len(out.Indexes))
+	for _, ix := range out.Indexes {
+		have[ix.Name] = true
+	}
+	var missing []string
+	for _, ix := range couchIndexes {
+		if !have[ix.name] {
+			missing = append(missing, ix.name)
+		}
+	}
+	var design couchDesignDoc
+	err := c.getJSONDoc(ctx, "CheckIndexes", c.dbName+"/"+couchRatingsDesignID, &design)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		missing = append(missing, couchRatingsDesignID)
+	case err != nil:
+		return err
+	case !reflect.DeepEqual(design.Views, couchRatingsDesign.Views):
+		missing = append(missing, couchRatingsDesignID+" (outdated)")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
 	}
 	return nil
 }
 
 // Health checks connectivity to the CouchDB instance/cluster.
 // It first tries the CouchDB _up endpoint (if supported) and falls back to a GET /.
-func (c *CouchAdapter) Health() error {
+func (c *CouchAdapter) Health(ctx context.Context) error {
 	// try _up endpoint which is available in many CouchDB setups
-	resp, err := c.doRequest("GET", "_up", nil)
+	resp, err := c.doRequest(ctx, "GET", "_up", nil)
 	if err == nil {
 		defer resp.Body.Close()
 		if resp.StatusCode == http.StatusOK {
@@ -159,7 +312,7 @@ func (c *CouchAdapter) Health() error {
 		return fmt.Errorf("couchdb _up returned: %s: %s", resp.Status, string(b))
 	}
 	// fallback: attempt simple GET to base DB root
-	resp2, err2 := c.doRequest("GET", "", nil)
+	resp2, err2 := c.doRequest(ctx, "GET", "", nil)
 	if err2 != nil {
 		return err2
 	}
@@ -180,13 +333,72 @@ type couchShishaDoc struct {
 	Name         string       `json:"name"`
 	Flavor       string       `json:"flavor"`
 	Manufacturer Manufacturer `json:"manufacturer"`
-	Smoked       int          `json:"smoked,omitempty"`
-	Ratings      []Rating     `json:"ratings,omitempty"`
-	Comments     []Comment    `json:"comments,omitempty"`
+	// Smoked and RatingAvg are always written: Mango sorts skip docs missing the field.
+	Smoked    int       `json:"smoked"`
+	RatingAvg float64   `json:"ratingAvg"`
+	Ratings   []Rating  `json:"ratings,omitempty"`
+	Comments  []Comment `json:"comments,omitempty"`
+}
+
+// newShishaDoc builds the document for a new shisha stored under id.
+func newShishaDoc(id uint, s *Shisha) *couchShishaDoc {
+	doc := &couchShishaDoc{
+		DocID:        shishaDocID(id),
+		Type:         "shisha",
+		ID:           id,
+		Name:         s.Name,
+		Flavor:       s.Flavor,
+		Manufacturer: s.Manufacturer,
+		Smoked:       s.Smoked,
+		Ratings:      s.Ratings,
+		Comments:     numberComments(s.Comments),
+	}
+	doc.refreshDerived()
+	return doc
+}
+
+// refreshDerived recomputes the fields derived from the ratings before a write.
+func (d *couchShishaDoc) refreshDerived() {
+	d.RatingAvg = averageScore(d.Ratings)
 }
 
-// helper: find doc by numeric id via _find
-func (c *CouchAdapter) findByNumericID(id uint) (*couchShishaDoc, error) {
+func (d *couchShishaDoc) toShisha() Shisha {
+	return Shisha{
+		ID:           d.ID,
+		Name:         d.Name,
+		Flavor:       d.Flavor,
+		Manufacturer: d.Manufacturer,
+		Smoked:       d.Smoked,
+		Ratings:      d.Ratings,
+		Comments:     d.Comments,
+	}
+}
+
+// findByNumericID loads the shisha doc with the given numeric id. Docs created by this
+// adapter live under the deterministic _id "shisha:<id>"; older docs with generated
+// _ids are located through a Mango _find on the numeric id field.
+func (c *CouchAdapter) findByNumericID(ctx context.Context, id uint) (*couchShishaDoc, error) {
+	resp, err := c.doRequest(ctx, "GET", c.dbName+"/"+shishaDocID(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		var doc couchShishaDoc
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return nil, err
+		}
+		return &doc, nil
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("findByNumericID failed: %s: %s", resp.Status, string(b))
+	}
+	return c.findLegacyByNumericID(ctx, id)
+}
+
+// findLegacyByNumericID looks up docs created before deterministic _ids were introduced.
+func (c *CouchAdapter) findLegacyByNumericID(ctx context.Context, id uint) (*couchShishaDoc, error) {
 	selector := map[string]interface{}{
 		"selector": map[string]interface{}{
 			"type": "shisha",
@@ -194,7 +406,7 @@ func (c *CouchAdapter) findByNumericID(id uint) (*couchShishaDoc, error) {
 		},
 		"limit": 1,
 	}
-	resp, err := c.doRequest("POST", c.dbName+"/_find", selector)
+	resp, err := c.doRequest(ctx, "POST", c.dbName+"/_find", selector)
 	if err != nil {
 		return nil, err
 	}
@@ -215,123 +427,250 @@ func (c *CouchAdapter) findByNumericID(id uint) (*couchShishaDoc, error) {
 	return &out.Docs[0], nil
 }
 
-func (c *CouchAdapter) ListShishas() ([]Shisha, error) {
-	log.Printf("couchdb ListShishas: starting _find db=%s", c.dbName)
-	// Use _find with selector type=shisha
+// couchSortFields maps ListOptions sort keys to document fields (see couchIndexes).
+var couchSortFields = map[string]string{
+	SortID:           "id",
+	SortName:         "name",
+	SortManufacturer: "manufacturer.name",
+	SortSmoked:       "smoked",
+	SortRating:       "ratingAvg",
+}
+
+// couchPageSize is the batch size used when a caller asks for every entry.
+const couchPageSize = 500
+
+// ListShishas reads whole documents. The per-item rating stats are computed from the
+// ratings embedded in them (withStats) rather than from the _design/ratings view: the
+// documents are read anyway, so this costs no request, and it matches the revision
+// returned, while the view is only brought up to date on the next query and a page would
+// need one grouped range query per shisha. The view serves RatingStats and the
+// catalogue totals, which would otherwise read every document.
+func (c *CouchAdapter) ListShishas(ctx context.Context, opts ListOptions) (*ShishaPage, error) {
+	opts, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	totals, err := c.ratingTotals(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Limit > 0 {
+		page, err := c.findPage(ctx, opts, opts.Limit, opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		withStats(page.Items, totals)
+		return page, nil
+	}
+	// no limit requested: follow bookmarks until CouchDB runs out of documents
+	page := &ShishaPage{Items: make([]Shisha, 0)}
+	cursor := opts.Cursor
+	for {
+		p, err := c.findPage(ctx, opts, couchPageSize, cursor)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, p.Items...)
+		if p.NextCursor == "" {
+			withStats(page.Items, totals)
+			return page, nil
+		}
+		cursor = p.NextCursor
+	}
+}
+
+// findPage runs one Mango _find for opts; the cursor is CouchDB's bookmark.
+func (c *CouchAdapter) findPage(ctx context.Context, opts ListOptions, limit int, bookmark string) (*ShishaPage, error) {
+	field := couchSortFields[opts.Sort]
+	dir := "asc"
+	if opts.Desc {
+		dir = "desc"
+	}
 	selector := map[string]interface{}{
-		"selector": map[string]interface{}{
-			"type": "shisha",
-		},
-		"limit": 1000,
+		"type": "shisha",
+		// referencing the sort field lets CouchDB pick the matching index
+		field: map[string]interface{}{"$gt": nil},
 	}
-	resp, err := c.doRequest("POST", c.dbName+"/_find", selector)
+	if opts.Manufacturer != "" {
+		selector["manufacturer.name"] = map[string]interface{}{"$regex": "(?i)^" + regexp.QuoteMeta(opts.Manufacturer) + "$"}
+	}
+	if opts.Flavor != "" {
+		selector["flavor"] = map[string]interface{}{"$regex": "(?i)" + regexp.QuoteMeta(opts.Flavor)}
+	}
+	query := map[string]interface{}{
+		"selector": selector,
+		"sort":     []map[string]string{{"type": dir}, {field: dir}},
+		"limit":    limit,
+	}
+	if bookmark != "" {
+		query["bookmark"] = bookmark
+	}
+	resp, err := c.doRequest(ctx, "POST", c.dbName+"/_find", query)
 	if err != nil {
-		log.Printf("couchdb ListShishas: request error: %v", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
 		b, _ := io.ReadAll(resp.Body)
-		log.Printf("couchdb ListShishas: _find failed status=%s body=%s", resp.Status, string(b))
+		slog.WarnContext(ctx, "couchdb: ListShishas _find failed", "status", resp.StatusCode)
+		if resp.StatusCode == http.StatusBadRequest && bookmark != "" {
+			return nil, fmt.Errorf("%w: invalid cursor", ErrValidation)
+		}
 		return nil, fmt.Errorf("ListShishas _find failed: %s: %s", resp.Status, string(b))
 	}
 	var out struct {
-		Docs []couchShishaDoc `json:"docs"`
+		Docs     []couchShishaDoc `json:"docs"`
+		Bookmark string           `json:"bookmark"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		log.Printf("couchdb ListShishas: decode error: %v", err)
+		slog.WarnContext(ctx, "couchdb: ListShishas decode failed", "error", err)
 		return nil, err
 	}
-	res := make([]Shisha, 0, len(out.Docs))
-	for _, d := range out.Docs {
-		res = append(res, Shisha{
-			ID:           d.ID,
-			Name:         d.Name,
-			Flavor:       d.Flavor,
-			Manufacturer: d.Manufacturer,
-			Smoked:       d.Smoked,
-			Ratings:      d.Ratings,
-			Comments:     d.Comments,
-		})
+	page := &ShishaPage{Items: make([]Shisha, 0, len(out.Docs))}
+	for i := range out.Docs {
+		page.Items = append(page.Items, out.Docs[i].toShisha())
+	}
+	// a short page means CouchDB has nothing left behind the bookmark
+	if len(out.Docs) == limit {
+		page.NextCursor = out.Bookmark
 	}
-	log.Printf("couchdb ListShishas: returning %d docs", len(res))
-	return res, nil
+	return page, nil
 }
 
-func (c *CouchAdapter) GetShisha(id uint) (*Shisha, error) {
-	doc, err := c.findByNumericID(id)
+func (c *CouchAdapter) GetShisha(ctx context.Context, id uint) (*Shisha, error) {
+	doc, err := c.findByNumericID(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 	if doc == nil {
+		return nil, fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+	}
+	s := doc.toShisha()
+	if err := c.fillStats(ctx, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// shishaDocID returns the deterministic CouchDB _id for a numeric shisha id. Because
+// CouchDB rejects a second PUT of the same _id, two replicas can never both persist
+// a shisha under the same numeric id.
+func shishaDocID(id uint) string {
+	return fmt.Sprintf("shisha:%d", id)
+}
+
+// shishaCounterDocID is the _id of the document holding the last allocated shisha id.
+const shishaCounterDocID = "counter:shisha"
+
+// couchSequence is a numeric id sequence: the counter document and the document type
+// whose highest stored id seeds the counter on first use.
+type couchSequence struct {
+	counterDocID string
+	docType      string
+}
+
+var (
+	shishaSequence       = couchSequence{counterDocID: shishaCounterDocID, docType: "shisha"}
+	manufacturerSequence = couchSequence{counterDocID: "counter:manufacturer", docType: "manufacturer"}
+)
+
+// couchCounterDoc stores the last allocated numeric id. It is updated with _rev
+// compare-and-swap so concurrent allocations across backend replicas never collide.
+type couchCounterDoc struct {
+	DocID string `json:"_id"`
+	Rev   string `json:"_rev,omitempty"`
+	Type  string `json:"type"`
+	Value uint   `json:"value"`
+}
+
+// maxAllocAttempts bounds id allocation retries; allocation contention is expected to be
+// higher than for single-document updates, so it gets more room than maxConflictRetries.
+const maxAllocAttempts = 10
+
+// allocateID reserves the next numeric shisha id by incrementing the counter document.
+// The first allocation seeds the counter from the highest id already stored.
+func (c *CouchAdapter) allocateID(ctx context.Context) (uint, error) {
+	return c.allocateIDs(ctx, shishaSequence, 1)
+}
+
+// allocateIDs reserves n consecutive ids of seq with a single counter update and returns
+// the first one.
+func (c *CouchAdapter) allocateIDs(ctx context.Context, seq couchSequence, n uint) (uint, error) {
+	for attempt := 0; attempt < maxAllocAttempts; attempt++ {
+		counter, err := c.getCounter(ctx, seq)
+		if err != nil {
+			return 0, err
+		}
+		if counter == nil {
+			max, err := c.maxNumericID(ctx, seq.docType)
+			if err != nil {
+				return 0, err
+			}
+			counter = &couchCounterDoc{DocID: seq.counterDocID, Type: "counter", Value: max}
+		}
+		counter.Value += n
+		resp, err := c.doRequest(ctx, "PUT", c.dbName+"/"+seq.counterDocID, counter)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusConflict {
+			if err := sleepCtx(ctx, backoffDelay(attempt)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if resp.StatusCode >= 400 {
+			return 0, fmt.Errorf("allocateID failed: %s", resp.Status)
+		}
+		return counter.Value - n + 1, nil
+	}
+	return 0, fmt.Errorf("allocateID: %w", ErrConflict)
+}
+
+// getCounter fetches the counter document of seq; nil means it has not been created yet.
+func (c *CouchAdapter) getCounter(ctx context.Context, seq couchSequence) (*couchCounterDoc, error) {
+	resp, err := c.doRequest(ctx, "GET", c.dbName+"/"+seq.counterDocID, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
 		return nil, nil
 	}
-	s := &Shisha{
-		ID:           doc.ID,
-		Name:         doc.Name,
-		Flavor:       doc.Flavor,
-		Manufacturer: doc.Manufacturer,
-		Smoked:       doc.Smoked,
-		Ratings:      doc.Ratings,
-		Comments:     doc.Comments,
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("getCounter failed: %s: %s", resp.Status, string(b))
 	}
-	return s, nil
+	var doc couchCounterDoc
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
 }
 
-// helper to find highest numeric id to allocate next id
-func (c *CouchAdapter) nextID() (uint, error) {
-	// selector type=shisha sort by id desc limit 1
+// maxNumericID returns the highest id of the docs of docType (0 if there are none).
+// It relies on the idx_type_id_desc index created by ensureIndexes.
+func (c *CouchAdapter) maxNumericID(ctx context.Context, docType string) (uint, error) {
 	payload := map[string]interface{}{
 		"selector": map[string]interface{}{
-			"type": "shisha",
+			"type": docType,
 		},
 		"sort": []map[string]string{
+			{"type": "desc"},
 			{"id": "desc"},
 		},
-		"limit": 1,
+		"fields": []string{"id"},
+		"limit":  1,
 	}
-	resp, err := c.doRequest("POST", c.dbName+"/_find", payload)
+	resp, err := c.doRequest(ctx, "POST", c.dbName+"/_find", payload)
 	if err != nil {
 		return 0, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		// Read body and detect common CouchDB error indicating missing/unsuitable index.
 		b, _ := io.ReadAll(resp.Body)
-		bodyStr := string(b)
-		// If error indicates no usable index, fall back to scanning all docs (safer for bootstrapping).
-		if strings.Contains(bodyStr, "no_usable_index") || strings.Contains(bodyStr, "No index exists") {
-			// Fallback: GET _all_docs?include_docs=true and scan numeric id fields.
-			ar, err := c.doRequest("GET", c.dbName+"/_all_docs?include_docs=true", nil)
-			if err != nil {
-				return 0, err
-			}
-			defer ar.Body.Close()
-			if ar.StatusCode >= 400 {
-				b2, _ := io.ReadAll(ar.Body)
-				return 0, fmt.Errorf("nextID fallback _all_docs failed: %s: %s", ar.Status, string(b2))
-			}
-			var all struct {
-				TotalRows int `json:"total_rows"`
-				Rows      []struct {
-					Doc couchShishaDoc `json:"doc"`
-				} `json:"rows"`
-			}
-			if err := json.NewDecoder(ar.Body).Decode(&all); err != nil {
-				return 0, err
-			}
-			max := uint(0)
-			for _, r := range all.Rows {
-				if r.Doc.ID > max {
-					max = r.Doc.ID
-				}
-			}
-			if max == 0 {
-				return 1, nil
-			}
-			return max + 1, nil
-		}
-		return 0, fmt.Errorf("nextID _find failed: %s: %s", resp.Status, bodyStr)
+		return 0, fmt.Errorf("maxNumericID _find failed: %s: %s", resp.Status, string(b))
 	}
 	var out struct {
 		Docs []couchShishaDoc `json:"docs"`
@@ -340,89 +679,278 @@ func (c *CouchAdapter) nextID() (uint, error) {
 		return 0, err
 	}
 	if len(out.Docs) == 0 {
-		return 1, nil
+		return 0, nil
 	}
-	return out.Docs[0].ID + 1, nil
+	return out.Docs[0].ID, nil
 }
 
-func (c *CouchAdapter) CreateShisha(s *Shisha) (*Shisha, error) {
-	if s == nil {
-		return nil, errors.New("nil shisha")
+func (c *CouchAdapter) CreateShisha(ctx context.Context, s *Shisha) (*Shisha, error) {
+	if err := validateShisha(s); err != nil {
+		return nil, err
 	}
-	nid, err := c.nextID()
+	mf, err := c.resolveManufacturer(ctx, s.Manufacturer, false)
 	if err != nil {
 		return nil, err
 	}
-	s.ID = nid
-	doc := couchShishaDoc{
-		Type:         "shisha",
-		ID:           s.ID,
-		Name:         s.Name,
-		Flavor:       s.Flavor,
-		Manufacturer: s.Manufacturer,
-		Smoked:       s.Smoked,
-		Ratings:      s.Ratings,
-		Comments:     s.Comments,
+	s.Manufacturer = mf
+	s.Comments = numberComments(s.Comments)
+	for attempt := 0; attempt < maxAllocAttempts; attempt++ {
+		nid, err := c.allocateID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = c.putDoc(ctx, "CreateShisha", newShishaDoc(nid, s))
+		if errors.Is(err, ErrConflict) {
+			// the _id is already taken (e.g. counter was reset); allocate the next one
+			slog.InfoContext(ctx, "couchdb: id already in use, allocating another", "op", "CreateShisha", "id", nid)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.ID = nid
+		if err := c.fillStats(ctx, s); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("CreateShisha: %w", ErrConflict)
+}
+
+// CreateShishas reserves a block of ids and writes all valid items with one _bulk_docs
+// request. Items whose _id turns out to be taken are retried one by one via CreateShisha.
+func (c *CouchAdapter) CreateShishas(ctx context.Context, items []Shisha) ([]BatchResult, error) {
+	results := make([]BatchResult, len(items))
+	var valid []int
+	// the copy receives the resolved manufacturers without touching the caller's items
+	items = append([]Shisha(nil), items...)
+	resolve := c.manufacturerResolver(false)
+	for i := range items {
+		if err := validateShisha(&items[i]); err != nil {
+			results[i].Err = err
+			continue
+		}
+		mf, err := resolve(ctx, items[i].Manufacturer)
+		if errors.Is(err, ErrValidation) {
+			results[i].Err = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items[i].Manufacturer = mf
+		valid = append(valid, i)
+	}
+	if len(valid) == 0 {
+		return results, nil
 	}
-	resp, err := c.doRequest("POST", c.dbName, doc)
+	first, err := c.allocateIDs(ctx, shishaSequence, uint(len(valid)))
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		b, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("CreateShisha failed: %s: %s", resp.Status, string(b))
+	docs := make([]interface{}, 0, len(valid))
+	for k, i := range valid {
+		docs = append(docs, newShishaDoc(first+uint(k), &items[i]))
 	}
-	// success, return created
-	return s, nil
+	out, err := c.bulkDocs(ctx, docs)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != len(docs) {
+		return nil, fmt.Errorf("_bulk_docs returned %d results for %d docs", len(out), len(docs))
+	}
+	for k, i := range valid {
+		switch r := out[k]; r.Error {
+		case "":
+			s := docs[k].(*couchShishaDoc).toShisha()
+			results[i].Shisha = &s
+		case "conflict":
+			s := items[i]
+			results[i].Shisha, results[i].Err = c.CreateShisha(ctx, &s)
+		default:
+			results[i].Err = fmt.Errorf("create %s: %s: %s", r.ID, r.Error, r.Reason)
+		}
+	}
+	if err := c.fillResultStats(ctx, results); err != nil {
+		return nil, err
+	}
+	return results, nil
 }
 
-func (c *CouchAdapter) UpdateShisha(id uint, s *Shisha) (*Shisha, error) {
-	if s == nil {
-		return nil, errors.New("nil shisha")
+// RestoreShishas writes items under their own ids with one _bulk_docs request and then
+// raises the id counter so later creates continue after the restored ids.
+func (c *CouchAdapter) RestoreShishas(ctx context.Context, items []Shisha) ([]BatchResult, error) {
+	results := make([]BatchResult, len(items))
+	var valid []int
+	var docs []interface{}
+	seen := make(map[uint]bool, len(items))
+	var maxID uint
+	items = append([]Shisha(nil), items...)
+	resolve := c.manufacturerResolver(true)
+	for i := range items {
+		if err := validateRestore(&items[i]); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if seen[items[i].ID] {
+			results[i].Err = fmt.Errorf("shisha %d: %w", items[i].ID, ErrConflict)
+			continue
+		}
+		mf, err := resolve(ctx, items[i].Manufacturer)
+		if errors.Is(err, ErrValidation) {
+			results[i].Err = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items[i].Manufacturer = mf
+		seen[items[i].ID] = true
+		if items[i].ID > maxID {
+			maxID = items[i].ID
+		}
+		valid = append(valid, i)
+		docs = append(docs, newShishaDoc(items[i].ID, &items[i]))
+	}
+	if len(docs) == 0 {
+		return results, nil
 	}
-	doc, err := c.findByNumericID(id)
+	out, err := c.bulkDocs(ctx, docs)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != len(docs) {
+		return nil, fmt.Errorf("_bulk_docs returned %d results for %d docs", len(out), len(docs))
+	}
+	for k, i := range valid {
+		switch r := out[k]; r.Error {
+		case "":
+			s := docs[k].(*couchShishaDoc).toShisha()
+			results[i].Shisha = &s
+		case "conflict":
+			results[i].Err = fmt.Errorf("shisha %d: %w", items[i].ID, ErrConflict)
+		default:
+			results[i].Err = fmt.Errorf("restore %s: %s: %s", r.ID, r.Error, r.Reason)
+		}
+	}
+	if err := c.raiseCounter(ctx, shishaSequence, maxID); err != nil {
+		return nil, err
+	}
+	if err := c.fillResultStats(ctx, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// raiseCounter makes sure the counter of seq is at least id. Without a counter doc
+// nothing needs to be done: the first allocation seeds it from the highest stored id.
+func (c *CouchAdapter) raiseCounter(ctx context.Context, seq couchSequence, id uint) error {
+	for attempt := 0; attempt < maxAllocAttempts; attempt++ {
+		counter, err := c.getCounter(ctx, seq)
+		if err != nil {
+			return err
+		}
+		if counter == nil || counter.Value >= id {
+			return nil
+		}
+		counter.Value = id
+		resp, err := c.doRequest(ctx, "PUT", c.dbName+"/"+seq.counterDocID, counter)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusConflict {
+			if err := sleepCtx(ctx, backoffDelay(attempt)); err != nil {
+				return err
+			}
+			continue
+		}
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("raiseCounter failed: %s", resp.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("raiseCounter: %w", ErrConflict)
+}
+
+func (c *CouchAdapter) UpdateShisha(ctx context.Context, id uint, s *Shisha) (*Shisha, error) {
+	if err := validateShisha(s); err != nil {
+		return nil, err
+	}
+	mf, err := c.resolveManufacturer(ctx, s.Manufacturer, false)
+	if err != nil {
+		return nil, err
+	}
+	var out Shisha
+	err = c.updateDoc(ctx, id, "UpdateShisha", func(doc *couchShishaDoc) error {
+		doc.Name = s.Name
+		doc.Flavor = s.Flavor
+		doc.Manufacturer = mf
+		out = doc.toShisha()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.fillStats(ctx, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *CouchAdapter) ReplaceShisha(ctx context.Context, id uint, s *Shisha) (*Shisha, error) {
+	if err := validateStored(s); err != nil {
+		return nil, err
+	}
+	doc, err := c.findByNumericID(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 	if doc == nil {
-		return nil, errors.New("not found")
+		return nil, fmt.Errorf("shisha %d: %w", id, ErrNotFound)
 	}
+	mf, err := c.resolveManufacturer(ctx, s.Manufacturer, false)
+	if err != nil {
+		return nil, err
+	}
+	s.Manufacturer = mf
 	// update fields and PUT doc
 	doc.Name = s.Name
 	doc.Flavor = s.Flavor
 	doc.Manufacturer = s.Manufacturer
 	doc.Smoked = s.Smoked
 	doc.Ratings = s.Ratings
-	doc.Comments = s.Comments
+	doc.Comments = numberComments(s.Comments)
+	s.Comments = doc.Comments
 
-	path := fmt.Sprintf("%s/%s", c.dbName, doc.DocID)
-	resp, err := c.doRequest("PUT", path, doc)
-	if err != nil {
+	// a full replacement is not retried: the caller's view of the document is stale
+	if err := c.putDoc(ctx, "ReplaceShisha", doc); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		b, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("UpdateShisha failed: %s: %s", resp.Status, string(b))
+	s.ID = id
+	if err := c.fillStats(ctx, s); err != nil {
+		return nil, err
 	}
 	return s, nil
 }
 
-func (c *CouchAdapter) DeleteShisha(id uint) error {
-	doc, err := c.findByNumericID(id)
+func (c *CouchAdapter) DeleteShisha(ctx context.Context, id uint) error {
+	doc, err := c.findByNumericID(ctx, id)
 	if err != nil {
 		return err
 	}
 	if doc == nil {
-		return nil
+		return fmt.Errorf("shisha %d: %w", id, ErrNotFound)
 	}
 	path := fmt.Sprintf("%s/%s?rev=%s", c.dbName, doc.DocID, doc.Rev)
-	resp, err := c.doRequest("DELETE", path, nil)
+	resp, err := c.doRequest(ctx, "DELETE", path, nil)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("DeleteShisha: %w", ErrConflict)
+	}
 	if resp.StatusCode >= 400 {
 		b, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("DeleteShisha failed: %s: %s", resp.Status, string(b))
@@ -430,79 +958,243 @@ func (c *CouchAdapter) DeleteShisha(id uint) error {
 	return nil
 }
 
-func (c *CouchAdapter) AddRating(id uint, user string, score int) error {
-	doc, err := c.findByNumericID(id)
+func (c *CouchAdapter) AddRating(ctx context.Context, id uint, user string, score int) error {
+	if err := validateRating(&user, score); err != nil {
+		return err
+	}
+	return c.updateDoc(ctx, id, "AddRating", func(doc *couchShishaDoc) error {
+		doc.Ratings = setRating(doc.Ratings, user, score, time.Now().Unix())
+		return nil
+	})
+}
+
+func (c *CouchAdapter) DeleteRating(ctx context.Context, id uint, user string) error {
+	user = strings.TrimSpace(user)
+	return c.updateDoc(ctx, id, "DeleteRating", func(doc *couchShishaDoc) error {
+		ratings, ok := removeRating(doc.Ratings, user)
+		if !ok {
+			return ratingNotFound(id, user)
+		}
+		doc.Ratings = ratings
+		return nil
+	})
+}
+
+func (c *CouchAdapter) AddComment(ctx context.Context, id uint, user, message string, parentID uint) (*Comment, error) {
+	if err := validateComment(&user, &message); err != nil {
+		return nil, err
+	}
+	var out Comment
+	err := c.updateDoc(ctx, id, "AddComment", func(doc *couchShishaDoc) error {
+		comments, cm, err := appendComment(doc.Comments, user, message, parentID, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		doc.Comments, out = comments, cm
+		return nil
+	})
 	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *CouchAdapter) UpdateComment(ctx context.Context, id, cid uint, author, message string) (*Comment, error) {
+	if err := validateMessage(&message); err != nil {
+		return nil, err
+	}
+	var out Comment
+	err := c.updateDoc(ctx, id, "UpdateComment", func(doc *couchShishaDoc) error {
+		var err error
+		out, err = editComment(doc.Comments, id, cid, author, message, time.Now().Unix())
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	if doc == nil {
-		return errors.New("not found")
+	return &out, nil
+}
+
+func (c *CouchAdapter) DeleteComment(ctx context.Context, id, cid uint, author string) error {
+	return c.updateDoc(ctx, id, "DeleteComment", func(doc *couchShishaDoc) error {
+		comments, err := removeComment(doc.Comments, id, cid, author)
+		if err != nil {
+			return err
+		}
+		doc.Comments = comments
+		return nil
+	})
+}
+
+func (c *CouchAdapter) AddSmoked(ctx context.Context, id uint) error {
+	return c.updateDoc(ctx, id, "AddSmoked", func(doc *couchShishaDoc) error {
+		doc.Smoked = doc.Smoked + 1
+		return nil
+	})
+}
+
+// maxConflictRetries bounds how often a read-modify-write is retried after CouchDB
+// rejected the PUT because the document's _rev changed underneath us.
+const maxConflictRetries = 5
+
+// conflictBackoff is the base delay between conflict retries; it doubles per attempt.
+var conflictBackoff = 20 * time.Millisecond
+
+// updateDoc loads the shisha doc with the given numeric id, applies mutate and PUTs it
+// back. A 409 (stale _rev) triggers a fresh read and another attempt with exponential
+// backoff plus jitter; once the retries are exhausted ErrConflict is returned. An error
+// from mutate aborts without writing.
+func (c *CouchAdapter) updateDoc(ctx context.Context, id uint, op string, mutate func(doc *couchShishaDoc) error) error {
+	for attempt := 0; ; attempt++ {
+		doc, err := c.findByNumericID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+		}
+		if err := mutate(doc); err != nil {
+			return err
+		}
+		err = c.putDoc(ctx, op, doc)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+		if attempt+1 >= maxConflictRetries {
+			slog.WarnContext(ctx, "couchdb: giving up after conflicting updates", "op", op, "id", id, "attempts", attempt+1)
+			return err
+		}
+		if err := sleepCtx(ctx, backoffDelay(attempt)); err != nil {
+			return err
+		}
 	}
-	r := Rating{User: user, Score: score, Timestamp: time.Now().Unix()}
-	doc.Ratings = append(doc.Ratings, r)
+}
+
+// putDoc writes doc with its current _rev. A 409 response is reported as ErrConflict.
+func (c *CouchAdapter) putDoc(ctx context.Context, op string, doc *couchShishaDoc) error {
+	doc.refreshDerived()
 	path := fmt.Sprintf("%s/%s", c.dbName, doc.DocID)
-	resp, err := c.doRequest("PUT", path, doc)
+	resp, err := c.doRequest(ctx, "PUT", path, doc)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("%s: %w", op, ErrConflict)
+	}
 	if resp.StatusCode >= 400 {
 		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("AddRating failed: %s: %s", resp.Status, string(b))
+		return fmt.Errorf("%s failed: %s: %s", op, resp.Status, string(b))
 	}
 	return nil
 }
 
-func (c *CouchAdapter) AddComment(id uint, user, message string) error {
-	doc, err := c.findByNumericID(id)
-	if err != nil {
-		return err
-	}
-	if doc == nil {
-		return errors.New("not found")
-	}
-	cm := Comment{User: user, Message: message}
-	doc.Comments = append(doc.Comments, cm)
-	path := fmt.Sprintf("%s/%s", c.dbName, doc.DocID)
-	resp, err := c.doRequest("PUT", path, doc)
+// backoffDelay returns the wait before retry number attempt+1: base * 2^attempt plus up to
+// 50% random jitter so that competing writers do not retry in lockstep.
+func backoffDelay(attempt int) time.Duration {
+	d := conflictBackoff << uint(attempt)
+	if d <= 0 {
+		return 0
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// couchBulkResult is one entry of a _bulk_docs response.
+type couchBulkResult struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// bulkDocs writes docs in a single _bulk_docs request. Per-document failures (e.g.
+// conflicts) are reported in the results, not as an error.
+func (c *CouchAdapter) bulkDocs(ctx context.Context, docs []interface{}) ([]couchBulkResult, error) {
+	resp, err := c.doRequest(ctx, "POST", c.dbName+"/_bulk_docs", map[string]interface{}{"docs": docs})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
 		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("AddComment failed: %s: %s", resp.Status, string(b))
+		return nil, fmt.Errorf("_bulk_docs failed: %s: %s", resp.Status, string(b))
 	}
-	return nil
+	var out []couchBulkResult
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
-func (c *CouchAdapter) AddSmoked(id uint) error {
-	doc, err := c.findByNumericID(id)
-	if err != nil {
-		return err
+// sleepCtx waits for d or until ctx is done, whichever comes first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
 	}
-	if doc == nil {
-		return errors.New("not found")
+}
+
+// couchSnapshotAttempts bounds how often Snapshot repeats a read that overlapped a write.
+const couchSnapshotAttempts = 3
+
+var _ Snapshotter = (*CouchAdapter)(nil)
+
+// Snapshot calls fn and checks that the update_seq of the database did not move while fn
+// ran. CouchDB has no read transactions across documents, so a read that overlapped a
+// write is repeated; ErrConflict reports that every attempt overlapped one.
+func (c *CouchAdapter) Snapshot(ctx context.Context, fn func(Storage) error) error {
+	for attempt := 1; ; attempt++ {
+		before, err := c.updateSeq(ctx)
+		if err != nil {
+			return err
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+		after, err := c.updateSeq(ctx)
+		if err != nil {
+			return err
+		}
+		if before == after {
+			return nil
+		}
+		if attempt == couchSnapshotAttempts {
+			return fmt.Errorf("%w: the database changed during each of %d reads", ErrConflict, attempt)
+		}
+		slog.InfoContext(ctx, "couchdb: database changed during a snapshot read, reading again", "attempt", attempt)
 	}
-	doc.Smoked = doc.Smoked + 1
-	path := fmt.Sprintf("%s/%s", c.dbName, doc.DocID)
-	resp, err := c.doRequest("PUT", path, doc)
+}
+
+// updateSeq returns the update_seq of the database, an opaque value that changes with
+// every document write.
+func (c *CouchAdapter) updateSeq(ctx context.Context) (string, error) {
+	resp, err := c.doRequest(ctx, "GET", c.dbName, nil)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
 		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("AddSmoked failed: %s: %s", resp.Status, string(b))
+		return "", fmt.Errorf("database info failed: %s: %s", resp.Status, string(b))
 	}
-	return nil
+	var info struct {
+		UpdateSeq json.RawMessage `json:"update_seq"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	return string(info.UpdateSeq), nil
 }
 
 // DBInfo returns basic information about the CouchDB instance/cluster.
 // It queries the _membership endpoint and falls back to counting all nodes if necessary.
-func (c *CouchAdapter) DBInfo() (*DBInfo, error) {
+func (c *CouchAdapter) DBInfo(ctx context.Context) (*DBInfo, error) {
 	// try _membership endpoint
-	resp, err := c.doRequest("GET", "_membership", nil)
+	resp, err := c.doRequest(ctx, "GET", "_membership", nil)
 	if err != nil {
 		// surface the error so caller knows why DBInfo failed
 		return nil, err
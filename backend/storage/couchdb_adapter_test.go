@@ -1,10 +1,19 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
 )
 
 func TestURLJoin(t *testing.T) {
@@ -31,6 +40,30 @@ func TestURLJoin(t *testing.T) {
 func TestNewCouchAdapter_EnsureDB(t *testing.T) {
 	// Mock CouchDB server that accepts PUT /shisha and returns 201
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// index creation runs right after the database check
+		if r.Method == http.MethodPost && r.URL.Path == "/shisha/_index" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		// the design doc of the rating views, then the data migrations, which find nothing
+		// to do in a new database
+		switch {
+		case r.URL.Path == "/shisha/_design/ratings" && r.Method == http.MethodGet:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case r.URL.Path == "/shisha/_design/ratings" && r.Method == http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+			return
+		case r.URL.Path == "/shisha/_local/shisha_migrations" && r.Method == http.MethodGet:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case r.URL.Path == "/shisha/_local/shisha_migrations" && r.Method == http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+			return
+		case r.URL.Path == "/shisha/_find":
+			_, _ = w.Write([]byte(`{"docs":[]}`))
+			return
+		}
 		if r.Method != http.MethodPut {
 			t.Fatalf("expected PUT method, got %s", r.Method)
 		}
@@ -65,3 +98,404 @@ func TestNewCouchAdapter_EnsureDB(t *testing.T) {
 		t.Fatalf("expected baseURL %q got %q", ts.URL, c.baseURL)
 	}
 }
+
+func TestAddRating_RetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	defer func(d time.Duration) { conflictBackoff = d }(conflictBackoff)
+	conflictBackoff = time.Millisecond
+
+	c, f := newFakeCouchAdapter(t)
+	s, err := c.CreateShisha(ctx, &Shisha{Name: "Mint"})
+	if err != nil {
+		t.Fatalf("CreateShisha: %v", err)
+	}
+	f.conflicts[shishaDocID(s.ID)] = 2
+
+	if err := c.AddRating(ctx, s.ID, "alice", 8); err != nil {
+		t.Fatalf("AddRating: %v", err)
+	}
+	got, err := c.GetShisha(ctx, s.ID)
+	if err != nil {
+		t.Fatalf("GetShisha: %v", err)
+	}
+	if len(got.Ratings) != 1 || got.Ratings[0].User != "alice" || got.Ratings[0].Score != 8 {
+		t.Fatalf("rating not persisted: %+v", got.Ratings)
+	}
+}
+
+func TestAddSmoked_ConflictExhausted(t *testing.T) {
+	ctx := context.Background()
+	defer func(d time.Duration) { conflictBackoff = d }(conflictBackoff)
+	conflictBackoff = time.Millisecond
+
+	c, f := newFakeCouchAdapter(t)
+	s, err := c.CreateShisha(ctx, &Shisha{Name: "Mint"})
+	if err != nil {
+		t.Fatalf("CreateShisha: %v", err)
+	}
+	f.conflicts[shishaDocID(s.ID)] = maxConflictRetries
+
+	if err := c.AddSmoked(ctx, s.ID); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	got, err := c.GetShisha(ctx, s.ID)
+	if err != nil {
+		t.Fatalf("GetShisha: %v", err)
+	}
+	if got.Smoked != 0 {
+		t.Fatalf("expected smoked to stay 0, got %d", got.Smoked)
+	}
+}
+
+func TestCreateShisha_ConcurrentReplicasGetDistinctIDs(t *testing.T) {
+	ctx := context.Background()
+	defer func(d time.Duration) { conflictBackoff = d }(conflictBackoff)
+	conflictBackoff = time.Millisecond
+
+	_, ts := newFakeCouch(t)
+	// two adapters simulate two backend pods sharing one database
+	replicas := make([]*CouchAdapter, 2)
+	for i := range replicas {
+		c, err := NewCouchAdapter(ts.URL, "", "", "shisha")
+		if err != nil {
+			t.Fatalf("NewCouchAdapter: %v", err)
+		}
+		replicas[i] = c
+	}
+
+	const perReplica = 5
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[uint]bool)
+	for _, c := range replicas {
+		for i := 0; i < perReplica; i++ {
+			wg.Add(1)
+			go func(c *CouchAdapter) {
+				defer wg.Done()
+				s, err := c.CreateShisha(ctx, &Shisha{Name: "Mint"})
+				if err != nil {
+					t.Errorf("CreateShisha: %v", err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if seen[s.ID] {
+					t.Errorf("id %d handed out twice", s.ID)
+				}
+				seen[s.ID] = true
+			}(c)
+		}
+	}
+	wg.Wait()
+	if len(seen) != 2*perReplica {
+		t.Fatalf("expected %d distinct ids, got %d", 2*perReplica, len(seen))
+	}
+}
+
+func TestCreateShisha_SeedsCounterFromLegacyDocs(t *testing.T) {
+	ctx := context.Background()
+	c, f := newFakeCouchAdapter(t)
+	// doc written by an older version with a server-generated _id
+	f.put(map[string]interface{}{"_id": "9f2c", "type": "shisha", "id": float64(41), "name": "Legacy"})
+
+	s, err := c.CreateShisha(ctx, &Shisha{Name: "New"})
+	if err != nil {
+		t.Fatalf("CreateShisha: %v", err)
+	}
+	if s.ID != 42 {
+		t.Fatalf("expected id 42, got %d", s.ID)
+	}
+	legacy, err := c.GetShisha(ctx, 41)
+	if err != nil || legacy == nil || legacy.Name != "Legacy" {
+		t.Fatalf("legacy lookup failed: %+v %v", legacy, err)
+	}
+}
+
+func TestCreateShisha_SkipsTakenDocID(t *testing.T) {
+	ctx := context.Background()
+	c, f := newFakeCouchAdapter(t)
+	f.put(map[string]interface{}{"_id": shishaCounterDocID, "type": "counter", "value": float64(0)})
+	f.put(map[string]interface{}{"_id": shishaDocID(1), "type": "shisha", "id": float64(1), "name": "Taken"})
+
+	s, err := c.CreateShisha(ctx, &Shisha{Name: "New"})
+	if err != nil {
+		t.Fatalf("CreateShisha: %v", err)
+	}
+	if s.ID != 2 {
+		t.Fatalf("expected id 2, got %d", s.ID)
+	}
+}
+
+func TestNewCouchAdapter_BackfillsSortFields(t *testing.T) {
+	ctx := context.Background()
+	f, ts := newFakeCouch(t)
+	// docs written before smoked and ratingAvg were always stored
+	f.put(map[string]interface{}{"_id": shishaDocID(1), "type": "shisha", "id": float64(1), "name": "Old",
+		"ratings": []interface{}{map[string]interface{}{"user": "alice", "score": float64(6)}}})
+	f.put(map[string]interface{}{"_id": shishaDocID(2), "type": "shisha", "id": float64(2), "name": "Older", "smoked": float64(3)})
+
+	c, err := NewCouchAdapter(ts.URL, "", "", f.db)
+	if err != nil {
+		t.Fatalf("NewCouchAdapter: %v", err)
+	}
+	if avg := f.docs[shishaDocID(1)]["ratingAvg"]; avg != float64(6) {
+		t.Fatalf("expected ratingAvg 6, got %v", avg)
+	}
+	if smoked, ok := f.docs[shishaDocID(1)]["smoked"]; !ok || smoked != float64(0) {
+		t.Fatalf("expected smoked 0, got %v", smoked)
+	}
+	if _, ok := f.docs[couchMigrationsDocID]; !ok {
+		t.Fatalf("migration not recorded")
+	}
+
+	page, err := c.ListShishas(ctx, ListOptions{Sort: SortSmoked, Desc: true})
+	if err != nil {
+		t.Fatalf("ListShishas: %v", err)
+	}
+	if len(page.Items) != 2 || page.Items[0].Name != "Older" {
+		t.Fatalf("legacy docs missing from sorted listing: %+v", page.Items)
+	}
+}
+
+func TestCreateShishas_RetriesTakenDocID(t *testing.T) {
+	ctx := context.Background()
+	c, f := newFakeCouchAdapter(t)
+	f.put(map[string]interface{}{"_id": shishaCounterDocID, "type": "counter", "value": float64(0)})
+	f.put(map[string]interface{}{"_id": shishaDocID(2), "type": "shisha", "id": float64(2), "name": "Taken"})
+
+	results, err := c.CreateShishas(ctx, []Shisha{{Name: "A"}, {Name: "B"}, {Name: "C"}})
+	if err != nil {
+		t.Fatalf("CreateShishas: %v", err)
+	}
+	got := make([]uint, 0, len(results))
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("CreateShishas item: %v", r.Err)
+		}
+		got = append(got, r.Shisha.ID)
+	}
+	// ids 1-3 are reserved in one go; B collides with the existing doc and gets id 4
+	if !reflect.DeepEqual(got, []uint{1, 4, 3}) {
+		t.Fatalf("unexpected ids %v", got)
+	}
+	if name := f.docs[shishaDocID(2)]["name"]; name != "Taken" {
+		t.Fatalf("existing doc overwritten: %v", name)
+	}
+}
+
+func TestNewCouchAdapter_AdoptsEmbeddedManufacturers(t *testing.T) {
+	ctx := context.Background()
+	f, ts := newFakeCouch(t)
+	// docs written while manufacturers only existed embedded in shishas
+	for i, name := range []string{"Al Fakher", "al fakher ", "Al Fakher", "Adalya"} {
+		id := i + 1
+		f.put(map[string]interface{}{"_id": shishaDocID(uint(id)), "type": "shisha", "id": float64(id), "name": "S",
+			"smoked": float64(0), "ratingAvg": float64(0),
+			"manufacturer": map[string]interface{}{"id": float64(0), "name": name}})
+	}
+
+	c, err := NewCouchAdapter(ts.URL, "", "", f.db)
+	if err != nil {
+		t.Fatalf("NewCouchAdapter: %v", err)
+	}
+	list, err := c.ListManufacturers(ctx)
+	if err != nil {
+		t.Fatalf("ListManufacturers: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "Adalya" || list[1].Name != "Al Fakher" {
+		t.Fatalf("manufacturers not adopted: %+v", list)
+	}
+	for id := uint(1); id <= 3; id++ {
+		got, err := c.GetShisha(ctx, id)
+		if err != nil || got.Manufacturer != list[1] {
+			t.Fatalf("shisha %d not relinked: %+v (%v)", id, got, err)
+		}
+	}
+	if again, err := c.NormalizeManufacturers(ctx); err != nil || len(again) != 0 {
+		t.Fatalf("second run: got %+v (%v)", again, err)
+	}
+}
+
+func TestNewCouchAdapter_ClaimsManufacturerNames(t *testing.T) {
+	ctx := context.Background()
+	f, ts := newFakeCouch(t)
+	// duplicates created concurrently before names were claimed
+	for id, name := range map[uint]string{1: "al fakher", 2: "Al Fakher"} {
+		f.put(map[string]interface{}{"_id": manufacturerDocID(id), "type": "manufacturer", "id": float64(id),
+			"name": name, "nameKey": manufacturerKey(name)})
+	}
+	f.put(map[string]interface{}{"_id": shishaDocID(1), "type": "shisha", "id": float64(1), "name": "S",
+		"smoked": float64(0), "ratingAvg": float64(0),
+		"manufacturer": map[string]interface{}{"id": float64(2), "name": "Al Fakher"}})
+
+	c, err := NewCouchAdapter(ts.URL, "", "", f.db)
+	if err != nil {
+		t.Fatalf("NewCouchAdapter: %v", err)
+	}
+	list, err := c.ListManufacturers(ctx)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("duplicates not merged: %+v (%v)", list, err)
+	}
+	if claim := f.docs["manufacturer-name:al fakher"]; claim == nil || claim["id"] != float64(list[0].ID) {
+		t.Fatalf("name not claimed: %v", claim)
+	}
+	if _, err := c.CreateManufacturer(ctx, &Manufacturer{Name: " AL FAKHER"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("CreateManufacturer of a taken name: expected ErrConflict, got %v", err)
+	}
+	// a create that passed the lookup before the name was claimed loses the claim
+	doc, created, err := c.createManufacturerDoc(ctx, "AL FAKHER", 0)
+	if err != nil || created || doc.ID != list[0].ID {
+		t.Fatalf("createManufacturerDoc of a claimed name: got %+v created=%v (%v)", doc, created, err)
+	}
+	if all, _ := c.ListManufacturers(ctx); len(all) != 1 {
+		t.Fatalf("losing doc not removed: %+v", all)
+	}
+
+	adalya, err := c.CreateManufacturer(ctx, &Manufacturer{Name: "Adalya"})
+	if err != nil {
+		t.Fatalf("CreateManufacturer: %v", err)
+	}
+	if _, err := c.UpdateManufacturer(ctx, adalya.ID, &Manufacturer{Name: "al Fakher"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("UpdateManufacturer to a taken name: expected ErrConflict, got %v", err)
+	}
+	if got, _ := c.GetManufacturer(ctx, adalya.ID); got.Name != "Adalya" {
+		t.Fatalf("name not reverted: %+v", got)
+	}
+	if _, err := c.UpdateManufacturer(ctx, adalya.ID, &Manufacturer{Name: "Darkside"}); err != nil {
+		t.Fatalf("UpdateManufacturer: %v", err)
+	}
+	if _, ok := f.docs["manufacturer-name:adalya"]; ok {
+		t.Fatalf("old name still claimed after rename")
+	}
+	// a claim left behind by a manufacturer that no longer holds the name is taken over
+	f.put(map[string]interface{}{"_id": "manufacturer-name:tangiers", "type": "manufacturerName", "nameKey": "tangiers", "id": float64(99)})
+	if _, err := c.CreateManufacturer(ctx, &Manufacturer{Name: "Tangiers"}); err != nil {
+		t.Fatalf("CreateManufacturer over a stale claim: %v", err)
+	}
+}
+
+func TestNewCouchAdapter_NumbersLegacyComments(t *testing.T) {
+	ctx := context.Background()
+	f, ts := newFakeCouch(t)
+	f.put(map[string]interface{}{"_id": shishaDocID(1), "type": "shisha", "id": float64(1), "name": "S",
+		"smoked": float64(0), "ratingAvg": float64(0),
+		"comments": []interface{}{
+			map[string]interface{}{"user": "bob", "message": "alt"},
+			map[string]interface{}{"user": "alice", "message": "auch alt"},
+		}})
+
+	c, err := NewCouchAdapter(ts.URL, "", "", f.db)
+	if err != nil {
+		t.Fatalf("NewCouchAdapter: %v", err)
+	}
+	got, err := c.GetShisha(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetShisha: %v", err)
+	}
+	if len(got.Comments) != 2 || got.Comments[0].ID != 1 || got.Comments[1].ID != 2 {
+		t.Fatalf("legacy comments not numbered: %+v", got.Comments)
+	}
+	if err := c.DeleteComment(ctx, 1, 2, "alice"); err != nil {
+		t.Fatalf("DeleteComment on migrated comment: %v", err)
+	}
+}
+
+func TestNewCouchAdapter_NormalizesLegacyRatings(t *testing.T) {
+	ctx := context.Background()
+	f, ts := newFakeCouch(t)
+	f.put(map[string]interface{}{"_id": shishaDocID(1), "type": "shisha", "id": float64(1), "name": "S",
+		"smoked": float64(0), "ratingAvg": float64(0),
+		"ratings": []interface{}{
+			map[string]interface{}{"user": "alice", "score": float64(4)},
+			map[string]interface{}{"user": "bob", "score": float64(9999)},
+			map[string]interface{}{"user": "Alice", "score": float64(9)},
+		}})
+
+	c, err := NewCouchAdapter(ts.URL, "", "", f.db)
+	if err != nil {
+		t.Fatalf("NewCouchAdapter: %v", err)
+	}
+	got, err := c.GetShisha(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetShisha: %v", err)
+	}
+	want := []Rating{{User: "Alice", Score: 9, History: []RatingRevision{{Score: 4}}}, {User: "bob", Score: MaxScore}}
+	if !reflect.DeepEqual(got.Ratings, want) {
+		t.Fatalf("legacy ratings not normalized:\n got %+v\nwant %+v", got.Ratings, want)
+	}
+}
+
+func TestCouchAdapter_SetupChecks(t *testing.T) {
+	ctx := context.Background()
+	c, f := newFakeCouchAdapter(t)
+
+	// the database as it looks after a restore from a plain document dump
+	f.mu.Lock()
+	delete(f.indexes, "idx_type_name")
+	delete(f.docs, couchRatingsDesignID)
+	delete(f.docs, couchMigrationsDocID)
+	f.mu.Unlock()
+
+	err := c.CheckIndexes(ctx)
+	if err == nil || !strings.Contains(err.Error(), "idx_type_name") || !strings.Contains(err.Error(), couchRatingsDesignID) {
+		t.Fatalf("CheckIndexes: expected the missing index and view, got %v", err)
+	}
+	pending, err := c.PendingMigrations(ctx)
+	if err != nil || len(pending) != len(couchMigrations) || pending[0] != couchMigrations[0].name {
+		t.Fatalf("PendingMigrations: expected all migrations, got %v (%v)", pending, err)
+	}
+}
+
+func TestCouchAdapter_DebugLogMasksHashes(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newFakeCouchAdapter(t)
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	if _, err := c.CreateUser(ctx, &User{Name: "alice", PasswordHash: "$2a$10$secretpasswordhash"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if _, err := c.CreateAPIToken(ctx, &APIToken{ID: "abc", User: "alice", SecretHash: "secrettokenhash"}); err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+	if _, err := c.GetUser(ctx, "alice"); err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "couchdb: request") || !strings.Contains(out, "[redacted]") {
+		t.Fatalf("expected logged bodies with masked hashes:\n%s", out)
+	}
+	if strings.Contains(out, "secretpasswordhash") || strings.Contains(out, "secrettokenhash") {
+		t.Fatalf("hash in the debug log:\n%s", out)
+	}
+}
+
+func TestCouchAdapter_SnapshotRepeatsOverlappingReads(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newFakeCouchAdapter(t)
+
+	calls := 0
+	err := c.Snapshot(ctx, func(view Storage) error {
+		calls++
+		if calls == 1 {
+			// a write by someone else while the first read runs
+			_, err := c.CreateShisha(ctx, &Shisha{Name: "Mint"})
+			return err
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("expected a second, undisturbed read: calls %d, err %v", calls, err)
+	}
+
+	calls = 0
+	err = c.Snapshot(ctx, func(view Storage) error {
+		calls++
+		return c.AddSmoked(ctx, 1)
+	})
+	if !errors.Is(err, ErrConflict) || calls != couchSnapshotAttempts {
+		t.Fatalf("expected ErrConflict after %d reads, got %v after %d", couchSnapshotAttempts, err, calls)
+	}
+}
@@ -0,0 +1,430 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCouch is an in-memory stand-in for the subset of the CouchDB HTTP API used by
+// CouchAdapter. It enforces _rev checks like the real server so conflict handling
+// and id allocation can be exercised without an external service.
+type fakeCouch struct {
+	t    *testing.T
+	mu   sync.Mutex
+	db   string
+	docs map[string]map[string]interface{}
+	seq  int
+
+	// conflicts makes the next n PUTs to a doc _id answer 409 (simulated concurrent writer).
+	conflicts map[string]int
+	// indexes holds the names of the Mango indexes created via POST /{db}/_index.
+	indexes map[string]bool
+}
+
+func newFakeCouch(t *testing.T) (*fakeCouch, *httptest.Server) {
+	t.Helper()
+	f := &fakeCouch{
+		t:         t,
+		db:        "shisha",
+		docs:      make(map[string]map[string]interface{}),
+		conflicts: make(map[string]int),
+		indexes:   make(map[string]bool),
+	}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	return f, ts
+}
+
+// newFakeCouchAdapter returns a CouchAdapter wired to a fresh fakeCouch.
+func newFakeCouchAdapter(t *testing.T) (*CouchAdapter, *fakeCouch) {
+	t.Helper()
+	f, ts := newFakeCouch(t)
+	c, err := NewCouchAdapter(ts.URL, "", "", f.db)
+	if err != nil {
+		t.Fatalf("NewCouchAdapter: %v", err)
+	}
+	return c, f
+}
+
+// put stores doc directly, bypassing the HTTP layer (test setup helper).
+func (f *fakeCouch) put(doc map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id, _ := doc["_id"].(string)
+	f.seq++
+	doc["_rev"] = fmt.Sprintf("%d-fake", f.seq)
+	f.docs[id] = doc
+}
+
+func (f *fakeCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch path {
+	case "_up":
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	case "_membership":
+		writeJSON(w, http.StatusOK, map[string][]string{"all_nodes": {"couchdb@node1"}, "cluster_nodes": {"couchdb@node1"}})
+		return
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if parts[0] != f.db {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not_found"})
+		return
+	}
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodPut:
+			writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": "file_exists"})
+		case http.MethodPost:
+			var doc map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			f.seq++
+			doc["_id"] = fmt.Sprintf("gen-%d", f.seq)
+			f.writeDoc(w, doc["_id"].(string), doc)
+		default:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"db_name": f.db, "doc_count": len(f.docs), "update_seq": strconv.Itoa(f.seq) + "-fake"})
+		}
+		return
+	}
+
+	switch rest := parts[1]; {
+	case rest == "_index" && r.Method == http.MethodPost:
+		var ix struct {
+			Name string `json:"name"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&ix)
+		f.indexes[ix.Name] = true
+		writeJSON(w, http.StatusOK, map[string]string{"result": "exists"})
+	case rest == "_index" && r.Method == http.MethodGet:
+		list := []map[string]string{{"name": "_all_docs", "type": "special"}}
+		for name := range f.indexes {
+			list = append(list, map[string]string{"name": name, "type": "json"})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"total_rows": len(list), "indexes": list})
+	case rest == "_find" && r.Method == http.MethodPost:
+		f.find(w, r)
+	case rest == "_bulk_docs" && r.Method == http.MethodPost:
+		f.bulkDocs(w, r)
+	case strings.HasPrefix(rest, couchRatingsDesignID+"/_view/") && r.Method == http.MethodGet:
+		f.ratingsView(w, r)
+	default:
+		f.doc(w, r, rest)
+	}
+}
+
+func (f *fakeCouch) doc(w http.ResponseWriter, r *http.Request, id string) {
+	cur, exists := f.docs[id]
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not_found", "reason": "missing"})
+			return
+		}
+		writeJSON(w, http.StatusOK, cur)
+	case http.MethodPut:
+		var doc map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if n := f.conflicts[id]; n > 0 {
+			f.conflicts[id] = n - 1
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "conflict"})
+			return
+		}
+		if exists && doc["_rev"] != cur["_rev"] || !exists && doc["_rev"] != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "conflict"})
+			return
+		}
+		f.writeDoc(w, id, doc)
+	case http.MethodDelete:
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not_found"})
+			return
+		}
+		if r.URL.Query().Get("rev") != cur["_rev"] {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "conflict"})
+			return
+		}
+		delete(f.docs, id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeCouch) writeDoc(w http.ResponseWriter, id string, doc map[string]interface{}) {
+	f.seq++
+	doc["_id"] = id
+	doc["_rev"] = fmt.Sprintf("%d-fake", f.seq)
+	f.docs[id] = doc
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": id, "rev": doc["_rev"]})
+}
+
+// find implements the Mango features the adapter relies on: equality and operator
+// selectors ($gt, $eq, $ne, $regex, $exists, $elemMatch, $or) on dotted field paths, a sort on one
+// field, limit and bookmarks (encoded as plain offsets).
+func (f *fakeCouch) find(w http.ResponseWriter, r *http.Request) {
+	var q struct {
+		Selector map[string]interface{} `json:"selector"`
+		Sort     []map[string]string    `json:"sort"`
+		Limit    int                    `json:"limit"`
+		Bookmark string                 `json:"bookmark"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	offset := 0
+	if q.Bookmark != "" {
+		n, err := strconv.Atoi(q.Bookmark)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_bookmark"})
+			return
+		}
+		offset = n
+	}
+	docs := make([]map[string]interface{}, 0)
+	for id, d := range f.docs {
+		if !strings.HasPrefix(id, "_local/") && matchSelector(d, q.Selector) {
+			docs = append(docs, d)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i]["_id"].(string) < docs[j]["_id"].(string) })
+	for _, s := range q.Sort {
+		for field, dir := range s {
+			if field == "type" {
+				continue
+			}
+			sort.SliceStable(docs, func(i, j int) bool {
+				a, b := fieldValue(docs[i], field), fieldValue(docs[j], field)
+				if dir == "desc" {
+					return lessValue(b, a)
+				}
+				return lessValue(a, b)
+			})
+		}
+	}
+	if offset > len(docs) {
+		offset = len(docs)
+	}
+	docs = docs[offset:]
+	if q.Limit > 0 && len(docs) > q.Limit {
+		docs = docs[:q.Limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"docs": docs, "bookmark": strconv.Itoa(offset + len(docs))})
+}
+
+// bulkDocs implements POST /{db}/_bulk_docs with per-document _rev checks.
+func (f *fakeCouch) bulkDocs(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Docs []map[string]interface{} `json:"docs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	results := make([]map[string]interface{}, 0, len(in.Docs))
+	for _, doc := range in.Docs {
+		id, _ := doc["_id"].(string)
+		if id == "" {
+			f.seq++
+			id = fmt.Sprintf("gen-%d", f.seq)
+		}
+		cur, exists := f.docs[id]
+		if exists && doc["_rev"] != cur["_rev"] || !exists && doc["_rev"] != nil {
+			results = append(results, map[string]interface{}{"id": id, "error": "conflict", "reason": "Document update conflict."})
+			continue
+		}
+		f.seq++
+		doc["_id"] = id
+		doc["_rev"] = fmt.Sprintf("%d-fake", f.seq)
+		f.docs[id] = doc
+		results = append(results, map[string]interface{}{"ok": true, "id": id, "rev": doc["_rev"]})
+	}
+	writeJSON(w, http.StatusCreated, results)
+}
+
+// ratingsView evaluates the ratings view (see couchRatingsDesign) in Go: rows keyed by
+// [id, score] reduced with _stats, either fully or with group_level=2. A startkey
+// restricts the rows to the shisha id it starts with.
+func (f *fakeCouch) ratingsView(w http.ResponseWriter, r *http.Request) {
+	if _, ok := f.docs[couchRatingsDesignID]; !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not_found", "reason": "missing"})
+		return
+	}
+	var start []float64
+	if v := r.URL.Query().Get("startkey"); v != "" {
+		if err := json.Unmarshal([]byte(v), &start); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request"})
+			return
+		}
+	}
+	type stats struct {
+		Sum   float64 `json:"sum"`
+		Count int     `json:"count"`
+	}
+	grouped := make(map[[2]float64]*stats)
+	var total stats
+	for _, d := range f.docs {
+		if d["type"] != "shisha" {
+			continue
+		}
+		id, _ := d["id"].(float64)
+		if len(start) > 0 && id != start[0] {
+			continue
+		}
+		ratings, _ := d["ratings"].([]interface{})
+		for _, rt := range ratings {
+			score, ok := rt.(map[string]interface{})["score"].(float64)
+			if !ok {
+				continue
+			}
+			k := [2]float64{id, score}
+			if grouped[k] == nil {
+				grouped[k] = &stats{}
+			}
+			grouped[k].Sum += score
+			grouped[k].Count++
+			total.Sum += score
+			total.Count++
+		}
+	}
+	rows := make([]map[string]interface{}, 0)
+	if r.URL.Query().Get("group_level") == "2" {
+		for k, v := range grouped {
+			rows = append(rows, map[string]interface{}{"key": []float64{k[0], k[1]}, "value": v})
+		}
+	} else if total.Count > 0 {
+		rows = append(rows, map[string]interface{}{"key": nil, "value": total})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rows": rows})
+}
+
+func matchSelector(doc, selector map[string]interface{}) bool {
+	for k, want := range selector {
+		if k == "$or" {
+			alts, _ := want.([]interface{})
+			matched := false
+			for _, alt := range alts {
+				if sub, ok := alt.(map[string]interface{}); ok && matchSelector(doc, sub) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+		if !matchCondition(doc, k, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchCondition(doc map[string]interface{}, field string, cond interface{}) bool {
+	got, exists := fieldLookup(doc, field)
+	ops, isOps := cond.(map[string]interface{})
+	if !isOps {
+		return exists && reflect.DeepEqual(got, cond)
+	}
+	for op, arg := range ops {
+		switch op {
+		case "$exists":
+			if exists != (arg == true) {
+				return false
+			}
+		case "$gt":
+			// only "$gt": null is used: matches every present, non-null value
+			if !exists || got == nil || (arg != nil && !lessValue(arg, got)) {
+				return false
+			}
+		case "$eq":
+			if !exists || !reflect.DeepEqual(got, arg) {
+				return false
+			}
+		case "$ne":
+			if exists && reflect.DeepEqual(got, arg) {
+				return false
+			}
+		case "$elemMatch":
+			items, _ := got.([]interface{})
+			sub, _ := arg.(map[string]interface{})
+			matched := false
+			for _, item := range items {
+				if m, ok := item.(map[string]interface{}); ok && matchSelector(m, sub) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "$regex":
+			str, ok := got.(string)
+			re, err := regexp.Compile(fmt.Sprint(arg))
+			if !ok || err != nil || !re.MatchString(str) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// fieldLookup resolves a dotted path like "manufacturer.name".
+func fieldLookup(doc map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func fieldValue(doc map[string]interface{}, path string) interface{} {
+	v, _ := fieldLookup(doc, path)
+	return v
+}
+
+func lessValue(a, b interface{}) bool {
+	switch av := a.(type) {
+	case float64:
+		bv, _ := b.(float64)
+		return av < bv
+	case string:
+		bv, _ := b.(string)
+		// CouchDB collates strings case-insensitively (ICU) for practical purposes
+		return strings.ToLower(av) < strings.ToLower(bv)
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
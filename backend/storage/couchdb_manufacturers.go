@@ -0,0 +1,770 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"golang.org/x/exp/slog"
+)
+
+// couchManufacturerDoc is a manufacturer document. Shisha docs keep a copy of id and name
+// in their manufacturer field so listings can filter and sort on it; renames and merges
+// rewrite those copies.
+type couchManufacturerDoc struct {
+	DocID string `json:"_id,omitempty"`
+	Rev   string `json:"_rev,omitempty"`
+	Type  string `json:"type"`
+	ID    uint   `json:"id"`
+	Name  string `json:"name"`
+	// NameKey is manufacturerKey(Name), used for lookups by name.
+	NameKey string `json:"nameKey"`
+}
+
+// couchManufacturerNameDoc claims a manufacturer name for the manufacturer ID. It is
+// stored under the deterministic _id "manufacturer-name:<manufacturerKey>", so CouchDB
+// itself rejects a second manufacturer with the same name. Lookups by name go through
+// the claim; a claim whose manufacturer is gone or renamed is stale and may be taken over.
+type couchManufacturerNameDoc struct {
+	DocID   string `json:"_id,omitempty"`
+	Rev     string `json:"_rev,omitempty"`
+	Type    string `json:"type"`
+	NameKey string `json:"nameKey"`
+	ID      uint   `json:"id"`
+}
+
+// manufacturerNameDocID returns the escaped _id of the claim for key; names may contain
+// non-ASCII letters and slashes.
+func manufacturerNameDocID(key string) string {
+	return url.PathEscape("manufacturer-name:" + key)
+}
+
+func manufacturerDocID(id uint) string {
+	return fmt.Sprintf("manufacturer:%d", id)
+}
+
+func newManufacturerDoc(id uint, name string) *couchManufacturerDoc {
+	return &couchManufacturerDoc{
+		DocID:   manufacturerDocID(id),
+		Type:    "manufacturer",
+		ID:      id,
+		Name:    name,
+		NameKey: manufacturerKey(name),
+	}
+}
+
+func (d *couchManufacturerDoc) toManufacturer() Manufacturer {
+	return Manufacturer{ID: d.ID, Name: d.Name}
+}
+
+func (c *CouchAdapter) ListManufacturers(ctx context.Context) ([]Manufacturer, error) {
+	var docs []couchManufacturerDoc
+	if err := c.findDocs(ctx, map[string]interface{}{"type": "manufacturer"}, 0, &docs); err != nil {
+		return nil, err
+	}
+	out := make([]Manufacturer, 0, len(docs))
+	for i := range docs {
+		out = append(out, docs[i].toManufacturer())
+	}
+	sortManufacturers(out)
+	return out, nil
+}
+
+func (c *CouchAdapter) GetManufacturer(ctx context.Context, id uint) (*Manufacturer, error) {
+	doc, err := c.getManufacturerDoc(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	m := doc.toManufacturer()
+	return &m, nil
+}
+
+func (c *CouchAdapter) CreateManufacturer(ctx context.Context, m *Manufacturer) (*Manufacturer, error) {
+	if err := validateManufacturer(m); err != nil {
+		return nil, err
+	}
+	existing, err := c.findManufacturerByKey(ctx, manufacturerKey(m.Name))
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("manufacturer %q exists as %d: %w", m.Name, existing.ID, ErrConflict)
+	}
+	doc, created, err := c.createManufacturerDoc(ctx, m.Name, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, fmt.Errorf("manufacturer %q exists as %d: %w", m.Name, doc.ID, ErrConflict)
+	}
+	out := doc.toManufacturer()
+	return &out, nil
+}
+
+func (c *CouchAdapter) UpdateManufacturer(ctx context.Context, id uint, m *Manufacturer) (*Manufacturer, error) {
+	if err := validateManufacturer(m); err != nil {
+		return nil, err
+	}
+	doc, err := c.getManufacturerDoc(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := c.findManufacturerByKey(ctx, manufacturerKey(m.Name))
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.ID != id {
+		return nil, fmt.Errorf("manufacturer %q exists as %d: %w", m.Name, existing.ID, ErrConflict)
+	}
+	oldName, oldKey := doc.Name, doc.NameKey
+	doc.Name, doc.NameKey = m.Name, manufacturerKey(m.Name)
+	if err := c.putJSONDoc(ctx, "UpdateManufacturer", doc.DocID, doc); err != nil {
+		return nil, err
+	}
+	if doc.NameKey != oldKey {
+		// the doc carries the new name before it claims it, so the claim is never stale
+		owner, err := c.claimManufacturerName(ctx, doc.NameKey, id)
+		if err != nil {
+			if errors.Is(err, ErrConflict) {
+				err = fmt.Errorf("manufacturer %q exists as %d: %w", m.Name, owner, ErrConflict)
+			}
+			return nil, c.revertManufacturerName(ctx, doc, oldName, err)
+		}
+	}
+	out := doc.toManufacturer()
+	if err := c.relinkShishas(ctx, id, out); err != nil {
+		return nil, err
+	}
+	if doc.NameKey != oldKey {
+		if err := c.releaseManufacturerName(ctx, oldKey, id); err != nil {
+			return nil, err
+		}
+	}
+	return &out, nil
+}
+
+// revertManufacturerName restores the name of a manufacturer whose new name could not be
+// claimed and returns cause.
+func (c *CouchAdapter) revertManufacturerName(ctx context.Context, doc *couchManufacturerDoc, name string, cause error) error {
+	err := c.updateManufacturerDoc(ctx, doc.ID, func(d *couchManufacturerDoc) {
+		d.Name, d.NameKey = name, manufacturerKey(name)
+	})
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("%w (reverting the name: %v)", cause, err)
+	}
+	return cause
+}
+
+// updateManufacturerDoc applies change to the current revision of a manufacturer doc,
+// re-reading it when a concurrent write intervenes.
+func (c *CouchAdapter) updateManufacturerDoc(ctx context.Context, id uint, change func(d *couchManufacturerDoc)) error {
+	for attempt := 0; attempt < maxAllocAttempts; attempt++ {
+		doc, err := c.getManufacturerDoc(ctx, id)
+		if err != nil {
+			return err
+		}
+		change(doc)
+		err = c.putJSONDoc(ctx, "UpdateManufacturer", doc.DocID, doc)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return fmt.Errorf("UpdateManufacturer: %w", ErrConflict)
+}
+
+func (c *CouchAdapter) DeleteManufacturer(ctx context.Context, id uint) error {
+	doc, err := c.getManufacturerDoc(ctx, id)
+	if err != nil {
+		return err
+	}
+	var used []couchShishaDoc
+	selector := map[string]interface{}{"type": "shisha", "manufacturer.id": id}
+	if err := c.findDocs(ctx, selector, 1, &used); err != nil {
+		return err
+	}
+	if len(used) > 0 {
+		return fmt.Errorf("manufacturer %d is used by shishas: %w", id, ErrConflict)
+	}
+	if err := c.deleteDoc(ctx, "DeleteManufacturer", doc.DocID, doc.Rev); err != nil {
+		return err
+	}
+	return c.releaseManufacturerName(ctx, doc.NameKey, id)
+}
+
+func (c *CouchAdapter) MergeManufacturers(ctx context.Context, into uint, ids []uint) (*Manufacturer, error) {
+	ids, err := validateMerge(into, ids)
+	if err != nil {
+		return nil, err
+	}
+	target, err := c.getManufacturerDoc(ctx, into)
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]*couchManufacturerDoc, 0, len(ids))
+	for _, id := range ids {
+		doc, err := c.getManufacturerDoc(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, doc)
+	}
+	out := target.toManufacturer()
+	for _, doc := range sources {
+		if err := c.relinkShishas(ctx, doc.ID, out); err != nil {
+			return nil, err
+		}
+		if err := c.deleteDoc(ctx, "MergeManufacturers", doc.DocID, doc.Rev); err != nil {
+			return nil, err
+		}
+		if err := c.releaseManufacturerName(ctx, doc.NameKey, doc.ID); err != nil {
+			return nil, err
+		}
+	}
+	return &out, nil
+}
+
+// NormalizeManufacturers also adopts the manufacturers that so far only exist as names
+// embedded in shisha docs (data written before manufacturer docs existed): every
+// distinct name, ignoring case and spacing, becomes a manufacturer doc under its most
+// frequent spelling and the shishas are pointed to it.
+func (c *CouchAdapter) NormalizeManufacturers(ctx context.Context) ([]ManufacturerMerge, error) {
+	var docs []couchManufacturerDoc
+	if err := c.findDocs(ctx, map[string]interface{}{"type": "manufacturer"}, 0, &docs); err != nil {
+		return nil, err
+	}
+	var shishas []couchShishaDoc
+	if err := c.findDocs(ctx, map[string]interface{}{"type": "shisha"}, 0, &shishas); err != nil {
+		return nil, err
+	}
+
+	uses := make(map[uint]int)
+	for i := range shishas {
+		uses[shishas[i].Manufacturer.ID]++
+	}
+	byID := make(map[uint]*couchManufacturerDoc, len(docs))
+	all := make([]manufacturerUsage, 0, len(docs))
+	for i := range docs {
+		byID[docs[i].ID] = &docs[i]
+		all = append(all, manufacturerUsage{Manufacturer: docs[i].toManufacturer(), uses: uses[docs[i].ID]})
+	}
+	plan := planNormalization(all)
+
+	// target manufacturer per name key: the survivor of its group or the only doc
+	target := make(map[string]Manufacturer)
+	merged := make(map[uint]bool)
+	for _, g := range plan {
+		target[manufacturerKey(g.keep.Name)] = g.keep
+		for _, m := range g.merge {
+			merged[m.ID] = true
+		}
+	}
+	for i := range docs {
+		if k := manufacturerKey(docs[i].Name); !merged[docs[i].ID] && target[k].ID == 0 {
+			target[k] = docs[i].toManufacturer()
+		}
+	}
+
+	// names that only exist embedded in shishas get a doc under their most used spelling
+	spellings := make(map[string]map[string]int)
+	for i := range shishas {
+		name := shishas[i].Manufacturer.Name
+		k := manufacturerKey(name)
+		if k == "" || target[k].ID != 0 {
+			continue
+		}
+		if spellings[k] == nil {
+			spellings[k] = make(map[string]int)
+		}
+		spellings[k][name]++
+	}
+	report := mergeReport(plan)
+	for _, k := range sortedKeys(spellings) {
+		best := mostUsedSpelling(spellings[k])
+		doc, _, err := c.createManufacturerDoc(ctx, cleanManufacturerName(best), 0)
+		if err != nil {
+			return nil, err
+		}
+		target[k] = doc.toManufacturer()
+		if len(spellings[k]) > 1 || best != doc.Name {
+			entry := ManufacturerMerge{Into: doc.toManufacturer(), Merged: []Manufacturer{}}
+			for _, name := range sortedKeys(spellings[k]) {
+				if name != best {
+					entry.Merged = append(entry.Merged, Manufacturer{Name: name})
+				}
+			}
+			report = append(report, entry)
+		}
+	}
+
+	for _, g := range plan {
+		if g.renamed {
+			doc := byID[g.keep.ID]
+			doc.Name, doc.NameKey = g.keep.Name, manufacturerKey(g.keep.Name)
+			if err := c.putJSONDoc(ctx, "NormalizeManufacturers", doc.DocID, doc); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// point every shisha to its target manufacturer
+	resolveTarget := func(current Manufacturer) Manufacturer {
+		if k := manufacturerKey(current.Name); k != "" {
+			return target[k]
+		}
+		if doc := byID[current.ID]; doc != nil && current.ID != 0 {
+			return target[manufacturerKey(doc.Name)]
+		}
+		return Manufacturer{} // dangling id-only reference
+	}
+	var pending []interface{}
+	for i := range shishas {
+		if want := resolveTarget(shishas[i].Manufacturer); shishas[i].Manufacturer != want {
+			shishas[i].Manufacturer = want
+			shishas[i].refreshDerived()
+			pending = append(pending, &shishas[i])
+		}
+	}
+	for start := 0; start < len(pending); start += couchPageSize {
+		end := start + couchPageSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		if err := c.writeRelinked(ctx, pending[start:end], func(doc *couchShishaDoc) {
+			doc.Manufacturer = resolveTarget(doc.Manufacturer)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, g := range plan {
+		for _, m := range g.merge {
+			doc := byID[m.ID]
+			if err := c.deleteDoc(ctx, "NormalizeManufacturers", doc.DocID, doc.Rev); err != nil && !errors.Is(err, ErrNotFound) {
+				return nil, err
+			}
+			if err := c.releaseManufacturerName(ctx, doc.NameKey, doc.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// adoptManufacturers is the data migration that creates manufacturer docs for existing
+// databases.
+func (c *CouchAdapter) adoptManufacturers(ctx context.Context) error {
+	merges, err := c.NormalizeManufacturers(ctx)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "couchdb: normalized manufacturers", "merged_groups", len(merges))
+	return nil
+}
+
+// claimManufacturerNames is the data migration that claims the names of manufacturers
+// stored before names were claimed. Duplicates are merged first, so every name has one
+// manufacturer left to claim it.
+func (c *CouchAdapter) claimManufacturerNames(ctx context.Context) error {
+	if err := c.adoptManufacturers(ctx); err != nil {
+		return err
+	}
+	var docs []couchManufacturerDoc
+	if err := c.findDocs(ctx, map[string]interface{}{"type": "manufacturer"}, 0, &docs); err != nil {
+		return err
+	}
+	for i := range docs {
+		owner, err := c.claimManufacturerName(ctx, docs[i].NameKey, docs[i].ID)
+		if errors.Is(err, ErrConflict) {
+			// created concurrently with the migration; NormalizeManufacturers merges it
+			slog.WarnContext(ctx, "couchdb: manufacturer name already claimed",
+				"manufacturer", docs[i].ID, "name", docs[i].Name, "owner", owner)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relinkShishas rewrites the embedded manufacturer of every shisha referencing the
+// manufacturer from to mf.
+func (c *CouchAdapter) relinkShishas(ctx context.Context, from uint, mf Manufacturer) error {
+	selector := map[string]interface{}{"type": "shisha", "manufacturer.id": from}
+	if from == mf.ID {
+		// rename: only docs still carrying another name; rewritten ones drop out
+		selector["manufacturer.name"] = map[string]interface{}{"$ne": mf.Name}
+	}
+	for {
+		var docs []couchShishaDoc
+		if err := c.findDocs(ctx, selector, couchPageSize, &docs); err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+		pending := make([]interface{}, 0, len(docs))
+		for i := range docs {
+			docs[i].Manufacturer = mf
+			docs[i].refreshDerived()
+			pending = append(pending, &docs[i])
+		}
+		if err := c.writeRelinked(ctx, pending, func(doc *couchShishaDoc) {
+			if doc.Manufacturer.ID == from {
+				doc.Manufacturer = mf
+			}
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// writeRelinked writes rewritten shisha docs with _bulk_docs. Docs changed concurrently
+// are re-read and patched with fix one by one.
+func (c *CouchAdapter) writeRelinked(ctx context.Context, docs []interface{}, fix func(doc *couchShishaDoc)) error {
+	results, err := c.bulkDocs(ctx, docs)
+	if err != nil {
+		return err
+	}
+	for k, r := range results {
+		switch r.Error {
+		case "":
+		case "conflict":
+			id := docs[k].(*couchShishaDoc).ID
+			err := c.updateDoc(ctx, id, "relink manufacturer", func(doc *couchShishaDoc) error {
+				fix(doc)
+				return nil
+			})
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		default:
+			return fmt.Errorf("relink %s: %s: %s", r.ID, r.Error, r.Reason)
+		}
+	}
+	return nil
+}
+
+// manufacturerResolver returns a resolveManufacturer that remembers its results, for
+// batch writes that mention the same manufacturers over and over.
+func (c *CouchAdapter) manufacturerResolver(keepID bool) func(ctx context.Context, ref Manufacturer) (Manufacturer, error) {
+	cache := make(map[string]Manufacturer)
+	return func(ctx context.Context, ref Manufacturer) (Manufacturer, error) {
+		key := manufacturerRefKey(ref)
+		if m, ok := cache[key]; ok {
+			return m, nil
+		}
+		m, err := c.resolveManufacturer(ctx, ref, keepID)
+		if err == nil {
+			cache[key] = m
+		}
+		return m, err
+	}
+}
+
+// resolveManufacturer returns the manufacturer a shisha write refers to (see Storage),
+// creating its doc for an unknown name. With keepID a new doc takes over the id carried
+// by ref when that id is free (restore).
+func (c *CouchAdapter) resolveManufacturer(ctx context.Context, ref Manufacturer, keepID bool) (Manufacturer, error) {
+	name := cleanManufacturerName(ref.Name)
+	if name == "" {
+		if ref.ID == 0 {
+			return Manufacturer{}, nil
+		}
+		doc, err := c.getManufacturerDoc(ctx, ref.ID)
+		if errors.Is(err, ErrNotFound) {
+			return Manufacturer{}, fmt.Errorf("%w: unknown manufacturer %d", ErrValidation, ref.ID)
+		}
+		if err != nil {
+			return Manufacturer{}, err
+		}
+		return doc.toManufacturer(), nil
+	}
+	doc, err := c.findManufacturerByKey(ctx, manufacturerKey(name))
+	if err != nil {
+		return Manufacturer{}, err
+	}
+	if doc == nil {
+		preferred := uint(0)
+		if keepID {
+			preferred = ref.ID
+		}
+		// a concurrent write may have created the name meanwhile; its doc is used then
+		if doc, _, err = c.createManufacturerDoc(ctx, name, preferred); err != nil {
+			return Manufacturer{}, err
+		}
+	}
+	return doc.toManufacturer(), nil
+}
+
+// createManufacturerDoc stores a new manufacturer doc, under preferredID if that is set
+// and free, otherwise under a freshly allocated id, and claims its name. When another
+// manufacturer holds the name, the new doc is removed again and the holder is returned
+// with created == false.
+func (c *CouchAdapter) createManufacturerDoc(ctx context.Context, name string, preferredID uint) (doc *couchManufacturerDoc, created bool, err error) {
+	doc, err = c.putNewManufacturerDoc(ctx, name, preferredID)
+	if err != nil {
+		return nil, false, err
+	}
+	owner, err := c.claimManufacturerName(ctx, doc.NameKey, doc.ID)
+	if err == nil {
+		return doc, true, nil
+	}
+	if !errors.Is(err, ErrConflict) {
+		return nil, false, err
+	}
+	if err := c.removeManufacturerDoc(ctx, doc.ID); err != nil {
+		return nil, false, err
+	}
+	holder, err := c.getManufacturerDoc(ctx, owner)
+	if err != nil {
+		return nil, false, err
+	}
+	return holder, false, nil
+}
+
+// putNewManufacturerDoc writes the doc of a new manufacturer, see createManufacturerDoc.
+func (c *CouchAdapter) putNewManufacturerDoc(ctx context.Context, name string, preferredID uint) (*couchManufacturerDoc, error) {
+	if preferredID != 0 {
+		doc := newManufacturerDoc(preferredID, name)
+		err := c.putJSONDoc(ctx, "CreateManufacturer", doc.DocID, doc)
+		if err == nil {
+			return doc, c.raiseCounter(ctx, manufacturerSequence, preferredID)
+		}
+		if !errors.Is(err, ErrConflict) {
+			return nil, err
+		}
+	}
+	for attempt := 0; attempt < maxAllocAttempts; attempt++ {
+		id, err := c.allocateIDs(ctx, manufacturerSequence, 1)
+		if err != nil {
+			return nil, err
+		}
+		doc := newManufacturerDoc(id, name)
+		err = c.putJSONDoc(ctx, "CreateManufacturer", doc.DocID, doc)
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("CreateManufacturer: %w", ErrConflict)
+}
+
+// removeManufacturerDoc deletes the doc of a manufacturer that lost the claim on its
+// name; no shisha can refer to it yet, as lookups only find claimed names.
+func (c *CouchAdapter) removeManufacturerDoc(ctx context.Context, id uint) error {
+	doc, err := c.getManufacturerDoc(ctx, id)
+	if err == nil {
+		err = c.deleteDoc(ctx, "CreateManufacturer", doc.DocID, doc.Rev)
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// claimManufacturerName records that manufacturer id holds the name key. The doc of id
+// must already carry that key. When another manufacturer holds it, ErrConflict is
+// returned along with that manufacturer's id.
+func (c *CouchAdapter) claimManufacturerName(ctx context.Context, key string, id uint) (owner uint, err error) {
+	docID := manufacturerNameDocID(key)
+	for attempt := 0; attempt < maxAllocAttempts; attempt++ {
+		claim := couchManufacturerNameDoc{Type: "manufacturerName", NameKey: key, ID: id}
+		var current couchManufacturerNameDoc
+		err := c.getJSONDoc(ctx, "claimManufacturerName", c.dbName+"/"+docID, &current)
+		switch {
+		case errors.Is(err, ErrNotFound):
+		case err != nil:
+			return 0, err
+		case current.ID == id:
+			return id, nil
+		default:
+			holder, err := c.getManufacturerDoc(ctx, current.ID)
+			if err == nil && holder.NameKey == key {
+				return current.ID, fmt.Errorf("manufacturer name %q is held by %d: %w", key, current.ID, ErrConflict)
+			}
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return 0, err
+			}
+			// stale: the holder was deleted or renamed without releasing the name
+			claim.Rev = current.Rev
+		}
+		err = c.putJSONDoc(ctx, "claimManufacturerName", docID, &claim)
+		if !errors.Is(err, ErrConflict) {
+			return id, err
+		}
+	}
+	return 0, fmt.Errorf("claimManufacturerName %q: %w", key, ErrConflict)
+}
+
+// releaseManufacturerName removes the claim on key if manufacturer id still holds it.
+func (c *CouchAdapter) releaseManufacturerName(ctx context.Context, key string, id uint) error {
+	docID := manufacturerNameDocID(key)
+	var current couchManufacturerNameDoc
+	err := c.getJSONDoc(ctx, "releaseManufacturerName", c.dbName+"/"+docID, &current)
+	if errors.Is(err, ErrNotFound) || err == nil && current.ID != id {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = c.deleteDoc(ctx, "releaseManufacturerName", docID, current.Rev)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) {
+		// released or taken over concurrently
+		return nil
+	}
+	return err
+}
+
+// getManufacturerDoc loads the manufacturer doc with the given id (ErrNotFound if missing).
+func (c *CouchAdapter) getManufacturerDoc(ctx context.Context, id uint) (*couchManufacturerDoc, error) {
+	resp, err := c.doRequest(ctx, "GET", c.dbName+"/"+manufacturerDocID(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("manufacturer %d: %w", id, ErrNotFound)
+	}
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("getManufacturer failed: %s: %s", resp.Status, string(b))
+	}
+	var doc couchManufacturerDoc
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// findManufacturerByKey returns the manufacturer holding the name key, or nil. Docs
+// whose name is not claimed (yet) are not found.
+func (c *CouchAdapter) findManufacturerByKey(ctx context.Context, key string) (*couchManufacturerDoc, error) {
+	var claim couchManufacturerNameDoc
+	err := c.getJSONDoc(ctx, "findManufacturer", c.dbName+"/"+manufacturerNameDocID(key), &claim)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc, err := c.getManufacturerDoc(ctx, claim.ID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil || doc.NameKey != key {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// findDocs runs a Mango query for selector and decodes the matching docs into out, a
+// pointer to a slice. limit 0 follows bookmarks until every match is read.
+func (c *CouchAdapter) findDocs(ctx context.Context, selector map[string]interface{}, limit int, out interface{}) error {
+	pageSize := limit
+	if pageSize == 0 {
+		pageSize = couchPageSize
+	}
+	var all []json.RawMessage
+	bookmark := ""
+	for {
+		query := map[string]interface{}{"selector": selector, "limit": pageSize}
+		if bookmark != "" {
+			query["bookmark"] = bookmark
+		}
+		resp, err := c.doRequest(ctx, "POST", c.dbName+"/_find", query)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Docs     []json.RawMessage `json:"docs"`
+			Bookmark string            `json:"bookmark"`
+		}
+		if resp.StatusCode >= 400 {
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return fmt.Errorf("_find failed: %s: %s", resp.Status, string(b))
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		all = append(all, page.Docs...)
+		if limit > 0 || len(page.Docs) < pageSize {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+	if all == nil {
+		all = []json.RawMessage{}
+	}
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// putJSONDoc writes doc under docID with the _rev it carries; 409 becomes ErrConflict.
+func (c *CouchAdapter) putJSONDoc(ctx context.Context, op, docID string, doc interface{}) error {
+	resp, err := c.doRequest(ctx, "PUT", c.dbName+"/"+docID, doc)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("%s: %w", op, ErrConflict)
+	}
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s failed: %s: %s", op, resp.Status, string(b))
+	}
+	return nil
+}
+
+// deleteDoc deletes docID at rev; 409 becomes ErrConflict and 404 ErrNotFound.
+func (c *CouchAdapter) deleteDoc(ctx context.Context, op, docID, rev string) error {
+	resp, err := c.doRequest(ctx, "DELETE", fmt.Sprintf("%s/%s?rev=%s", c.dbName, docID, rev), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return fmt.Errorf("%s: %w", op, ErrConflict)
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%s %s: %w", op, docID, ErrNotFound)
+	case resp.StatusCode >= 400:
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s failed: %s: %s", op, resp.Status, string(b))
+	}
+	return nil
+}
+
+func mostUsedSpelling(counts map[string]int) string {
+	best := ""
+	for _, name := range sortedKeys(counts) {
+		if best == "" || counts[name] > counts[best] {
+			best = name
+		}
+	}
+	return best
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
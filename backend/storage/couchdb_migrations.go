@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+
+	"golang.org/x/exp/slog"
+)
+
+// couchMigrationsDocID records which data migrations ran against the database. A _local
+// doc is never returned by _find/_all_docs and is not replicated, so it stays out of
+// exports; re-running a migration on a replicated copy is harmless.
+const couchMigrationsDocID = "_local/shisha_migrations"
+
+type couchMigrationsDoc struct {
+	Rev     string   `json:"_rev,omitempty"`
+	Applied []string `json:"applied"`
+}
+
+// couchMigration is an idempotent data migration run once at startup.
+type couchMigration struct {
+	name string
+	run  func(c *CouchAdapter, ctx context.Context) error
+}
+
+// couchMigrations lists all data migrations in the order they must run.
+var couchMigrations = []couchMigration{
+	{name: "0001_derived_sort_fields", run: (*CouchAdapter).backfillDerivedFields},
+	{name: "0002_manufacturer_docs", run: (*CouchAdapter).adoptManufacturers},
+	{name: "0003_comment_ids", run: (*CouchAdapter).numberStoredComments},
+	{name: "0004_normalize_ratings", run: (*CouchAdapter).normalizeStoredRatings},
+	{name: "0005_manufacturer_names", run: (*CouchAdapter).claimManufacturerNames},
+}
+
+// migrate runs every migration that has not been recorded as applied yet.
+func (c *CouchAdapter) migrate(ctx context.Context) error {
+	state, err := c.migrationState(ctx)
+	if err != nil {
+		return err
+	}
+	applied := make(map[string]bool, len(state.Applied))
+	for _, name := range state.Applied {
+		applied[name] = true
+	}
+	for _, m := range couchMigrations {
+		if applied[m.name] {
+			continue
+		}
+		slog.InfoContext(ctx, "couchdb: running data migration", "migration", m.name)
+		if err := m.run(c, ctx); err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		state.Applied = append(state.Applied, m.name)
+		resp, err := c.doRequest(ctx, "PUT", c.dbName+"/"+couchMigrationsDocID, state)
+		if err != nil {
+			return err
+		}
+		var out struct {
+			Rev string `json:"rev"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		// a concurrent replica may have recorded it first; the migration itself is idempotent
+		if resp.StatusCode >= 400 && resp.StatusCode != http.StatusConflict {
+			return fmt.Errorf("record migration %s failed: %s", m.name, resp.Status)
+		}
+		state.Rev = out.Rev
+	}
+	return nil
+}
+
+// PendingMigrations returns the data migrations not recorded as applied yet.
+func (c *CouchAdapter) PendingMigrations(ctx context.Context) ([]string, error) {
+	state, err := c.migrationState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[string]bool, len(state.Applied))
+	for _, name := range state.Applied {
+		applied[name] = true
+	}
+	var pending []string
+	for _, m := range couchMigrations {
+		if !applied[m.name] {
+			pending = append(pending, m.name)
+		}
+	}
+	return pending, nil
+}
+
+// migrationState loads the applied-migrations record (empty when none ran yet).
+func (c *CouchAdapter) migrationState(ctx context.Context) (*couchMigrationsDoc, error) {
+	resp, err := c.doRequest(ctx, "GET", c.dbName+"/"+couchMigrationsDocID, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &couchMigrationsDoc{}, nil
+	}
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("load migrations failed: %s: %s", resp.Status, string(b))
+	}
+	var doc couchMigrationsDoc
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// backfillDerivedFields writes smoked and ratingAvg into docs created before those fields
+// were always stored, so they show up in sorted listings.
+func (c *CouchAdapter) backfillDerivedFields(ctx context.Context) error {
+	for {
+		query := map[string]interface{}{
+			"selector": map[string]interface{}{
+				"type": "shisha",
+				"$or": []interface{}{
+					map[string]interface{}{"smoked": map[string]interface{}{"$exists": false}},
+					map[string]interface{}{"ratingAvg": map[string]interface{}{"$exists": false}},
+				},
+			},
+			"limit": couchPageSize,
+		}
+		resp, err := c.doRequest(ctx, "POST", c.dbName+"/_find", query)
+		if err != nil {
+			return err
+		}
+		var out struct {
+			Docs []couchShishaDoc `json:"docs"`
+		}
+		if resp.StatusCode >= 400 {
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return fmt.Errorf("_find failed: %s: %s", resp.Status, string(b))
+		}
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(out.Docs) == 0 {
+			return nil
+		}
+		docs := make([]interface{}, 0, len(out.Docs))
+		for i := range out.Docs {
+			out.Docs[i].refreshDerived()
+			docs = append(docs, &out.Docs[i])
+		}
+		results, err := c.bulkDocs(ctx, docs)
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			// a conflict means someone else rewrote the doc (with the fields) meanwhile
+			if r.Error != "" && r.Error != "conflict" {
+				return fmt.Errorf("backfill %s: %s: %s", r.ID, r.Error, r.Reason)
+			}
+		}
+		if len(out.Docs) < couchPageSize {
+			return nil
+		}
+	}
+}
+
+// numberStoredComments assigns ids to the comments stored before comments had ids, so
+// they can be edited and deleted.
+func (c *CouchAdapter) numberStoredComments(ctx context.Context) error {
+	selector := map[string]interface{}{
+		"type":     "shisha",
+		"comments": map[string]interface{}{"$elemMatch": map[string]interface{}{"id": map[string]interface{}{"$exists": false}}},
+	}
+	for {
+		var docs []couchShishaDoc
+		if err := c.findDocs(ctx, selector, couchPageSize, &docs); err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+		pending := make([]interface{}, 0, len(docs))
+		for i := range docs {
+			docs[i].Comments = numberComments(docs[i].Comments)
+			pending = append(pending, &docs[i])
+		}
+		results, err := c.bulkDocs(ctx, pending)
+		if err != nil {
+			return err
+		}
+		for k, r := range results {
+			switch r.Error {
+			case "":
+			case "conflict":
+				// rewritten concurrently: number the current revision instead
+				err := c.updateDoc(ctx, docs[k].ID, "number comments", func(doc *couchShishaDoc) error {
+					doc.Comments = numberComments(doc.Comments)
+					return nil
+				})
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					return err
+				}
+			default:
+				return fmt.Errorf("number comments of %s: %s: %s", r.ID, r.Error, r.Reason)
+			}
+		}
+	}
+}
+
+// normalizeStoredRatings applies NormalizeRatings to docs written before scores were
+// range-checked and ratings were unique per user, so restores and migrations of them
+// verify against targets that only store normalized ratings.
+func (c *CouchAdapter) normalizeStoredRatings(ctx context.Context) error {
+	var docs []couchShishaDoc
+	selector := map[string]interface{}{"type": "shisha", "ratings": map[string]interface{}{"$exists": true}}
+	if err := c.findDocs(ctx, selector, 0, &docs); err != nil {
+		return err
+	}
+	var pending []interface{}
+	for i := range docs {
+		normalized := NormalizeRatings(docs[i].Ratings)
+		if reflect.DeepEqual(normalized, docs[i].Ratings) {
+			continue
+		}
+		docs[i].Ratings = normalized
+		docs[i].refreshDerived()
+		pending = append(pending, &docs[i])
+	}
+	for start := 0; start < len(pending); start += couchPageSize {
+		end := start + couchPageSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		results, err := c.bulkDocs(ctx, pending[start:end])
+		if err != nil {
+			return err
+		}
+		for k, r := range results {
+			switch r.Error {
+			case "":
+			case "conflict":
+				// rewritten concurrently: normalize the current revision instead
+				doc := pending[start+k].(*couchShishaDoc)
+				err := c.updateDoc(ctx, doc.ID, "normalize ratings", func(doc *couchShishaDoc) error {
+					doc.Ratings = NormalizeRatings(doc.Ratings)
+					return nil
+				})
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					return err
+				}
+			default:
+				return fmt.Errorf("normalize ratings of %s: %s: %s", r.ID, r.Error, r.Reason)
+			}
+		}
+	}
+	return nil
+}
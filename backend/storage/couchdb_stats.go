@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+)
+
+// couchRatingsDesignID holds the map/reduce view behind the rating statistics.
+const couchRatingsDesignID = "_design/ratings"
+
+// couchRatingsView emits one row per rating keyed by [shisha id, score] and reduces them
+// with the built-in _stats. Grouped by both key parts it yields the histogram of a shisha
+// (group_level=2), fully reduced the count and sum of all ratings (the Bayesian prior),
+// so neither needs to read the shisha documents.
+const couchRatingsView = "by_shisha_score"
+
+type couchView struct {
+	Map    string `json:"map"`
+	Reduce string `json:"reduce,omitempty"`
+}
+
+type couchDesignDoc struct {
+	ID       string               `json:"_id"`
+	Rev      string               `json:"_rev,omitempty"`
+	Language string               `json:"language"`
+	Views    map[string]couchView `json:"views"`
+}
+
+var couchRatingsDesign = couchDesignDoc{
+	ID:       couchRatingsDesignID,
+	Language: "javascript",
+	Views: map[string]couchView{
+		couchRatingsView: {
+			Map: `function (doc) {
+  if (doc.type !== 'shisha' || !doc.ratings) return;
+  for (var i = 0; i < doc.ratings.length; i++) {
+    if (typeof doc.ratings[i].score === 'number') emit([doc.id, doc.ratings[i].score], doc.ratings[i].score);
+  }
+}`,
+			Reduce: "_stats",
+		},
+	},
+}
+
+// ensureViews creates or updates the design documents used by the adapter. Replicas
+// starting together may race on the PUT; the loser's 409 is fine as both write the same
+// definition.
+func (c *CouchAdapter) ensureViews(ctx context.Context) error {
+	path := c.dbName + "/" + couchRatingsDesignID
+	resp, err := c.doRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	var current couchDesignDoc
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+	case resp.StatusCode >= 400:
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return fmt.Errorf("load %s failed: %s: %s", couchRatingsDesignID, resp.Status, string(b))
+	default:
+		err = json.NewDecoder(resp.Body).Decode(&current)
+	}
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(current.Views, couchRatingsDesign.Views) {
+		return nil
+	}
+	doc := couchRatingsDesign
+	doc.Rev = current.Rev
+	resp, err = c.doRequest(ctx, "PUT", path, doc)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusConflict {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("write %s failed: %s: %s", couchRatingsDesignID, resp.Status, string(b))
+	}
+	return nil
+}
+
+type couchStatsRow struct {
+	Key   json.RawMessage `json:"key"`
+	Value struct {
+		Sum   float64 `json:"sum"`
+		Count int     `json:"count"`
+	} `json:"value"`
+}
+
+// queryRatings queries the ratings view with the given parameters.
+func (c *CouchAdapter) queryRatings(ctx context.Context, params url.Values) ([]couchStatsRow, error) {
+	path := fmt.Sprintf("%s/%s/_view/%s?%s", c.dbName, couchRatingsDesignID, couchRatingsView, params.Encode())
+	resp, err := c.doRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("ratings view failed: %s: %s", resp.Status, string(b))
+	}
+	var out struct {
+		Rows []couchStatsRow `json:"rows"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out.Rows, nil
+}
+
+// ratingTotals returns the count and sum of all ratings from the fully reduced view.
+func (c *CouchAdapter) ratingTotals(ctx context.Context) (ratingTotals, error) {
+	rows, err := c.queryRatings(ctx, url.Values{"reduce": {"true"}})
+	if err != nil || len(rows) == 0 {
+		return ratingTotals{}, err
+	}
+	return ratingTotals{count: rows[0].Value.Count, sum: int(rows[0].Value.Sum)}, nil
+}
+
+// RatingStats reads the histogram of shisha id from the ratings view.
+func (c *CouchAdapter) RatingStats(ctx context.Context, id uint) (*ShishaStats, error) {
+	doc, err := c.findByNumericID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+	}
+	rows, err := c.queryRatings(ctx, url.Values{
+		"group_level": {"2"},
+		"startkey":    {fmt.Sprintf("[%d]", id)},
+		"endkey":      {fmt.Sprintf("[%d,{}]", id)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	hist := newHistogram()
+	count, sum := 0, 0
+	for _, r := range rows {
+		var key []float64
+		if err := json.Unmarshal(r.Key, &key); err != nil || len(key) != 2 {
+			return nil, fmt.Errorf("ratings view: unexpected key %s", r.Key)
+		}
+		hist[histogramBucket(int(key[1]))] += r.Value.Count
+		count += r.Value.Count
+		sum += int(r.Value.Sum)
+	}
+	totals, err := c.ratingTotals(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newShishaStats(id, newRatingStats(count, sum, hist, totals), totals), nil
+}
+
+// fillStats sets the RatingStats of the given shishas from their embedded ratings (see
+// ListShishas for why not from the view) and the catalogue totals from the view.
+func (c *CouchAdapter) fillStats(ctx context.Context, items ...*Shisha) error {
+	totals, err := c.ratingTotals(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range items {
+		if s != nil {
+			s.RatingStats = statsOf(s.Ratings, totals)
+		}
+	}
+	return nil
+}
+
+// fillResultStats fills the RatingStats of the stored shishas in results.
+func (c *CouchAdapter) fillResultStats(ctx context.Context, results []BatchResult) error {
+	items := make([]*Shisha, 0, len(results))
+	for i := range results {
+		items = append(items, results[i].Shisha)
+	}
+	return c.fillStats(ctx, items...)
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// couchUserDoc is an account document stored under the deterministic _id
+// "user:<userKey>", so CouchDB itself rejects a second account with the same name.
+type couchUserDoc struct {
+	DocID        string `json:"_id,omitempty"`
+	Rev          string `json:"_rev,omitempty"`
+	Type         string `json:"type"`
+	Name         string `json:"name"`
+	Role         string `json:"role,omitempty"`
+	PasswordHash string `json:"passwordHash"`
+	CreatedAt    int64  `json:"createdAt"`
+}
+
+// couchTokenDoc is an API token document stored under "token:<id>".
+type couchTokenDoc struct {
+	DocID string `json:"_id,omitempty"`
+	Rev   string `json:"_rev,omitempty"`
+	Type  string `json:"type"`
+	ID    string `json:"id"`
+	// UserKey is userKey(User), used to list the tokens of a user.
+	UserKey    string `json:"userKey"`
+	User       string `json:"user"`
+	Name       string `json:"name"`
+	SecretHash string `json:"secretHash"`
+	CreatedAt  int64  `json:"createdAt"`
+}
+
+// userDocPath returns the escaped document path of the account name; names may contain
+// non-ASCII letters.
+func (c *CouchAdapter) userDocPath(name string) string {
+	return c.dbName + "/" + url.PathEscape("user:"+userKey(name))
+}
+
+func (c *CouchAdapter) tokenDocPath(id string) string {
+	return c.dbName + "/" + url.PathEscape("token:"+id)
+}
+
+func (d *couchUserDoc) toUser() User {
+	return withDefaultRole(User{Name: d.Name, Role: d.Role, PasswordHash: d.PasswordHash, CreatedAt: d.CreatedAt})
+}
+
+func (d *couchTokenDoc) toAPIToken() APIToken {
+	return APIToken{ID: d.ID, User: d.User, Name: d.Name, SecretHash: d.SecretHash, CreatedAt: d.CreatedAt}
+}
+
+func (c *CouchAdapter) CreateUser(ctx context.Context, u *User) (*User, error) {
+	if err := validateUser(u); err != nil {
+		return nil, err
+	}
+	doc := couchUserDoc{Type: "user", Name: u.Name, Role: u.Role, PasswordHash: u.PasswordHash, CreatedAt: u.CreatedAt}
+	resp, err := c.doRequest(ctx, "PUT", c.userDocPath(u.Name), doc)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return nil, fmt.Errorf("user %q exists: %w", u.Name, ErrConflict)
+	}
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("CreateUser failed: %s: %s", resp.Status, string(b))
+	}
+	out := *u
+	return &out, nil
+}
+
+func (c *CouchAdapter) GetUser(ctx context.Context, name string) (*User, error) {
+	doc, err := c.getUserDoc(ctx, "GetUser", name)
+	if err != nil {
+		return nil, err
+	}
+	out := doc.toUser()
+	return &out, nil
+}
+
+func (c *CouchAdapter) getUserDoc(ctx context.Context, op, name string) (*couchUserDoc, error) {
+	var doc couchUserDoc
+	err := c.getJSONDoc(ctx, op, c.userDocPath(name), &doc)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err != nil || doc.Type != "user" {
+		return nil, userNotFound(name)
+	}
+	return &doc, nil
+}
+
+func (c *CouchAdapter) ListUsers(ctx context.Context) ([]User, error) {
+	var docs []couchUserDoc
+	if err := c.findDocs(ctx, map[string]interface{}{"type": "user"}, 0, &docs); err != nil {
+		return nil, err
+	}
+	out := make([]User, 0, len(docs))
+	for i := range docs {
+		out = append(out, docs[i].toUser())
+	}
+	sortUsers(out)
+	return out, nil
+}
+
+// SetUserRole is a single read-modify-write; a concurrent change of the same account is
+// reported as ErrConflict.
+func (c *CouchAdapter) SetUserRole(ctx context.Context, name, role string) (*User, error) {
+	if err := validateRole(role); err != nil {
+		return nil, err
+	}
+	doc, err := c.getUserDoc(ctx, "SetUserRole", name)
+	if err != nil {
+		return nil, err
+	}
+	doc.Role = role
+	if err := c.putJSONDoc(ctx, "SetUserRole", url.PathEscape(doc.DocID), doc); err != nil {
+		return nil, err
+	}
+	out := doc.toUser()
+	return &out, nil
+}
+
+func (c *CouchAdapter) CreateAPIToken(ctx context.Context, t *APIToken) (*APIToken, error) {
+	if err := validateAPIToken(t); err != nil {
+		return nil, err
+	}
+	u, err := c.GetUser(ctx, t.User)
+	if err != nil {
+		return nil, err
+	}
+	doc := couchTokenDoc{
+		Type:       "token",
+		ID:         t.ID,
+		UserKey:    userKey(u.Name),
+		User:       u.Name,
+		Name:       t.Name,
+		SecretHash: t.SecretHash,
+		CreatedAt:  t.CreatedAt,
+	}
+	if err := c.putJSONDoc(ctx, "CreateAPIToken", url.PathEscape("token:"+t.ID), doc); err != nil {
+		return nil, err
+	}
+	out := doc.toAPIToken()
+	return &out, nil
+}
+
+func (c *CouchAdapter) GetAPIToken(ctx context.Context, id string) (*APIToken, error) {
+	var doc couchTokenDoc
+	err := c.getJSONDoc(ctx, "GetAPIToken", c.tokenDocPath(id), &doc)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err != nil || doc.Type != "token" {
+		return nil, tokenNotFound(id)
+	}
+	out := doc.toAPIToken()
+	return &out, nil
+}
+
+func (c *CouchAdapter) ListAPITokens(ctx context.Context, user string) ([]APIToken, error) {
+	var docs []couchTokenDoc
+	if err := c.findDocs(ctx, map[string]interface{}{"type": "token", "userKey": userKey(user)}, 0, &docs); err != nil {
+		return nil, err
+	}
+	out := make([]APIToken, 0, len(docs))
+	for i := range docs {
+		out = append(out, docs[i].toAPIToken())
+	}
+	sortTokens(out)
+	return out, nil
+}
+
+func (c *CouchAdapter) DeleteAPIToken(ctx context.Context, user, id string) error {
+	var doc couchTokenDoc
+	err := c.getJSONDoc(ctx, "DeleteAPIToken", c.tokenDocPath(id), &doc)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err != nil || doc.Type != "token" || doc.UserKey != userKey(user) {
+		return tokenNotFound(id)
+	}
+	return c.deleteDoc(ctx, "DeleteAPIToken", url.PathEscape(doc.DocID), doc.Rev)
+}
+
+// getJSONDoc loads the document at path into out; 404 becomes ErrNotFound.
+func (c *CouchAdapter) getJSONDoc(ctx context.Context, op, path string, out interface{}) error {
+	resp, err := c.doRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", op, path, ErrNotFound)
+	}
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s failed: %s: %s", op, resp.Status, string(b))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,18 @@
+package storage
+
+import "errors"
+
+// Sentinel errors returned by every Storage implementation. Adapters wrap them with
+// context (fmt.Errorf("...: %w", ErrNotFound)), so callers should test with errors.Is.
+var (
+	// ErrNotFound is returned when the addressed shisha does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a write lost a race against a concurrent update
+	// and could not be applied (e.g. CouchDB _rev mismatch after all retries).
+	ErrConflict = errors.New("conflict")
+	// ErrValidation is returned when the input is rejected before it is stored.
+	ErrValidation = errors.New("validation failed")
+	// ErrForbidden is returned when the caller may not change the addressed entry, e.g. a
+	// comment written by someone else.
+	ErrForbidden = errors.New("forbidden")
+)
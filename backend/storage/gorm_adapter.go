@@ -1,9 +1,17 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
 )
 
 // GormAdapter implements Storage backed by GORM DB.
@@ -15,137 +23,948 @@ func NewGormAdapter(db *gorm.DB) *GormAdapter {
 	return &GormAdapter{DB: db}
 }
 
-func (g *GormAdapter) ListShishas() ([]Shisha, error) {
-	// local struct mapping
-	type Manufacturer struct {
-		ID   uint   `json:"id"`
-		Name string `json:"name"`
+// Close closes the connection pool. Call it once no request uses the adapter anymore.
+func (g *GormAdapter) Close() error {
+	sqlDB, err := g.DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+var _ Snapshotter = (*GormAdapter)(nil)
+
+// Snapshot runs fn in one read-only transaction. On PostgreSQL it uses REPEATABLE READ,
+// so every query of fn sees the same committed state; SQLite transactions are
+// serializable anyway, and as SQLite has a single connection other requests wait until
+// fn returns.
+func (g *GormAdapter) Snapshot(ctx context.Context, fn func(Storage) error) error {
+	var opts *sql.TxOptions
+	if g.DB.Dialector.Name() == "postgres" {
+		opts = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	}
+	return g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&GormAdapter{DB: tx})
+	}, opts)
+}
+
+// Migrate creates or updates the shishas, manufacturers, ratings and comments tables.
+// It is safe to run on every start; GORM only adds missing tables, columns and indexes.
+func (g *GormAdapter) Migrate(ctx context.Context) error {
+	db := g.DB.WithContext(ctx)
+	// the unique indexes need every row keyed and no two rows with the same key
+	if err := migrateManufacturerKeys(db); err != nil {
+		return err
+	}
+	if err := migrateRatingKeys(db); err != nil {
+		return err
 	}
-	type Rating struct {
-		User  string `json:"user"`
-		Score int    `json:"score"`
+	if err := db.AutoMigrate(gormModels...); err != nil {
+		return err
 	}
-	type Comment struct {
-		User    string `json:"user"`
-		Message string `json:"message"`
+	// comments stored before comments had ids take their row id, unique per shisha too
+	return db.Model(&gormComment{}).Where("comment_id = 0").UpdateColumn("comment_id", gorm.Expr("id")).Error
+}
+
+var _ SetupChecker = (*GormAdapter)(nil)
+
+// CheckIndexes verifies that the tables of all models and their indexes exist.
+func (g *GormAdapter) CheckIndexes(ctx context.Context) error {
+	m := g.DB.WithContext(ctx).Migrator()
+	var missing []string
+	for _, model := range gormModels {
+		sch, err := g.parseModel(model)
+		if err != nil {
+			return err
+		}
+		if !m.HasTable(model) {
+			missing = append(missing, "table "+sch.Table)
+			continue
+		}
+		for _, idx := range sch.ParseIndexes() {
+			if !m.HasIndex(model, idx.Name) {
+				missing = append(missing, "index "+idx.Name)
+			}
+		}
 	}
-	type ShishaGorm struct {
-		ID           uint
-		Name         string
-		Flavor       string
-		Manufacturer Manufacturer
-		Ratings      []Rating
-		Comments     []Comment
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
 	}
+	return ctx.Err()
+}
 
-	var rows []Shisha
-	// naive implementation: use raw queries to map to storage.Shisha
-	// This keeps adapter simple for now; full mapping omitted for brevity.
-	if err := g.DB.Find(&rows).Error; err != nil {
+// PendingMigrations reports what Migrate would still change: "schema" while a column of
+// the models is missing, "comment_ids" while comments without an id are stored,
+// "rating_keys" while ratings without a user key are stored and "manufacturer_keys"
+// while manufacturers without a name key are stored.
+func (g *GormAdapter) PendingMigrations(ctx context.Context) ([]string, error) {
+	db := g.DB.WithContext(ctx)
+	var pending []string
+	for _, model := range gormModels {
+		sch, err := g.parseModel(model)
+		if err != nil {
+			return nil, err
+		}
+		if !db.Migrator().HasTable(model) {
+			return []string{"schema"}, nil
+		}
+		cols, err := db.Migrator().ColumnTypes(model)
+		if err != nil {
+			return nil, err
+		}
+		have := make(map[string]bool, len(cols))
+		for _, col := range cols {
+			have[strings.ToLower(col.Name())] = true
+		}
+		if !hasAllColumns(sch, have) {
+			// without the columns the data migrations cannot be checked either
+			return []string{"schema"}, nil
+		}
+	}
+	var unnumbered int64
+	if err := db.Model(&gormComment{}).Where("comment_id = 0").Count(&unnumbered).Error; err != nil {
+		return nil, err
+	}
+	if unnumbered > 0 {
+		pending = append(pending, "comment_ids")
+	}
+	var unkeyed int64
+	if err := db.Model(&gormRating{}).Where("user_key = ''").Count(&unkeyed).Error; err != nil {
+		return nil, err
+	}
+	if unkeyed > 0 {
+		pending = append(pending, "rating_keys")
+	}
+	var unkeyedManufacturers int64
+	if err := db.Model(&gormManufacturer{}).Where("name_key = ''").Count(&unkeyedManufacturers).Error; err != nil {
 		return nil, err
 	}
-	return rows, nil
+	if unkeyedManufacturers > 0 {
+		pending = append(pending, "manufacturer_keys")
+	}
+	return pending, nil
 }
 
-func (g *GormAdapter) GetShisha(id uint) (*Shisha, error) {
-	var s Shisha
-	if err := g.DB.First(&s, id).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, nil
+// migrateManufacturerKeys sets the name key of manufacturers stored before they had one.
+// Manufacturers whose names only differ in case or spacing are merged first, as
+// NormalizeManufacturers does, so the unique index can be created.
+func migrateManufacturerKeys(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&gormManufacturer{}) {
+		return nil
+	}
+	if !m.HasColumn(&gormManufacturer{}, "NameKey") {
+		if err := m.AddColumn(&gormManufacturer{}, "NameKey"); err != nil {
+			return err
+		}
+	}
+	var unkeyed int64
+	if err := db.Model(&gormManufacturer{}).Where("name_key = ''").Count(&unkeyed).Error; err != nil || unkeyed == 0 {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if _, err := normalizeManufacturerRows(tx); err != nil {
+			return err
+		}
+		var rows []gormManufacturer
+		if err := tx.Where("name_key = ''").Find(&rows).Error; err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if err := tx.Model(&gormManufacturer{ID: r.ID}).UpdateColumn("name_key", manufacturerKey(r.Name)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migrateRatingKeys sets the user key of ratings stored before ratings had one. Several
+// ratings of the same user on a shisha, stored before ratings were unique per user, are
+// folded into one (see foldRatings) so the unique index can be created.
+func migrateRatingKeys(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&gormRating{}) {
+		return nil
+	}
+	if !m.HasColumn(&gormRating{}, "UserKey") {
+		if err := m.AddColumn(&gormRating{}, "UserKey"); err != nil {
+			return err
+		}
+	}
+	var rows []gormRating
+	unkeyed := db.Model(&gormRating{}).Select("shisha_id").Where("user_key = ''")
+	if err := db.Where("shisha_id IN (?)", unkeyed).Order("shisha_id, id").Find(&rows).Error; err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for start := 0; start < len(rows); {
+			end := start
+			ratings := []Rating(nil)
+			for ; end < len(rows) && rows[end].ShishaID == rows[start].ShishaID; end++ {
+				ratings = append(ratings, rows[end].toRating())
+			}
+			if err := rekeyRatings(tx, rows[start:end], foldRatings(ratings)); err != nil {
+				return err
+			}
+			start = end
+		}
+		return nil
+	})
+}
+
+// rekeyRatings stores the user keys of rows, the ratings of one shisha. When folded
+// merged some of them, the rows are replaced by folded.
+func rekeyRatings(tx *gorm.DB, rows []gormRating, folded []Rating) error {
+	if len(folded) < len(rows) {
+		if err := tx.Where("shisha_id = ?", rows[0].ShishaID).Delete(&gormRating{}).Error; err != nil {
+			return err
+		}
+		replaced := gormRatingsFrom(rows[0].ShishaID, folded)
+		return tx.Create(&replaced).Error
+	}
+	for _, r := range rows {
+		if r.UserKey == userKey(r.User) {
+			continue
+		}
+		if err := tx.Model(&r).UpdateColumn("user_key", userKey(r.User)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *GormAdapter) parseModel(model interface{}) (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: g.DB}
+	if err := stmt.Parse(model); err != nil {
+		return nil, err
+	}
+	return stmt.Schema, nil
+}
+
+func hasAllColumns(sch *schema.Schema, have map[string]bool) bool {
+	for _, name := range sch.DBNames {
+		if !have[strings.ToLower(name)] {
+			return false
+		}
+	}
+	return true
+}
+
+// withRelations preloads everything needed to build a complete Shisha DTO.
+func withRelations(db *gorm.DB) *gorm.DB {
+	return db.Preload("Manufacturer").
+		Preload("Ratings", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Preload("Comments", func(db *gorm.DB) *gorm.DB { return db.Order("id") })
+}
+
+// gormSortColumns maps ListOptions sort keys to SQL expressions (whitelist, never user input).
+// The average is cast to a float, so a key read back for a cursor compares exactly.
+var gormSortColumns = map[string]string{
+	SortID:           "shishas.id",
+	SortName:         "LOWER(shishas.name)",
+	SortSmoked:       "shishas.smoked",
+	SortManufacturer: "LOWER(COALESCE(manufacturers.name, ''))",
+	SortRating:       "CAST((SELECT COALESCE(AVG(ratings.score), 0) FROM ratings WHERE ratings.shisha_id = shishas.id) AS DOUBLE PRECISION)",
+}
+
+func (g *GormAdapter) ListShishas(ctx context.Context, opts ListOptions) (*ShishaPage, error) {
+	opts, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := decodeKeysetCursor(opts)
+	if err != nil {
+		return nil, err
+	}
+	db := g.DB.WithContext(ctx)
+	expr := gormSortColumns[opts.Sort]
+	q := db.Model(&gormShisha{}).
+		Joins("LEFT JOIN manufacturers ON manufacturers.id = shishas.manufacturer_id")
+	if opts.Manufacturer != "" {
+		q = q.Where("LOWER(manufacturers.name) = ?", strings.ToLower(opts.Manufacturer))
+	}
+	if opts.Flavor != "" {
+		q = q.Where(`LOWER(shishas.flavor) LIKE ? ESCAPE '\'`, "%"+escapeLike(strings.ToLower(opts.Flavor))+"%")
+	}
+	dir := "ASC"
+	if opts.Desc {
+		dir = "DESC"
+	}
+	q = q.Order(expr + " " + dir).Order("shishas.id " + dir)
+	if cursor != nil {
+		op := ">"
+		if opts.Desc {
+			op = "<"
+		}
+		if opts.Sort == SortID {
+			q = q.Where("shishas.id "+op+" ?", cursor.ID)
+		} else {
+			q = q.Where(fmt.Sprintf("(%s %s ? OR (%s = ? AND shishas.id %s ?))", expr, op, expr, op), cursor.Key, cursor.Key, cursor.ID)
+		}
+	}
+
+	page := &ShishaPage{}
+	var rows []gormShisha
+	if opts.Limit == 0 {
+		if err := withRelations(q.Select("shishas.*")).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+	} else {
+		// the page's ids and sort keys first, as the database orders them; the next
+		// cursor continues after the last key as the database computed it (SQLite's
+		// LOWER, for one, only folds ASCII). One extra row tells whether a next page exists.
+		var keys []gormListKey
+		if err := q.Select("shishas.id AS id, " + expr + " AS sort_key").Limit(opts.Limit + 1).Scan(&keys).Error; err != nil {
+			return nil, err
+		}
+		if len(keys) > opts.Limit {
+			keys = keys[:opts.Limit]
+			last := keys[len(keys)-1]
+			key, err := last.key(opts.Sort)
+			if err != nil {
+				return nil, err
+			}
+			page.NextCursor = encodeKeysetCursor(keysetCursor{Sort: opts.Sort, Desc: opts.Desc, Key: key, ID: last.ID})
+		}
+		if rows, err = gormShishasInOrder(db, keys); err != nil {
+			return nil, err
+		}
+	}
+	totals, err := gormRatingTotals(db)
+	if err != nil {
+		return nil, err
+	}
+	page.Items = make([]Shisha, 0, len(rows))
+	for i := range rows {
+		page.Items = append(page.Items, rows[i].toShisha())
+	}
+	withStats(page.Items, totals)
+	return page, nil
+}
+
+// gormListKey is the id and sort key of one listed shisha.
+type gormListKey struct {
+	ID      uint
+	SortKey string
+}
+
+// key returns SortKey typed as the cursor of sortBy holds it; nil for SortID.
+func (k gormListKey) key(sortBy string) (interface{}, error) {
+	switch sortBy {
+	case SortName, SortManufacturer:
+		return k.SortKey, nil
+	case SortSmoked:
+		return strconv.ParseInt(k.SortKey, 10, 64)
+	case SortRating:
+		return strconv.ParseFloat(k.SortKey, 64)
+	}
+	return nil, nil
+}
+
+// gormShishasInOrder loads the shishas of keys with their relations, in the order of
+// keys. Shishas deleted meanwhile are left out.
+func gormShishasInOrder(db *gorm.DB, keys []gormListKey) ([]gormShisha, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, k.ID)
+	}
+	var rows []gormShisha
+	if err := withRelations(db).Where("id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*gormShisha, len(rows))
+	for i := range rows {
+		byID[rows[i].ID] = &rows[i]
+	}
+	out := make([]gormShisha, 0, len(rows))
+	for _, id := range ids {
+		if r := byID[id]; r != nil {
+			out = append(out, *r)
 		}
+	}
+	return out, nil
+}
+
+// escapeLike escapes LIKE wildcards so user input matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (g *GormAdapter) GetShisha(ctx context.Context, id uint) (*Shisha, error) {
+	return g.getShisha(g.DB.WithContext(ctx), id)
+}
+
+func (g *GormAdapter) getShisha(db *gorm.DB, id uint) (*Shisha, error) {
+	var row gormShisha
+	if err := withRelations(db).First(&row, id).Error; err != nil {
+		return nil, translateGormError(err, id)
+	}
+	totals, err := gormRatingTotals(db)
+	if err != nil {
 		return nil, err
 	}
+	s := row.toShisha()
+	s.RatingStats = statsOf(s.Ratings, totals)
 	return &s, nil
 }
 
-func (g *GormAdapter) CreateShisha(s *Shisha) (*Shisha, error) {
-	if err := g.DB.Create(s).Error; err != nil {
+// RatingStats aggregates the ratings of shisha id in SQL.
+func (g *GormAdapter) RatingStats(ctx context.Context, id uint) (*ShishaStats, error) {
+	db := g.DB.WithContext(ctx)
+	if err := g.ensureExists(db, id); err != nil {
+		return nil, err
+	}
+	var buckets []struct {
+		Score int
+		N     int
+	}
+	err := db.Model(&gormRating{}).Select("score, COUNT(*) AS n").
+		Where("shisha_id = ?", id).Group("score").Scan(&buckets).Error
+	if err != nil {
 		return nil, err
 	}
-	return s, nil
+	totals, err := gormRatingTotals(db)
+	if err != nil {
+		return nil, err
+	}
+	hist := newHistogram()
+	count, sum := 0, 0
+	for _, b := range buckets {
+		hist[histogramBucket(b.Score)] += b.N
+		count += b.N
+		sum += b.Score * b.N
+	}
+	return newShishaStats(id, newRatingStats(count, sum, hist, totals), totals), nil
 }
 
-func (g *GormAdapter) UpdateShisha(id uint, s *Shisha) (*Shisha, error) {
-	var existing Shisha
-	if err := g.DB.First(&existing, id).Error; err != nil {
+// gormRatingTotals sums up all stored ratings.
+func gormRatingTotals(db *gorm.DB) (ratingTotals, error) {
+	var row struct {
+		N     int
+		Total int
+	}
+	err := db.Model(&gormRating{}).Select("COUNT(*) AS n, COALESCE(SUM(score), 0) AS total").Scan(&row).Error
+	return ratingTotals{count: row.N, sum: row.Total}, err
+}
+
+func (g *GormAdapter) CreateShisha(ctx context.Context, s *Shisha) (*Shisha, error) {
+	if err := validateShisha(s); err != nil {
 		return nil, err
 	}
-	s.ID = id
-	if err := g.DB.Save(s).Error; err != nil {
+	var out *Shisha
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		mf, err := resolveManufacturer(tx, s.Manufacturer, false)
+		if err != nil {
+			return err
+		}
+		row := gormShisha{Name: s.Name, Flavor: s.Flavor, ManufacturerID: mf.id(), Smoked: s.Smoked}
+		if err := tx.Create(&row).Error; err != nil {
+			return err
+		}
+		if err := replaceEntries(tx, row.ID, s); err != nil {
+			return err
+		}
+		out, err = g.getShisha(tx, row.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// gormBatchSize is the number of rows per INSERT statement in CreateShishas.
+const gormBatchSize = 200
+
+func (g *GormAdapter) CreateShishas(ctx context.Context, items []Shisha) ([]BatchResult, error) {
+	return g.insertBatch(ctx, items, false)
+}
+
+func (g *GormAdapter) RestoreShishas(ctx context.Context, items []Shisha) ([]BatchResult, error) {
+	return g.insertBatch(ctx, items, true)
+}
+
+// insertBatch writes items in one transaction with batched INSERTs. With keepIDs the
+// rows keep the ids of the items (and the id sequence is moved past them), otherwise
+// the database assigns new ones.
+func (g *GormAdapter) insertBatch(ctx context.Context, items []Shisha, keepIDs bool) ([]BatchResult, error) {
+	results := make([]BatchResult, len(items))
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		validate := validateShisha
+		taken := map[uint]bool{}
+		if keepIDs {
+			validate = validateRestore
+			ids := make([]uint, 0, len(items))
+			for i := range items {
+				ids = append(ids, items[i].ID)
+			}
+			var existing []uint
+			if err := tx.Model(&gormShisha{}).Where("id IN ?", ids).Pluck("id", &existing).Error; err != nil {
+				return err
+			}
+			for _, id := range existing {
+				taken[id] = true
+			}
+		}
+		// resolve every distinct manufacturer once instead of per item
+		manufacturers := make(map[string]*gormManufacturer)
+		rows := make([]gormShisha, 0, len(items))
+		index := make([]int, 0, len(items)) // rows[k] belongs to items[index[k]]
+		rowManufacturers := make([]*gormManufacturer, 0, len(items))
+		for i := range items {
+			if err := validate(&items[i]); err != nil {
+				results[i].Err = err
+				continue
+			}
+			if taken[items[i].ID] {
+				results[i].Err = fmt.Errorf("shisha %d: %w", items[i].ID, ErrConflict)
+				continue
+			}
+			key := manufacturerRefKey(items[i].Manufacturer)
+			mf, ok := manufacturers[key]
+			if !ok {
+				var err error
+				mf, err = resolveManufacturer(tx, items[i].Manufacturer, keepIDs)
+				if errors.Is(err, ErrValidation) {
+					results[i].Err = err
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				manufacturers[key] = mf
+			}
+			row := gormShisha{Name: items[i].Name, Flavor: items[i].Flavor, ManufacturerID: mf.id(), Smoked: items[i].Smoked}
+			if keepIDs {
+				row.ID = items[i].ID
+				taken[row.ID] = true // duplicates within the batch
+			}
+			rows = append(rows, row)
+			rowManufacturers = append(rowManufacturers, mf)
+			index = append(index, i)
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		if err := tx.CreateInBatches(&rows, gormBatchSize).Error; err != nil {
+			return err
+		}
+		var ratings []gormRating
+		var comments []gormComment
+		for k, row := range rows {
+			ratings = append(ratings, gormRatingsFrom(row.ID, items[index[k]].Ratings)...)
+			comments = append(comments, gormCommentsFrom(row.ID, items[index[k]].Comments)...)
+		}
+		if len(ratings) > 0 {
+			if err := tx.CreateInBatches(&ratings, gormBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		if len(comments) > 0 {
+			if err := tx.CreateInBatches(&comments, gormBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		if keepIDs {
+			for _, table := range []string{"shishas", "manufacturers"} {
+				if err := syncIDSequence(tx, table); err != nil {
+					return err
+				}
+			}
+		}
+		totals, err := gormRatingTotals(tx)
+		if err != nil {
+			return err
+		}
+		for k, row := range rows {
+			out := items[index[k]]
+			out.ID = row.ID
+			out.Manufacturer = rowManufacturers[k].toManufacturer()
+			out.RatingStats = statsOf(out.Ratings, totals)
+			results[index[k]].Shisha = &out
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	return s, nil
+	return results, nil
 }
 
-func (g *GormAdapter) DeleteShisha(id uint) error {
-	if err := g.DB.Delete(&Shisha{}, id).Error; err != nil {
+// syncIDSequence moves the Postgres id sequence of table (a constant, never user input)
+// past the highest stored id after rows were inserted with explicit ids. SQLite derives
+// the next rowid from the table itself, and CockroachDB's default unique_rowid() ids
+// have no sequence.
+func syncIDSequence(tx *gorm.DB, table string) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	var seq *string
+	if err := tx.Raw("SELECT pg_get_serial_sequence(?, 'id')", table).Scan(&seq).Error; err != nil {
 		return err
 	}
-	return nil
+	if seq == nil || *seq == "" {
+		return nil
+	}
+	return tx.Exec("SELECT setval(?, (SELECT COALESCE(MAX(id), 1) FROM "+table+"))", *seq).Error
 }
 
-func (g *GormAdapter) AddRating(id uint, user string, score int) error {
-	// simple GORM-backed implementation: insert into ratings table
-	type ratingGorm struct {
-		ID       uint   `gorm:"primaryKey"`
-		ShishaID uint   `gorm:"column:shisha_id"`
-		User     string `gorm:"column:user"`
-		Score    int    `gorm:"column:score"`
+func (g *GormAdapter) UpdateShisha(ctx context.Context, id uint, s *Shisha) (*Shisha, error) {
+	if err := validateShisha(s); err != nil {
+		return nil, err
+	}
+	var out *Shisha
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing gormShisha
+		if err := tx.First(&existing, id).Error; err != nil {
+			return translateGormError(err, id)
+		}
+		mf, err := resolveManufacturer(tx, s.Manufacturer, false)
+		if err != nil {
+			return err
+		}
+		updates := map[string]interface{}{
+			"name":            s.Name,
+			"flavor":          s.Flavor,
+			"manufacturer_id": mf.id(),
+		}
+		if err := tx.Model(&existing).Updates(updates).Error; err != nil {
+			return err
+		}
+		out, err = g.getShisha(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	r := ratingGorm{
-		ShishaID: id,
-		User:     user,
-		Score:    score,
+	return out, nil
+}
+
+func (g *GormAdapter) ReplaceShisha(ctx context.Context, id uint, s *Shisha) (*Shisha, error) {
+	if err := validateStored(s); err != nil {
+		return nil, err
 	}
-	if err := g.DB.Create(&r).Error; err != nil {
+	var out *Shisha
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing gormShisha
+		if err := tx.First(&existing, id).Error; err != nil {
+			return translateGormError(err, id)
+		}
+		mf, err := resolveManufacturer(tx, s.Manufacturer, false)
+		if err != nil {
+			return err
+		}
+		updates := map[string]interface{}{
+			"name":            s.Name,
+			"flavor":          s.Flavor,
+			"manufacturer_id": mf.id(),
+			"smoked":          s.Smoked,
+		}
+		if err := tx.Model(&existing).Updates(updates).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("shisha_id = ?", id).Delete(&gormRating{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("shisha_id = ?", id).Delete(&gormComment{}).Error; err != nil {
+			return err
+		}
+		if err := replaceEntries(tx, id, s); err != nil {
+			return err
+		}
+		out, err = g.getShisha(tx, id)
 		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// replaceEntries inserts the ratings and comments carried by s for the given shisha.
+func replaceEntries(tx *gorm.DB, id uint, s *Shisha) error {
+	if ratings := gormRatingsFrom(id, s.Ratings); len(ratings) > 0 {
+		if err := tx.Create(&ratings).Error; err != nil {
+			return err
+		}
+	}
+	if comments := gormCommentsFrom(id, s.Comments); len(comments) > 0 {
+		if err := tx.Create(&comments).Error; err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (g *GormAdapter) AddComment(id uint, user, message string) error {
-	// simple GORM-backed implementation: insert into comments table
-	type commentGorm struct {
-		ID       uint   `gorm:"primaryKey"`
-		ShishaID uint   `gorm:"column:shisha_id"`
-		User     string `gorm:"column:user"`
-		Message  string `gorm:"column:message"`
+// resolveManufacturer returns the manufacturers row a shisha write refers to (see
+// Storage), creating it for an unknown name; nil means no manufacturer. With keepID a
+// new row takes over the id carried by ref when that id is free (restore).
+func resolveManufacturer(tx *gorm.DB, ref Manufacturer, keepID bool) (*gormManufacturer, error) {
+	name := cleanManufacturerName(ref.Name)
+	if name == "" {
+		if ref.ID == 0 {
+			return nil, nil
+		}
+		var row gormManufacturer
+		if err := tx.First(&row, ref.ID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, fmt.Errorf("%w: unknown manufacturer %d", ErrValidation, ref.ID)
+			}
+			return nil, err
+		}
+		return &row, nil
+	}
+	row, err := findManufacturerByName(tx, name)
+	if err != nil || row != nil {
+		return row, err
+	}
+	row = &gormManufacturer{Name: name, NameKey: manufacturerKey(name)}
+	if keepID && ref.ID != 0 {
+		var count int64
+		if err := tx.Model(&gormManufacturer{}).Where("id = ?", ref.ID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			row.ID = ref.ID
+		}
+	}
+	inserted, err := insertManufacturer(tx, row)
+	if err != nil || inserted {
+		return row, err
 	}
-	c := commentGorm{
-		ShishaID: id,
-		User:     user,
-		Message:  message,
+	// a concurrent write created the name meanwhile
+	row, err = findManufacturerByName(tx, name)
+	if err == nil && row == nil {
+		err = fmt.Errorf("manufacturer %q: %w", name, ErrConflict)
 	}
-	if err := g.DB.Create(&c).Error; err != nil {
+	return row, err
+}
+
+func (g *GormAdapter) DeleteShisha(ctx context.Context, id uint) error {
+	return g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// delete children explicitly so databases without enforced FKs stay consistent
+		if err := tx.Where("shisha_id = ?", id).Delete(&gormRating{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("shisha_id = ?", id).Delete(&gormComment{}).Error; err != nil {
+			return err
+		}
+		res := tx.Delete(&gormShisha{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+		}
+		return nil
+	})
+}
+
+func (g *GormAdapter) AddRating(ctx context.Context, id uint, user string, score int) error {
+	if err := validateRating(&user, score); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	return g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := g.ensureExists(tx, id); err != nil {
+			return err
+		}
+		// the unique index on (shisha_id, user_key) tells a first rating from a later one,
+		// also when the same user rates concurrently
+		row := gormRatingsFrom(id, []Rating{{User: user, Score: score, Timestamp: now}})[0]
+		res := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "shisha_id"}, {Name: "user_key"}},
+			DoNothing: true,
+		}).Create(&row)
+		if res.Error != nil || res.RowsAffected == 1 {
+			return res.Error
+		}
+		var own gormRating
+		if err := tx.Where(ratingOf(id, user)).Take(&own).Error; err != nil {
+			return err
+		}
+		next := setRating([]Rating{own.toRating()}, user, score, now)[0]
+		own.User, own.Score, own.Timestamp, own.History = next.User, next.Score, next.Timestamp, next.History
+		return tx.Select("user", "score", "timestamp", "history").Save(&own).Error
+	})
+}
+
+func (g *GormAdapter) DeleteRating(ctx context.Context, id uint, user string) error {
+	db := g.DB.WithContext(ctx)
+	if err := g.ensureExists(db, id); err != nil {
 		return err
 	}
+	user = strings.TrimSpace(user)
+	res := db.Where(ratingOf(id, user)).Delete(&gormRating{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ratingNotFound(id, user)
+	}
 	return nil
 }
 
-func (g *GormAdapter) AddSmoked(id uint) error {
+// ratingOf selects the rating of user on shisha id, matching the name case-insensitively.
+func ratingOf(id uint, user string) map[string]interface{} {
+	return map[string]interface{}{"shisha_id": id, "user_key": userKey(user)}
+}
+
+func (g *GormAdapter) AddComment(ctx context.Context, id uint, user, message string, parentID uint) (*Comment, error) {
+	if err := validateComment(&user, &message); err != nil {
+		return nil, err
+	}
+	var out Comment
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		comments, err := lockComments(tx, id)
+		if err != nil {
+			return err
+		}
+		_, out, err = appendComment(comments, user, message, parentID, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		return tx.Create(&gormCommentsFrom(id, []Comment{out})[0]).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (g *GormAdapter) UpdateComment(ctx context.Context, id, cid uint, author, message string) (*Comment, error) {
+	if err := validateMessage(&message); err != nil {
+		return nil, err
+	}
+	var out Comment
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		comments, err := lockComments(tx, id)
+		if err != nil {
+			return err
+		}
+		out, err = editComment(comments, id, cid, author, message, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		return tx.Model(&gormComment{}).Where("shisha_id = ? AND comment_id = ?", id, cid).
+			Updates(map[string]interface{}{"message": out.Message, "edited_at": out.EditedAt}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (g *GormAdapter) DeleteComment(ctx context.Context, id, cid uint, author string) error {
+	return g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		comments, err := lockComments(tx, id)
+		if err != nil {
+			return err
+		}
+		if _, err := removeComment(comments, id, cid, author); err != nil {
+			return err
+		}
+		return tx.Where("shisha_id = ? AND (comment_id = ? OR parent_id = ?)", id, cid, cid).Delete(&gormComment{}).Error
+	})
+}
+
+// lockComments loads the comments of shisha id, locking the shisha on PostgreSQL so
+// concurrent writers do not hand out the same comment id.
+func lockComments(tx *gorm.DB, id uint) ([]Comment, error) {
+	q := tx.Select("id")
+	if tx.Dialector.Name() == "postgres" {
+		q = q.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	var row gormShisha
+	if err := q.First(&row, id).Error; err != nil {
+		return nil, translateGormError(err, id)
+	}
+	var rows []gormComment
+	if err := tx.Where("shisha_id = ?", id).Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	comments := make([]Comment, 0, len(rows))
+	for i := range rows {
+		comments = append(comments, rows[i].toComment())
+	}
+	return comments, nil
+}
+
+func (g *GormAdapter) AddSmoked(ctx context.Context, id uint) error {
 	// increment smoked counter atomically
-	if err := g.DB.Model(&Shisha{}).Where("id = ?", id).UpdateColumn("smoked", gorm.Expr("COALESCE(smoked,0) + ?", 1)).Error; err != nil {
+	res := g.DB.WithContext(ctx).Model(&gormShisha{}).Where("id = ?", id).UpdateColumn("smoked", gorm.Expr("COALESCE(smoked,0) + ?", 1))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// ensureExists returns ErrNotFound unless a shisha with the given id exists.
+func (g *GormAdapter) ensureExists(db *gorm.DB, id uint) error {
+	var count int64
+	if err := db.Model(&gormShisha{}).Where("id = ?", id).Count(&count).Error; err != nil {
 		return err
 	}
+	if count == 0 {
+		return fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+	}
 	return nil
 }
 
+// translateGormError maps gorm.ErrRecordNotFound to the package's ErrNotFound.
+func translateGormError(err error, id uint) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+	}
+	return err
+}
+
 // Health checks connectivity to the underlying SQL database.
-func (g *GormAdapter) Health() error {
+// Health pings the database and checks that the tables of the models exist: with
+// DB_AUTO_MIGRATE off the schema is managed externally and may not be there (yet),
+// which would fail every request.
+func (g *GormAdapter) Health(ctx context.Context) error {
 	sqlDB, err := g.DB.DB()
 	if err != nil {
 		return err
 	}
 	// Ping the underlying database connection.
-	return sqlDB.Ping()
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return err
+	}
+	m := g.DB.WithContext(ctx).Migrator()
+	var missing []string
+	for _, model := range gormModels {
+		if !m.HasTable(model) {
+			sch, err := g.parseModel(model)
+			if err != nil {
+				return err
+			}
+			missing = append(missing, sch.Table)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("schema not migrated, missing tables %s (run with DB_AUTO_MIGRATE=true or apply the migrations)", strings.Join(missing, ", "))
+	}
+	return nil
 }
 
 // DBInfo returns basic information about the SQL storage.
 // For most SQL deployments in this project we cannot reliably detect cluster membership,
 // so return a sensible default (single-node) to keep responses consistent.
-func (g *GormAdapter) DBInfo() (*DBInfo, error) {
+func (g *GormAdapter) DBInfo(ctx context.Context) (*DBInfo, error) {
 	// Attempt a simple ping first to ensure DB is reachable.
-	if err := g.Health(); err != nil {
+	if err := g.Health(ctx); err != nil {
 		return nil, err
 	}
 	return &DBInfo{IsCluster: false, Nodes: 1}, nil
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// slowQueryThreshold is the duration above which a SQL statement is logged as slow.
+const slowQueryThreshold = 200 * time.Millisecond
+
+// gormLogger sends GORM's log output to slog. SQL statements carry user-supplied values,
+// so they are logged at debug level only; failures and slow statements are logged
+// without them.
+type gormLogger struct {
+	level logger.LogLevel
+}
+
+// GormLogger returns the GORM logger used by the SQL adapters.
+func GormLogger() logger.Interface { return gormLogger{level: logger.Warn} }
+
+func (l gormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	return gormLogger{level: level}
+}
+
+func (l gormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= logger.Info {
+		slog.InfoContext(ctx, "gorm: "+fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l gormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= logger.Warn {
+		slog.WarnContext(ctx, "gorm: "+fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l gormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= logger.Error {
+		slog.ErrorContext(ctx, "gorm: "+fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level <= logger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= logger.Error:
+		slog.WarnContext(ctx, "gorm: statement failed", "error", err, "duration_ms", elapsed.Seconds()*1000)
+	case elapsed > slowQueryThreshold && l.level >= logger.Warn:
+		slog.WarnContext(ctx, "gorm: slow statement", "duration_ms", elapsed.Seconds()*1000)
+	}
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		sql, rows := fc()
+		slog.DebugContext(ctx, "gorm: statement", "sql", sql, "rows", rows, "duration_ms", elapsed.Seconds()*1000)
+	}
+}
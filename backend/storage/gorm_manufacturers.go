@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func (g *GormAdapter) ListManufacturers(ctx context.Context) ([]Manufacturer, error) {
+	var rows []gormManufacturer
+	if err := g.DB.WithContext(ctx).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]Manufacturer, 0, len(rows))
+	for i := range rows {
+		out = append(out, rows[i].toManufacturer())
+	}
+	sortManufacturers(out)
+	return out, nil
+}
+
+func (g *GormAdapter) GetManufacturer(ctx context.Context, id uint) (*Manufacturer, error) {
+	row, err := getManufacturer(g.DB.WithContext(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+	m := row.toManufacturer()
+	return &m, nil
+}
+
+func (g *GormAdapter) CreateManufacturer(ctx context.Context, m *Manufacturer) (*Manufacturer, error) {
+	if err := validateManufacturer(m); err != nil {
+		return nil, err
+	}
+	var out Manufacturer
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		existing, err := findManufacturerByName(tx, m.Name)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("manufacturer %q exists as %d: %w", m.Name, existing.ID, ErrConflict)
+		}
+		row := gormManufacturer{Name: m.Name, NameKey: manufacturerKey(m.Name)}
+		inserted, err := insertManufacturer(tx, &row)
+		if err != nil {
+			return err
+		}
+		if !inserted {
+			return fmt.Errorf("manufacturer %q was created concurrently: %w", m.Name, ErrConflict)
+		}
+		out = row.toManufacturer()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (g *GormAdapter) UpdateManufacturer(ctx context.Context, id uint, m *Manufacturer) (*Manufacturer, error) {
+	if err := validateManufacturer(m); err != nil {
+		return nil, err
+	}
+	var out Manufacturer
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		row, err := getManufacturer(tx, id)
+		if err != nil {
+			return err
+		}
+		existing, err := findManufacturerByName(tx, m.Name)
+		if err != nil {
+			return err
+		}
+		if existing != nil && existing.ID != id {
+			return fmt.Errorf("manufacturer %q exists as %d: %w", m.Name, existing.ID, ErrConflict)
+		}
+		// shishas reference the row by id, so the new name applies to all of them at once
+		err = tx.Model(row).Updates(map[string]interface{}{"name": m.Name, "name_key": manufacturerKey(m.Name)}).Error
+		if isDuplicateKey(tx, err) {
+			return fmt.Errorf("manufacturer %q was created concurrently: %w", m.Name, ErrConflict)
+		}
+		if err != nil {
+			return err
+		}
+		out = Manufacturer{ID: id, Name: m.Name}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (g *GormAdapter) DeleteManufacturer(ctx context.Context, id uint) error {
+	return g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if _, err := getManufacturer(tx, id); err != nil {
+			return err
+		}
+		var uses int64
+		if err := tx.Model(&gormShisha{}).Where("manufacturer_id = ?", id).Count(&uses).Error; err != nil {
+			return err
+		}
+		if uses > 0 {
+			return fmt.Errorf("manufacturer %d is used by %d shishas: %w", id, uses, ErrConflict)
+		}
+		return tx.Delete(&gormManufacturer{}, id).Error
+	})
+}
+
+func (g *GormAdapter) MergeManufacturers(ctx context.Context, into uint, ids []uint) (*Manufacturer, error) {
+	ids, err := validateMerge(into, ids)
+	if err != nil {
+		return nil, err
+	}
+	var out Manufacturer
+	err = g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		target, err := getManufacturer(tx, into)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if _, err := getManufacturer(tx, id); err != nil {
+				return err
+			}
+		}
+		if err := mergeManufacturerRows(tx, into, ids); err != nil {
+			return err
+		}
+		out = target.toManufacturer()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (g *GormAdapter) NormalizeManufacturers(ctx context.Context) ([]ManufacturerMerge, error) {
+	var plan []manufacturerGroup
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) (err error) {
+		plan, err = normalizeManufacturerRows(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeReport(plan), nil
+}
+
+// normalizeManufacturerRows merges and renames the manufacturers rows as planned by
+// planNormalization and returns the plan.
+func normalizeManufacturerRows(tx *gorm.DB) ([]manufacturerGroup, error) {
+	var rows []gormManufacturer
+	if err := tx.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	var counts []struct {
+		ManufacturerID uint
+		Uses           int
+	}
+	if err := tx.Model(&gormShisha{}).
+		Select("manufacturer_id, COUNT(*) AS uses").
+		Where("manufacturer_id IS NOT NULL").
+		Group("manufacturer_id").
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	uses := make(map[uint]int, len(counts))
+	for _, c := range counts {
+		uses[c.ManufacturerID] = c.Uses
+	}
+	all := make([]manufacturerUsage, 0, len(rows))
+	for i := range rows {
+		all = append(all, manufacturerUsage{Manufacturer: rows[i].toManufacturer(), uses: uses[rows[i].ID]})
+	}
+	plan := planNormalization(all)
+	for _, group := range plan {
+		if len(group.merge) > 0 {
+			ids := make([]uint, 0, len(group.merge))
+			for _, m := range group.merge {
+				ids = append(ids, m.ID)
+			}
+			if err := mergeManufacturerRows(tx, group.keep.ID, ids); err != nil {
+				return nil, err
+			}
+		}
+		if group.renamed {
+			renamed := map[string]interface{}{"name": group.keep.Name, "name_key": manufacturerKey(group.keep.Name)}
+			if err := tx.Model(&gormManufacturer{ID: group.keep.ID}).Updates(renamed).Error; err != nil {
+				return nil, err
+			}
+		}
+	}
+	return plan, nil
+}
+
+// mergeManufacturerRows points the shishas of the manufacturers ids to into and deletes
+// those manufacturers.
+func mergeManufacturerRows(tx *gorm.DB, into uint, ids []uint) error {
+	if err := tx.Model(&gormShisha{}).Where("manufacturer_id IN ?", ids).Update("manufacturer_id", into).Error; err != nil {
+		return err
+	}
+	return tx.Delete(&gormManufacturer{}, ids).Error
+}
+
+// getManufacturer loads the manufacturers row with the given id (ErrNotFound if missing).
+func getManufacturer(tx *gorm.DB, id uint) (*gormManufacturer, error) {
+	var row gormManufacturer
+	if err := tx.First(&row, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("manufacturer %d: %w", id, ErrNotFound)
+		}
+		return nil, err
+	}
+	return &row, nil
+}
+
+// findManufacturerByName returns the manufacturer named name ignoring case and spacing
+// (manufacturerKey), or nil.
+func findManufacturerByName(tx *gorm.DB, name string) (*gormManufacturer, error) {
+	var rows []gormManufacturer
+	err := tx.Where("name_key = ?", manufacturerKey(name)).Limit(1).Find(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return &rows[0], nil
+}
+
+// insertManufacturer inserts row unless the unique name key (or the id) is taken, which
+// it reports as inserted == false instead of failing the transaction.
+func insertManufacturer(tx *gorm.DB, row *gormManufacturer) (inserted bool, err error) {
+	res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(row)
+	return res.RowsAffected == 1, res.Error
+}
+
+// isDuplicateKey reports whether err is a unique constraint violation of the database.
+func isDuplicateKey(tx *gorm.DB, err error) bool {
+	if err == nil {
+		return false
+	}
+	if t, ok := tx.Dialector.(gorm.ErrorTranslator); ok {
+		err = t.Translate(err)
+	}
+	return errors.Is(err, gorm.ErrDuplicatedKey)
+}
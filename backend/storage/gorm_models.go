@@ -0,0 +1,162 @@
+package storage
+
+// GORM persistence model. These rows are private to the adapter; handlers only ever
+// see the Shisha DTO, which is converted from/to these structs below.
+
+type gormManufacturer struct {
+	ID   uint   `gorm:"primaryKey"`
+	Name string `gorm:"size:255;not null;index"`
+	// NameKey is manufacturerKey(Name); its unique index keeps concurrent creates of the
+	// same name from both inserting. Rows stored before it existed are keyed by Migrate.
+	NameKey string `gorm:"size:255;not null;default:'';uniqueIndex"`
+}
+
+func (gormManufacturer) TableName() string { return "manufacturers" }
+
+// id returns the foreign key value referencing r (nil for no manufacturer).
+func (r *gormManufacturer) id() *uint {
+	if r == nil {
+		return nil
+	}
+	return &r.ID
+}
+
+func (r *gormManufacturer) toManufacturer() Manufacturer {
+	if r == nil {
+		return Manufacturer{}
+	}
+	return Manufacturer{ID: r.ID, Name: r.Name}
+}
+
+type gormShisha struct {
+	ID             uint              `gorm:"primaryKey"`
+	Name           string            `gorm:"size:255;not null"`
+	Flavor         string            `gorm:"size:255"`
+	ManufacturerID *uint             `gorm:"index"`
+	Manufacturer   *gormManufacturer `gorm:"foreignKey:ManufacturerID;constraint:OnDelete:SET NULL"`
+	Smoked         int               `gorm:"not null;default:0"`
+	Ratings        []gormRating      `gorm:"foreignKey:ShishaID;constraint:OnDelete:CASCADE"`
+	Comments       []gormComment     `gorm:"foreignKey:ShishaID;constraint:OnDelete:CASCADE"`
+}
+
+func (gormShisha) TableName() string { return "shishas" }
+
+type gormRating struct {
+	ID       uint   `gorm:"primaryKey"`
+	ShishaID uint   `gorm:"not null;index;uniqueIndex:idx_ratings_shisha_user_key,priority:1"`
+	User     string `gorm:"size:255"`
+	// UserKey is userKey(User); the unique index keeps one rating per user and shisha
+	// whatever the case of the name. Rows stored before it existed are keyed by Migrate.
+	UserKey   string `gorm:"size:255;not null;default:'';uniqueIndex:idx_ratings_shisha_user_key,priority:2"`
+	Score     int
+	Timestamp int64
+	// History holds the replaced scores as JSON; it is only ever read with the rating.
+	History []RatingRevision `gorm:"serializer:json;type:text"`
+}
+
+func (gormRating) TableName() string { return "ratings" }
+
+func (r *gormRating) toRating() Rating {
+	return Rating{User: r.User, Score: r.Score, Timestamp: r.Timestamp, History: r.History}
+}
+
+type gormComment struct {
+	ID       uint `gorm:"primaryKey"`
+	ShishaID uint `gorm:"not null;index"`
+	// CommentID is the id of the comment within its shisha (Comment.ID), ParentID the
+	// CommentID it replies to. Rows stored before comments had ids are numbered by Migrate.
+	CommentID uint   `gorm:"not null;default:0"`
+	ParentID  uint   `gorm:"not null;default:0"`
+	User      string `gorm:"size:255"`
+	Message   string `gorm:"type:text"`
+	CreatedAt int64  `gorm:"autoCreateTime:false"`
+	EditedAt  int64
+}
+
+func (gormComment) TableName() string { return "comments" }
+
+type gormUser struct {
+	// NameKey is userKey(Name), the case-insensitive identity of the account.
+	NameKey      string `gorm:"primaryKey;size:50"`
+	Name         string `gorm:"size:50;not null"`
+	Role         string `gorm:"size:20;not null;default:member"`
+	PasswordHash string `gorm:"size:255;not null"`
+	CreatedAt    int64  `gorm:"autoCreateTime:false"`
+}
+
+func (gormUser) TableName() string { return "users" }
+
+func (r *gormUser) toUser() User {
+	return withDefaultRole(User{Name: r.Name, Role: r.Role, PasswordHash: r.PasswordHash, CreatedAt: r.CreatedAt})
+}
+
+type gormAPIToken struct {
+	ID         string `gorm:"primaryKey;size:64"`
+	UserKey    string `gorm:"size:50;not null;index"`
+	UserName   string `gorm:"size:50;not null"`
+	Name       string `gorm:"size:100"`
+	SecretHash string `gorm:"size:255;not null"`
+	CreatedAt  int64  `gorm:"autoCreateTime:false"`
+}
+
+func (gormAPIToken) TableName() string { return "api_tokens" }
+
+func (r *gormAPIToken) toAPIToken() APIToken {
+	return APIToken{ID: r.ID, User: r.UserName, Name: r.Name, SecretHash: r.SecretHash, CreatedAt: r.CreatedAt}
+}
+
+// gormModels lists every table managed by GormAdapter.Migrate, parents first.
+var gormModels = []interface{}{
+	&gormManufacturer{},
+	&gormShisha{},
+	&gormRating{},
+	&gormComment{},
+	&gormUser{},
+	&gormAPIToken{},
+}
+
+func (r *gormShisha) toShisha() Shisha {
+	s := Shisha{
+		ID:     r.ID,
+		Name:   r.Name,
+		Flavor: r.Flavor,
+		Smoked: r.Smoked,
+	}
+	s.Manufacturer = r.Manufacturer.toManufacturer()
+	for _, rt := range r.Ratings {
+		s.Ratings = append(s.Ratings, rt.toRating())
+	}
+	for _, cm := range r.Comments {
+		s.Comments = append(s.Comments, cm.toComment())
+	}
+	return s
+}
+
+func gormRatingsFrom(shishaID uint, in []Rating) []gormRating {
+	out := make([]gormRating, 0, len(in))
+	for _, r := range in {
+		out = append(out, gormRating{ShishaID: shishaID, User: r.User, UserKey: userKey(r.User), Score: r.Score, Timestamp: r.Timestamp, History: r.History})
+	}
+	return out
+}
+
+func (r *gormComment) toComment() Comment {
+	return Comment{ID: r.CommentID, ParentID: r.ParentID, User: r.User, Message: r.Message, CreatedAt: r.CreatedAt, EditedAt: r.EditedAt}
+}
+
+func gormCommentsFrom(shishaID uint, in []Comment) []gormComment {
+	in = numberComments(in)
+	out := make([]gormComment, 0, len(in))
+	for _, c := range in {
+		out = append(out, gormComment{
+			ShishaID:  shishaID,
+			CommentID: c.ID,
+			ParentID:  c.ParentID,
+			User:      c.User,
+			Message:   c.Message,
+			CreatedAt: c.CreatedAt,
+			EditedAt:  c.EditedAt,
+		})
+	}
+	return out
+}
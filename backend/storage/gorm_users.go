@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+func (g *GormAdapter) CreateUser(ctx context.Context, u *User) (*User, error) {
+	if err := validateUser(u); err != nil {
+		return nil, err
+	}
+	row := gormUser{NameKey: userKey(u.Name), Name: u.Name, Role: u.Role, PasswordHash: u.PasswordHash, CreatedAt: u.CreatedAt}
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		existing, err := getUser(tx, u.Name)
+		if err == nil {
+			return fmt.Errorf("user %q exists as %q: %w", u.Name, existing.Name, ErrConflict)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return tx.Create(&row).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := row.toUser()
+	return &out, nil
+}
+
+func (g *GormAdapter) GetUser(ctx context.Context, name string) (*User, error) {
+	row, err := getUser(g.DB.WithContext(ctx), name)
+	if err != nil {
+		return nil, err
+	}
+	out := row.toUser()
+	return &out, nil
+}
+
+func (g *GormAdapter) ListUsers(ctx context.Context) ([]User, error) {
+	var rows []gormUser
+	if err := g.DB.WithContext(ctx).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]User, 0, len(rows))
+	for i := range rows {
+		out = append(out, rows[i].toUser())
+	}
+	sortUsers(out)
+	return out, nil
+}
+
+func (g *GormAdapter) SetUserRole(ctx context.Context, name, role string) (*User, error) {
+	if err := validateRole(role); err != nil {
+		return nil, err
+	}
+	var out User
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		row, err := getUser(tx, name)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(row).Update("role", role).Error; err != nil {
+			return err
+		}
+		out = row.toUser()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// getUser loads the users row of name (ErrNotFound if missing).
+func getUser(tx *gorm.DB, name string) (*gormUser, error) {
+	var row gormUser
+	if err := tx.Where("name_key = ?", userKey(name)).Take(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, userNotFound(name)
+		}
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (g *GormAdapter) CreateAPIToken(ctx context.Context, t *APIToken) (*APIToken, error) {
+	if err := validateAPIToken(t); err != nil {
+		return nil, err
+	}
+	var out APIToken
+	err := g.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		u, err := getUser(tx, t.User)
+		if err != nil {
+			return err
+		}
+		row := gormAPIToken{ID: t.ID, UserKey: u.NameKey, UserName: u.Name, Name: t.Name, SecretHash: t.SecretHash, CreatedAt: t.CreatedAt}
+		if err := tx.Create(&row).Error; err != nil {
+			return err
+		}
+		out = row.toAPIToken()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (g *GormAdapter) GetAPIToken(ctx context.Context, id string) (*APIToken, error) {
+	var row gormAPIToken
+	if err := g.DB.WithContext(ctx).Where("id = ?", id).Take(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, tokenNotFound(id)
+		}
+		return nil, err
+	}
+	out := row.toAPIToken()
+	return &out, nil
+}
+
+func (g *GormAdapter) ListAPITokens(ctx context.Context, user string) ([]APIToken, error) {
+	var rows []gormAPIToken
+	if err := g.DB.WithContext(ctx).Where("user_key = ?", userKey(user)).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]APIToken, 0, len(rows))
+	for i := range rows {
+		out = append(out, rows[i].toAPIToken())
+	}
+	sortTokens(out)
+	return out, nil
+}
+
+func (g *GormAdapter) DeleteAPIToken(ctx context.Context, user, id string) error {
+	res := g.DB.WithContext(ctx).Where("id = ? AND user_key = ?", id, userKey(user)).Delete(&gormAPIToken{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return tokenNotFound(id)
+	}
+	return nil
+}
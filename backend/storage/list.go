@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Sort keys accepted by ListOptions.Sort.
+const (
+	SortID           = "id"
+	SortName         = "name"
+	SortRating       = "rating"
+	SortSmoked       = "smoked"
+	SortManufacturer = "manufacturer"
+)
+
+// MaxListLimit caps the page size a client may request.
+const MaxListLimit = 1000
+
+// ListOptions controls paging, ordering and filtering of ListShishas.
+type ListOptions struct {
+	// Limit is the page size; 0 returns every matching entry.
+	Limit int
+	// Cursor continues a previous listing (ShishaPage.NextCursor). It is opaque to
+	// callers and only valid for the same sort and filters.
+	Cursor string
+	// Sort is one of the Sort* keys; empty means SortID.
+	Sort string
+	// Desc reverses the sort order.
+	Desc bool
+	// Manufacturer keeps entries whose manufacturer name matches exactly (case-insensitive).
+	Manufacturer string
+	// Flavor keeps entries whose flavor contains the value (case-insensitive).
+	Flavor string
+}
+
+// ShishaPage is one page of a listing.
+type ShishaPage struct {
+	Items []Shisha `json:"items"`
+	// NextCursor fetches the following page; empty when there are no more entries.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// normalize validates o and fills in defaults.
+func (o ListOptions) normalize() (ListOptions, error) {
+	switch o.Sort {
+	case "":
+		o.Sort = SortID
+	case SortID, SortName, SortRating, SortSmoked, SortManufacturer:
+	default:
+		return o, fmt.Errorf("%w: unknown sort %q", ErrValidation, o.Sort)
+	}
+	if o.Limit < 0 {
+		return o, fmt.Errorf("%w: limit must not be negative", ErrValidation)
+	}
+	if o.Limit > MaxListLimit {
+		o.Limit = MaxListLimit
+	}
+	o.Manufacturer = strings.TrimSpace(o.Manufacturer)
+	o.Flavor = strings.TrimSpace(o.Flavor)
+	return o, nil
+}
+
+// averageScore returns the mean rating score, 0 without ratings.
+func averageScore(ratings []Rating) float64 {
+	if len(ratings) == 0 {
+		return 0
+	}
+	sum := 0
+	for _, r := range ratings {
+		sum += r.Score
+	}
+	return float64(sum) / float64(len(ratings))
+}
+
+// keysetCursor continues a listing after the entry with sort key Key and id ID. The
+// adapters that page in SQL or memory (GORM, memory) use it instead of an offset, so
+// entries created or deleted between two pages neither repeat nor get skipped. Sort
+// and Desc record the order it was issued for.
+type keysetCursor struct {
+	Sort string      `json:"s"`
+	Desc bool        `json:"d,omitempty"`
+	Key  interface{} `json:"k,omitempty"`
+	ID   uint        `json:"id"`
+}
+
+func encodeKeysetCursor(c keysetCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeKeysetCursor parses the cursor of opts (nil if none) and checks that it was
+// issued for the same order. Keys of numeric sorts come back as int64 (smoked) or
+// float64 (rating), those of text sorts as string.
+func decodeKeysetCursor(opts ListOptions) (*keysetCursor, error) {
+	if opts.Cursor == "" {
+		return nil, nil
+	}
+	invalid := fmt.Errorf("%w: invalid cursor", ErrValidation)
+	b, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+	if err != nil {
+		return nil, invalid
+	}
+	var c keysetCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, invalid
+	}
+	if c.Sort != opts.Sort || c.Desc != opts.Desc {
+		return nil, fmt.Errorf("%w: cursor belongs to another sort order", ErrValidation)
+	}
+	switch k := c.Key.(type) {
+	case nil:
+		if c.Sort != SortID {
+			return nil, invalid
+		}
+	case string:
+		if c.Sort != SortName && c.Sort != SortManufacturer {
+			return nil, invalid
+		}
+	case float64:
+		switch {
+		case c.Sort == SortRating:
+		case c.Sort == SortSmoked && k == math.Trunc(k):
+			c.Key = int64(k)
+		default:
+			return nil, invalid
+		}
+	default:
+		return nil, invalid
+	}
+	return &c, nil
+}
+
+// listSortKey returns the key s is ordered by under sortBy in memory (before the id);
+// nil for SortID.
+func listSortKey(s *Shisha, sortBy string) interface{} {
+	switch sortBy {
+	case SortName:
+		return strings.ToLower(s.Name)
+	case SortManufacturer:
+		return strings.ToLower(s.Manufacturer.Name)
+	case SortSmoked:
+		return int64(s.Smoked)
+	case SortRating:
+		return averageScore(s.Ratings)
+	}
+	return nil
+}
+
+// compareSortKeys compares two keys of the same sort as returned by listSortKey.
+func compareSortKeys(a, b interface{}) int {
+	switch x := a.(type) {
+	case string:
+		return strings.Compare(x, b.(string))
+	case int64:
+		if y := b.(int64); x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	case float64:
+		if y := b.(float64); x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// filterSortPage applies opts to an in-memory slice. opts must be normalized.
+func filterSortPage(all []Shisha, opts ListOptions) (*ShishaPage, error) {
+	cursor, err := decodeKeysetCursor(opts)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Shisha, 0, len(all))
+	flavor := strings.ToLower(opts.Flavor)
+	for _, s := range all {
+		if opts.Manufacturer != "" && !strings.EqualFold(s.Manufacturer.Name, opts.Manufacturer) {
+			continue
+		}
+		if flavor != "" && !strings.Contains(strings.ToLower(s.Flavor), flavor) {
+			continue
+		}
+		items = append(items, s)
+	}
+	keys := make(map[uint]interface{}, len(items))
+	for i := range items {
+		keys[items[i].ID] = listSortKey(&items[i], opts.Sort)
+	}
+	// compare orders an entry against the key and id of another, in the listing's order
+	compare := func(s *Shisha, key interface{}, id uint) int {
+		c := compareSortKeys(keys[s.ID], key)
+		if c == 0 && s.ID != id {
+			c = 1
+			if s.ID < id {
+				c = -1
+			}
+		}
+		if opts.Desc {
+			return -c
+		}
+		return c
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return compare(&items[i], keys[items[j].ID], items[j].ID) < 0
+	})
+	start := 0
+	if cursor != nil {
+		start = sort.Search(len(items), func(i int) bool {
+			return compare(&items[i], cursor.Key, cursor.ID) > 0
+		})
+	}
+	page := &ShishaPage{Items: items[start:]}
+	if opts.Limit > 0 && len(page.Items) > opts.Limit {
+		page.Items = page.Items[:opts.Limit]
+		last := &page.Items[len(page.Items)-1]
+		page.NextCursor = encodeKeysetCursor(keysetCursor{Sort: opts.Sort, Desc: opts.Desc, Key: keys[last.ID], ID: last.ID})
+	}
+	return page, nil
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ManufacturerMerge describes one group of duplicate manufacturers that
+// NormalizeManufacturers folded into a single entry.
+type ManufacturerMerge struct {
+	Into Manufacturer `json:"into"`
+	// Merged are the entries (or, for CouchDB, embedded spellings) that were folded into
+	// Into. Empty when only the spelling of Into was cleaned up.
+	Merged []Manufacturer `json:"merged"`
+}
+
+// cleanManufacturerName trims name and collapses inner whitespace.
+func cleanManufacturerName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// manufacturerKey identifies a manufacturer regardless of case and spacing, so
+// "Al Fakher" and "al  fakher" resolve to the same entry.
+func manufacturerKey(name string) string {
+	return strings.ToLower(cleanManufacturerName(name))
+}
+
+// manufacturerRefKey identifies the manufacturer reference of a shisha write, for caching
+// resolved manufacturers within a batch.
+func manufacturerRefKey(ref Manufacturer) string {
+	if key := manufacturerKey(ref.Name); key != "" {
+		return "name:" + key
+	}
+	return fmt.Sprintf("id:%d", ref.ID)
+}
+
+// validateManufacturer checks m and cleans its name in place.
+func validateManufacturer(m *Manufacturer) error {
+	if m == nil {
+		return fmt.Errorf("%w: missing manufacturer", ErrValidation)
+	}
+	m.Name = cleanManufacturerName(m.Name)
+	if m.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrValidation)
+	}
+	return nil
+}
+
+// validateMerge checks the arguments of MergeManufacturers and returns the ids to fold
+// into into, without duplicates and without into itself.
+func validateMerge(into uint, ids []uint) ([]uint, error) {
+	seen := map[uint]bool{into: true}
+	var out []uint
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: no manufacturers to merge into %d", ErrValidation, into)
+	}
+	return out, nil
+}
+
+// sortManufacturers orders ms by name (case-insensitive), then id.
+func sortManufacturers(ms []Manufacturer) {
+	sort.Slice(ms, func(i, j int) bool {
+		a, b := strings.ToLower(ms[i].Name), strings.ToLower(ms[j].Name)
+		if a != b {
+			return a < b
+		}
+		return ms[i].ID < ms[j].ID
+	})
+}
+
+// manufacturerUsage is a manufacturer together with the number of shishas referencing it.
+type manufacturerUsage struct {
+	Manufacturer
+	uses int
+}
+
+// manufacturerGroup is one step of a normalisation plan: merge the entries in merge into
+// keep and store keep under its (cleaned) name.
+type manufacturerGroup struct {
+	keep    Manufacturer
+	merge   []Manufacturer
+	renamed bool
+}
+
+// planNormalization groups ms by manufacturerKey. The most used entry of each group
+// survives (lowest id on ties) under its cleaned name. Only groups that need a change
+// are returned, ordered by name.
+func planNormalization(ms []manufacturerUsage) []manufacturerGroup {
+	byKey := make(map[string][]manufacturerUsage)
+	for _, m := range ms {
+		k := manufacturerKey(m.Name)
+		byKey[k] = append(byKey[k], m)
+	}
+	var plan []manufacturerGroup
+	for _, members := range byKey {
+		sort.Slice(members, func(i, j int) bool {
+			if members[i].uses != members[j].uses {
+				return members[i].uses > members[j].uses
+			}
+			return members[i].ID < members[j].ID
+		})
+		g := manufacturerGroup{keep: members[0].Manufacturer}
+		g.keep.Name = cleanManufacturerName(g.keep.Name)
+		g.renamed = g.keep.Name != members[0].Name
+		for _, m := range members[1:] {
+			g.merge = append(g.merge, m.Manufacturer)
+		}
+		if g.renamed || len(g.merge) > 0 {
+			plan = append(plan, g)
+		}
+	}
+	sort.Slice(plan, func(i, j int) bool { return strings.ToLower(plan[i].keep.Name) < strings.ToLower(plan[j].keep.Name) })
+	return plan
+}
+
+// mergeReport converts a plan into the result of NormalizeManufacturers.
+func mergeReport(plan []manufacturerGroup) []ManufacturerMerge {
+	out := make([]ManufacturerMerge, 0, len(plan))
+	for _, g := range plan {
+		merged := g.merge
+		if merged == nil {
+			merged = []Manufacturer{}
+		}
+		out = append(out, ManufacturerMerge{Into: g.keep, Merged: merged})
+	}
+	return out
+}
@@ -0,0 +1,457 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryAdapter implements Storage in process memory. It is meant for local
+// development, demos and tests; all data is lost when the process exits.
+type MemoryAdapter struct {
+	mu     sync.RWMutex
+	items  map[uint]*Shisha
+	nextID uint
+
+	manufacturers      map[uint]*Manufacturer
+	nextManufacturerID uint
+
+	// users is keyed by userKey, tokens by id.
+	users  map[string]*User
+	tokens map[string]*APIToken
+}
+
+// NewMemoryAdapter returns an empty in-memory store pre-filled with seed. Seed entries
+// keep their id when set; entries without an id get the next free one. Manufacturers
+// are resolved like in RestoreShishas.
+func NewMemoryAdapter(seed ...Shisha) *MemoryAdapter {
+	m := &MemoryAdapter{
+		items:              make(map[uint]*Shisha),
+		nextID:             1,
+		manufacturers:      make(map[uint]*Manufacturer),
+		nextManufacturerID: 1,
+		users:              make(map[string]*User),
+		tokens:             make(map[string]*APIToken),
+	}
+	for i := range seed {
+		s := storedShisha(&seed[i])
+		if s.ID == 0 {
+			s.ID = m.nextID
+		}
+		if s.ID >= m.nextID {
+			m.nextID = s.ID + 1
+		}
+		// an unknown id-only reference cannot be resolved; the entry keeps no manufacturer
+		s.Manufacturer, _ = m.resolveManufacturer(s.Manufacturer, true)
+		m.items[s.ID] = s
+	}
+	return m
+}
+
+// SampleShishas returns the small demo catalogue used by the mock backend.
+func SampleShishas() []Shisha {
+	return []Shisha{
+		{
+			ID:           1,
+			Name:         "Mint Breeze",
+			Flavor:       "Minze",
+			Manufacturer: Manufacturer{ID: 1, Name: "Al Fakher"},
+			// Bob hatte Geschmack -> mindestens 0.5 Sterne (Score 1)
+			Ratings:  []Rating{{User: "alice", Score: 4}, {User: "bob", Score: 1}},
+			Comments: []Comment{{User: "bob", Message: "Leicht und frisch"}},
+		},
+	}
+}
+
+// LoadSeedFile reads a JSON array of shishas, e.g. for seeding a MemoryAdapter.
+func LoadSeedFile(path string) ([]Shisha, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []Shisha
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("parse seed file %s: %w", path, err)
+	}
+	return out, nil
+}
+
+func (m *MemoryAdapter) ListShishas(ctx context.Context, opts ListOptions) (*ShishaPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	opts, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	all := make([]Shisha, 0, len(m.items))
+	for _, s := range m.items {
+		all = append(all, *cloneShisha(s))
+	}
+	totals := m.totals()
+	m.mu.RUnlock()
+	withStats(all, totals)
+	return filterSortPage(all, opts)
+}
+
+func (m *MemoryAdapter) GetShisha(ctx context.Context, id uint) (*Shisha, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.items[id]
+	if !ok {
+		return nil, fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+	}
+	return m.output(s, m.totals()), nil
+}
+
+// RatingStats computes the stats of shisha id from its ratings.
+func (m *MemoryAdapter) RatingStats(ctx context.Context, id uint) (*ShishaStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.items[id]
+	if !ok {
+		return nil, fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+	}
+	totals := m.totals()
+	return newShishaStats(id, statsOf(s.Ratings, totals), totals), nil
+}
+
+func (m *MemoryAdapter) CreateShisha(ctx context.Context, s *Shisha) (*Shisha, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := validateShisha(s); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mf, err := m.resolveManufacturer(s.Manufacturer, false)
+	if err != nil {
+		return nil, err
+	}
+	stored := storedShisha(s)
+	stored.ID = m.nextID
+	stored.Manufacturer = mf
+	m.nextID++
+	m.items[stored.ID] = stored
+	return m.output(stored, m.totals()), nil
+}
+
+func (m *MemoryAdapter) CreateShishas(ctx context.Context, items []Shisha) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	results := make([]BatchResult, len(items))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range items {
+		if err := validateShisha(&items[i]); err != nil {
+			results[i].Err = err
+			continue
+		}
+		mf, err := m.resolveManufacturer(items[i].Manufacturer, false)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		stored := storedShisha(&items[i])
+		stored.ID = m.nextID
+		stored.Manufacturer = mf
+		m.nextID++
+		m.items[stored.ID] = stored
+		results[i].Shisha = stored
+	}
+	m.outputResults(results)
+	return results, nil
+}
+
+func (m *MemoryAdapter) RestoreShishas(ctx context.Context, items []Shisha) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	results := make([]BatchResult, len(items))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range items {
+		if err := validateRestore(&items[i]); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if _, taken := m.items[items[i].ID]; taken {
+			results[i].Err = fmt.Errorf("shisha %d: %w", items[i].ID, ErrConflict)
+			continue
+		}
+		mf, err := m.resolveManufacturer(items[i].Manufacturer, true)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		stored := storedShisha(&items[i])
+		stored.Manufacturer = mf
+		m.items[stored.ID] = stored
+		if stored.ID >= m.nextID {
+			m.nextID = stored.ID + 1
+		}
+		results[i].Shisha = stored
+	}
+	m.outputResults(results)
+	return results, nil
+}
+
+func (m *MemoryAdapter) UpdateShisha(ctx context.Context, id uint, s *Shisha) (*Shisha, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := validateShisha(s); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.items[id]
+	if !ok {
+		return nil, fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+	}
+	mf, err := m.resolveManufacturer(s.Manufacturer, false)
+	if err != nil {
+		return nil, err
+	}
+	stored.Name = s.Name
+	stored.Flavor = s.Flavor
+	stored.Manufacturer = mf
+	return m.output(stored, m.totals()), nil
+}
+
+func (m *MemoryAdapter) ReplaceShisha(ctx context.Context, id uint, s *Shisha) (*Shisha, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := validateStored(s); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.items[id]; !ok {
+		return nil, fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+	}
+	mf, err := m.resolveManufacturer(s.Manufacturer, false)
+	if err != nil {
+		return nil, err
+	}
+	stored := storedShisha(s)
+	stored.ID = id
+	stored.Manufacturer = mf
+	m.items[id] = stored
+	return m.output(stored, m.totals()), nil
+}
+
+func (m *MemoryAdapter) DeleteShisha(ctx context.Context, id uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.items[id]; !ok {
+		return fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+	}
+	delete(m.items, id)
+	return nil
+}
+
+func (m *MemoryAdapter) AddRating(ctx context.Context, id uint, user string, score int) error {
+	if err := validateRating(&user, score); err != nil {
+		return err
+	}
+	return m.update(ctx, id, func(s *Shisha) error {
+		s.Ratings = setRating(s.Ratings, user, score, time.Now().Unix())
+		return nil
+	})
+}
+
+func (m *MemoryAdapter) DeleteRating(ctx context.Context, id uint, user string) error {
+	user = strings.TrimSpace(user)
+	return m.update(ctx, id, func(s *Shisha) error {
+		ratings, ok := removeRating(s.Ratings, user)
+		if !ok {
+			return ratingNotFound(id, user)
+		}
+		s.Ratings = ratings
+		return nil
+	})
+}
+
+func (m *MemoryAdapter) AddComment(ctx context.Context, id uint, user, message string, parentID uint) (*Comment, error) {
+	if err := validateComment(&user, &message); err != nil {
+		return nil, err
+	}
+	var out Comment
+	err := m.update(ctx, id, func(s *Shisha) error {
+		comments, c, err := appendComment(s.Comments, user, message, parentID, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		s.Comments, out = comments, c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (m *MemoryAdapter) UpdateComment(ctx context.Context, id, cid uint, author, message string) (*Comment, error) {
+	if err := validateMessage(&message); err != nil {
+		return nil, err
+	}
+	var out Comment
+	err := m.update(ctx, id, func(s *Shisha) error {
+		var err error
+		out, err = editComment(s.Comments, id, cid, author, message, time.Now().Unix())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (m *MemoryAdapter) DeleteComment(ctx context.Context, id, cid uint, author string) error {
+	return m.update(ctx, id, func(s *Shisha) error {
+		comments, err := removeComment(s.Comments, id, cid, author)
+		if err != nil {
+			return err
+		}
+		s.Comments = comments
+		return nil
+	})
+}
+
+func (m *MemoryAdapter) AddSmoked(ctx context.Context, id uint) error {
+	return m.update(ctx, id, func(s *Shisha) error {
+		s.Smoked++
+		return nil
+	})
+}
+
+// update applies mutate to the stored shisha under the write lock.
+func (m *MemoryAdapter) update(ctx context.Context, id uint, mutate func(s *Shisha) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.items[id]
+	if !ok {
+		return fmt.Errorf("shisha %d: %w", id, ErrNotFound)
+	}
+	return mutate(s)
+}
+
+// Health always succeeds for the in-memory store.
+func (m *MemoryAdapter) Health(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// DBInfo reports the in-memory store as a single node.
+func (m *MemoryAdapter) DBInfo(ctx context.Context) (*DBInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &DBInfo{IsCluster: false, Nodes: 1}, nil
+}
+
+// totals sums up the ratings of all shishas. Callers hold the lock.
+func (m *MemoryAdapter) totals() ratingTotals {
+	var t ratingTotals
+	for _, s := range m.items {
+		t.add(s.Ratings)
+	}
+	return t
+}
+
+// output returns the copy of the stored s handed to callers, with its stats filled in.
+func (m *MemoryAdapter) output(s *Shisha, totals ratingTotals) *Shisha {
+	c := cloneShisha(s)
+	c.RatingStats = statsOf(c.Ratings, totals)
+	return c
+}
+
+// outputResults replaces the stored shishas in results by their output copies. Callers
+// hold the lock.
+func (m *MemoryAdapter) outputResults(results []BatchResult) {
+	totals := m.totals()
+	for i := range results {
+		if results[i].Shisha != nil {
+			results[i].Shisha = m.output(results[i].Shisha, totals)
+		}
+	}
+}
+
+// storedShisha returns the copy of the input s kept in the store, with its comments numbered.
+func storedShisha(s *Shisha) *Shisha {
+	c := cloneShisha(s)
+	c.Comments = numberComments(c.Comments)
+	return c
+}
+
+var _ Snapshotter = (*MemoryAdapter)(nil)
+
+// Snapshot calls fn with a copy of the store taken under one lock.
+func (m *MemoryAdapter) Snapshot(ctx context.Context, fn func(Storage) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	view := &MemoryAdapter{
+		items:              make(map[uint]*Shisha, len(m.items)),
+		nextID:             m.nextID,
+		manufacturers:      make(map[uint]*Manufacturer, len(m.manufacturers)),
+		nextManufacturerID: m.nextManufacturerID,
+		users:              make(map[string]*User, len(m.users)),
+		tokens:             make(map[string]*APIToken, len(m.tokens)),
+	}
+	for id, s := range m.items {
+		view.items[id] = cloneShisha(s)
+	}
+	for id, mf := range m.manufacturers {
+		c := *mf
+		view.manufacturers[id] = &c
+	}
+	for key, u := range m.users {
+		c := *u
+		view.users[key] = &c
+	}
+	for id, t := range m.tokens {
+		c := *t
+		view.tokens[id] = &c
+	}
+	m.mu.RUnlock()
+	return fn(view)
+}
+
+// cloneShisha deep-copies s so callers never share slices with the store.
+func cloneShisha(s *Shisha) *Shisha {
+	c := *s
+	if s.Ratings != nil {
+		c.Ratings = append([]Rating(nil), s.Ratings...)
+		for i := range c.Ratings {
+			if c.Ratings[i].History != nil {
+				c.Ratings[i].History = append([]RatingRevision(nil), c.Ratings[i].History...)
+			}
+		}
+	}
+	if s.Comments != nil {
+		c.Comments = append([]Comment(nil), s.Comments...)
+	}
+	return &c
+}
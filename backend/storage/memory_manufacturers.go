@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+func (m *MemoryAdapter) ListManufacturers(ctx context.Context) ([]Manufacturer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	out := make([]Manufacturer, 0, len(m.manufacturers))
+	for _, mf := range m.manufacturers {
+		out = append(out, *mf)
+	}
+	m.mu.RUnlock()
+	sortManufacturers(out)
+	return out, nil
+}
+
+func (m *MemoryAdapter) GetManufacturer(ctx context.Context, id uint) (*Manufacturer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mf, ok := m.manufacturers[id]
+	if !ok {
+		return nil, fmt.Errorf("manufacturer %d: %w", id, ErrNotFound)
+	}
+	c := *mf
+	return &c, nil
+}
+
+func (m *MemoryAdapter) CreateManufacturer(ctx context.Context, in *Manufacturer) (*Manufacturer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := validateManufacturer(in); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if found := m.manufacturerByKey(manufacturerKey(in.Name)); found != nil {
+		return nil, fmt.Errorf("manufacturer %q exists as %d: %w", in.Name, found.ID, ErrConflict)
+	}
+	mf := &Manufacturer{ID: m.nextManufacturerID, Name: in.Name}
+	m.nextManufacturerID++
+	m.manufacturers[mf.ID] = mf
+	c := *mf
+	return &c, nil
+}
+
+func (m *MemoryAdapter) UpdateManufacturer(ctx context.Context, id uint, in *Manufacturer) (*Manufacturer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := validateManufacturer(in); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mf, ok := m.manufacturers[id]
+	if !ok {
+		return nil, fmt.Errorf("manufacturer %d: %w", id, ErrNotFound)
+	}
+	if found := m.manufacturerByKey(manufacturerKey(in.Name)); found != nil && found.ID != id {
+		return nil, fmt.Errorf("manufacturer %q exists as %d: %w", in.Name, found.ID, ErrConflict)
+	}
+	mf.Name = in.Name
+	m.relink(id, *mf)
+	c := *mf
+	return &c, nil
+}
+
+func (m *MemoryAdapter) DeleteManufacturer(ctx context.Context, id uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.manufacturers[id]; !ok {
+		return fmt.Errorf("manufacturer %d: %w", id, ErrNotFound)
+	}
+	uses := 0
+	for _, s := range m.items {
+		if s.Manufacturer.ID == id {
+			uses++
+		}
+	}
+	if uses > 0 {
+		return fmt.Errorf("manufacturer %d is used by %d shishas: %w", id, uses, ErrConflict)
+	}
+	delete(m.manufacturers, id)
+	return nil
+}
+
+func (m *MemoryAdapter) MergeManufacturers(ctx context.Context, into uint, ids []uint) (*Manufacturer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ids, err := validateMerge(into, ids)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target, ok := m.manufacturers[into]
+	if !ok {
+		return nil, fmt.Errorf("manufacturer %d: %w", into, ErrNotFound)
+	}
+	for _, id := range ids {
+		if _, ok := m.manufacturers[id]; !ok {
+			return nil, fmt.Errorf("manufacturer %d: %w", id, ErrNotFound)
+		}
+	}
+	for _, id := range ids {
+		m.relink(id, *target)
+		delete(m.manufacturers, id)
+	}
+	c := *target
+	return &c, nil
+}
+
+func (m *MemoryAdapter) NormalizeManufacturers(ctx context.Context) ([]ManufacturerMerge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	uses := make(map[uint]int)
+	for _, s := range m.items {
+		uses[s.Manufacturer.ID]++
+	}
+	all := make([]manufacturerUsage, 0, len(m.manufacturers))
+	for _, mf := range m.manufacturers {
+		all = append(all, manufacturerUsage{Manufacturer: *mf, uses: uses[mf.ID]})
+	}
+	plan := planNormalization(all)
+	for _, g := range plan {
+		m.manufacturers[g.keep.ID].Name = g.keep.Name
+		m.relink(g.keep.ID, g.keep)
+		for _, mf := range g.merge {
+			m.relink(mf.ID, g.keep)
+			delete(m.manufacturers, mf.ID)
+		}
+	}
+	return mergeReport(plan), nil
+}
+
+// relink points every shisha referencing manufacturer id to mf. Callers hold the write
+// lock.
+func (m *MemoryAdapter) relink(id uint, mf Manufacturer) {
+	for _, s := range m.items {
+		if s.Manufacturer.ID == id {
+			s.Manufacturer = mf
+		}
+	}
+}
+
+// manufacturerByKey returns the manufacturer with the given manufacturerKey (lowest id
+// if there are duplicates) or nil. Callers hold the lock.
+func (m *MemoryAdapter) manufacturerByKey(key string) *Manufacturer {
+	var found *Manufacturer
+	for _, mf := range m.manufacturers {
+		if manufacturerKey(mf.Name) == key && (found == nil || mf.ID < found.ID) {
+			found = mf
+		}
+	}
+	return found
+}
+
+// resolveManufacturer returns the stored manufacturer a shisha write refers to (see
+// Storage), creating it for an unknown name. With keepID a new manufacturer takes over
+// the id carried by ref when that id is free (restore). Callers hold the write lock.
+func (m *MemoryAdapter) resolveManufacturer(ref Manufacturer, keepID bool) (Manufacturer, error) {
+	if name := cleanManufacturerName(ref.Name); name != "" {
+		if found := m.manufacturerByKey(manufacturerKey(name)); found != nil {
+			return *found, nil
+		}
+		id := ref.ID
+		if !keepID || id == 0 || m.manufacturers[id] != nil {
+			id = m.nextManufacturerID
+		}
+		if id >= m.nextManufacturerID {
+			m.nextManufacturerID = id + 1
+		}
+		mf := &Manufacturer{ID: id, Name: name}
+		m.manufacturers[id] = mf
+		return *mf, nil
+	}
+	if ref.ID == 0 {
+		return Manufacturer{}, nil
+	}
+	mf, ok := m.manufacturers[ref.ID]
+	if !ok {
+		return Manufacturer{}, fmt.Errorf("%w: unknown manufacturer %d", ErrValidation, ref.ID)
+	}
+	return *mf, nil
+}
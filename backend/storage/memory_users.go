@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+func (m *MemoryAdapter) CreateUser(ctx context.Context, in *User) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := validateUser(in); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := userKey(in.Name)
+	if found, ok := m.users[key]; ok {
+		return nil, fmt.Errorf("user %q exists as %q: %w", in.Name, found.Name, ErrConflict)
+	}
+	u := *in
+	m.users[key] = &u
+	out := u
+	return &out, nil
+}
+
+func (m *MemoryAdapter) GetUser(ctx context.Context, name string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.users[userKey(name)]
+	if !ok {
+		return nil, userNotFound(name)
+	}
+	c := *u
+	return &c, nil
+}
+
+func (m *MemoryAdapter) ListUsers(ctx context.Context) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	out := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		out = append(out, *u)
+	}
+	m.mu.RUnlock()
+	sortUsers(out)
+	return out, nil
+}
+
+func (m *MemoryAdapter) SetUserRole(ctx context.Context, name, role string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := validateRole(role); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userKey(name)]
+	if !ok {
+		return nil, userNotFound(name)
+	}
+	u.Role = role
+	c := *u
+	return &c, nil
+}
+
+func (m *MemoryAdapter) CreateAPIToken(ctx context.Context, in *APIToken) (*APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := validateAPIToken(in); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userKey(in.User)]
+	if !ok {
+		return nil, userNotFound(in.User)
+	}
+	if _, taken := m.tokens[in.ID]; taken {
+		return nil, fmt.Errorf("token %q: %w", in.ID, ErrConflict)
+	}
+	t := *in
+	t.User = u.Name
+	m.tokens[t.ID] = &t
+	return &t, nil
+}
+
+func (m *MemoryAdapter) GetAPIToken(ctx context.Context, id string) (*APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.tokens[id]
+	if !ok {
+		return nil, tokenNotFound(id)
+	}
+	c := *t
+	return &c, nil
+}
+
+func (m *MemoryAdapter) ListAPITokens(ctx context.Context, user string) ([]APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	out := make([]APIToken, 0)
+	for _, t := range m.tokens {
+		if userKey(t.User) == userKey(user) {
+			out = append(out, *t)
+		}
+	}
+	m.mu.RUnlock()
+	sortTokens(out)
+	return out, nil
+}
+
+func (m *MemoryAdapter) DeleteAPIToken(ctx context.Context, user, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[id]
+	if !ok || userKey(t.User) != userKey(user) {
+		return tokenNotFound(id)
+	}
+	delete(m.tokens, id)
+	return nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scores are half stars times two: 0 (no star) up to 10 (five stars).
+const (
+	MinScore = 0
+	MaxScore = 10
+)
+
+// maxRatingUser bounds the length of the user name stored with a rating.
+const maxRatingUser = 100
+
+// maxRatingHistory bounds the number of earlier scores kept per rating.
+const maxRatingHistory = 20
+
+// RatingRevision is an earlier score of a rating that was replaced by re-rating.
+type RatingRevision struct {
+	Score     int   `json:"score"`
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// validateRating checks the input of AddRating and trims user in place.
+func validateRating(user *string, score int) error {
+	*user = strings.TrimSpace(*user)
+	if *user == "" {
+		return fmt.Errorf("%w: user is required", ErrValidation)
+	}
+	if len(*user) > maxRatingUser {
+		return fmt.Errorf("%w: user must be at most %d characters", ErrValidation, maxRatingUser)
+	}
+	if score < MinScore || score > MaxScore {
+		return fmt.Errorf("%w: score must be between %d and %d", ErrValidation, MinScore, MaxScore)
+	}
+	return nil
+}
+
+// setRating returns ratings with the rating of user set to score. Users match
+// case-insensitively (userKey). An existing rating is replaced in place and its old score
+// moves into History; several ratings of the same user (stored before ratings were unique
+// per user) are folded into one.
+func setRating(ratings []Rating, user string, score int, now int64) []Rating {
+	out := make([]Rating, 0, len(ratings)+1)
+	at := -1
+	var history []RatingRevision
+	key := userKey(user)
+	for _, r := range ratings {
+		if userKey(r.User) != key {
+			out = append(out, r)
+			continue
+		}
+		if at < 0 {
+			at = len(out)
+			out = append(out, Rating{})
+		}
+		history = append(history, r.History...)
+		history = append(history, RatingRevision{Score: r.Score, Timestamp: r.Timestamp})
+	}
+	if len(history) > maxRatingHistory {
+		history = history[len(history)-maxRatingHistory:]
+	}
+	r := Rating{User: user, Score: score, Timestamp: now, History: history}
+	if at < 0 {
+		return append(out, r)
+	}
+	out[at] = r
+	return out
+}
+
+// foldRatings merges several ratings of the same user, as imports and data stored before
+// ratings were unique per user may hold them, into one at the position of the first: the
+// last rating wins and the earlier ones move into its History.
+func foldRatings(ratings []Rating) []Rating {
+	out := ratings[:0:0]
+	at := make(map[string]int, len(ratings))
+	for _, r := range ratings {
+		i, ok := at[userKey(r.User)]
+		if !ok {
+			at[userKey(r.User)] = len(out)
+			out = append(out, r)
+			continue
+		}
+		prev := out[i]
+		history := append(prev.History[:len(prev.History):len(prev.History)], RatingRevision{Score: prev.Score, Timestamp: prev.Timestamp})
+		history = append(history, r.History...)
+		if len(history) > maxRatingHistory {
+			history = history[len(history)-maxRatingHistory:]
+		}
+		r.History = history
+		out[i] = r
+	}
+	return out
+}
+
+// NormalizeRatings returns ratings as the adapters store them since ratings are unique
+// per user: scores outside MinScore..MaxScore, which older versions accepted, are
+// clamped and several ratings of the same user are folded (see foldRatings). Restores,
+// replacements and the data migrations apply it to stored data instead of rejecting it.
+func NormalizeRatings(ratings []Rating) []Rating {
+	out := make([]Rating, len(ratings))
+	copy(out, ratings)
+	for i := range out {
+		out[i].Score = clampScore(out[i].Score)
+	}
+	return foldRatings(out)
+}
+
+func clampScore(score int) int {
+	if score < MinScore {
+		return MinScore
+	}
+	if score > MaxScore {
+		return MaxScore
+	}
+	return score
+}
+
+// removeRating returns ratings without the rating (and history) of user and whether
+// there was one. Users match case-insensitively (userKey).
+func removeRating(ratings []Rating, user string) ([]Rating, bool) {
+	out := ratings[:0:0]
+	key := userKey(user)
+	for _, r := range ratings {
+		if userKey(r.User) != key {
+			out = append(out, r)
+		}
+	}
+	return out, len(out) != len(ratings)
+}
+
+// ratingNotFound is the error of DeleteRating when user has not rated shisha id.
+func ratingNotFound(id uint, user string) error {
+	return fmt.Errorf("rating of %q on shisha %d: %w", user, id, ErrNotFound)
+}
@@ -0,0 +1,34 @@
+package storage
+
+import "context"
+
+// Snapshotter is implemented by adapters that can read a consistent point-in-time view
+// of everything they store, as backups need it.
+type Snapshotter interface {
+	// Snapshot calls fn with a read-only view of the storage as of one point in time:
+	// writes made while fn runs are not visible to it. fn must not write through the
+	// view.
+	Snapshot(ctx context.Context, fn func(Storage) error) error
+}
+
+// Unwrapper is implemented by decorators (tracing, metrics, search) to expose the
+// storage they wrap, so optional capabilities such as Snapshotter stay reachable.
+type Unwrapper interface {
+	Unwrap() Storage
+}
+
+// ReadSnapshot calls fn with a consistent view of s when s, or a storage it wraps, is a
+// Snapshotter, and with s itself otherwise.
+func ReadSnapshot(ctx context.Context, s Storage, fn func(Storage) error) error {
+	for inner := s; inner != nil; {
+		if sn, ok := inner.(Snapshotter); ok {
+			return sn.Snapshot(ctx, fn)
+		}
+		u, ok := inner.(Unwrapper)
+		if !ok {
+			break
+		}
+		inner = u.Unwrap()
+	}
+	return fn(s)
+}
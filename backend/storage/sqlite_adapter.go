@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// SQLiteAdapter implements Storage in a single local SQLite file. It reuses the GORM
+// persistence model (same tables and relations as Postgres/CockroachDB) through a
+// pure-Go driver, so binaries stay CGO-free.
+type SQLiteAdapter struct {
+	*GormAdapter
+}
+
+// NewSQLiteAdapter opens (or creates) the database file at path and creates the schema
+// on first start. Use ":memory:" for a throwaway database.
+func NewSQLiteAdapter(path string) (*SQLiteAdapter, error) {
+	if path == "" {
+		path = "shisha.db"
+	}
+	if path != ":memory:" {
+		if dir := filepath.Dir(path); dir != "." {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nil, fmt.Errorf("create sqlite directory: %w", err)
+			}
+		}
+	}
+	// foreign keys are off by default in SQLite; WAL lets readers proceed during writes
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)", path)
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: GormLogger()})
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite %s: %w", path, err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serialising connections avoids "database is locked"
+	sqlDB.SetMaxOpenConns(1)
+
+	s := &SQLiteAdapter{GormAdapter: NewGormAdapter(db)}
+	if err := s.Migrate(context.Background()); err != nil {
+		return nil, fmt.Errorf("create sqlite schema: %w", err)
+	}
+	return s, nil
+}
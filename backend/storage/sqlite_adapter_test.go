@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestSQLiteAdapter(t *testing.T, path string) *SQLiteAdapter {
+	t.Helper()
+	s, err := NewSQLiteAdapter(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteAdapter: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestSQLiteAdapter_PersistsAcrossRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "data", "shisha.db")
+
+	s := newTestSQLiteAdapter(t, path)
+	created, err := s.CreateShisha(ctx, &Shisha{Name: "Mint", Flavor: "Minze", Manufacturer: Manufacturer{Name: "Al Fakher"}})
+	if err != nil {
+		t.Fatalf("CreateShisha: %v", err)
+	}
+	if err := s.AddRating(ctx, created.ID, "alice", 8); err != nil {
+		t.Fatalf("AddRating: %v", err)
+	}
+	if _, err := s.AddComment(ctx, created.ID, "bob", "frisch", 0); err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+	if err := s.AddSmoked(ctx, created.ID); err != nil {
+		t.Fatalf("AddSmoked: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened := newTestSQLiteAdapter(t, path)
+	got, err := reopened.GetShisha(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("GetShisha after reopen: %v", err)
+	}
+	if got.Manufacturer.Name != "Al Fakher" || got.Smoked != 1 || len(got.Ratings) != 1 || len(got.Comments) != 1 {
+		t.Fatalf("data not persisted: %+v", got)
+	}
+}
+
+func TestSQLiteAdapter_MigrateMergesManufacturers(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLiteAdapter(t, filepath.Join(t.TempDir(), "shisha.db"))
+	// the table as it was before manufacturers had a unique name key, with duplicates
+	// created before names were matched case-insensitively
+	if err := s.DB.Migrator().DropTable(&gormManufacturer{}); err != nil {
+		t.Fatalf("drop table: %v", err)
+	}
+	if err := s.DB.Exec(`CREATE TABLE manufacturers (id integer PRIMARY KEY AUTOINCREMENT, name text NOT NULL)`).Error; err != nil {
+		t.Fatalf("create legacy table: %v", err)
+	}
+	if err := s.DB.Exec(`INSERT INTO manufacturers (id, name) VALUES (1, 'al fakher'), (2, ' Al  Fakher '), (3, 'Adalya')`).Error; err != nil {
+		t.Fatalf("insert manufacturers: %v", err)
+	}
+	for i, mid := range []uint{1, 2, 2, 3} {
+		mid := mid
+		if err := s.DB.Create(&gormShisha{ID: uint(i + 1), Name: "S", ManufacturerID: &mid}).Error; err != nil {
+			t.Fatalf("insert shisha: %v", err)
+		}
+	}
+
+	if pending, err := s.PendingMigrations(ctx); err != nil || !reflect.DeepEqual(pending, []string{"schema"}) {
+		t.Fatalf("PendingMigrations: expected schema, got %v (%v)", pending, err)
+	}
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if err := s.CheckIndexes(ctx); err != nil {
+		t.Fatalf("CheckIndexes after Migrate: %v", err)
+	}
+	want := Manufacturer{ID: 2, Name: "Al Fakher"}
+	if got, _ := s.GetShisha(ctx, 1); got.Manufacturer != want {
+		t.Fatalf("shisha not relinked: %+v", got.Manufacturer)
+	}
+	list, _ := s.ListManufacturers(ctx)
+	if !reflect.DeepEqual(list, []Manufacturer{{ID: 3, Name: "Adalya"}, {ID: 2, Name: "Al Fakher"}}) {
+		t.Fatalf("manufacturers after normalize: %+v", list)
+	}
+	if again, err := s.NormalizeManufacturers(ctx); err != nil || len(again) != 0 {
+		t.Fatalf("NormalizeManufacturers after Migrate: got %+v (%v)", again, err)
+	}
+	if _, err := s.CreateManufacturer(ctx, &Manufacturer{Name: "ADALYA"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("CreateManufacturer of a taken name: expected ErrConflict, got %v", err)
+	}
+	// a row that slipped past the lookup, as a concurrent create would, hits the unique key
+	if inserted, err := insertManufacturer(s.DB, &gormManufacturer{Name: "adalya", NameKey: "adalya"}); err != nil || inserted {
+		t.Fatalf("insert of a taken name key: inserted=%v (%v)", inserted, err)
+	}
+	if _, err := s.UpdateManufacturer(ctx, 3, &Manufacturer{Name: " al fakher"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("UpdateManufacturer to a taken name: expected ErrConflict, got %v", err)
+	}
+}
+
+func TestSQLiteAdapter_MigrateNumbersComments(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLiteAdapter(t, filepath.Join(t.TempDir(), "shisha.db"))
+	created, err := s.CreateShisha(ctx, &Shisha{Name: "Mint"})
+	if err != nil {
+		t.Fatalf("CreateShisha: %v", err)
+	}
+	// rows as they were stored before comments had ids
+	legacy := []gormComment{{ShishaID: created.ID, User: "bob", Message: "alt"}, {ShishaID: created.ID, User: "alice", Message: "auch alt"}}
+	if err := s.DB.Create(&legacy).Error; err != nil {
+		t.Fatalf("insert legacy comments: %v", err)
+	}
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	got, err := s.GetShisha(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("GetShisha: %v", err)
+	}
+	if len(got.Comments) != 2 || got.Comments[0].ID == 0 || got.Comments[1].ID == got.Comments[0].ID {
+		t.Fatalf("legacy comments not numbered: %+v", got.Comments)
+	}
+	if _, err := s.UpdateComment(ctx, created.ID, got.Comments[0].ID, "bob", "neu"); err != nil {
+		t.Fatalf("UpdateComment on migrated comment: %v", err)
+	}
+}
+
+func TestSQLiteAdapter_MigrateFoldsRatings(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLiteAdapter(t, filepath.Join(t.TempDir(), "shisha.db"))
+	created, err := s.CreateShisha(ctx, &Shisha{Name: "Mint"})
+	if err != nil {
+		t.Fatalf("CreateShisha: %v", err)
+	}
+	// the table as it was before ratings had a user key: duplicates per user were possible
+	if err := s.DB.Migrator().DropTable(&gormRating{}); err != nil {
+		t.Fatalf("drop table: %v", err)
+	}
+	if err := s.DB.Exec(`CREATE TABLE ratings (id integer PRIMARY KEY AUTOINCREMENT, shisha_id integer NOT NULL, user text, score integer, timestamp integer, history text)`).Error; err != nil {
+		t.Fatalf("create legacy table: %v", err)
+	}
+	for _, r := range []struct {
+		user  string
+		score int
+	}{{"alice", 4}, {"bob", 6}, {"Alice", 9}} {
+		if err := s.DB.Exec(`INSERT INTO ratings (shisha_id, user, score) VALUES (?, ?, ?)`, created.ID, r.user, r.score).Error; err != nil {
+			t.Fatalf("insert legacy rating: %v", err)
+		}
+	}
+	if pending, err := s.PendingMigrations(ctx); err != nil || !reflect.DeepEqual(pending, []string{"schema"}) {
+		t.Fatalf("PendingMigrations: expected schema, got %v (%v)", pending, err)
+	}
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if err := s.CheckIndexes(ctx); err != nil {
+		t.Fatalf("CheckIndexes after Migrate: %v", err)
+	}
+	got, err := s.GetShisha(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("GetShisha: %v", err)
+	}
+	if len(got.Ratings) != 2 || got.Ratings[0].User != "Alice" || got.Ratings[0].Score != 9 ||
+		len(got.Ratings[0].History) != 1 || got.Ratings[0].History[0].Score != 4 {
+		t.Fatalf("legacy ratings not folded: %+v", got.Ratings)
+	}
+	if err := s.AddRating(ctx, created.ID, "bob", 7); err != nil {
+		t.Fatalf("AddRating on migrated rating: %v", err)
+	}
+	if err := s.DB.Create(&gormRating{ShishaID: created.ID, User: "BOB", UserKey: "bob", Score: 1}).Error; err == nil {
+		t.Fatal("unique index accepted a second rating of bob")
+	}
+}
+
+func TestSQLiteAdapter_SetupChecks(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLiteAdapter(t, filepath.Join(t.TempDir(), "shisha.db"))
+	created, err := s.CreateShisha(ctx, &Shisha{Name: "Mint"})
+	if err != nil {
+		t.Fatalf("CreateShisha: %v", err)
+	}
+	if err := s.DB.Create(&gormComment{ShishaID: created.ID, User: "bob", Message: "alt"}).Error; err != nil {
+		t.Fatalf("insert legacy comment: %v", err)
+	}
+	if pending, err := s.PendingMigrations(ctx); err != nil || !reflect.DeepEqual(pending, []string{"comment_ids"}) {
+		t.Fatalf("PendingMigrations: expected comment_ids, got %v (%v)", pending, err)
+	}
+
+	if err := s.DB.Migrator().DropTable(&gormAPIToken{}); err != nil {
+		t.Fatalf("drop table: %v", err)
+	}
+	if err := s.CheckIndexes(ctx); err == nil || !strings.Contains(err.Error(), "table api_tokens") {
+		t.Fatalf("CheckIndexes: expected the missing table, got %v", err)
+	}
+	if err := s.Health(ctx); err == nil || !strings.Contains(err.Error(), "api_tokens") {
+		t.Fatalf("Health: expected the missing table, got %v", err)
+	}
+	if pending, err := s.PendingMigrations(ctx); err != nil || !reflect.DeepEqual(pending, []string{"schema"}) {
+		t.Fatalf("PendingMigrations: expected schema, got %v (%v)", pending, err)
+	}
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if pending, err := s.PendingMigrations(ctx); err != nil || len(pending) != 0 {
+		t.Fatalf("PendingMigrations after Migrate: got %v (%v)", pending, err)
+	}
+	if err := s.Health(ctx); err != nil {
+		t.Fatalf("Health after Migrate: %v", err)
+	}
+}
+
+func TestSQLiteAdapter_Snapshot(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLiteAdapter(t, filepath.Join(t.TempDir(), "shisha.db"))
+	if _, err := s.CreateShisha(ctx, &Shisha{Name: "Mint", Ratings: []Rating{{User: "alice", Score: 7}}}); err != nil {
+		t.Fatalf("CreateShisha: %v", err)
+	}
+	var listed []Shisha
+	var users []User
+	err := ReadSnapshot(ctx, s, func(view Storage) error {
+		page, err := view.ListShishas(ctx, ListOptions{})
+		if err != nil {
+			return err
+		}
+		listed = page.Items
+		users, err = view.ListUsers(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ReadSnapshot: %v", err)
+	}
+	if len(listed) != 1 || len(listed[0].Ratings) != 1 || len(users) != 0 {
+		t.Fatalf("unexpected snapshot: %+v, users %+v", listed, users)
+	}
+	// the transaction ended: writes go through again
+	if _, err := s.CreateShisha(ctx, &Shisha{Name: "Grape"}); err != nil {
+		t.Fatalf("CreateShisha after snapshot: %v", err)
+	}
+}
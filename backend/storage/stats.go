@@ -0,0 +1,111 @@
+package storage
+
+// RatingPriorWeight is the number of virtual ratings at the catalogue-wide mean that the
+// Bayesian score adds to every shisha.
+const RatingPriorWeight = 5
+
+// RatingStats aggregates the ratings of one shisha. It is embedded in Shisha, so the
+// fields appear directly on every shisha response.
+type RatingStats struct {
+	RatingCount int     `json:"ratingCount"`
+	RatingAvg   float64 `json:"ratingAvg"`
+	// RatingWeighted is the Bayesian average: RatingAvg pulled towards the mean of all
+	// ratings by RatingPriorWeight virtual votes, so a single 10 does not outrank fifty 9s.
+	RatingWeighted float64 `json:"ratingWeighted"`
+	// RatingHistogram counts the ratings per score, index MinScore to MaxScore.
+	RatingHistogram []int `json:"ratingHistogram"`
+}
+
+// ShishaStats answers GET /api/shishas/:id/stats: the stats of one shisha together with
+// the prior its Bayesian score was computed with.
+type ShishaStats struct {
+	ShishaID uint `json:"shishaId"`
+	RatingStats
+	// PriorAvg is the mean of all ratings in the catalogue (the middle of the scale while
+	// there are none); RatingWeighted is pulled towards it.
+	PriorAvg     float64 `json:"priorAvg"`
+	PriorWeight  int     `json:"priorWeight"`
+	TotalRatings int     `json:"totalRatings"`
+}
+
+// ratingTotals is the number and sum of all ratings of the catalogue, the prior of the
+// Bayesian score.
+type ratingTotals struct {
+	count int
+	sum   int
+}
+
+func (t *ratingTotals) add(ratings []Rating) {
+	for _, r := range ratings {
+		t.count++
+		t.sum += r.Score
+	}
+}
+
+// mean returns the average of all ratings, the middle of the scale without any.
+func (t ratingTotals) mean() float64 {
+	if t.count == 0 {
+		return float64(MinScore+MaxScore) / 2
+	}
+	return float64(t.sum) / float64(t.count)
+}
+
+// newRatingStats computes the stats of count ratings summing up to sum. Scores outside
+// MinScore..MaxScore (stored before scores were validated) are counted in the histogram
+// bucket they are closest to.
+func newRatingStats(count, sum int, hist []int, global ratingTotals) RatingStats {
+	st := RatingStats{
+		RatingCount:     count,
+		RatingHistogram: hist,
+		RatingWeighted:  (RatingPriorWeight*global.mean() + float64(sum)) / float64(RatingPriorWeight+count),
+	}
+	if count > 0 {
+		st.RatingAvg = float64(sum) / float64(count)
+	}
+	return st
+}
+
+// newHistogram returns an empty histogram with one bucket per score.
+func newHistogram() []int {
+	return make([]int, MaxScore-MinScore+1)
+}
+
+// histogramBucket returns the histogram index of score.
+func histogramBucket(score int) int {
+	switch {
+	case score < MinScore:
+		return 0
+	case score > MaxScore:
+		return MaxScore - MinScore
+	}
+	return score - MinScore
+}
+
+// statsOf computes the stats of ratings.
+func statsOf(ratings []Rating, global ratingTotals) RatingStats {
+	hist := newHistogram()
+	sum := 0
+	for _, r := range ratings {
+		hist[histogramBucket(r.Score)]++
+		sum += r.Score
+	}
+	return newRatingStats(len(ratings), sum, hist, global)
+}
+
+// withStats fills the RatingStats of every item from its ratings.
+func withStats(items []Shisha, global ratingTotals) {
+	for i := range items {
+		items[i].RatingStats = statsOf(items[i].Ratings, global)
+	}
+}
+
+// newShishaStats builds the stats endpoint response.
+func newShishaStats(id uint, st RatingStats, global ratingTotals) *ShishaStats {
+	return &ShishaStats{
+		ShishaID:     id,
+		RatingStats:  st,
+		PriorAvg:     global.mean(),
+		PriorWeight:  RatingPriorWeight,
+		TotalRatings: global.count,
+	}
+}
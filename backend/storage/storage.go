@@ -1,22 +1,36 @@
 package storage
 
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
 // Manufacturer represents a shisha manufacturer.
 type Manufacturer struct {
 	ID   uint   `json:"id"`
 	Name string `json:"name"`
 }
 
-// Rating represents a user rating for a shisha.
+// Rating represents a user rating for a shisha. Every user has at most one rating per
+// shisha; re-rating replaces Score and keeps the previous scores in History, oldest first.
 type Rating struct {
-	User      string `json:"user"`
-	Score     int    `json:"score"`
-	Timestamp int64  `json:"timestamp,omitempty"`
+	User      string           `json:"user"`
+	Score     int              `json:"score"`
+	Timestamp int64            `json:"timestamp,omitempty"`
+	History   []RatingRevision `json:"history,omitempty"`
 }
 
-// Comment represents a user comment for a shisha.
+// Comment represents a user comment for a shisha. IDs are unique within the shisha. A
+// comment with a ParentID is a reply to the top-level comment of that id; replies cannot
+// be answered themselves. Timestamps are Unix seconds.
 type Comment struct {
-	User    string `json:"user"`
-	Message string `json:"message"`
+	ID        uint   `json:"id"`
+	ParentID  uint   `json:"parentId,omitempty"`
+	User      string `json:"user"`
+	Message   string `json:"message"`
+	CreatedAt int64  `json:"createdAt,omitempty"`
+	EditedAt  int64  `json:"editedAt,omitempty"`
 }
 
 // Shisha minimal DTO for storage layer
@@ -28,6 +42,9 @@ type Shisha struct {
 	Smoked       int          `json:"smoked,omitempty"`
 	Ratings      []Rating     `json:"ratings,omitempty"`
 	Comments     []Comment    `json:"comments,omitempty"`
+	// RatingStats is derived from Ratings by the storage on every read; values sent by
+	// clients are ignored.
+	RatingStats
 }
 
 // DBInfo represents basic information about the configured database/backend.
@@ -36,19 +53,152 @@ type DBInfo struct {
 	Nodes     int  `json:"nodes,omitempty"`
 }
 
+// BatchResult is the outcome of one item of a CreateShishas call: either the stored
+// shisha (with its assigned id) or the reason it was rejected.
+type BatchResult struct {
+	Shisha *Shisha
+	Err    error
+}
+
 // Storage interface abstracts data operations used by the server handlers.
+// Implementations must honour cancellation and deadlines of the passed context.
+//
+// Shishas reference their manufacturer by id. When a shisha is written, its manufacturer
+// is resolved by name if one is given (ignoring case and spacing, unknown names create a
+// new manufacturer) and by id otherwise (unknown ids are rejected with ErrValidation).
+// The stored shisha always carries the manufacturer's current id and name.
 type Storage interface {
-	ListShishas() ([]Shisha, error)
-	GetShisha(id uint) (*Shisha, error)
-	CreateShisha(s *Shisha) (*Shisha, error)
-	UpdateShisha(id uint, s *Shisha) (*Shisha, error)
-	DeleteShisha(id uint) error
-	AddRating(id uint, user string, score int) error
-	AddComment(id uint, user, message string) error
+	// ListShishas returns one page of shishas matching opts (all of them when opts.Limit is 0).
+	ListShishas(ctx context.Context, opts ListOptions) (*ShishaPage, error)
+	GetShisha(ctx context.Context, id uint) (*Shisha, error)
+	CreateShisha(ctx context.Context, s *Shisha) (*Shisha, error)
+	// CreateShishas stores several new shishas in as few round trips as the backend
+	// allows (bulk import). The result holds one entry per item, in input order; the
+	// error is only set when the batch as a whole could not be processed.
+	CreateShishas(ctx context.Context, items []Shisha) ([]BatchResult, error)
+	// RestoreShishas stores items under the ids they carry (restore, migration) and
+	// moves the id allocation past them. An item without id is rejected with
+	// ErrValidation, an id that is already taken with ErrConflict.
+	RestoreShishas(ctx context.Context, items []Shisha) ([]BatchResult, error)
+	// UpdateShisha changes the catalogue fields of a shisha: name, flavor and
+	// manufacturer. Ratings, comments and the smoked counter are kept, whatever s carries.
+	UpdateShisha(ctx context.Context, id uint, s *Shisha) (*Shisha, error)
+	// ReplaceShisha overwrites a shisha with everything s carries, ratings, comments and
+	// smoked counter included. It is meant for migrations, not for API clients.
+	ReplaceShisha(ctx context.Context, id uint, s *Shisha) (*Shisha, error)
+	DeleteShisha(ctx context.Context, id uint) error
+	// AddRating sets the rating of user: a first rating is added, a later one replaces the
+	// score (see Rating). Users match case-insensitively, like account names. The score must lie within MinScore..MaxScore (ErrValidation).
+	AddRating(ctx context.Context, id uint, user string, score int) error
+	// RatingStats returns the rating statistics of one shisha, including the prior of its
+	// Bayesian score.
+	RatingStats(ctx context.Context, id uint) (*ShishaStats, error)
+	// DeleteRating removes the rating of user (matched case-insensitively) including its
+	// history; ErrNotFound when user has not rated the shisha.
+	DeleteRating(ctx context.Context, id uint, user string) error
+	// AddComment stores a new comment of user and returns it with its id. A non-zero
+	// parentID makes it a reply to that top-level comment (ErrValidation otherwise).
+	AddComment(ctx context.Context, id uint, user, message string, parentID uint) (*Comment, error)
+	// UpdateComment replaces the message of comment cid and sets its EditedAt. A non-empty
+	// author restricts the change to comments written by author (ErrForbidden otherwise);
+	// an empty author acts with admin rights.
+	UpdateComment(ctx context.Context, id, cid uint, author, message string) (*Comment, error)
+	// DeleteComment removes comment cid together with its replies; author as for
+	// UpdateComment.
+	DeleteComment(ctx context.Context, id, cid uint, author string) error
 	// Increment smoked counter for shisha with given id.
-	AddSmoked(id uint) error
+	AddSmoked(ctx context.Context, id uint) error
+
+	// ListManufacturers returns all manufacturers ordered by name.
+	ListManufacturers(ctx context.Context) ([]Manufacturer, error)
+	GetManufacturer(ctx context.Context, id uint) (*Manufacturer, error)
+	// CreateManufacturer stores a new manufacturer; a name that already exists (ignoring
+	// case and spacing) is rejected with ErrConflict.
+	CreateManufacturer(ctx context.Context, m *Manufacturer) (*Manufacturer, error)
+	// UpdateManufacturer renames a manufacturer; every shisha referencing it shows the
+	// new name.
+	UpdateManufacturer(ctx context.Context, id uint, m *Manufacturer) (*Manufacturer, error)
+	// DeleteManufacturer removes an unused manufacturer; ErrConflict while shishas still
+	// reference it.
+	DeleteManufacturer(ctx context.Context, id uint) error
+	// MergeManufacturers moves the shishas of the manufacturers ids to into and deletes
+	// them.
+	MergeManufacturers(ctx context.Context, into uint, ids []uint) (*Manufacturer, error)
+	// NormalizeManufacturers folds manufacturers whose names only differ in case or
+	// spacing together and cleans up their spelling. It is idempotent.
+	NormalizeManufacturers(ctx context.Context) ([]ManufacturerMerge, error)
+
+	// CreateUser registers a new account; a name that already exists (ignoring case) is
+	// rejected with ErrConflict.
+	CreateUser(ctx context.Context, u *User) (*User, error)
+	// GetUser returns the account with the given name (ignoring case).
+	GetUser(ctx context.Context, name string) (*User, error)
+	// ListUsers returns all accounts ordered by name.
+	ListUsers(ctx context.Context) ([]User, error)
+	// SetUserRole changes the role of an account; an unknown role is rejected with
+	// ErrValidation.
+	SetUserRole(ctx context.Context, name, role string) (*User, error)
+	// CreateAPIToken stores a new token of t.User.
+	CreateAPIToken(ctx context.Context, t *APIToken) (*APIToken, error)
+	// GetAPIToken returns the token with the given id.
+	GetAPIToken(ctx context.Context, id string) (*APIToken, error)
+	// ListAPITokens returns the tokens of user, oldest first.
+	ListAPITokens(ctx context.Context, user string) ([]APIToken, error)
+	// DeleteAPIToken revokes token id of user; ErrNotFound when user has no such token.
+	DeleteAPIToken(ctx context.Context, user, id string) error
+
 	// Health checks connectivity to the underlying storage (e.g. DB or CouchDB cluster).
-	Health() error
+	Health(ctx context.Context) error
 	// DBInfo returns information about the storage backend (cluster membership, node count, ...).
-	DBInfo() (*DBInfo, error)
+	DBInfo(ctx context.Context) (*DBInfo, error)
+}
+
+// SetupChecker is implemented by adapters that prepare the database at startup (indexes,
+// views, data migrations). Readiness probes use it to notice a database that is
+// reachable but lost that setup, e.g. after a restore.
+type SetupChecker interface {
+	// CheckIndexes returns an error naming the indexes, views or tables that are missing.
+	CheckIndexes(ctx context.Context) error
+	// PendingMigrations returns the migrations not applied yet, in order.
+	PendingMigrations(ctx context.Context) ([]string, error)
+}
+
+// validateShisha performs the input checks shared by all adapters on create and update.
+func validateShisha(s *Shisha) error {
+	if s == nil {
+		return fmt.Errorf("%w: missing shisha", ErrValidation)
+	}
+	if strings.TrimSpace(s.Name) == "" {
+		return fmt.Errorf("%w: name is required", ErrValidation)
+	}
+	// imports and restores carry ratings; they follow the rules of AddRating, so several
+	// ratings of one user are folded into one
+	for i := range s.Ratings {
+		if err := validateRating(&s.Ratings[i].User, s.Ratings[i].Score); err != nil {
+			return fmt.Errorf("rating %d: %w", i+1, err)
+		}
+	}
+	s.Ratings = foldRatings(s.Ratings)
+	return nil
+}
+
+// validateStored is validateShisha for entries that carry stored data (ReplaceShisha,
+// RestoreShishas): legacy ratings are normalized (NormalizeRatings) instead of rejected,
+// so migrations and restores of data written by older versions go through.
+func validateStored(s *Shisha) error {
+	if s != nil {
+		s.Ratings = NormalizeRatings(s.Ratings)
+	}
+	return validateShisha(s)
+}
+
+// validateRestore extends validateStored with the id check of RestoreShishas.
+func validateRestore(s *Shisha) error {
+	if err := validateStored(s); err != nil {
+		return err
+	}
+	if s.ID == 0 {
+		return fmt.Errorf("%w: id is required", ErrValidation)
+	}
+	return nil
 }
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// User is a registered account. Its Name is the author of the user's ratings and
+// comments; names are unique regardless of case.
+type User struct {
+	Name string `json:"name"`
+	// Role is one of Roles; accounts stored without a role are members.
+	Role string `json:"role"`
+	// PasswordHash is the bcrypt hash of the password; it never leaves the backend.
+	PasswordHash string `json:"-"`
+	CreatedAt    int64  `json:"createdAt"`
+}
+
+// User roles. Each role includes the rights of the ones before it in Roles.
+const (
+	// RoleViewer may only read and manage its own API tokens.
+	RoleViewer = "viewer"
+	// RoleMember rates, comments and counts smoked sessions; the role of new accounts.
+	RoleMember = "member"
+	// RoleCurator maintains the catalogue: shishas and manufacturers.
+	RoleCurator = "curator"
+	// RoleAdmin deletes, imports, moderates and manages users and backups.
+	RoleAdmin = "admin"
+)
+
+// Roles lists the roles in ascending order of rights.
+var Roles = []string{RoleViewer, RoleMember, RoleCurator, RoleAdmin}
+
+// RoleRank returns the position of role in Roles, or -1 for an unknown role.
+func RoleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+func validateRole(role string) error {
+	if RoleRank(role) < 0 {
+		return fmt.Errorf("%w: unknown role %q (one of %s)", ErrValidation, role, strings.Join(Roles, ", "))
+	}
+	return nil
+}
+
+// withDefaultRole returns u with accounts stored before roles existed made members.
+func withDefaultRole(u User) User {
+	if u.Role == "" {
+		u.Role = RoleMember
+	}
+	return u
+}
+
+// APIToken is a personal access token of a user for scripts. Only a hash of the secret
+// is stored; the secret itself is shown once when the token is created.
+type APIToken struct {
+	ID         string `json:"id"`
+	User       string `json:"user"`
+	Name       string `json:"name"`
+	SecretHash string `json:"-"`
+	CreatedAt  int64  `json:"createdAt"`
+}
+
+// Bounds of user names.
+const (
+	minUserName = 2
+	maxUserName = 50
+)
+
+// maxTokenName bounds the length of the label of an API token.
+const maxTokenName = 100
+
+// userKey identifies a user regardless of case.
+func userKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// validateUser checks a new user and trims its name in place. Names consist of letters,
+// digits, '.', '_' and '-' so they read unambiguously as rating and comment authors.
+func validateUser(u *User) error {
+	if u == nil {
+		return fmt.Errorf("%w: missing user", ErrValidation)
+	}
+	u.Name = strings.TrimSpace(u.Name)
+	if n := len([]rune(u.Name)); n < minUserName || n > maxUserName {
+		return fmt.Errorf("%w: name must be %d to %d characters", ErrValidation, minUserName, maxUserName)
+	}
+	for _, r := range u.Name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && r != '_' && r != '-' {
+			return fmt.Errorf("%w: name may only contain letters, digits, '.', '_' and '-'", ErrValidation)
+		}
+	}
+	if u.PasswordHash == "" {
+		return fmt.Errorf("%w: password is required", ErrValidation)
+	}
+	if u.Role == "" {
+		u.Role = RoleMember
+	}
+	return validateRole(u.Role)
+}
+
+// sortUsers orders users by name regardless of case.
+func sortUsers(users []User) {
+	sort.Slice(users, func(i, j int) bool {
+		return userKey(users[i].Name) < userKey(users[j].Name)
+	})
+}
+
+// validateAPIToken checks a new token and trims its label in place.
+func validateAPIToken(t *APIToken) error {
+	if t == nil || t.ID == "" || t.SecretHash == "" || t.User == "" {
+		return fmt.Errorf("%w: incomplete token", ErrValidation)
+	}
+	t.Name = strings.TrimSpace(t.Name)
+	if len(t.Name) > maxTokenName {
+		return fmt.Errorf("%w: token name must be at most %d characters", ErrValidation, maxTokenName)
+	}
+	return nil
+}
+
+// sortTokens orders tokens by creation time, then id.
+func sortTokens(tokens []APIToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].CreatedAt != tokens[j].CreatedAt {
+			return tokens[i].CreatedAt < tokens[j].CreatedAt
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+}
+
+func userNotFound(name string) error {
+	return fmt.Errorf("user %q: %w", name, ErrNotFound)
+}
+
+func tokenNotFound(id string) error {
+	return fmt.Errorf("token %q: %w", id, ErrNotFound)
+}
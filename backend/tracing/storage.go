@@ -0,0 +1,250 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+
+	"github.com/shisha-tracker/backend/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation is the tracer name of the backend's own spans.
+const instrumentation = "github.com/shisha-tracker/backend"
+
+// Storage wraps a storage.Storage and opens a child span "storage.<Method>" around every
+// call. Like metrics.Storage it does not embed the wrapped storage, so a method added to
+// the interface fails to compile here instead of going untraced.
+type Storage struct {
+	inner   storage.Storage
+	backend string
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+// WrapStorage returns s traced under the given backend name (couchdb, gorm, sqlite or
+// memory). The tracer is looked up per call, so the wrapper follows the global provider.
+func WrapStorage(s storage.Storage, backend string) *Storage {
+	return &Storage{inner: s, backend: backend}
+}
+
+// Unwrap returns the wrapped storage (storage.Unwrapper).
+func (s *Storage) Unwrap() storage.Storage { return s.inner }
+
+func (s *Storage) start(ctx context.Context, op string) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, "storage."+op,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attribute.String("storage.backend", s.backend), semconv.DBOperation(op)))
+}
+
+// end records err on span and closes it. Expected outcomes such as a missing id or a
+// failed validation are recorded as events but do not mark the span as failed.
+func (s *Storage) end(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		if !isClientError(*err) {
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+	}
+	span.End()
+}
+
+func isClientError(err error) bool {
+	return errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrConflict) ||
+		errors.Is(err, storage.ErrValidation) || errors.Is(err, storage.ErrForbidden)
+}
+
+func (s *Storage) ListShishas(ctx context.Context, opts storage.ListOptions) (_ *storage.ShishaPage, err error) {
+	ctx, span := s.start(ctx, "ListShishas")
+	defer s.end(span, &err)
+	return s.inner.ListShishas(ctx, opts)
+}
+
+func (s *Storage) GetShisha(ctx context.Context, id uint) (_ *storage.Shisha, err error) {
+	ctx, span := s.start(ctx, "GetShisha")
+	defer s.end(span, &err)
+	return s.inner.GetShisha(ctx, id)
+}
+
+func (s *Storage) CreateShisha(ctx context.Context, sh *storage.Shisha) (_ *storage.Shisha, err error) {
+	ctx, span := s.start(ctx, "CreateShisha")
+	defer s.end(span, &err)
+	return s.inner.CreateShisha(ctx, sh)
+}
+
+func (s *Storage) CreateShishas(ctx context.Context, items []storage.Shisha) (_ []storage.BatchResult, err error) {
+	ctx, span := s.start(ctx, "CreateShishas")
+	defer s.end(span, &err)
+	return s.inner.CreateShishas(ctx, items)
+}
+
+func (s *Storage) RestoreShishas(ctx context.Context, items []storage.Shisha) (_ []storage.BatchResult, err error) {
+	ctx, span := s.start(ctx, "RestoreShishas")
+	defer s.end(span, &err)
+	return s.inner.RestoreShishas(ctx, items)
+}
+
+func (s *Storage) UpdateShisha(ctx context.Context, id uint, sh *storage.Shisha) (_ *storage.Shisha, err error) {
+	ctx, span := s.start(ctx, "UpdateShisha")
+	defer s.end(span, &err)
+	return s.inner.UpdateShisha(ctx, id, sh)
+}
+
+func (s *Storage) ReplaceShisha(ctx context.Context, id uint, sh *storage.Shisha) (_ *storage.Shisha, err error) {
+	ctx, span := s.start(ctx, "ReplaceShisha")
+	defer s.end(span, &err)
+	return s.inner.ReplaceShisha(ctx, id, sh)
+}
+
+func (s *Storage) DeleteShisha(ctx context.Context, id uint) (err error) {
+	ctx, span := s.start(ctx, "DeleteShisha")
+	defer s.end(span, &err)
+	return s.inner.DeleteShisha(ctx, id)
+}
+
+func (s *Storage) AddRating(ctx context.Context, id uint, user string, score int) (err error) {
+	ctx, span := s.start(ctx, "AddRating")
+	defer s.end(span, &err)
+	return s.inner.AddRating(ctx, id, user, score)
+}
+
+func (s *Storage) RatingStats(ctx context.Context, id uint) (_ *storage.ShishaStats, err error) {
+	ctx, span := s.start(ctx, "RatingStats")
+	defer s.end(span, &err)
+	return s.inner.RatingStats(ctx, id)
+}
+
+func (s *Storage) DeleteRating(ctx context.Context, id uint, user string) (err error) {
+	ctx, span := s.start(ctx, "DeleteRating")
+	defer s.end(span, &err)
+	return s.inner.DeleteRating(ctx, id, user)
+}
+
+func (s *Storage) AddComment(ctx context.Context, id uint, user, message string, parentID uint) (_ *storage.Comment, err error) {
+	ctx, span := s.start(ctx, "AddComment")
+	defer s.end(span, &err)
+	return s.inner.AddComment(ctx, id, user, message, parentID)
+}
+
+func (s *Storage) UpdateComment(ctx context.Context, id, cid uint, author, message string) (_ *storage.Comment, err error) {
+	ctx, span := s.start(ctx, "UpdateComment")
+	defer s.end(span, &err)
+	return s.inner.UpdateComment(ctx, id, cid, author, message)
+}
+
+func (s *Storage) DeleteComment(ctx context.Context, id, cid uint, author string) (err error) {
+	ctx, span := s.start(ctx, "DeleteComment")
+	defer s.end(span, &err)
+	return s.inner.DeleteComment(ctx, id, cid, author)
+}
+
+func (s *Storage) AddSmoked(ctx context.Context, id uint) (err error) {
+	ctx, span := s.start(ctx, "AddSmoked")
+	defer s.end(span, &err)
+	return s.inner.AddSmoked(ctx, id)
+}
+
+func (s *Storage) ListManufacturers(ctx context.Context) (_ []storage.Manufacturer, err error) {
+	ctx, span := s.start(ctx, "ListManufacturers")
+	defer s.end(span, &err)
+	return s.inner.ListManufacturers(ctx)
+}
+
+func (s *Storage) GetManufacturer(ctx context.Context, id uint) (_ *storage.Manufacturer, err error) {
+	ctx, span := s.start(ctx, "GetManufacturer")
+	defer s.end(span, &err)
+	return s.inner.GetManufacturer(ctx, id)
+}
+
+func (s *Storage) CreateManufacturer(ctx context.Context, m *storage.Manufacturer) (_ *storage.Manufacturer, err error) {
+	ctx, span := s.start(ctx, "CreateManufacturer")
+	defer s.end(span, &err)
+	return s.inner.CreateManufacturer(ctx, m)
+}
+
+func (s *Storage) UpdateManufacturer(ctx context.Context, id uint, m *storage.Manufacturer) (_ *storage.Manufacturer, err error) {
+	ctx, span := s.start(ctx, "UpdateManufacturer")
+	defer s.end(span, &err)
+	return s.inner.UpdateManufacturer(ctx, id, m)
+}
+
+func (s *Storage) DeleteManufacturer(ctx context.Context, id uint) (err error) {
+	ctx, span := s.start(ctx, "DeleteManufacturer")
+	defer s.end(span, &err)
+	return s.inner.DeleteManufacturer(ctx, id)
+}
+
+func (s *Storage) MergeManufacturers(ctx context.Context, into uint, ids []uint) (_ *storage.Manufacturer, err error) {
+	ctx, span := s.start(ctx, "MergeManufacturers")
+	defer s.end(span, &err)
+	return s.inner.MergeManufacturers(ctx, into, ids)
+}
+
+func (s *Storage) NormalizeManufacturers(ctx context.Context) (_ []storage.ManufacturerMerge, err error) {
+	ctx, span := s.start(ctx, "NormalizeManufacturers")
+	defer s.end(span, &err)
+	return s.inner.NormalizeManufacturers(ctx)
+}
+
+func (s *Storage) CreateUser(ctx context.Context, u *storage.User) (_ *storage.User, err error) {
+	ctx, span := s.start(ctx, "CreateUser")
+	defer s.end(span, &err)
+	return s.inner.CreateUser(ctx, u)
+}
+
+func (s *Storage) GetUser(ctx context.Context, name string) (_ *storage.User, err error) {
+	ctx, span := s.start(ctx, "GetUser")
+	defer s.end(span, &err)
+	return s.inner.GetUser(ctx, name)
+}
+
+func (s *Storage) ListUsers(ctx context.Context) (_ []storage.User, err error) {
+	ctx, span := s.start(ctx, "ListUsers")
+	defer s.end(span, &err)
+	return s.inner.ListUsers(ctx)
+}
+
+func (s *Storage) SetUserRole(ctx context.Context, name, role string) (_ *storage.User, err error) {
+	ctx, span := s.start(ctx, "SetUserRole")
+	defer s.end(span, &err)
+	return s.inner.SetUserRole(ctx, name, role)
+}
+
+func (s *Storage) CreateAPIToken(ctx context.Context, t *storage.APIToken) (_ *storage.APIToken, err error) {
+	ctx, span := s.start(ctx, "CreateAPIToken")
+	defer s.end(span, &err)
+	return s.inner.CreateAPIToken(ctx, t)
+}
+
+func (s *Storage) GetAPIToken(ctx context.Context, id string) (_ *storage.APIToken, err error) {
+	ctx, span := s.start(ctx, "GetAPIToken")
+	defer s.end(span, &err)
+	return s.inner.GetAPIToken(ctx, id)
+}
+
+func (s *Storage) ListAPITokens(ctx context.Context, user string) (_ []storage.APIToken, err error) {
+	ctx, span := s.start(ctx, "ListAPITokens")
+	defer s.end(span, &err)
+	return s.inner.ListAPITokens(ctx, user)
+}
+
+func (s *Storage) DeleteAPIToken(ctx context.Context, user, id string) (err error) {
+	ctx, span := s.start(ctx, "DeleteAPIToken")
+	defer s.end(span, &err)
+	return s.inner.DeleteAPIToken(ctx, user, id)
+}
+
+func (s *Storage) Health(ctx context.Context) (err error) {
+	ctx, span := s.start(ctx, "Health")
+	defer s.end(span, &err)
+	return s.inner.Health(ctx)
+}
+
+func (s *Storage) DBInfo(ctx context.Context) (_ *storage.DBInfo, err error) {
+	ctx, span := s.start(ctx, "DBInfo")
+	defer s.end(span, &err)
+	return s.inner.DBInfo(ctx)
+}
@@ -0,0 +1,101 @@
+// Package tracing sets up OpenTelemetry tracing: the exporter, the global tracer provider
+// and the W3C trace context propagation, plus a span-per-call wrapper for
+// storage.Storage.
+//
+// Configuration follows the OpenTelemetry environment variables:
+//
+//	OTEL_TRACES_EXPORTER   otlp, console or none (default none: no spans are recorded)
+//	OTEL_TRACES_FILE       with console, write spans to this file instead of stdout
+//	OTEL_SERVICE_NAME      service name of the spans (default shisha-backend)
+//	OTEL_EXPORTER_OTLP_*   endpoint, headers and timeout of the OTLP/HTTP exporter
+//	OTEL_TRACES_SAMPLER    sampler, e.g. parentbased_traceidratio with OTEL_TRACES_SAMPLER_ARG
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"golang.org/x/exp/slog"
+)
+
+// ServiceName is the default service name of the backend's spans.
+const ServiceName = "shisha-backend"
+
+// Setup installs the propagator and, unless OTEL_TRACES_EXPORTER is empty or "none", a
+// tracer provider with the configured exporter. The returned function flushes pending
+// spans and must be called before the process exits.
+func Setup(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	// incoming traceparent headers are honoured even when no spans are exported, so
+	// callers' trace ids still reach the logs
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	noop := func(context.Context) error { return nil }
+	exporter, closer, err := newExporter(ctx, os.Getenv("OTEL_TRACES_EXPORTER"))
+	if err != nil || exporter == nil {
+		return noop, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName())))
+	if err != nil {
+		return noop, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// newExporter creates the exporter named by kind; nil means tracing is off. closer, if
+// set, is the file to close on shutdown.
+func newExporter(ctx context.Context, kind string) (exp sdktrace.SpanExporter, closer io.Closer, err error) {
+	switch kind {
+	case "", "none":
+		return nil, nil, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("otlp exporter: %w", err)
+		}
+		slog.Info("tracing: exporting spans via OTLP/HTTP")
+		return exp, nil, nil
+	case "console":
+		var w io.Writer = os.Stdout
+		if path := os.Getenv("OTEL_TRACES_FILE"); path != "" {
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				return nil, nil, fmt.Errorf("trace file: %w", err)
+			}
+			w, closer = f, f
+			slog.Info("tracing: writing spans to a file", "path", path)
+		} else {
+			slog.Info("tracing: writing spans to stdout")
+		}
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, nil, err
+		}
+		return exp, closer, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q (otlp, console or none)", kind)
+	}
+}
+
+func serviceName() string {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		return name
+	}
+	return ServiceName
+}
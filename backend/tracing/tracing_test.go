@@ -0,0 +1,126 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shisha-tracker/backend/storage"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// record installs a tracer provider that keeps finished spans in memory.
+func record(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return rec
+}
+
+func TestWrapStorage(t *testing.T) {
+	rec := record(t)
+	s := WrapStorage(storage.NewMemoryAdapter(storage.SampleShishas()...), "memory")
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	if _, err := s.GetShisha(ctx, 1); err != nil {
+		t.Fatalf("GetShisha: %v", err)
+	}
+	if _, err := s.GetShisha(ctx, 99); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetShisha missing: expected ErrNotFound, got %v", err)
+	}
+	parent.End()
+
+	spans := rec.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+	for _, sp := range spans[:2] {
+		if sp.Name() != "storage.GetShisha" {
+			t.Errorf("unexpected span name %q", sp.Name())
+		}
+		if sp.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("%s is not a child of the request span", sp.Name())
+		}
+	}
+	if n := len(spans[1].Events()); n != 1 {
+		t.Errorf("expected the not-found error as event, got %d events", n)
+	}
+	if spans[1].Status().Code == codes.Error {
+		t.Error("a not-found lookup must not mark the span as failed")
+	}
+}
+
+func TestTraceparentPropagation(t *testing.T) {
+	rec := record(t)
+	gin.SetMode(gin.TestMode)
+	s := WrapStorage(storage.NewMemoryAdapter(storage.SampleShishas()...), "memory")
+	r := gin.New()
+	r.Use(otelgin.Middleware(ServiceName))
+	r.GET("/api/shishas/:id", func(c *gin.Context) {
+		if _, err := s.GetShisha(c.Request.Context(), 1); err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/api/shishas/1", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected storage and server span, got %d", len(spans))
+	}
+	for _, sp := range spans {
+		if got := sp.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("%s: expected trace %s, got %s", sp.Name(), traceID, got)
+		}
+	}
+	if spans[1].Name() != "/api/shishas/:id" || spans[0].Parent().SpanID() != spans[1].SpanContext().SpanID() {
+		t.Errorf("storage span %q is not a child of the route span %q", spans[0].Name(), spans[1].Name())
+	}
+}
+
+func TestConsoleExporterFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	t.Setenv("OTEL_TRACES_FILE", path)
+	exp, closer, err := newExporter(context.Background(), "console")
+	if err != nil {
+		t.Fatalf("newExporter: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	_, span := tp.Tracer("test").Start(context.Background(), "hello")
+	span.End()
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	closer.Close()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read spans: %v", err)
+	}
+	if !strings.Contains(string(b), `"Name":"hello"`) {
+		t.Errorf("span missing in %s", b)
+	}
+	if _, _, err := newExporter(context.Background(), "zipkin"); err == nil {
+		t.Error("expected an error for an unknown exporter")
+	}
+}
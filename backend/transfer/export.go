@@ -0,0 +1,182 @@
+package transfer
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+// Supported file formats of Export and Import.
+const (
+	// FormatJSONL is one storage.Shisha JSON object per line (also the scraper output).
+	FormatJSONL = "jsonl"
+	// FormatCSV is a spreadsheet-friendly table; ratings and comments are JSON-encoded cells.
+	FormatCSV = "csv"
+	// FormatJSON is a single snapshot object: {"version":1,"exportedAt":...,"shishas":[...]}.
+	FormatJSON = "json"
+)
+
+// snapshotVersion is written into FormatJSON snapshots.
+const snapshotVersion = 1
+
+// exportPageSize is the number of entries fetched per ListShishas call while exporting.
+const exportPageSize = 500
+
+// csvHeader is the column layout of FormatCSV. rating_avg is informational and ignored
+// on import.
+var csvHeader = []string{"id", "name", "flavor", "manufacturer_id", "manufacturer", "smoked", "rating_avg", "ratings", "comments"}
+
+// ValidFormat reports whether format is one of the Format* constants.
+func ValidFormat(format string) bool {
+	switch format {
+	case FormatJSONL, FormatCSV, FormatJSON:
+		return true
+	}
+	return false
+}
+
+// ContentType returns the MIME type of format.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatJSON:
+		return "application/json"
+	default:
+		return "application/x-ndjson"
+	}
+}
+
+// Export streams every shisha of st, with ratings, comments and smoked count, to w in
+// the given format and returns the number of entries written. Entries are read page by
+// page, so memory use does not grow with the catalogue.
+func Export(ctx context.Context, st storage.Storage, w io.Writer, format string) (int, error) {
+	var enc exporter
+	switch format {
+	case FormatJSONL:
+		enc = &jsonlExporter{enc: json.NewEncoder(w)}
+	case FormatCSV:
+		enc = &csvExporter{w: csv.NewWriter(w)}
+	case FormatJSON:
+		enc = &snapshotExporter{w: w}
+	default:
+		return 0, fmt.Errorf("%w: unknown format %q", storage.ErrValidation, format)
+	}
+	if err := enc.begin(); err != nil {
+		return 0, err
+	}
+	n := 0
+	opts := storage.ListOptions{Limit: exportPageSize}
+	for {
+		page, err := st.ListShishas(ctx, opts)
+		if err != nil {
+			return n, err
+		}
+		for i := range page.Items {
+			if err := enc.write(&page.Items[i]); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	return n, enc.end()
+}
+
+type exporter interface {
+	begin() error
+	write(s *storage.Shisha) error
+	end() error
+}
+
+type jsonlExporter struct {
+	enc *json.Encoder
+}
+
+func (e *jsonlExporter) begin() error                  { return nil }
+func (e *jsonlExporter) write(s *storage.Shisha) error { return e.enc.Encode(s) }
+func (e *jsonlExporter) end() error                    { return nil }
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) begin() error { return e.w.Write(csvHeader) }
+
+func (e *csvExporter) write(s *storage.Shisha) error {
+	ratings, err := jsonCell(s.Ratings, len(s.Ratings))
+	if err != nil {
+		return err
+	}
+	comments, err := jsonCell(s.Comments, len(s.Comments))
+	if err != nil {
+		return err
+	}
+	avg := ""
+	if s.RatingCount > 0 {
+		avg = strconv.FormatFloat(s.RatingAvg, 'f', 2, 64)
+	}
+	return e.w.Write([]string{
+		strconv.FormatUint(uint64(s.ID), 10),
+		s.Name,
+		s.Flavor,
+		strconv.FormatUint(uint64(s.Manufacturer.ID), 10),
+		s.Manufacturer.Name,
+		strconv.Itoa(s.Smoked),
+		avg,
+		ratings,
+		comments,
+	})
+}
+
+// jsonCell encodes v for a CSV cell; empty lists become an empty cell.
+func jsonCell(v interface{}, n int) (string, error) {
+	if n == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (e *csvExporter) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type snapshotExporter struct {
+	w     io.Writer
+	count int
+}
+
+func (e *snapshotExporter) begin() error {
+	_, err := fmt.Fprintf(e.w, "{\"version\":%d,\"exportedAt\":%q,\"shishas\":[", snapshotVersion, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (e *snapshotExporter) write(s *storage.Shisha) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if e.count == 0 {
+		sep = "\n"
+	}
+	e.count++
+	_, err = io.WriteString(e.w, sep+string(b))
+	return err
+}
+
+func (e *snapshotExporter) end() error {
+	_, err := io.WriteString(e.w, "\n]}\n")
+	return err
+}
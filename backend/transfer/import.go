@@ -0,0 +1,151 @@
+// Package transfer moves shisha data in and out of a storage.Storage: bulk import of the
+// scraper JSONL files and the inverse export.
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+// DefaultBatchSize is the number of entries written per storage round trip.
+const DefaultBatchSize = 200
+
+// maxReportedErrors caps ImportSummary.Errors so a broken file cannot blow up the response.
+const maxReportedErrors = 100
+
+// ImportOptions controls Import.
+type ImportOptions struct {
+	// Format of the input, one of the Format* constants; empty means FormatJSONL.
+	Format string
+	// DryRun parses and deduplicates the input but writes nothing.
+	DryRun bool
+	// BatchSize is the number of entries per write; 0 means DefaultBatchSize.
+	BatchSize int
+}
+
+// LineError describes why one input line was not imported. For FormatJSON Line is the
+// 1-based position of the entry in the shishas array.
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportSummary reports the outcome of an import. In a dry run Created counts the
+// entries that would have been created.
+type ImportSummary struct {
+	DryRun  bool        `json:"dryRun"`
+	Created int         `json:"created"`
+	Skipped int         `json:"skipped"`
+	Failed  int         `json:"failed"`
+	Errors  []LineError `json:"errors,omitempty"`
+}
+
+func (s *ImportSummary) fail(line int, err error) {
+	s.Failed++
+	if len(s.Errors) < maxReportedErrors {
+		s.Errors = append(s.Errors, LineError{Line: line, Error: err.Error()})
+	}
+}
+
+// Import reads shishas from r in the format given by opts (by default one JSON shisha
+// per line as written by the scrapers and by Export, e.g.
+// {"name":...,"flavor":...,"manufacturer":{"name":...}}) and creates the entries in st.
+// Entries whose normalised name and manufacturer already exist in st, or appeared
+// earlier in the input, are skipped. Ids in the input are ignored; blank lines are
+// allowed. Entries that cannot be parsed or are rejected by the storage are counted as
+// failed and do not stop the import; a storage or read error does.
+func Import(ctx context.Context, st storage.Storage, r io.Reader, opts ImportOptions) (*ImportSummary, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	src, err := newSource(r, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := st.ListShishas(ctx, storage.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("load existing entries: %w", err)
+	}
+	seen := make(map[string]bool, len(existing.Items))
+	for _, s := range existing.Items {
+		seen[dedupKey(s)] = true
+	}
+
+	sum := &ImportSummary{DryRun: opts.DryRun}
+	var batch []storage.Shisha
+	var batchLines []int
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() { batch, batchLines = batch[:0], batchLines[:0] }()
+		if opts.DryRun {
+			sum.Created += len(batch)
+			return nil
+		}
+		results, err := st.CreateShishas(ctx, batch)
+		if err != nil {
+			return fmt.Errorf("write batch ending at line %d: %w", batchLines[len(batchLines)-1], err)
+		}
+		for k, res := range results {
+			if res.Err != nil {
+				sum.fail(batchLines[k], res.Err)
+				continue
+			}
+			sum.Created++
+		}
+		return nil
+	}
+
+	for {
+		e, err := src.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sum, err
+		}
+		if e.err != nil {
+			sum.fail(e.line, e.err)
+			continue
+		}
+		s := e.shisha
+		s.ID = 0
+		s.Name = strings.TrimSpace(s.Name)
+		s.Manufacturer.Name = strings.TrimSpace(s.Manufacturer.Name)
+		if s.Name == "" {
+			sum.fail(e.line, fmt.Errorf("%w: name is required", storage.ErrValidation))
+			continue
+		}
+		key := dedupKey(s)
+		if seen[key] {
+			sum.Skipped++
+			continue
+		}
+		seen[key] = true
+		batch = append(batch, s)
+		batchLines = append(batchLines, e.line)
+		if len(batch) >= opts.BatchSize {
+			if err := flush(); err != nil {
+				return sum, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return sum, err
+	}
+	return sum, nil
+}
+
+// dedupKey identifies an entry by name and manufacturer, ignoring case and whitespace.
+func dedupKey(s storage.Shisha) string {
+	return normalize(s.Manufacturer.Name) + "\x00" + normalize(s.Name)
+}
+
+func normalize(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
@@ -0,0 +1,73 @@
+package transfer
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+const scraperLines = `{"name": "Adalya Love 66", "flavor": "Wassermelone Honigmelone", "manufacturer": {"name": "Adalya"}}
+{"name": "Aino Dark Tobacco Black", "flavor": "Blaubeere", "manufacturer": {"name": "Aino Dark"}}
+
+{"name": "adalya  love 66", "flavor": "duplicate in file", "manufacturer": {"name": "ADALYA"}}
+{"name": "Mint Breeze", "flavor": "Minze", "manufacturer": {"name": "al fakher"}}
+not json
+{"name": "", "manufacturer": {"name": "Adalya"}}
+{"id": 99, "name": "Aino Dark Tobacco Galaxchee", "flavor": "Litschi", "manufacturer": {"name": "Aino Dark"}}
+`
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMemoryAdapter(storage.SampleShishas()...) // already holds Mint Breeze / Al Fakher
+
+	sum, err := Import(ctx, st, strings.NewReader(scraperLines), ImportOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if sum.Created != 3 || sum.Skipped != 2 || sum.Failed != 2 || sum.DryRun {
+		t.Fatalf("unexpected summary %+v", sum)
+	}
+	if len(sum.Errors) != 2 || sum.Errors[0].Line != 6 || sum.Errors[1].Line != 7 {
+		t.Fatalf("unexpected line errors %+v", sum.Errors)
+	}
+	page, err := st.ListShishas(ctx, storage.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListShishas: %v", err)
+	}
+	if len(page.Items) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(page.Items))
+	}
+	for _, s := range page.Items {
+		if s.ID == 99 {
+			t.Fatalf("input id was kept: %+v", s)
+		}
+	}
+
+	// importing the same file again creates nothing
+	sum, err = Import(ctx, st, strings.NewReader(scraperLines), ImportOptions{})
+	if err != nil {
+		t.Fatalf("second Import: %v", err)
+	}
+	if sum.Created != 0 || sum.Skipped != 5 {
+		t.Fatalf("re-import not deduplicated: %+v", sum)
+	}
+}
+
+func TestImport_DryRun(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMemoryAdapter()
+
+	sum, err := Import(ctx, st, strings.NewReader(scraperLines), ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if !sum.DryRun || sum.Created != 4 || sum.Skipped != 1 || sum.Failed != 2 {
+		t.Fatalf("unexpected summary %+v", sum)
+	}
+	page, _ := st.ListShishas(ctx, storage.ListOptions{})
+	if len(page.Items) != 0 {
+		t.Fatalf("dry run wrote %d entries", len(page.Items))
+	}
+}
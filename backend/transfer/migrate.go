@@ -0,0 +1,369 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+// maxReportedIDs caps the id lists of a VerifyReport.
+const maxReportedIDs = 100
+
+// ErrVerifyFailed reports that source and target differ after a migration.
+var ErrVerifyFailed = errors.New("verification failed")
+
+// MigrateOptions controls Migrate.
+type MigrateOptions struct {
+	// BatchSize is the number of entries read and written per round trip; 0 means
+	// DefaultBatchSize.
+	BatchSize int
+	// Progress, if set, is called after every batch.
+	Progress func(MigrateReport)
+}
+
+// MigrateReport summarises a Migrate run.
+type MigrateReport struct {
+	// Copied entries were missing in the target and written with their source id.
+	Copied int `json:"copied"`
+	// Updated entries existed in the target with different content (changed in the
+	// source since an earlier run) and were overwritten.
+	Updated int `json:"updated"`
+	// Unchanged entries were already identical in the target.
+	Unchanged int `json:"unchanged"`
+	// ManufacturersCopied counts the manufacturers created in the target; most come
+	// with their shishas, this covers the ones no shisha references.
+	ManufacturersCopied int `json:"manufacturersCopied"`
+	// UsersCopied and TokensCopied count the accounts and API tokens created in the
+	// target; RolesUpdated the accounts whose role was changed to the source's.
+	UsersCopied  int           `json:"usersCopied"`
+	TokensCopied int           `json:"tokensCopied"`
+	RolesUpdated int           `json:"rolesUpdated"`
+	Verify       *VerifyReport `json:"verify,omitempty"`
+}
+
+// VerifyReport is the result of comparing two storages record by record.
+type VerifyReport struct {
+	SourceCount int `json:"sourceCount"`
+	TargetCount int `json:"targetCount"`
+	// Missing ids exist in the source only, Extra ids in the target only and Mismatched
+	// ids in both with different content. The lists are capped at 100 ids each; the
+	// counts are complete.
+	MissingCount    int    `json:"missingCount"`
+	ExtraCount      int    `json:"extraCount"`
+	MismatchedCount int    `json:"mismatchedCount"`
+	Missing         []uint `json:"missing,omitempty"`
+	Extra           []uint `json:"extra,omitempty"`
+	Mismatched      []uint `json:"mismatched,omitempty"`
+	// Manufacturers of the source (by name) that are missing in the target.
+	Manufacturers []string `json:"manufacturers,omitempty"`
+	// Users (by name) and APITokens (by id) of the source that are missing in the target
+	// or differ there (role, password hash, owner). Accounts only in the target are not
+	// reported.
+	Users     []string `json:"users,omitempty"`
+	APITokens []string `json:"apiTokens,omitempty"`
+}
+
+// OK reports whether source and target hold exactly the same records.
+func (r *VerifyReport) OK() bool {
+	return r.MissingCount == 0 && r.ExtraCount == 0 && r.MismatchedCount == 0 && len(r.Manufacturers) == 0 && len(r.Users) == 0 && len(r.APITokens) == 0
+}
+
+// Migrate copies every shisha with ratings, comments and smoked counter from one
+// storage to another, keeping the numeric ids, then the manufacturers without shishas,
+// the accounts with their roles and
+// password hashes and the API tokens, and finishes with Verify.
+//
+// It is safe to interrupt and run again: entries already present in the target with the
+// same content are skipped, entries that changed in the source meanwhile are
+// overwritten. Running it once more right before switching backends therefore catches
+// up with writes made while the first pass ran. Entries deleted from the source are
+// not deleted from the target; Verify reports them as extra.
+func Migrate(ctx context.Context, from, to storage.Storage, opts MigrateOptions) (*MigrateReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	target, err := checksums(ctx, to)
+	if err != nil {
+		return nil, fmt.Errorf("read target: %w", err)
+	}
+	report := &MigrateReport{}
+	listOpts := storage.ListOptions{Limit: opts.BatchSize, Sort: storage.SortID}
+	for {
+		page, err := from.ListShishas(ctx, listOpts)
+		if err != nil {
+			return report, fmt.Errorf("read source: %w", err)
+		}
+		var missing []storage.Shisha
+		for _, s := range page.Items {
+			sum, exists := target[s.ID]
+			switch {
+			case !exists:
+				missing = append(missing, s)
+			case sum == Checksum(s):
+				report.Unchanged++
+			default:
+				s := s
+				if _, err := to.ReplaceShisha(ctx, s.ID, &s); err != nil {
+					return report, fmt.Errorf("update shisha %d: %w", s.ID, err)
+				}
+				report.Updated++
+			}
+		}
+		if len(missing) > 0 {
+			results, err := to.RestoreShishas(ctx, missing)
+			if err != nil {
+				return report, fmt.Errorf("copy shishas %d-%d: %w", missing[0].ID, missing[len(missing)-1].ID, err)
+			}
+			for k, res := range results {
+				if res.Err != nil {
+					return report, fmt.Errorf("copy shisha %d: %w", missing[k].ID, res.Err)
+				}
+				report.Copied++
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(*report)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		listOpts.Cursor = page.NextCursor
+	}
+	if err := migrateManufacturers(ctx, from, to, report); err != nil {
+		return report, err
+	}
+	if err := migrateAccounts(ctx, from, to, report); err != nil {
+		return report, err
+	}
+
+	report.Verify, err = Verify(ctx, from, to)
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// migrateManufacturers creates the manufacturers of from that are missing in to. Their
+// ids are not kept: SQL backends assign their own, shishas refer to them by name.
+func migrateManufacturers(ctx context.Context, from, to storage.Storage, report *MigrateReport) error {
+	manufacturers, err := from.ListManufacturers(ctx)
+	if err != nil {
+		return fmt.Errorf("read source manufacturers: %w", err)
+	}
+	for _, m := range manufacturers {
+		_, err := to.CreateManufacturer(ctx, &storage.Manufacturer{Name: m.Name})
+		switch {
+		case errors.Is(err, storage.ErrConflict):
+			// already there, with its shishas or from an earlier run
+		case err != nil:
+			return fmt.Errorf("copy manufacturer %s: %w", m.Name, err)
+		default:
+			report.ManufacturersCopied++
+		}
+	}
+	return nil
+}
+
+// migrateAccounts creates the accounts and API tokens of from that are missing in to and
+// aligns the roles of existing accounts. Accounts cannot change their password hash, so
+// a differing hash is left to Verify.
+func migrateAccounts(ctx context.Context, from, to storage.Storage, report *MigrateReport) error {
+	users, err := from.ListUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("read source users: %w", err)
+	}
+	for _, u := range users {
+		existing, err := to.GetUser(ctx, u.Name)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			u := u
+			if _, err := to.CreateUser(ctx, &u); err != nil {
+				return fmt.Errorf("copy user %s: %w", u.Name, err)
+			}
+			report.UsersCopied++
+		case err != nil:
+			return fmt.Errorf("read target user %s: %w", u.Name, err)
+		case existing.Role != u.Role:
+			if _, err := to.SetUserRole(ctx, u.Name, u.Role); err != nil {
+				return fmt.Errorf("update role of %s: %w", u.Name, err)
+			}
+			report.RolesUpdated++
+		}
+
+		tokens, err := from.ListAPITokens(ctx, u.Name)
+		if err != nil {
+			return fmt.Errorf("read source tokens of %s: %w", u.Name, err)
+		}
+		for _, t := range tokens {
+			_, err := to.GetAPIToken(ctx, t.ID)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, storage.ErrNotFound) {
+				return fmt.Errorf("read target token %s: %w", t.ID, err)
+			}
+			t := t
+			if _, err := to.CreateAPIToken(ctx, &t); err != nil {
+				return fmt.Errorf("copy token %s: %w", t.ID, err)
+			}
+			report.TokensCopied++
+		}
+	}
+	return nil
+}
+
+// Verify compares the record counts and per-record checksums of two storages, and the
+// manufacturers, accounts and API tokens of the source with the target.
+func Verify(ctx context.Context, from, to storage.Storage) (*VerifyReport, error) {
+	source, err := checksums(ctx, from)
+	if err != nil {
+		return nil, fmt.Errorf("read source: %w", err)
+	}
+	target, err := checksums(ctx, to)
+	if err != nil {
+		return nil, fmt.Errorf("read target: %w", err)
+	}
+	r := &VerifyReport{SourceCount: len(source), TargetCount: len(target)}
+	for id, sum := range source {
+		other, ok := target[id]
+		switch {
+		case !ok:
+			r.MissingCount++
+			r.Missing = append(r.Missing, id)
+		case other != sum:
+			r.MismatchedCount++
+			r.Mismatched = append(r.Mismatched, id)
+		}
+	}
+	for id := range target {
+		if _, ok := source[id]; !ok {
+			r.ExtraCount++
+			r.Extra = append(r.Extra, id)
+		}
+	}
+	r.Missing, r.Extra, r.Mismatched = capIDs(r.Missing), capIDs(r.Extra), capIDs(r.Mismatched)
+	if r.Manufacturers, err = missingManufacturers(ctx, from, to); err != nil {
+		return nil, err
+	}
+	if err := verifyAccounts(ctx, from, to, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// missingManufacturers returns the names of the manufacturers of from that to lacks.
+func missingManufacturers(ctx context.Context, from, to storage.Storage) ([]string, error) {
+	source, err := from.ListManufacturers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read source manufacturers: %w", err)
+	}
+	target, err := to.ListManufacturers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read target manufacturers: %w", err)
+	}
+	have := make(map[string]bool, len(target))
+	for _, m := range target {
+		have[m.Name] = true
+	}
+	var missing []string
+	for _, m := range source {
+		if !have[m.Name] {
+			missing = append(missing, m.Name)
+		}
+	}
+	return missing, nil
+}
+
+// verifyAccounts lists the accounts and tokens of from that to lacks or holds
+// differently.
+func verifyAccounts(ctx context.Context, from, to storage.Storage, r *VerifyReport) error {
+	users, err := from.ListUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("read source users: %w", err)
+	}
+	for _, u := range users {
+		other, err := to.GetUser(ctx, u.Name)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			r.Users = append(r.Users, u.Name)
+			continue
+		case err != nil:
+			return fmt.Errorf("read target user %s: %w", u.Name, err)
+		case other.Role != u.Role || other.PasswordHash != u.PasswordHash:
+			r.Users = append(r.Users, u.Name)
+		}
+		tokens, err := from.ListAPITokens(ctx, u.Name)
+		if err != nil {
+			return fmt.Errorf("read source tokens of %s: %w", u.Name, err)
+		}
+		for _, t := range tokens {
+			other, err := to.GetAPIToken(ctx, t.ID)
+			switch {
+			case errors.Is(err, storage.ErrNotFound):
+				r.APITokens = append(r.APITokens, t.ID)
+			case err != nil:
+				return fmt.Errorf("read target token %s: %w", t.ID, err)
+			case *other != t:
+				r.APITokens = append(r.APITokens, t.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// Checksum fingerprints the content of s that a migration must preserve. Manufacturer
+// ids are left out because SQL backends assign their own; empty and missing lists
+// hash the same. Ratings are compared normalized (storage.NormalizeRatings), as the
+// target stores them, so legacy duplicates and out-of-range scores of a source do not
+// count as a change on every run.
+func Checksum(s storage.Shisha) [sha256.Size]byte {
+	canonical := struct {
+		ID           uint              `json:"id"`
+		Name         string            `json:"name"`
+		Flavor       string            `json:"flavor"`
+		Manufacturer string            `json:"manufacturer"`
+		Smoked       int               `json:"smoked"`
+		Ratings      []storage.Rating  `json:"ratings"`
+		Comments     []storage.Comment `json:"comments"`
+	}{s.ID, s.Name, s.Flavor, s.Manufacturer.Name, s.Smoked, storage.NormalizeRatings(s.Ratings), s.Comments}
+	if len(canonical.Ratings) == 0 {
+		canonical.Ratings = nil
+	}
+	if len(canonical.Comments) == 0 {
+		canonical.Comments = nil
+	}
+	b, _ := json.Marshal(canonical) // cannot fail for these field types
+	return sha256.Sum256(b)
+}
+
+// checksums reads every entry of st and returns id -> Checksum.
+func checksums(ctx context.Context, st storage.Storage) (map[uint][sha256.Size]byte, error) {
+	out := make(map[uint][sha256.Size]byte)
+	opts := storage.ListOptions{Limit: exportPageSize}
+	for {
+		page, err := st.ListShishas(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range page.Items {
+			out[s.ID] = Checksum(s)
+		}
+		if page.NextCursor == "" {
+			return out, nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+func capIDs(ids []uint) []uint {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > maxReportedIDs {
+		ids = ids[:maxReportedIDs]
+	}
+	return ids
+}
@@ -0,0 +1,192 @@
+package transfer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+func newSQLiteTarget(t *testing.T) storage.Storage {
+	t.Helper()
+	st, err := storage.NewSQLiteAdapter(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLiteAdapter: %v", err)
+	}
+	return st
+}
+
+func TestMigrate_CopiesEverythingAndVerifies(t *testing.T) {
+	ctx := context.Background()
+	from := storage.NewMemoryAdapter(exportFixture()...)
+	to := newSQLiteTarget(t)
+
+	report, err := Migrate(ctx, from, to, MigrateOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if report.Copied != 3 || report.Updated != 0 || report.Unchanged != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if !report.Verify.OK() || report.Verify.SourceCount != 3 || report.Verify.TargetCount != 3 {
+		t.Fatalf("verification failed: %+v", report.Verify)
+	}
+	got, err := to.GetShisha(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetShisha: %v", err)
+	}
+	want := exportFixture()[0]
+	if got.Name != want.Name || got.Smoked != want.Smoked || !reflect.DeepEqual(got.Ratings, want.Ratings) || !reflect.DeepEqual(got.Comments, want.Comments) {
+		t.Fatalf("copied entry differs:\n got %+v\nwant %+v", got, want)
+	}
+
+	// ids continue after the migrated ones
+	created, err := to.CreateShisha(ctx, &storage.Shisha{Name: "Neu", Manufacturer: storage.Manufacturer{Name: "Adalya"}})
+	if err != nil {
+		t.Fatalf("CreateShisha: %v", err)
+	}
+	if created.ID != 4 {
+		t.Fatalf("expected next id 4, got %d", created.ID)
+	}
+}
+
+func TestMigrate_ResumesAndCatchesUp(t *testing.T) {
+	ctx := context.Background()
+	from := storage.NewMemoryAdapter(exportFixture()...)
+	to := newSQLiteTarget(t)
+
+	// an interrupted earlier run copied entry 1 only
+	if _, err := to.RestoreShishas(ctx, exportFixture()[:1]); err != nil {
+		t.Fatalf("RestoreShishas: %v", err)
+	}
+	// entry 1 changed in the source meanwhile
+	if err := from.AddSmoked(ctx, 1); err != nil {
+		t.Fatalf("AddSmoked: %v", err)
+	}
+
+	report, err := Migrate(ctx, from, to, MigrateOptions{})
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if report.Copied != 2 || report.Updated != 1 || report.Unchanged != 0 || !report.Verify.OK() {
+		t.Fatalf("unexpected report %+v (verify %+v)", report, report.Verify)
+	}
+	got, _ := to.GetShisha(ctx, 1)
+	if got.Smoked != 4 {
+		t.Fatalf("expected smoked 4 after catch-up, got %d", got.Smoked)
+	}
+
+	report, err = Migrate(ctx, from, to, MigrateOptions{})
+	if err != nil {
+		t.Fatalf("second Migrate: %v", err)
+	}
+	if report.Copied != 0 || report.Updated != 0 || report.Unchanged != 3 {
+		t.Fatalf("expected a no-op re-run, got %+v", report)
+	}
+}
+
+func TestVerify_ReportsDifferences(t *testing.T) {
+	ctx := context.Background()
+	items := exportFixture()
+	from := storage.NewMemoryAdapter(items[0], items[1])
+	changed := items[0]
+	changed.Comments = nil
+	to := storage.NewMemoryAdapter(changed, items[2])
+
+	r, err := Verify(ctx, from, to)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if r.OK() {
+		t.Fatal("expected differences")
+	}
+	if !reflect.DeepEqual(r.Missing, []uint{2}) || !reflect.DeepEqual(r.Extra, []uint{3}) || !reflect.DeepEqual(r.Mismatched, []uint{1}) {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if r.SourceCount != 2 || r.TargetCount != 2 {
+		t.Fatalf("unexpected counts %+v", r)
+	}
+}
+
+func TestChecksum_IgnoresManufacturerIDAndEmptyLists(t *testing.T) {
+	a := storage.Shisha{ID: 1, Name: "X", Manufacturer: storage.Manufacturer{ID: 1, Name: "M"}, Ratings: []storage.Rating{}}
+	b := storage.Shisha{ID: 1, Name: "X", Manufacturer: storage.Manufacturer{ID: 7, Name: "M"}}
+	if Checksum(a) != Checksum(b) {
+		t.Fatal("expected equal checksums")
+	}
+	b.Smoked = 1
+	if Checksum(a) == Checksum(b) {
+		t.Fatal("expected smoked to change the checksum")
+	}
+}
+
+func TestMigrate_CopiesManufacturersAndAccounts(t *testing.T) {
+	ctx := context.Background()
+	from := storage.NewMemoryAdapter(exportFixture()...)
+	for _, u := range []storage.User{
+		{Name: "alice", Role: storage.RoleAdmin, PasswordHash: "$2a$10$alice", CreatedAt: 1700000000},
+		{Name: "bob", Role: storage.RoleCurator, PasswordHash: "$2a$10$bob", CreatedAt: 1700000050},
+	} {
+		u := u
+		if _, err := from.CreateUser(ctx, &u); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+	token := storage.APIToken{ID: "9f3c2a1b0e4d5c6f", User: "alice", Name: "skript", SecretHash: "c2VjcmV0", CreatedAt: 1700000200}
+	if _, err := from.CreateAPIToken(ctx, &token); err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+	if _, err := from.CreateManufacturer(ctx, &storage.Manufacturer{Name: "Tangiers"}); err != nil {
+		t.Fatalf("CreateManufacturer: %v", err)
+	}
+	to := newSQLiteTarget(t)
+	// bob registered in the target before the migration, still as a member
+	if _, err := to.CreateUser(ctx, &storage.User{Name: "bob", Role: storage.RoleMember, PasswordHash: "$2a$10$bob", CreatedAt: 1700000050}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	report, err := Migrate(ctx, from, to, MigrateOptions{})
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if report.ManufacturersCopied != 1 || report.UsersCopied != 1 || report.RolesUpdated != 1 || report.TokensCopied != 1 || !report.Verify.OK() {
+		t.Fatalf("unexpected report %+v, verify %+v", report, report.Verify)
+	}
+	if got, err := to.GetAPIToken(ctx, token.ID); err != nil || *got != token {
+		t.Fatalf("token not copied: %+v (%v)", got, err)
+	}
+
+	// a second run copies nothing
+	report, err = Migrate(ctx, from, to, MigrateOptions{})
+	if err != nil || report.ManufacturersCopied != 0 || report.UsersCopied != 0 || report.TokensCopied != 0 || report.RolesUpdated != 0 {
+		t.Fatalf("second run: %+v (%v)", report, err)
+	}
+}
+
+func TestMigrate_VerifiesLegacyRatings(t *testing.T) {
+	ctx := context.Background()
+	// written by an older version: two ratings of alice and a score beyond the scale
+	legacy := storage.Shisha{ID: 1, Name: "Mint", Ratings: []storage.Rating{
+		{User: "alice", Score: 4}, {User: "bob", Score: 9999}, {User: "Alice", Score: 9},
+	}}
+	from := storage.NewMemoryAdapter(legacy)
+	to := newSQLiteTarget(t)
+
+	for run := 1; run <= 2; run++ {
+		report, err := Migrate(ctx, from, to, MigrateOptions{})
+		if err != nil {
+			t.Fatalf("run %d: Migrate: %v", run, err)
+		}
+		if !report.Verify.OK() || report.Updated != 0 {
+			t.Fatalf("run %d: unexpected report %+v (verify %+v)", run, report, report.Verify)
+		}
+	}
+	got, err := to.GetShisha(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetShisha: %v", err)
+	}
+	if len(got.Ratings) != 2 || got.Ratings[0].Score != 9 || got.Ratings[1].Score != storage.MaxScore {
+		t.Fatalf("ratings not normalized: %+v", got.Ratings)
+	}
+}
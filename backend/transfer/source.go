@@ -0,0 +1,228 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/shisha-tracker/backend/storage"
+)
+
+// maxLineBytes bounds a single JSONL line.
+const maxLineBytes = 1 << 20
+
+// entry is one decoded input record. err is set when just this record is unusable.
+type entry struct {
+	line   int
+	shisha storage.Shisha
+	err    error
+}
+
+// source yields the entries of an import input. next returns io.EOF at the end and any
+// other error when the input cannot be read any further.
+type source interface {
+	next() (entry, error)
+}
+
+func newSource(r io.Reader, format string) (source, error) {
+	switch format {
+	case "", FormatJSONL:
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 64*1024), maxLineBytes)
+		return &jsonlSource{sc: sc}, nil
+	case FormatCSV:
+		return newCSVSource(r)
+	case FormatJSON:
+		return &snapshotSource{dec: json.NewDecoder(r)}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown format %q", storage.ErrValidation, format)
+}
+
+type jsonlSource struct {
+	sc   *bufio.Scanner
+	line int
+}
+
+func (s *jsonlSource) next() (entry, error) {
+	for s.sc.Scan() {
+		s.line++
+		text := strings.TrimSpace(s.sc.Text())
+		if text == "" {
+			continue
+		}
+		e := entry{line: s.line}
+		if err := json.Unmarshal([]byte(text), &e.shisha); err != nil {
+			e.err = fmt.Errorf("invalid JSON: %w", err)
+		}
+		return e, nil
+	}
+	if err := s.sc.Err(); err != nil {
+		return entry{}, fmt.Errorf("read line %d: %w", s.line+1, err)
+	}
+	return entry{}, io.EOF
+}
+
+type csvSource struct {
+	r    *csv.Reader
+	cols map[string]int
+}
+
+func newCSVSource(r io.Reader) (*csvSource, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return &csvSource{r: cr, cols: map[string]int{"name": 0}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read CSV header: %w", err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, h := range header {
+		// spreadsheet programs like to prepend a UTF-8 byte order mark
+		cols[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))] = i
+	}
+	if _, ok := cols["name"]; !ok {
+		return nil, fmt.Errorf("%w: CSV header has no name column", storage.ErrValidation)
+	}
+	return &csvSource{r: cr, cols: cols}, nil
+}
+
+func (s *csvSource) next() (entry, error) {
+	rec, err := s.r.Read()
+	if err == io.EOF {
+		return entry{}, io.EOF
+	}
+	var perr *csv.ParseError
+	if errors.As(err, &perr) {
+		return entry{line: perr.Line, err: err}, nil
+	}
+	if err != nil {
+		return entry{}, err
+	}
+	line, _ := s.r.FieldPos(0)
+	e := entry{line: line}
+	e.shisha, e.err = s.decode(rec)
+	return e, nil
+}
+
+// decode maps a CSV record onto a Shisha using the csvHeader column names.
+func (s *csvSource) decode(rec []string) (storage.Shisha, error) {
+	field := func(name string) string {
+		if i, ok := s.cols[name]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+	sh := storage.Shisha{
+		Name:         field("name"),
+		Flavor:       field("flavor"),
+		Manufacturer: storage.Manufacturer{Name: field("manufacturer")},
+	}
+	if v := field("manufacturer_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			return sh, fmt.Errorf("invalid manufacturer_id %q", v)
+		}
+		sh.Manufacturer.ID = uint(id)
+	}
+	if v := field("smoked"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return sh, fmt.Errorf("invalid smoked %q", v)
+		}
+		sh.Smoked = n
+	}
+	if v := field("ratings"); v != "" {
+		if err := json.Unmarshal([]byte(v), &sh.Ratings); err != nil {
+			return sh, fmt.Errorf("invalid ratings: %w", err)
+		}
+	}
+	if v := field("comments"); v != "" {
+		if err := json.Unmarshal([]byte(v), &sh.Comments); err != nil {
+			return sh, fmt.Errorf("invalid comments: %w", err)
+		}
+	}
+	return sh, nil
+}
+
+// snapshotSource streams the shishas array of a FormatJSON snapshot. A bare JSON array
+// of shishas (the MEMORY_SEED_FILE format) is accepted as well.
+type snapshotSource struct {
+	dec     *json.Decoder
+	started bool
+	index   int
+}
+
+func (s *snapshotSource) next() (entry, error) {
+	if !s.started {
+		s.started = true
+		if err := s.seekShishas(); err != nil {
+			return entry{}, err
+		}
+	}
+	if !s.dec.More() {
+		return entry{}, io.EOF
+	}
+	s.index++
+	e := entry{line: s.index}
+	if err := s.dec.Decode(&e.shisha); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			// a syntax error leaves the decoder unusable
+			return entry{}, fmt.Errorf("entry %d: %w", s.index, err)
+		}
+		e.err = fmt.Errorf("invalid entry: %w", err)
+	}
+	return e, nil
+}
+
+// seekShishas positions the decoder inside the shishas array.
+func (s *snapshotSource) seekShishas() error {
+	tok, err := s.dec.Token()
+	if err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+	if tok == json.Delim('[') {
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("%w: snapshot must be a JSON object or array", storage.ErrValidation)
+	}
+	for s.dec.More() {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return fmt.Errorf("read snapshot: %w", err)
+		}
+		switch tok {
+		case "version":
+			var v int
+			if err := s.dec.Decode(&v); err != nil {
+				return fmt.Errorf("read snapshot version: %w", err)
+			}
+			if v > snapshotVersion {
+				return fmt.Errorf("%w: snapshot version %d is newer than supported %d", storage.ErrValidation, v, snapshotVersion)
+			}
+		case "shishas":
+			tok, err := s.dec.Token()
+			if err != nil {
+				return fmt.Errorf("read snapshot: %w", err)
+			}
+			if tok != json.Delim('[') {
+				return fmt.Errorf("%w: shishas must be an array", storage.ErrValidation)
+			}
+			return nil
+		default:
+			var skip json.RawMessage
+			if err := s.dec.Decode(&skip); err != nil {
+				return fmt.Errorf("read snapshot: %w", err)
+			}
+		}
+	}
+	return fmt.Errorf("%w: snapshot has no shishas", storage.ErrValidation)
+}